@@ -18,10 +18,10 @@ import (
 )
 
 type config struct {
-	DBUrl      string `env:"DB_URL",notEmpty`
-	DBUsername string `env:"DB_USERNAME",notEmpty`
-	DBPassword string `env:"DB_PASSWORD",notEmpty`
-	DBName     string `env:"DB_NAME",notEmpty`
+	DBUrl      string `env:"DB_URL"`
+	DBUsername string `env:"DB_USERNAME"`
+	DBPassword string `env:"DB_PASSWORD"`
+	DBName     string `env:"DB_NAME"`
 }
 
 func GetDBConnection(ctx context.Context) *bun.DB {
@@ -85,6 +85,24 @@ func DBInit(db *bun.DB, ctx context.Context) {
 	if err != nil {
 		log.Fatalf("failed to create bot_endpoint table: %v", err)
 	}
+	_, err = db.Exec(`ALTER TABLE bot_endpoints ADD COLUMN IF NOT EXISTS signing_secret varchar NOT NULL DEFAULT '';`)
+	if err != nil {
+		log.Fatalf("failed to add signing_secret column to bot_endpoint table: %v", err)
+	}
+	//秘密鍵がない既存のbotにも秘密鍵を設定する。この秘密鍵は誰も知らないので、
+	//botの所有者がログインしてローテーションし、新しい秘密鍵を取得する
+	_, err = db.Exec(`UPDATE bot_endpoints SET signing_secret = replace(gen_random_uuid()::text || gen_random_uuid()::text, '-', '') WHERE signing_secret = '';`)
+	if err != nil {
+		log.Fatalf("failed to backfill signing_secret of bot_endpoint table: %v", err)
+	}
+	_, err = db.Exec(`ALTER TABLE bot_endpoints ADD COLUMN IF NOT EXISTS previous_signing_secret varchar, ADD COLUMN IF NOT EXISTS previous_signing_secret_expires_at timestamptz;`)
+	if err != nil {
+		log.Fatalf("failed to add previous_signing_secret column to bot_endpoint table: %v", err)
+	}
+	_, err = db.Exec(`ALTER TABLE bot_endpoints ADD COLUMN IF NOT EXISTS event_subscriptions varchar[] NOT NULL DEFAULT '{message_created}';`)
+	if err != nil {
+		log.Fatalf("failed to add event_subscriptions column to bot_endpoint table: %v", err)
+	}
 	_, err = db.NewCreateTable().Model((*entity.Server)(nil)).IfNotExists().Exec(ctx)
 	if err != nil {
 		log.Fatalf("failed to create server table: %v", err)
@@ -97,13 +115,45 @@ func DBInit(db *bun.DB, ctx context.Context) {
 	if err != nil {
 		log.Fatalf("failed to create user table: %v", err)
 	}
-	_, err = db.NewCreateTable().Model((*entity.Message)(nil)).IfNotExists().ForeignKey("(user_id) REFERENCES users (id) ON DELETE CASCADE").ForeignKey("(bot_endpoint_id) REFERENCES bot_endpoints (id) ON DELETE CASCADE").ForeignKey("(channel_id) REFERENCES channels (id) ON DELETE CASCADE").Exec(ctx)
+	//usersテーブルを参照するので、usersテーブルを作成した後に追加する
+	_, err = db.Exec(`ALTER TABLE bot_endpoints ADD COLUMN IF NOT EXISTS owner_user_id varchar REFERENCES users (id) ON DELETE SET NULL;`)
+	if err != nil {
+		log.Fatalf("failed to add owner_user_id column to bot_endpoint table: %v", err)
+	}
+	_, err = db.Exec(`ALTER TABLE bot_endpoints ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT current_timestamp, ADD COLUMN IF NOT EXISTS deleted_at timestamptz;`)
+	if err != nil {
+		log.Fatalf("failed to add created_at and deleted_at columns to bot_endpoint table: %v", err)
+	}
+	//既存のbotは検証されていないので、所有者が検証し直すまではイベントを送らない
+	//所有者がいない既存のbotは、管理者が所有者を設定してから所有者が検証し直す
+	_, err = db.Exec(`ALTER TABLE bot_endpoints ADD COLUMN IF NOT EXISTS verified boolean NOT NULL DEFAULT false;`)
+	if err != nil {
+		log.Fatalf("failed to add verified column to bot_endpoint table: %v", err)
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS bot_endpoints_owner_user_id_idx ON bot_endpoints (owner_user_id) WHERE deleted_at IS NULL;`)
+	if err != nil {
+		log.Fatalf("failed to create index on bot_endpoint table: %v", err)
+	}
+	_, err = db.NewCreateTable().Model((*entity.Webhook)(nil)).IfNotExists().ForeignKey("(server_id) REFERENCES servers (id) ON DELETE CASCADE").ForeignKey("(channel_id) REFERENCES channels (id) ON DELETE CASCADE").ForeignKey("(created_by_user_id) REFERENCES users (id) ON DELETE SET NULL").Exec(ctx)
+	if err != nil {
+		log.Fatalf("failed to create webhook table: %v", err)
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS webhooks_server_id_idx ON webhooks (server_id) WHERE revoked_at IS NULL;`)
+	if err != nil {
+		log.Fatalf("failed to create index on webhook table: %v", err)
+	}
+	_, err = db.NewCreateTable().Model((*entity.Message)(nil)).IfNotExists().ForeignKey("(user_id) REFERENCES users (id) ON DELETE CASCADE").ForeignKey("(bot_endpoint_id) REFERENCES bot_endpoints (id) ON DELETE CASCADE").ForeignKey("(channel_id) REFERENCES channels (id) ON DELETE CASCADE").ForeignKey("(parent_message_id) REFERENCES messages (id) ON DELETE CASCADE").ForeignKey("(webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE").Exec(ctx)
 	if err != nil {
 		log.Fatalf("failed to create message table: %v", err)
 	}
+	_, err = db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS webhook_id uuid REFERENCES webhooks (id) ON DELETE CASCADE, ADD COLUMN IF NOT EXISTS display_name varchar, ADD COLUMN IF NOT EXISTS display_icon_url varchar;`)
+	if err != nil {
+		log.Fatalf("failed to add webhook_id column to message table: %v", err)
+	}
 
-	//メッセージテーブルに制約があるかどうかを"bot_id_or_user_id"という名前の制約が掛かっているカラムの数を取得して確認する
-	MessagesTableConstraintCount, err := db.NewSelect().Table("information_schema.constraint_column_usage").Where("table_name =? AND constraint_name = ?", "messages", "bot_id_or_user_id").Count(ctx)
+	//メッセージテーブルに制約があるかどうかを"message_sender"という名前の制約が掛かっているカラムの数を取得して確認する
+	//webhookのメッセージはuser_idがNULLなので、以前の"bot_id_or_user_id"制約があれば置き換える
+	MessagesTableConstraintCount, err := db.NewSelect().Table("information_schema.constraint_column_usage").Where("table_name =? AND constraint_name = ?", "messages", "message_sender").Count(ctx)
 	if err != nil {
 		log.Fatalf("failed to check if messages table constraint exists: %v", err)
 	}
@@ -111,20 +161,138 @@ func DBInit(db *bun.DB, ctx context.Context) {
 	if !existMessagesTableConstraint {
 		_, err = db.Exec(`
 		ALTER TABLE messages
-		ADD CONSTRAINT bot_id_or_user_id
-		CHECK ((is_bot = true AND bot_endpoint_id IS NOT NULL) OR (is_bot = false AND user_id IS NOT NULL));`)
+		DROP CONSTRAINT IF EXISTS bot_id_or_user_id,
+		ADD CONSTRAINT message_sender
+		CHECK ((is_bot = true AND bot_endpoint_id IS NOT NULL) OR (is_bot = false AND (user_id IS NOT NULL OR webhook_id IS NOT NULL)));`)
 		if err != nil {
 			log.Fatalf("failed to add constraint to message table: %v", err)
 		}
 	}
+	//既に作成済みのテーブルにはカラムが追加されないので、後から追加したカラムはALTER TABLEで追加する
+	_, err = db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at timestamptz;`)
+	if err != nil {
+		log.Fatalf("failed to add edited_at column to message table: %v", err)
+	}
+	_, err = db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at timestamptz;`)
+	if err != nil {
+		log.Fatalf("failed to add deleted_at column to message table: %v", err)
+	}
+	_, err = db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS parent_message_id uuid REFERENCES messages (id) ON DELETE CASCADE;`)
+	if err != nil {
+		log.Fatalf("failed to add parent_message_id column to message table: %v", err)
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS messages_parent_message_id_idx ON messages (parent_message_id);`)
+	if err != nil {
+		log.Fatalf("failed to create index on parent_message_id of message table: %v", err)
+	}
+	_, err = db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_msg_id varchar;`)
+	if err != nil {
+		log.Fatalf("failed to add client_msg_id column to message table: %v", err)
+	}
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS messages_user_id_client_msg_id_key ON messages (user_id, client_msg_id) WHERE client_msg_id IS NOT NULL;`)
+	if err != nil {
+		log.Fatalf("failed to create unique index on client_msg_id of message table: %v", err)
+	}
+	_, err = db.Exec(`ALTER TABLE channels ADD COLUMN IF NOT EXISTS last_seq bigint NOT NULL DEFAULT 0;`)
+	if err != nil {
+		log.Fatalf("failed to add last_seq column to channel table: %v", err)
+	}
+	_, err = db.Exec(`ALTER TABLE channels ADD COLUMN IF NOT EXISTS topic varchar NOT NULL DEFAULT '';`)
+	if err != nil {
+		log.Fatalf("failed to add topic column to channel table: %v", err)
+	}
+	_, err = db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS seq bigint;`)
+	if err != nil {
+		log.Fatalf("failed to add seq column to message table: %v", err)
+	}
+	//seqを追加する前に保存されたメッセージには、チャンネルごとに作成日時の順でseqを採番する
+	_, err = db.Exec(`
+	UPDATE messages AS m SET seq = s.seq
+	FROM (
+		SELECT id, COALESCE((SELECT max(x.seq) FROM messages AS x WHERE x.channel_id = messages.channel_id), 0)
+			+ row_number() OVER (PARTITION BY channel_id ORDER BY created_at, id) AS seq
+		FROM messages WHERE seq IS NULL AND parent_message_id IS NULL
+	) AS s
+	WHERE m.id = s.id;`)
+	if err != nil {
+		log.Fatalf("failed to backfill seq of message table: %v", err)
+	}
+	_, err = db.Exec(`
+	UPDATE channels AS c SET last_seq = s.max_seq
+	FROM (SELECT channel_id, max(seq) AS max_seq FROM messages GROUP BY channel_id) AS s
+	WHERE c.id = s.channel_id AND c.last_seq < s.max_seq;`)
+	if err != nil {
+		log.Fatalf("failed to backfill last_seq of channel table: %v", err)
+	}
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS messages_channel_id_seq_key ON messages (channel_id, seq);`)
+	if err != nil {
+		log.Fatalf("failed to create unique index on seq of message table: %v", err)
+	}
+	_, err = db.NewCreateTable().Model((*entity.MessageEdit)(nil)).IfNotExists().ForeignKey("(message_id) REFERENCES messages (id) ON DELETE CASCADE").Exec(ctx)
+	if err != nil {
+		log.Fatalf("failed to create message_edit table: %v", err)
+	}
 	_, err = db.NewCreateTable().Model((*entity.ServerBotEndpoint)(nil)).IfNotExists().ForeignKey("(server_id) REFERENCES servers (id) ON DELETE CASCADE").ForeignKey("(bot_endpoint_id) REFERENCES bot_endpoints (id) ON DELETE CASCADE").Exec(ctx)
 	if err != nil {
 		log.Fatalf("failed to create server_bot_endpoint table: %v", err)
 	}
+	_, err = db.Exec(`ALTER TABLE server_bot_endpoints ADD COLUMN IF NOT EXISTS event_subscriptions varchar[];`)
+	if err != nil {
+		log.Fatalf("failed to add event_subscriptions column to server_bot_endpoint table: %v", err)
+	}
+	_, err = db.NewCreateTable().Model((*entity.BotDelivery)(nil)).IfNotExists().ForeignKey("(bot_endpoint_id) REFERENCES bot_endpoints (id) ON DELETE CASCADE").ForeignKey("(server_id) REFERENCES servers (id) ON DELETE CASCADE").ForeignKey("(channel_id) REFERENCES channels (id) ON DELETE CASCADE").Exec(ctx)
+	if err != nil {
+		log.Fatalf("failed to create bot_delivery table: %v", err)
+	}
+	//member_joinedのようにチャンネルがないイベントも配信する
+	_, err = db.Exec(`ALTER TABLE bot_deliveries ALTER COLUMN channel_id DROP NOT NULL;`)
+	if err != nil {
+		log.Fatalf("failed to drop not null constraint of channel_id of bot_delivery table: %v", err)
+	}
+	//workerが次に送る配信を探すためのインデックス
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS bot_deliveries_status_next_attempt_at_idx ON bot_deliveries (status, next_attempt_at);`)
+	if err != nil {
+		log.Fatalf("failed to create index on bot_delivery table: %v", err)
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS bot_deliveries_bot_endpoint_id_status_idx ON bot_deliveries (bot_endpoint_id, status);`)
+	if err != nil {
+		log.Fatalf("failed to create index on bot_delivery table: %v", err)
+	}
+	_, err = db.NewCreateTable().Model((*entity.BotToken)(nil)).IfNotExists().ForeignKey("(bot_endpoint_id) REFERENCES bot_endpoints (id) ON DELETE CASCADE").Exec(ctx)
+	if err != nil {
+		log.Fatalf("failed to create bot_token table: %v", err)
+	}
+	_, err = db.NewCreateTable().Model((*entity.BotCommand)(nil)).IfNotExists().ForeignKey("(bot_endpoint_id) REFERENCES bot_endpoints (id) ON DELETE CASCADE").Exec(ctx)
+	if err != nil {
+		log.Fatalf("failed to create bot_command table: %v", err)
+	}
+	//PostgresBackplaneがNOTIFYで送れない大きさのイベントを一時的に保存する
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ws_hub_event_payloads (id uuid PRIMARY KEY DEFAULT gen_random_uuid(), payload text NOT NULL, created_at timestamptz NOT NULL DEFAULT current_timestamp);`)
+	if err != nil {
+		log.Fatalf("failed to create ws_hub_event_payloads table: %v", err)
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS ws_hub_event_payloads_created_at_idx ON ws_hub_event_payloads (created_at);`)
+	if err != nil {
+		log.Fatalf("failed to create index on ws_hub_event_payloads table: %v", err)
+	}
 	_, err = db.NewCreateTable().Model((*entity.UserServer)(nil)).IfNotExists().ForeignKey("(user_id) REFERENCES users (id) ON DELETE CASCADE").ForeignKey("(server_id) REFERENCES servers (id) ON DELETE CASCADE").Exec(ctx)
 	if err != nil {
 		log.Fatalf("failed to create user_server table: %v", err)
 	}
+	_, err = db.Exec(`ALTER TABLE user_servers ADD COLUMN IF NOT EXISTS role varchar NOT NULL DEFAULT 'member';`)
+	if err != nil {
+		log.Fatalf("failed to add role column to user_server table: %v", err)
+	}
+	//role列を追加する前に作成されたサーバーにはownerがいないので、最初に参加したuserをownerにする
+	//user_serversには作成日時がないので、行を挿入したトランザクションが最も古いuserを最初に参加したuserとする
+	//サーバーを作成したuserはサーバーの作成と同じトランザクションで参加しているので、通常はそのuserがownerになる
+	_, err = db.Exec(`UPDATE user_servers SET role = 'owner'
+		FROM (SELECT DISTINCT ON (server_id) server_id, user_id FROM user_servers ORDER BY server_id, age(xmin) DESC, user_id) AS first_members
+		WHERE user_servers.server_id = first_members.server_id AND user_servers.user_id = first_members.user_id
+		AND NOT EXISTS (SELECT 1 FROM user_servers AS owners WHERE owners.server_id = first_members.server_id AND owners.role = 'owner');`)
+	if err != nil {
+		log.Fatalf("failed to backfill owner of user_server table: %v", err)
+	}
 	_, err = db.NewCreateTable().Model((*entity.ReactionType)(nil)).IfNotExists().Exec(ctx)
 	if err != nil {
 		log.Fatalf("failed to create reaction_type table: %v", err)
@@ -133,4 +301,13 @@ func DBInit(db *bun.DB, ctx context.Context) {
 	if err != nil {
 		log.Fatalf("failed to create user_reaction table: %v", err)
 	}
+	//作成済みのテーブルにはunique制約が付かないので、リアクションの重複を防ぐためにインデックスを作成する
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS reaction_types_emoji_key ON reaction_types (emoji);`)
+	if err != nil {
+		log.Fatalf("failed to create unique index on reaction_type table: %v", err)
+	}
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS user_reactions_message_id_user_id_reaction_type_id_key ON user_reactions (message_id, user_id, reaction_type_id);`)
+	if err != nil {
+		log.Fatalf("failed to create unique index on user_reaction table: %v", err)
+	}
 }
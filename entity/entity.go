@@ -1,6 +1,7 @@
 package entity
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,6 +15,20 @@ type BotEndpoint struct {
 	Endpoint string `json:"endpoint" bun:"endpoint,notnull" validate:"required"`
 	Name     string `json:"name" bun:"name,notnull" validate:"required"`
 	IconURL  string `json:"icon_url" bun:"icon_url,notnull" validate:"required"`
+	//botを管理できるuser。所有者を設定する前に登録されたbotはNULL
+	OwnerUserId string    `json:"owner_user_id" bun:"owner_user_id,nullzero"` //FK
+	CreatedAt   time.Time `json:"created_at" bun:"created_at,nullzero,notnull,default:current_timestamp"`
+	//エンドポイントがchallengeに応答できたbotのみtrue。trueのbotにのみイベントを送る
+	Verified bool `json:"verified" bun:"verified,notnull,default:false"`
+	//削除されたbotのメッセージが残るように、行自体は削除せずにDeletedAtを設定する
+	DeletedAt *time.Time `json:"deleted_at" bun:"deleted_at"`
+	//botへのリクエストの署名に使う秘密鍵。登録時とローテーション時にのみbotの運用者に返す
+	SigningSecret string `json:"-" bun:"signing_secret,notnull"`
+	//ローテーション前の秘密鍵。PreviousSigningSecretExpiresAtまでは古い秘密鍵でも署名する
+	PreviousSigningSecret          *string    `json:"-" bun:"previous_signing_secret"`
+	PreviousSigningSecretExpiresAt *time.Time `json:"-" bun:"previous_signing_secret_expires_at"`
+	//botが購読しているイベントの種類。購読しているイベントのみエンドポイントに送る
+	EventSubscriptions []string `json:"event_subscriptions" bun:"event_subscriptions,array,notnull,default:'{message_created}'"`
 }
 
 type Server struct {
@@ -25,6 +40,10 @@ type Channel struct {
 	Id       *uuid.UUID `bun:"id,pk,type:uuid,default:gen_random_uuid()"`
 	ServerId uuid.UUID  `bun:"server_id,unique:serverIdAndChannelName,notnull,type:uuid"` //FK
 	Name     string     `bun:"name,unique:serverIdAndChannelName,notnull"`
+	//チャンネルで最後に採番したメッセージのSeq
+	LastSeq int64 `bun:"last_seq,notnull,default:0"`
+	//チャンネルのトピック。/topicで変更する
+	Topic string `bun:"topic,notnull,default:''"`
 }
 
 type User struct {
@@ -35,48 +54,157 @@ type User struct {
 }
 
 // IsBotによってbotからのメッセージかどうかを判定する
-// IsBotがtrueの場合はBotEndpointIDが必須, falseの場合はUserIDが必須
+// IsBotがtrueの場合はBotEndpointIDが必須, falseの場合はUserIDかWebhookIdが必須
 
 // Message構造体のテーブルを作成した後にSQLで制約を追加する
 // _, err = db.Exec(`
 // ALTER TABLE messages
-// ADD CONSTRAINT bot_id_or_user_id
-// CHECK ((is_bot = true AND bot_endpoint_id IS NOT NULL) OR (is_bot = false AND user_id IS NOT NULL));`)
+// ADD CONSTRAINT message_sender
+// CHECK ((is_bot = true AND bot_endpoint_id IS NOT NULL) OR (is_bot = false AND (user_id IS NOT NULL OR webhook_id IS NOT NULL)));`)
+const (
+	BotDeliveryStatusPending = "pending"
+	//最大回数まで再送しても届かなかった配信。redriveするまで再送しない
+	BotDeliveryStatusDead = "dead"
+)
+
+// BotDeliveryはbotのエンドポイントへのイベントの配信。配信に成功したら削除する
+// Payloadにはcallback_tokenを含めず、送信する度に有効期限の新しいトークンを付ける
+type BotDelivery struct {
+	Id              *uuid.UUID      `json:"delivery_id" bun:"id,pk,type:uuid,default:gen_random_uuid()"`
+	BotEndpointId   uuid.UUID       `json:"bot_endpoint_id" bun:"bot_endpoint_id,notnull,type:uuid"` //FK
+	ServerId        uuid.UUID       `json:"server_id" bun:"server_id,notnull,type:uuid"`             //FK
+	ChannelId       *uuid.UUID      `json:"channel_id" bun:"channel_id,type:uuid"`                   //FK member_joinedのようにチャンネルがないイベントの場合はNULL
+	ParentMessageId *uuid.UUID      `json:"parent_message_id" bun:"parent_message_id,type:uuid"`
+	EventType       string          `json:"event_type" bun:"event_type,notnull"`
+	Payload         json.RawMessage `json:"-" bun:"payload,type:jsonb,notnull"`
+	Status          string          `json:"status" bun:"status,notnull,default:'pending'"`
+	Attempts        int             `json:"attempts" bun:"attempts,notnull,default:0"`
+	NextAttemptAt   time.Time       `json:"next_attempt_at" bun:"next_attempt_at,nullzero,notnull,default:current_timestamp"`
+	LastError       *string         `json:"last_error" bun:"last_error"`
+	CreatedAt       time.Time       `json:"created_at" bun:"created_at,nullzero,notnull,default:current_timestamp"`
+}
+
+// BotTokenはbotがwebsocketで接続するためのトークン
+// トークン自体は発行時にのみ返し、DBにはハッシュだけを保存する
+type BotToken struct {
+	Id            *uuid.UUID `json:"token_id" bun:"id,pk,type:uuid,default:gen_random_uuid()"`
+	BotEndpointId uuid.UUID  `json:"bot_endpoint_id" bun:"bot_endpoint_id,notnull,type:uuid"` //FK
+	TokenHash     string     `json:"-" bun:"token_hash,notnull,unique"`
+	CreatedAt     time.Time  `json:"created_at" bun:"created_at,nullzero,notnull,default:current_timestamp"`
+	RevokedAt     *time.Time `json:"revoked_at" bun:"revoked_at"`
+}
+
+// BotCommandはbotが登録したスラッシュコマンド
+// botが追加されているサーバーで/{name}が実行されるとbotのエンドポイントに送る
+type BotCommand struct {
+	BotEndpointId uuid.UUID `json:"bot_endpoint_id" bun:"bot_endpoint_id,pk,type:uuid"` //FK
+	Name          string    `json:"name" bun:"name,pk"`
+	Description   string    `json:"description" bun:"description,notnull,default:''"`
+	Usage         string    `json:"usage" bun:"usage,notnull,default:''"`
+}
+
+// Webhookはチャンネルにメッセージを投稿するための受信webhook
+// URLに含めるトークンは作成時にのみ返し、DBにはハッシュだけを保存する
+type Webhook struct {
+	Id        *uuid.UUID `json:"webhook_id" bun:"id,pk,type:uuid,default:gen_random_uuid()"`
+	ServerId  uuid.UUID  `json:"server_id" bun:"server_id,notnull,type:uuid"`   //FK
+	ChannelId uuid.UUID  `json:"channel_id" bun:"channel_id,notnull,type:uuid"` //FK
+	//投稿時に表示名とアイコンが指定されなかった場合に使う
+	Name            string     `json:"name" bun:"name,notnull"`
+	IconURL         string     `json:"icon_url" bun:"icon_url,notnull,default:''"`
+	TokenHash       string     `json:"-" bun:"token_hash,notnull,unique"`
+	CreatedByUserId string     `json:"created_by_user_id" bun:"created_by_user_id,nullzero"` //FK
+	CreatedAt       time.Time  `json:"created_at" bun:"created_at,nullzero,notnull,default:current_timestamp"`
+	RevokedAt       *time.Time `json:"revoked_at" bun:"revoked_at"`
+}
+
 type Message struct {
 	Id            *uuid.UUID `json:"message_id" bun:"id,pk,type:uuid,default:gen_random_uuid()"`
 	ChannelId     uuid.UUID  `json:"channel_id" bun:"channel_id,notnull,type:uuid"`   //FK
-	UserId        string     `json:"user_id" bun:"user_id"`                           //FK
+	UserId        string     `json:"user_id" bun:"user_id,nullzero"`                  //FK botのメッセージの場合はNULL
 	BotEndpointId *uuid.UUID `json:"bot_endpoint_id" bun:"bot_endpoint_id,type:uuid"` //FK
 	CreatedAt     time.Time  `json:"created_at" bun:"created_at,nullzero,notnull,default:current_timestamp"`
 	Message       string     `json:"message" bun:"message,notnull"`
 	IsBot         bool       `json:"is_bot" bun:"is_bot,notnull"`
+	EditedAt      *time.Time `json:"edited_at" bun:"edited_at"` //編集されていない場合はnil
+	//削除されたメッセージは本文を空にしてDeletedAtを設定する
+	//スレッドやリアクションからの参照が残るように行自体は削除しない
+	DeletedAt *time.Time `json:"deleted_at" bun:"deleted_at"`
+	//スレッドの返信の場合は返信先のメッセージのId。返信先は同じチャンネルのスレッドの返信ではないメッセージに限る
+	ParentMessageId *uuid.UUID `json:"parent_message_id" bun:"parent_message_id,type:uuid"` //FK
+	//クライアントが再送したメッセージを重複して保存しないためのキー。userごとに一意
+	ClientMsgId *string `json:"client_msg_id" bun:"client_msg_id"`
+	//チャンネルごとに1から連番で採番する。クライアントはSeqが飛んでいることでメッセージの取りこぼしを検知できる
+	//スレッドの返信はスレッドに参加しているuserにしか送られないので、チャンネルの連番には含めずnilにする
+	Seq *int64 `json:"seq" bun:"seq"`
+	//webhookのメッセージの場合のみ設定する。user_idとbot_endpoint_idはNULL
+	//表示名とアイコンは投稿時のものを保存するので、後からwebhookの名前が変わっても過去のメッセージの表示は変わらない
+	WebhookId      *uuid.UUID `json:"webhook_id" bun:"webhook_id,type:uuid"` //FK
+	DisplayName    string     `json:"display_name" bun:"display_name,nullzero"`
+	DisplayIconURL string     `json:"display_icon_url" bun:"display_icon_url,nullzero"`
+}
+
+// MessageEditはメッセージが編集される前の本文を編集履歴として保存する
+type MessageEdit struct {
+	Id        *uuid.UUID `json:"message_edit_id" bun:"id,pk,type:uuid,default:gen_random_uuid()"`
+	MessageId uuid.UUID  `json:"message_id" bun:"message_id,notnull,type:uuid"` //FK
+	Message   string     `json:"message" bun:"message,notnull"`
+	EditedAt  time.Time  `json:"edited_at" bun:"edited_at,notnull"`
 }
 
 type ServerBotEndpoint struct {
 	ServerId      string `json:"server_id" bun:"server_id,pk,type:uuid"`             //FK
 	BotEndpointId string `json:"bot_endpoint_id" bun:"bot_endpoint_id,pk,type:uuid"` //FK
+	//サーバーのownerがこのサーバーでbotに送るイベントを絞り込む場合に設定する
+	//NULLの場合はbotが購読している全てのイベントを送る
+	EventSubscriptions []string `json:"event_subscriptions" bun:"event_subscriptions,array"`
 }
 
+// サーバー内でのuserの役割
+// ownerはサーバーを作成したuser、moderatorはownerと同じく他のuserのメッセージを削除できる
+const (
+	ServerRoleOwner     = "owner"
+	ServerRoleModerator = "moderator"
+	ServerRoleMember    = "member"
+)
+
 type UserServer struct {
 	UserId   string    `json:"user_id" bun:"user_id,pk"`               //FK
 	ServerId uuid.UUID `json:"server_id" bun:"server_id,pk,type:uuid"` //FK
+	Role     string    `json:"role" bun:"role,notnull,default:'member'"`
 }
 
+// 1人のuserは1つのメッセージに同じ種類のリアクションを1つだけ付けられる
 type UserReaction struct {
 	Id             string `json:"user_reaction_id" bun:"id,pk,type:uuid,default:gen_random_uuid()"`
-	MessageId      string `json:"message_id" bun:"message_id,notnull,type:uuid"`             //FK
-	UserId         string `json:"user_id" bun:"user_id,notnull"`                             //FK
-	ReactionTypeId string `json:"reaction_type_id" bun:"reaction_type_id,notnull,type:uuid"` //FK
+	MessageId      string `json:"message_id" bun:"message_id,notnull,type:uuid,unique:messageUserReactionType"`             //FK
+	UserId         string `json:"user_id" bun:"user_id,notnull,unique:messageUserReactionType"`                             //FK
+	ReactionTypeId string `json:"reaction_type_id" bun:"reaction_type_id,notnull,type:uuid,unique:messageUserReactionType"` //FK
 }
 
 type ReactionType struct {
 	Id    string `json:"reaction_type_id" bun:"id,pk,type:uuid,default:gen_random_uuid()"`
-	Emoji string `json:"emoji" bun:"emoji,notnull"`
+	Emoji string `json:"emoji" bun:"emoji,notnull,unique"`
+}
+
+// ReactionCountはメッセージに付けられたリアクションを絵文字ごとに集計したもの
+// Reactedはリクエストしたuserがその絵文字でリアクションしているかどうか
+type ReactionCount struct {
+	MessageId uuid.UUID `bun:"message_id"`
+	Emoji     string    `bun:"emoji"`
+	Count     int       `bun:"count"`
+	Reacted   bool      `bun:"reacted"`
 }
 
 // MessageWithUserはmessageテーブルとusersテーブルをJOINしてメッセージを取得する際に使用する
+// ReplyCountとLastReplyAtはスレッドの返信の数と最後の返信の日時で、チャンネルのメッセージを取得する際にのみ設定する
 type MessageWithUser struct {
 	Message
-	UserName string `bun:"user_name"`
-	IconURL  string `bun:"user_icon_image_url"`
+	UserName    string     `bun:"user_name"`
+	IconURL     string     `bun:"user_icon_image_url"`
+	ReplyCount  int        `bun:"reply_count"`
+	LastReplyAt *time.Time `bun:"last_reply_at"`
+	//複数のサーバーのメッセージをまとめて取得する際にのみ設定する
+	ServerId  uuid.UUID       `bun:"server_id"`
+	Reactions []ReactionCount `bun:"-"`
 }
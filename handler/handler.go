@@ -3,12 +3,14 @@ package handler
 import (
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 
+	"github.com/hebitigo/CATechAccelChatApp/entity"
 	"github.com/hebitigo/CATechAccelChatApp/usecase"
 	validate "github.com/hebitigo/CATechAccelChatApp/util"
 )
@@ -24,35 +26,1279 @@ func NewBotEndpointHandler(usecase usecase.BotEndpointUsecaseInterface) *botEndp
 //	### POST /registerBotEndpoint
 //
 // bot のエンドポイントを登録
+// endpointはhttpまたはhttpsのURLで、BOT_ENDPOINT_ALLOW_PRIVATE=trueでない場合はプライベートアドレスは使えない
+// 登録時にendpointに{"type": "url_verification", "challenge": "string"}をPOSTするので、
+// botはレスポンスのボディで{"challenge": "string"}を返す。challengeに応答できたbotにのみイベントを送る
 //
 // ヘッダ
 //
 // ```
 // Content-Type: application/json
-// Authorization: Bearer {jwt}
+// Authorization: Bearer {auth0のjwt}
 // ```
 //
+// ログインしているuserがbotの所有者になる
+//
+// ボディ
+//
+// ```
+//
+//	{
+//	   "name": "string",
+//	   "icon_url": "string",
+//	   "endpoint": "string",
+//	   "event_subscriptions": ["message_created", "reaction_added"],
+//	}
+//
+// ```
+//
+// event_subscriptionsはbotのエンドポイントに送るイベントの種類で、省略した場合はmessage_createdのみ送る
+// message_created、message_edited、message_deleted、reaction_added、channel_created、member_joinedを指定できる
+
+// verifiedがfalseの場合はverification_errorにchallengeに失敗した理由を返す
+type responseRegisterBotEndpoint struct {
+	Message           string `json:"message"`
+	BotEndpointId     string `json:"bot_endpoint_id"`
+	SigningSecret     string `json:"signing_secret"`
+	Verified          bool   `json:"verified"`
+	VerificationError string `json:"verification_error,omitempty"`
+}
+
+// websocketで接続するbotはendpointを省略できる
+type requestRegisterBotEndpoint struct {
+	Name               string   `json:"name" validate:"required"`
+	IconURL            string   `json:"icon_url" validate:"required"`
+	Endpoint           string   `json:"endpoint"`
+	EventSubscriptions []string `json:"event_subscriptions"`
+}
+
+func (handler *botEndpointHandler) RegisterBotEndpoint(c *gin.Context) {
+	var request requestRegisterBotEndpoint
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		err := errors.Wrap(err, fmt.Sprintf("requestRegisterBotEndpoint validation failed. botEndpoint -> %+v", request))
+		log.Printf("%+v", err)
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	registerBotEndpointDto := usecase.RegisterBotEndpointInputDTO{
+		UserId:             authenticatedUserId(c),
+		Name:               request.Name,
+		IconURL:            request.IconURL,
+		Endpoint:           request.Endpoint,
+		EventSubscriptions: request.EventSubscriptions,
+	}
+
+	output, err := handler.usecase.RegisterBotEndpoint(c.Request.Context(), registerBotEndpointDto)
+	if err != nil {
+		err := errors.Wrap(err, fmt.Sprintf("failed to register bot endpoint. botEndpoint -> %+v", request))
+		log.Printf("%+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	//signing_secretはこのレスポンスでしか返さない
+	c.JSON(200, responseRegisterBotEndpoint{
+		Message:           "bot endpoint registered successfully",
+		BotEndpointId:     output.BotEndpointId,
+		SigningSecret:     output.SigningSecret,
+		Verified:          output.Verified,
+		VerificationError: output.VerificationError,
+	})
+}
+
+// responseBotEndpointはbotの所有者に返すbot。signing_secretは含めない
+type responseBotEndpoint struct {
+	BotEndpointId      string    `json:"bot_endpoint_id"`
+	OwnerUserId        string    `json:"owner_user_id"`
+	Name               string    `json:"name"`
+	IconURL            string    `json:"icon_url"`
+	Endpoint           string    `json:"endpoint"`
+	EventSubscriptions []string  `json:"event_subscriptions"`
+	Verified           bool      `json:"verified"`
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+func newResponseBotEndpoint(botEndpoint entity.BotEndpoint) responseBotEndpoint {
+	return responseBotEndpoint{
+		BotEndpointId:      botEndpoint.Id,
+		OwnerUserId:        botEndpoint.OwnerUserId,
+		Name:               botEndpoint.Name,
+		IconURL:            botEndpoint.IconURL,
+		Endpoint:           botEndpoint.Endpoint,
+		EventSubscriptions: botEndpoint.EventSubscriptions,
+		Verified:           botEndpoint.Verified,
+		CreatedAt:          botEndpoint.CreatedAt,
+	}
+}
+
+// GET /bot_endpoints
+//
+// ログインしているuserが所有しているbotを取得する
+func (handler *botEndpointHandler) GetBotEndpoints(c *gin.Context) {
+	botEndpoints, err := handler.usecase.GetBotEndpoints(c.Request.Context(), usecase.GetBotEndpointsInputDTO{UserId: authenticatedUserId(c)})
+	if err != nil {
+		log.Printf("failed to get bot endpoints: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	response := make([]responseBotEndpoint, 0, len(botEndpoints))
+	for _, botEndpoint := range botEndpoints {
+		response = append(response, newResponseBotEndpoint(botEndpoint))
+	}
+	c.JSON(200, gin.H{"bot_endpoints": response})
+}
+
+// GET /bot_endpoints/unowned
+//
+// 所有者を設定する前に登録されたbotを取得する。BOT_ADMIN_USER_IDSに含まれるuserのみ取得できる
+func (handler *botEndpointHandler) GetUnownedBotEndpoints(c *gin.Context) {
+	botEndpoints, err := handler.usecase.GetUnownedBotEndpoints(c.Request.Context(), usecase.GetBotEndpointsInputDTO{UserId: authenticatedUserId(c)})
+	if err != nil {
+		log.Printf("failed to get unowned bot endpoints: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	response := make([]responseBotEndpoint, 0, len(botEndpoints))
+	for _, botEndpoint := range botEndpoints {
+		response = append(response, newResponseBotEndpoint(botEndpoint))
+	}
+	c.JSON(200, gin.H{"bot_endpoints": response})
+}
+
+//	### PUT /bot_endpoint/:bot_endpoint_id/owner
+//
+// 所有者を設定する前に登録されたbotに所有者を設定する。BOT_ADMIN_USER_IDSに含まれるuserのみ設定できる
+// 既に所有者がいるbotの所有者は変更できない
+//
+// ボディ
+//
+// ```
+//
+//	{
+//	   "owner_user_id": "string",
+//	}
+//
+// ```
+
+type requestAssignBotEndpointOwner struct {
+	BotEndpointId string `uri:"bot_endpoint_id" json:"-" validate:"required,uuid"`
+	OwnerUserId   string `json:"owner_user_id" validate:"required"`
+}
+
+func (handler *botEndpointHandler) AssignBotEndpointOwner(c *gin.Context) {
+	var request requestAssignBotEndpointOwner
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = c.BindJSON(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	botEndpointId, err := uuid.Parse(request.BotEndpointId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = handler.usecase.AssignBotEndpointOwner(c.Request.Context(), usecase.AssignBotEndpointOwnerInputDTO{
+		AdminUserId:   authenticatedUserId(c),
+		BotEndpointId: botEndpointId,
+		OwnerUserId:   request.OwnerUserId,
+	})
+	if err != nil {
+		log.Printf("failed to assign bot endpoint owner: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "bot endpoint owner assigned successfully"})
+}
+
+type requestBotEndpointOwner struct {
+	BotEndpointId string `uri:"bot_endpoint_id" validate:"required,uuid"`
+}
+
+// bindBotEndpointOwnerはpath paramのbot_endpoint_idとログインしているuserのIdを取得する
+// 取得できない場合はレスポンスを返してfalseを返す
+func bindBotEndpointOwner(c *gin.Context) (usecase.BotEndpointOwnerInputDTO, bool) {
+	var request requestBotEndpointOwner
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return usecase.BotEndpointOwnerInputDTO{}, false
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return usecase.BotEndpointOwnerInputDTO{}, false
+	}
+	botEndpointId, err := uuid.Parse(request.BotEndpointId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return usecase.BotEndpointOwnerInputDTO{}, false
+	}
+	return usecase.BotEndpointOwnerInputDTO{UserId: authenticatedUserId(c), BotEndpointId: botEndpointId}, true
+}
+
+// GET /bot_endpoint/:bot_endpoint_id
+//
+// botを取得する。botの所有者のみ取得できる
+func (handler *botEndpointHandler) GetBotEndpoint(c *gin.Context) {
+	botEndpointOwnerInputDTO, ok := bindBotEndpointOwner(c)
+	if !ok {
+		return
+	}
+	botEndpoint, err := handler.usecase.GetBotEndpoint(c.Request.Context(), botEndpointOwnerInputDTO)
+	if err != nil {
+		log.Printf("failed to get bot endpoint: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, newResponseBotEndpoint(botEndpoint))
+}
+
+// 変更しない項目は省略する
+type requestUpdateBotEndpoint struct {
+	BotEndpointId      string    `uri:"bot_endpoint_id" json:"-" validate:"required,uuid"`
+	Name               *string   `json:"name" validate:"omitempty,min=1"`
+	IconURL            *string   `json:"icon_url" validate:"omitempty,min=1"`
+	Endpoint           *string   `json:"endpoint" validate:"omitempty,min=1"`
+	EventSubscriptions *[]string `json:"event_subscriptions"`
+}
+
+// PATCH /bot_endpoint/:bot_endpoint_id
+//
+// botの名前、アイコン、エンドポイント、購読するイベントを更新する。botの所有者のみ更新できる
+// エンドポイントを変更した場合は新しいエンドポイントを検証し直す
+func (handler *botEndpointHandler) UpdateBotEndpoint(c *gin.Context) {
+	var request requestUpdateBotEndpoint
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = c.BindJSON(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	botEndpointId, err := uuid.Parse(request.BotEndpointId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	updateBotEndpointInputDTO := usecase.UpdateBotEndpointInputDTO{
+		UserId:             authenticatedUserId(c),
+		BotEndpointId:      botEndpointId,
+		Name:               request.Name,
+		IconURL:            request.IconURL,
+		Endpoint:           request.Endpoint,
+		EventSubscriptions: request.EventSubscriptions,
+	}
+	botEndpoint, err := handler.usecase.UpdateBotEndpoint(c.Request.Context(), updateBotEndpointInputDTO)
+	if err != nil {
+		log.Printf("failed to update bot endpoint: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, newResponseBotEndpoint(botEndpoint))
+}
+
+// DELETE /bot_endpoint/:bot_endpoint_id
+//
+// botを削除して、botが追加されていた全てのサーバーから削除する。botの所有者のみ削除できる
+func (handler *botEndpointHandler) DeleteBotEndpoint(c *gin.Context) {
+	botEndpointOwnerInputDTO, ok := bindBotEndpointOwner(c)
+	if !ok {
+		return
+	}
+	err := handler.usecase.DeleteBotEndpoint(c.Request.Context(), botEndpointOwnerInputDTO)
+	if err != nil {
+		log.Printf("failed to delete bot endpoint: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "bot endpoint deleted successfully"})
+}
+
+// POST /bot_endpoint/:bot_endpoint_id/verify
+//
+// botのエンドポイントにchallengeをPOSTして検証し直す。botの所有者のみ検証できる
+func (handler *botEndpointHandler) VerifyBotEndpoint(c *gin.Context) {
+	botEndpointOwnerInputDTO, ok := bindBotEndpointOwner(c)
+	if !ok {
+		return
+	}
+	err := handler.usecase.VerifyBotEndpoint(c.Request.Context(), botEndpointOwnerInputDTO)
+	if err != nil {
+		log.Printf("failed to verify bot endpoint: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "bot endpoint verified successfully"})
+}
+
+type responseCreateBotToken struct {
+	TokenId string `json:"token_id"`
+	Token   string `json:"token"`
+}
+
+// POST /bot_endpoint/:bot_endpoint_id/tokens
+//
+// botがwebsocketで接続するためのトークンを発行する。botの所有者のみ発行できる
+// botは/wsにAuthorization: Bearer {token}で接続する
+func (handler *botEndpointHandler) CreateBotToken(c *gin.Context) {
+	botEndpointOwnerInputDTO, ok := bindBotEndpointOwner(c)
+	if !ok {
+		return
+	}
+	output, err := handler.usecase.CreateBotToken(c.Request.Context(), botEndpointOwnerInputDTO)
+	if err != nil {
+		log.Printf("failed to create bot token: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	//tokenはこのレスポンスでしか返さない
+	c.JSON(200, responseCreateBotToken{TokenId: output.TokenId.String(), Token: output.Token})
+}
+
+// GET /bot_endpoint/:bot_endpoint_id/tokens
+//
+// botの失効していないトークンの一覧を取得する。トークン自体は返さない
+func (handler *botEndpointHandler) GetBotTokens(c *gin.Context) {
+	botEndpointOwnerInputDTO, ok := bindBotEndpointOwner(c)
+	if !ok {
+		return
+	}
+	botTokens, err := handler.usecase.GetBotTokens(c.Request.Context(), botEndpointOwnerInputDTO)
+	if err != nil {
+		log.Printf("failed to get bot tokens: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"tokens": botTokens})
+}
+
+type requestRevokeBotToken struct {
+	BotEndpointId string `uri:"bot_endpoint_id" validate:"required,uuid"`
+	TokenId       string `uri:"token_id" validate:"required,uuid"`
+}
+
+// DELETE /bot_endpoint/:bot_endpoint_id/tokens/:token_id
+//
+// botのトークンを失効させる。botの所有者のみ失効させられる
+func (handler *botEndpointHandler) RevokeBotToken(c *gin.Context) {
+	var request requestRevokeBotToken
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	botEndpointId, err := uuid.Parse(request.BotEndpointId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	tokenId, err := uuid.Parse(request.TokenId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = handler.usecase.RevokeBotToken(c.Request.Context(), usecase.RevokeBotTokenInputDTO{
+		UserId:        authenticatedUserId(c),
+		BotEndpointId: botEndpointId,
+		TokenId:       tokenId,
+	})
+	if err != nil {
+		log.Printf("failed to revoke bot token: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "bot token revoked successfully"})
+}
+
+//	### POST /bot_endpoint/:bot_endpoint_id/secret/rotate
+//
+// botへのリクエストの署名に使う秘密鍵をローテーションする。botの所有者のみローテーションできる
+// grace_period_secondsの間(デフォルトは24時間、最大7日)は古い秘密鍵と新しい秘密鍵の両方で署名する
+//
+// ヘッダ
+//
+// ```
+// Content-Type: application/json
+// Authorization: Bearer {auth0のjwt}
+// ```
+//
+// ボディ
+//
+// ```
+//
+//	{
+//	   "grace_period_seconds": 86400,
+//	}
+//
+// ```
+
+type requestRotateSigningSecretUri struct {
+	BotEndpointId string `uri:"bot_endpoint_id" validate:"required,uuid"`
+}
+
+type requestRotateSigningSecret struct {
+	GracePeriodSeconds *int64 `json:"grace_period_seconds" validate:"omitempty,min=0"`
+}
+
+type responseRotateSigningSecret struct {
+	SigningSecret           string    `json:"signing_secret"`
+	PreviousSecretExpiresAt time.Time `json:"previous_secret_expires_at"`
+}
+
+func (handler *botEndpointHandler) RotateSigningSecret(c *gin.Context) {
+	var uri requestRotateSigningSecretUri
+	err := c.BindUri(&uri)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	var request requestRotateSigningSecret
+	//ボディは省略できる
+	if c.Request.ContentLength != 0 {
+		err = c.BindJSON(&request)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(uri)
+	if err == nil {
+		err = validator.Struct(request)
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	botEndpointId, err := uuid.Parse(uri.BotEndpointId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	gracePeriod := usecase.DefaultSigningSecretGracePeriod
+	if request.GracePeriodSeconds != nil {
+		gracePeriod = time.Duration(*request.GracePeriodSeconds) * time.Second
+	}
+	rotateSigningSecretInputDTO := usecase.RotateSigningSecretInputDTO{
+		BotEndpointId: botEndpointId,
+		UserId:        authenticatedUserId(c),
+		GracePeriod:   gracePeriod,
+	}
+	output, err := handler.usecase.RotateSigningSecret(c.Request.Context(), rotateSigningSecretInputDTO)
+	if err != nil {
+		log.Printf("failed to rotate signing secret: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, responseRotateSigningSecret{SigningSecret: output.SigningSecret, PreviousSecretExpiresAt: output.PreviousSecretExpiresAt})
+}
+
+const (
+	defaultBotDeliveriesLimit = 50
+	maxBotDeliveriesLimit     = 100
+)
+
+type requestGetBotDeliveries struct {
+	BotEndpointId string `uri:"bot_endpoint_id" validate:"required,uuid"`
+	Status        string `form:"status" validate:"omitempty,oneof=pending dead"`
+	Limit         int    `form:"limit" validate:"omitempty,min=1,max=100"`
+}
+
+// GET /bot_endpoint/:bot_endpoint_id/deliveries?status={pending|dead}&limit={limit}
+//
+// botにまだ届いていない配信を古い順に取得する。statusを省略した場合は両方を取得する。botの所有者のみ取得できる
+func (handler *botEndpointHandler) GetBotDeliveries(c *gin.Context) {
+	var request requestGetBotDeliveries
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = c.BindQuery(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	botEndpointId, err := uuid.Parse(request.BotEndpointId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	getBotDeliveriesInputDTO := usecase.GetBotDeliveriesInputDTO{
+		BotEndpointId: botEndpointId,
+		UserId:        authenticatedUserId(c),
+		Status:        request.Status,
+		Limit:         defaultBotDeliveriesLimit,
+	}
+	if request.Limit != 0 {
+		getBotDeliveriesInputDTO.Limit = min(request.Limit, maxBotDeliveriesLimit)
+	}
+	deliveries, err := handler.usecase.GetBotDeliveries(c.Request.Context(), getBotDeliveriesInputDTO)
+	if err != nil {
+		log.Printf("failed to get bot deliveries: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"deliveries": deliveries})
+}
+
+//	### POST /bot_endpoint/:bot_endpoint_id/deliveries/redrive
+//
+// deadになった配信を再送する。delivery_idsを省略した場合はbotの全てのdeadの配信を再送する。botの所有者のみ再送できる
+//
+// ヘッダ
+//
+// ```
+// Content-Type: application/json
+// Authorization: Bearer {auth0のjwt}
+// ```
+//
+// ボディ
+//
+// ```
+//
+//	{
+//	   "delivery_ids": ["string"],
+//	}
+//
+// ```
+
+type requestRedriveBotDeliveriesUri struct {
+	BotEndpointId string `uri:"bot_endpoint_id" validate:"required,uuid"`
+}
+
+type requestRedriveBotDeliveries struct {
+	DeliveryIds []string `json:"delivery_ids" validate:"omitempty,max=100,dive,uuid"`
+}
+
+func (handler *botEndpointHandler) RedriveBotDeliveries(c *gin.Context) {
+	var uri requestRedriveBotDeliveriesUri
+	err := c.BindUri(&uri)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	var request requestRedriveBotDeliveries
+	//ボディは省略できる
+	if c.Request.ContentLength != 0 {
+		err = c.BindJSON(&request)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(uri)
+	if err == nil {
+		err = validator.Struct(request)
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	botEndpointId, err := uuid.Parse(uri.BotEndpointId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	deliveryIds := make([]uuid.UUID, 0, len(request.DeliveryIds))
+	for _, id := range request.DeliveryIds {
+		deliveryId, err := uuid.Parse(id)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		deliveryIds = append(deliveryIds, deliveryId)
+	}
+	redriveBotDeliveriesInputDTO := usecase.RedriveBotDeliveriesInputDTO{
+		BotEndpointId: botEndpointId,
+		UserId:        authenticatedUserId(c),
+		DeliveryIds:   deliveryIds,
+	}
+	redriven, err := handler.usecase.RedriveBotDeliveries(c.Request.Context(), redriveBotDeliveriesInputDTO)
+	if err != nil {
+		log.Printf("failed to redrive bot deliveries: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"redriven": redriven})
+}
+
+// bearerTokenはAuthorizationヘッダのBearerトークンを取得する
+func bearerToken(c *gin.Context) (string, bool) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return token, ok && token != ""
+}
+
+type BotEventHandler struct {
+	usecase usecase.BotEventUsecaseInterface
+}
+
+func NewBotEventHandler(usecase usecase.BotEventUsecaseInterface) *BotEventHandler {
+	return &BotEventHandler{usecase: usecase}
+}
+
+//	### POST /bot/callback
+//
+// botのエンドポイントに送ったイベントのcallback_tokenを使って、botがメッセージを投稿する
+// イベントが発生したチャンネル(スレッドの返信の場合はスレッド)に投稿される
+//
+// ヘッダ
+//
+// ```
+// Content-Type: application/json
+// Authorization: Bearer {callback_token}
+// ```
+//
+// ボディ
+//
+// ```
+//
+//	{
+//	   "message": "string",
+//	}
+//
+// ```
+
+type requestPostCallbackMessage struct {
+	Message string `json:"message" validate:"required"`
+}
+
+func (handler *BotEventHandler) PostCallbackMessage(c *gin.Context) {
+	token, ok := bearerToken(c)
+	if !ok {
+		c.JSON(401, gin.H{"error": "bearer token is required"})
+		return
+	}
+	var request requestPostCallbackMessage
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	postCallbackMessageInputDTO := usecase.PostCallbackMessageInputDTO{
+		Token:   []byte(token),
+		Message: request.Message,
+	}
+	message, err := handler.usecase.PostCallbackMessage(c.Request.Context(), postCallbackMessageInputDTO)
+	if err != nil {
+		log.Printf("failed to post bot callback message: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, newResponseMessage(message))
+}
+
+type requestBotCommand struct {
+	Name        string `json:"name" validate:"required"`
+	Description string `json:"description" validate:"max=200"`
+	Usage       string `json:"usage" validate:"max=200"`
+}
+
+type requestSetBotCommands struct {
+	BotEndpointId string              `uri:"bot_endpoint_id" json:"-" validate:"required,uuid"`
+	Commands      []requestBotCommand `json:"commands" validate:"dive"`
+}
+
+// PUT /bot_endpoint/:bot_endpoint_id/commands
+//
+// botのスラッシュコマンドを全て置き換える。botの所有者のみ登録できる
+// コマンドが実行されるとbotのエンドポイントにtypeがcommandのイベントをPOSTする
+func (handler *botEndpointHandler) SetBotCommands(c *gin.Context) {
+	var request requestSetBotCommands
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = c.BindJSON(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	botEndpointId, err := uuid.Parse(request.BotEndpointId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	commands := make([]entity.BotCommand, 0, len(request.Commands))
+	for _, command := range request.Commands {
+		commands = append(commands, entity.BotCommand{Name: command.Name, Description: command.Description, Usage: command.Usage})
+	}
+	botCommands, err := handler.usecase.SetBotCommands(c.Request.Context(), usecase.SetBotCommandsInputDTO{
+		UserId:        authenticatedUserId(c),
+		BotEndpointId: botEndpointId,
+		Commands:      commands,
+	})
+	if err != nil {
+		log.Printf("failed to set bot commands: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"commands": botCommands})
+}
+
+// GET /bot_endpoint/:bot_endpoint_id/commands
+//
+// botが登録しているスラッシュコマンドを取得する。botの所有者のみ取得できる
+func (handler *botEndpointHandler) GetBotCommands(c *gin.Context) {
+	botEndpointOwnerInputDTO, ok := bindBotEndpointOwner(c)
+	if !ok {
+		return
+	}
+	botCommands, err := handler.usecase.GetBotCommands(c.Request.Context(), botEndpointOwnerInputDTO)
+	if err != nil {
+		log.Printf("failed to get bot commands: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"commands": botCommands})
+}
+
+type CommandHandler struct {
+	usecase usecase.CommandUsecaseInterface
+}
+
+func NewCommandHandler(usecase usecase.CommandUsecaseInterface) *CommandHandler {
+	return &CommandHandler{usecase: usecase}
+}
+
+type requestGetCommands struct {
+	ServerId string `uri:"server_id" validate:"required,uuid"`
+	UserId   string `form:"user_id" validate:"required"`
+}
+
+// bot_endpoint_idとbot_nameはbotのコマンドの場合のみ返す
+type responseCommand struct {
+	Name          string `json:"name"`
+	Description   string `json:"description"`
+	Usage         string `json:"usage"`
+	BotEndpointId string `json:"bot_endpoint_id,omitempty"`
+	BotName       string `json:"bot_name,omitempty"`
+}
+
+// GET /server/:server_id/commands?user_id={user_id}
+//
+// サーバーで使えるスラッシュコマンドを取得する。クライアントの入力補完に使う
+// 組み込みのコマンドの後に、サーバーに追加されているbotのコマンドを返す
+func (handler *CommandHandler) GetCommands(c *gin.Context) {
+	var request requestGetCommands
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = c.BindQuery(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	serverId, err := uuid.Parse(request.ServerId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	commands, err := handler.usecase.GetCommands(c.Request.Context(), usecase.GetCommandsInputDTO{
+		UserId:   request.UserId,
+		ServerId: serverId,
+	})
+	if err != nil {
+		log.Printf("failed to get commands: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	response := make([]responseCommand, 0, len(commands))
+	for _, command := range commands {
+		response = append(response, responseCommand{
+			Name:          command.Name,
+			Description:   command.Description,
+			Usage:         command.Usage,
+			BotEndpointId: command.BotEndpointId,
+			BotName:       command.BotName,
+		})
+	}
+	c.JSON(200, gin.H{"commands": response})
+}
+
+type ServerBotEndpointHandler struct {
+	usecase usecase.ServerBotEndpointUsecaseInterface
+}
+
+func NewServerBotEndpointHandler(usecase usecase.ServerBotEndpointUsecaseInterface) *ServerBotEndpointHandler {
+	return &ServerBotEndpointHandler{usecase: usecase}
+}
+
+type requestInstallBot struct {
+	ServerId      string `uri:"server_id" json:"-" validate:"required,uuid"`
+	BotEndpointId string `json:"bot_endpoint_id" validate:"required,uuid"`
+}
+
+// POST /server/:server_id/bots
+//
+// サーバーにbotを追加する。Authorizationヘッダのトークンのuserがサーバーのownerの場合のみ追加できる
+func (handler *ServerBotEndpointHandler) InstallBot(c *gin.Context) {
+	var request requestInstallBot
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = c.BindJSON(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	serverId, err := uuid.Parse(request.ServerId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	botEndpointId, err := uuid.Parse(request.BotEndpointId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	serverBotEndpointInputDTO := usecase.ServerBotEndpointInputDTO{
+		UserId:        authenticatedUserId(c),
+		ServerId:      serverId,
+		BotEndpointId: botEndpointId,
+	}
+	err = handler.usecase.InstallBot(c.Request.Context(), serverBotEndpointInputDTO)
+	if err != nil {
+		log.Printf("failed to install bot: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "bot installed successfully"})
+}
+
+type requestUninstallBot struct {
+	ServerId      string `uri:"server_id" validate:"required,uuid"`
+	BotEndpointId string `uri:"bot_endpoint_id" validate:"required,uuid"`
+}
+
+// DELETE /server/:server_id/bots/:bot_endpoint_id
+//
+// サーバーからbotを削除する。Authorizationヘッダのトークンのuserがサーバーのownerの場合のみ削除できる
+func (handler *ServerBotEndpointHandler) UninstallBot(c *gin.Context) {
+	var request requestUninstallBot
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	serverId, err := uuid.Parse(request.ServerId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	botEndpointId, err := uuid.Parse(request.BotEndpointId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	serverBotEndpointInputDTO := usecase.ServerBotEndpointInputDTO{
+		UserId:        authenticatedUserId(c),
+		ServerId:      serverId,
+		BotEndpointId: botEndpointId,
+	}
+	err = handler.usecase.UninstallBot(c.Request.Context(), serverBotEndpointInputDTO)
+	if err != nil {
+		log.Printf("failed to uninstall bot: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "bot uninstalled successfully"})
+}
+
+// event_typesにnullを指定すると絞り込みをやめて、botが購読している全てのイベントを送る
+type requestSetBotEventSubscriptions struct {
+	ServerId      string   `uri:"server_id" json:"-" validate:"required,uuid"`
+	BotEndpointId string   `uri:"bot_endpoint_id" json:"-" validate:"required,uuid"`
+	EventTypes    []string `json:"event_types"`
+}
+
+// PUT /server/:server_id/bots/:bot_endpoint_id/events
+//
+// サーバーでbotに送るイベントを絞り込む。Authorizationヘッダのトークンのuserがサーバーのownerの場合のみ設定できる
+// botに送るのはbotが購読しているイベントのうち、event_typesに含まれるイベントのみ
+func (handler *ServerBotEndpointHandler) SetBotEventSubscriptions(c *gin.Context) {
+	var request requestSetBotEventSubscriptions
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = c.BindJSON(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	serverId, err := uuid.Parse(request.ServerId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	botEndpointId, err := uuid.Parse(request.BotEndpointId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = handler.usecase.SetBotEventSubscriptions(c.Request.Context(), usecase.SetBotEventSubscriptionsInputDTO{
+		UserId:        authenticatedUserId(c),
+		ServerId:      serverId,
+		BotEndpointId: botEndpointId,
+		EventTypes:    request.EventTypes,
+	})
+	if err != nil {
+		log.Printf("failed to set bot event subscriptions: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"event_types": request.EventTypes})
+}
+
+type requestGetInstalledBots struct {
+	ServerId string `uri:"server_id" validate:"required,uuid"`
+}
+
+type responseInstalledBot struct {
+	BotEndpointId string `json:"bot_endpoint_id"`
+	Name          string `json:"name"`
+	IconURL       string `json:"icon_url"`
+}
+
+// GET /server/:server_id/bots
+//
+// サーバーに追加されているbotを取得する。Authorizationヘッダのトークンのuserがサーバーのメンバーであれば取得できる
+func (handler *ServerBotEndpointHandler) GetInstalledBots(c *gin.Context) {
+	var request requestGetInstalledBots
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	serverId, err := uuid.Parse(request.ServerId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	getInstalledBotsInputDTO := usecase.GetInstalledBotsInputDTO{
+		UserId:   authenticatedUserId(c),
+		ServerId: serverId,
+	}
+	botEndpoints, err := handler.usecase.GetInstalledBots(c.Request.Context(), getInstalledBotsInputDTO)
+	if err != nil {
+		log.Printf("failed to get installed bots: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	//botのエンドポイントのURLはbotの運用者以外には返さない
+	response := make([]responseInstalledBot, 0, len(botEndpoints))
+	for _, botEndpoint := range botEndpoints {
+		response = append(response, responseInstalledBot{BotEndpointId: botEndpoint.Id, Name: botEndpoint.Name, IconURL: botEndpoint.IconURL})
+	}
+	c.JSON(200, gin.H{"bots": response})
+}
+
+type WebhookHandler struct {
+	usecase usecase.WebhookUsecaseInterface
+}
+
+func NewWebhookHandler(usecase usecase.WebhookUsecaseInterface) *WebhookHandler {
+	return &WebhookHandler{usecase: usecase}
+}
+
+type requestCreateWebhook struct {
+	ServerId  string `uri:"server_id" json:"-" validate:"required,uuid"`
+	ChannelId string `json:"channel_id" validate:"required,uuid"`
+	Name      string `json:"name" validate:"required,max=80"`
+	IconURL   string `json:"icon_url" validate:"omitempty,url"`
+}
+
+type responseWebhook struct {
+	WebhookId string    `json:"webhook_id"`
+	ChannelId string    `json:"channel_id"`
+	Name      string    `json:"name"`
+	IconURL   string    `json:"icon_url"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newResponseWebhook(webhook entity.Webhook) responseWebhook {
+	return responseWebhook{
+		WebhookId: webhook.Id.String(),
+		ChannelId: webhook.ChannelId.String(),
+		Name:      webhook.Name,
+		IconURL:   webhook.IconURL,
+		CreatedAt: webhook.CreatedAt,
+	}
+}
+
+type responseCreateWebhook struct {
+	responseWebhook
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+// POST /server/:server_id/webhooks
+//
+// チャンネルにメッセージを投稿するwebhookを作成する。Authorizationヘッダのトークンのuserがサーバーのownerの場合のみ作成できる
+// レスポンスのurlにPOSTするとメッセージを投稿できる。urlにはトークンが含まれるので、このレスポンスでしか返さない
+func (handler *WebhookHandler) CreateWebhook(c *gin.Context) {
+	var request requestCreateWebhook
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = c.BindJSON(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	serverId, err := uuid.Parse(request.ServerId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	channelId, err := uuid.Parse(request.ChannelId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	output, err := handler.usecase.CreateWebhook(c.Request.Context(), usecase.CreateWebhookInputDTO{
+		UserId:    authenticatedUserId(c),
+		ServerId:  serverId,
+		ChannelId: channelId,
+		Name:      request.Name,
+		IconURL:   request.IconURL,
+	})
+	if err != nil {
+		log.Printf("failed to create webhook: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, responseCreateWebhook{
+		responseWebhook: newResponseWebhook(output.Webhook),
+		Token:           output.Token,
+		URL:             fmt.Sprintf("%s://%s/webhooks/%s/%s", requestScheme(c), c.Request.Host, output.Webhook.Id, output.Token),
+	})
+}
+
+// requestSchemeはリクエストのschemeを返す。ロードバランサーでTLSを終端している場合はX-Forwarded-Protoを使う
+func requestScheme(c *gin.Context) string {
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+type requestGetWebhooks struct {
+	ServerId string `uri:"server_id" validate:"required,uuid"`
+}
+
+// GET /server/:server_id/webhooks
+//
+// サーバーの失効していないwebhookの一覧を取得する。Authorizationヘッダのトークンのuserがサーバーのownerの場合のみ取得できる。トークンは返さない
+func (handler *WebhookHandler) GetWebhooks(c *gin.Context) {
+	var request requestGetWebhooks
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	serverId, err := uuid.Parse(request.ServerId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	webhooks, err := handler.usecase.GetWebhooks(c.Request.Context(), usecase.GetWebhooksInputDTO{
+		UserId:   authenticatedUserId(c),
+		ServerId: serverId,
+	})
+	if err != nil {
+		log.Printf("failed to get webhooks: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	response := make([]responseWebhook, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		response = append(response, newResponseWebhook(webhook))
+	}
+	c.JSON(200, gin.H{"webhooks": response})
+}
+
+type requestRevokeWebhook struct {
+	ServerId  string `uri:"server_id" validate:"required,uuid"`
+	WebhookId string `uri:"webhook_id" validate:"required,uuid"`
+}
+
+// DELETE /server/:server_id/webhooks/:webhook_id
+//
+// webhookを失効させる。Authorizationヘッダのトークンのuserがサーバーのownerの場合のみ失効させられる。失効したwebhookのurlには投稿できない
+func (handler *WebhookHandler) RevokeWebhook(c *gin.Context) {
+	var request requestRevokeWebhook
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	serverId, err := uuid.Parse(request.ServerId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	webhookId, err := uuid.Parse(request.WebhookId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = handler.usecase.RevokeWebhook(c.Request.Context(), usecase.RevokeWebhookInputDTO{
+		UserId:    authenticatedUserId(c),
+		ServerId:  serverId,
+		WebhookId: webhookId,
+	})
+	if err != nil {
+		log.Printf("failed to revoke webhook: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "webhook revoked successfully"})
+}
+
+//	### POST /webhooks/:webhook_id/:token
+//
+// webhookのチャンネルにメッセージを投稿する。userのメッセージと同じくサーバーのメンバーにchat_messageで送られる
+// nameとicon_urlを省略した場合はwebhookの作成時に指定した表示名とアイコンを使う
+//
 // ボディ
 //
 // ```
 //
 //	{
+//	   "message": "string",
 //	   "name": "string",
 //	   "icon_url": "string",
-//	   "endpoint": "string",
 //	}
 //
 // ```
 
-type requestRegisterBotEndpoint struct {
-	Name     string `json:"name" validate:"required"`
-	IconURL  string `json:"icon_url" validate:"required"`
-	Endpoint string `json:"endpoint" validate:"required"`
+type requestExecuteWebhook struct {
+	WebhookId string `uri:"webhook_id" json:"-" validate:"required,uuid"`
+	Token     string `uri:"token" json:"-" validate:"required"`
+	Message   string `json:"message" validate:"required,max=4000"`
+	Name      string `json:"name" validate:"omitempty,max=80"`
+	IconURL   string `json:"icon_url" validate:"omitempty,url"`
 }
 
-func (handler *botEndpointHandler) RegisterBotEndpoint(c *gin.Context) {
-	var request requestRegisterBotEndpoint
-	err := c.BindJSON(&request)
+func (handler *WebhookHandler) ExecuteWebhook(c *gin.Context) {
+	var request requestExecuteWebhook
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = c.BindJSON(&request)
 	if err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
@@ -60,26 +1306,27 @@ func (handler *botEndpointHandler) RegisterBotEndpoint(c *gin.Context) {
 	validator := validate.GetValidater()
 	err = validator.Struct(request)
 	if err != nil {
-		err := errors.Wrap(err, fmt.Sprintf("requestRegisterBotEndpoint validation failed. botEndpoint -> %+v", request))
-		log.Printf("%+v", err)
-		c.JSON(400, gin.H{"error": err.Error()})
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
 		return
 	}
-
-	registerBotEndpointDto := usecase.RegisterBotEndpointInputDTO{
-		Name:     request.Name,
-		IconURL:  request.IconURL,
-		Endpoint: request.Endpoint,
+	webhookId, err := uuid.Parse(request.WebhookId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
 	}
-
-	err = handler.usecase.RegisterBotEndpoint(registerBotEndpointDto)
+	message, err := handler.usecase.ExecuteWebhook(c.Request.Context(), usecase.ExecuteWebhookInputDTO{
+		WebhookId: webhookId,
+		Token:     request.Token,
+		Message:   request.Message,
+		Name:      request.Name,
+		IconURL:   request.IconURL,
+	})
 	if err != nil {
-		err := errors.Wrap(err, fmt.Sprintf("failed to register bot endpoint. botEndpoint -> %+v", request))
-		log.Printf("%+v", err)
-		c.JSON(500, gin.H{"error": err.Error()})
+		log.Printf("failed to execute webhook: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(200, gin.H{"message": "bot endpoint registered successfully"})
+	c.JSON(200, newResponseMessage(message))
 }
 
 type ServerHandler struct {
@@ -104,35 +1351,98 @@ func (handler *ServerHandler) RegisterServer(c *gin.Context) {
 	var request requestRegisterServer
 	err := c.BindJSON(&request)
 	if err != nil {
-		err := errors.Wrap(err, fmt.Sprintf("failed to bind json. request -> %+v", request))
-		log.Printf("%+v", err)
+		err := errors.Wrap(err, fmt.Sprintf("failed to bind json. request -> %+v", request))
+		log.Printf("%+v", err)
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		err := errors.Wrap(err, fmt.Sprintf("request validation failed. request -> %+v", request))
+		log.Printf("%+v", err)
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	registerServerDto := usecase.RegisterServerInputDTO{
+		ServerName: request.Name,
+		UserId:     request.UserId,
+	}
+	serverId, err := handler.usecase.RegisterServer(c.Request.Context(), registerServerDto)
+	if err != nil {
+		log.Printf("failed to register server: %+v", err)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	response := responseRegisterServer{
+		ServerID: serverId,
+		Name:     request.Name,
+	}
+
+	c.JSON(200, response)
+}
+
+type requestSetMemberRole struct {
+	ServerId string `uri:"server_id" json:"-" validate:"required,uuid"`
+	UserId   string `uri:"user_id" json:"-" validate:"required"`
+	Role     string `json:"role" validate:"required,oneof=moderator member"`
+}
+
+//	### PUT /server/:server_id/members/:user_id/role
+//
+// サーバーのメンバーの役割をmoderatorかmemberに変更する。サーバーのownerのみ変更できる
+//
+// ヘッダ
+//
+// ```
+// Content-Type: application/json
+// Authorization: Bearer {auth0のjwt}
+// ```
+//
+// ボディ
+//
+// ```
+//
+//	{
+//	   "role": "moderator",
+//	}
+//
+// ```
+func (handler *ServerHandler) SetMemberRole(c *gin.Context) {
+	var request requestSetMemberRole
+	err := c.BindUri(&request)
+	if err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	validator := validate.GetValidater()
-	err = validator.Struct(request)
+	err = c.BindJSON(&request)
 	if err != nil {
-		err := errors.Wrap(err, fmt.Sprintf("request validation failed. request -> %+v", request))
-		log.Printf("%+v", err)
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	registerServerDto := usecase.RegisterServerInputDTO{
-		ServerName: request.Name,
-		UserId:     request.UserId,
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
 	}
-	serverId, err := handler.usecase.RegisterServer(c.Request.Context(), registerServerDto)
+	serverId, err := uuid.Parse(request.ServerId)
 	if err != nil {
-		log.Printf("failed to register server: %+v", err)
-		c.JSON(500, gin.H{"error": err.Error()})
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	response := responseRegisterServer{
-		ServerID: serverId,
-		Name:     request.Name,
+	err = handler.usecase.SetMemberRole(c.Request.Context(), usecase.SetMemberRoleInputDTO{
+		UserId:       authenticatedUserId(c),
+		ServerId:     serverId,
+		MemberUserId: request.UserId,
+		Role:         request.Role,
+	})
+	if err != nil {
+		log.Printf("failed to set member role: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
 	}
-
-	c.JSON(200, response)
+	c.JSON(200, gin.H{"user_id": request.UserId, "role": request.Role})
 }
 
 type requestGetServersByUserID struct {
@@ -314,6 +1624,82 @@ func (handler *UserHandler) UpsertUser(c *gin.Context) {
 	c.JSON(200, gin.H{"message": "user upserted successfully"})
 }
 
+type AuthHandler struct {
+	usecase usecase.AuthUsecaseInterface
+}
+
+func NewAuthHandler(usecase usecase.AuthUsecaseInterface) *AuthHandler {
+	return &AuthHandler{usecase: usecase}
+}
+
+type responseCreateWebsocketToken struct {
+	Token string `json:"token"` //jwt
+}
+
+//	### POST /ws/token
+//
+// websocketの接続時にクエリパラメータのtoken、Authorizationヘッダ、
+// Sec-WebSocket-Protocolヘッダのいずれかで送るトークンを発行する
+// トークンはAuthorizationヘッダのauth0が発行したjwtのsubのuserに対して発行する
+//
+// ヘッダ
+//
+// ```
+// Authorization: Bearer {auth0のjwt}
+// ```
+func (handler *AuthHandler) CreateWebsocketToken(c *gin.Context) {
+	identityToken, ok := bearerToken(c)
+	if !ok {
+		c.JSON(401, gin.H{"error": "Authorization header with Bearer token is required"})
+		return
+	}
+	createWebsocketTokenInputDTO := usecase.CreateWebsocketTokenInputDTO{
+		IdentityToken: identityToken,
+	}
+	token, err := handler.usecase.CreateWebsocketToken(c.Request.Context(), createWebsocketTokenInputDTO)
+	if err != nil {
+		log.Printf("failed to create websocket token: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, responseCreateWebsocketToken{Token: string(token)})
+}
+
+// authenticatedUserIdKeyはNewAuthMiddlewareが認証したuserのIdをgin.Contextに保存するキー
+const authenticatedUserIdKey = "authenticated_user_id"
+
+// NewAuthMiddlewareはAuthorizationヘッダのauth0が発行したjwtを検証して、ログインしているuserのIdをgin.Contextに保存する
+// 検証できない場合はレスポンスを返して、後続のhandlerを実行しない
+// 権限の確認にはリクエストのuser_idではなく、authenticatedUserIdで取得したuserのIdを使う
+//
+// ヘッダ
+//
+// ```
+// Authorization: Bearer {auth0のjwt}
+// ```
+func NewAuthMiddleware(usecase usecase.AuthUsecaseInterface) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identityToken, ok := bearerToken(c)
+		if !ok {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Authorization header with Bearer token is required"})
+			return
+		}
+		userId, err := usecase.Authenticate(identityToken)
+		if err != nil {
+			log.Printf("failed to authenticate request: %+v", err)
+			c.AbortWithStatusJSON(errorStatusCode(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(authenticatedUserIdKey, userId)
+		c.Next()
+	}
+}
+
+// authenticatedUserIdはNewAuthMiddlewareが認証したuserのIdを返す
+func authenticatedUserId(c *gin.Context) string {
+	return c.GetString(authenticatedUserIdKey)
+}
+
 type ChannelHandler struct {
 	usecase usecase.ChannelUsecaseInterface
 }
@@ -372,9 +1758,12 @@ type requestGetChannelsByServerID struct {
 	ServerId string `uri:"server_id" validate:"required,uuid"`
 }
 
+// last_seqはチャンネルの最新のメッセージのseqで、クライアントが取りこぼしたメッセージがあるかどうかの判定に使う
 type responseGetChannelsByServerID struct {
 	ChannelID string `json:"channel_id"`
 	Name      string `json:"name"`
+	LastSeq   int64  `json:"last_seq"`
+	Topic     string `json:"topic"`
 }
 
 func (handler *ChannelHandler) GetChannelsByServerID(c *gin.Context) {
@@ -409,6 +1798,8 @@ func (handler *ChannelHandler) GetChannelsByServerID(c *gin.Context) {
 		response = append(response, responseGetChannelsByServerID{
 			ChannelID: channel.Id.String(),
 			Name:      channel.Name,
+			LastSeq:   channel.LastSeq,
+			Topic:     channel.Topic,
 		})
 	}
 	c.JSON(200, response)
@@ -422,17 +1813,97 @@ func NewMessageHandler(usecase usecase.MessageUsecaseInterface) *MessageHandler
 	return &MessageHandler{usecase: usecase}
 }
 
+const (
+	defaultMessagesLimit = 50
+	maxMessagesLimit     = 100
+)
+
+// user_idはリアクションをしたかどうかを判定するために任意で受け取る
+// before、after、aroundにはメッセージのseqを指定し、最大1つだけ指定できる。どれも指定しない場合は最新のメッセージを返す
+// from_seqとto_seqを指定すると、Seqがその範囲に含まれるメッセージのみ返す
 type requestGetMessagesByChannelID struct {
 	ChannelId string `uri:"channel_id" validate:"required,uuid"`
+	UserId    string `form:"user_id"`
+	Before    *int64 `form:"before" validate:"omitempty,min=1,excluded_with=After Around FromSeq ToSeq"`
+	After     *int64 `form:"after" validate:"omitempty,min=0,excluded_with=Before Around FromSeq ToSeq"`
+	Around    *int64 `form:"around" validate:"omitempty,min=1,excluded_with=Before After FromSeq ToSeq"`
+	FromSeq   *int64 `form:"from_seq" validate:"omitempty,min=1"`
+	ToSeq     *int64 `form:"to_seq" validate:"omitempty,min=1"`
+	Limit     int    `form:"limit" validate:"omitempty,min=1,max=100"`
 }
 
+// prev_cursorはより古いメッセージがある場合にbeforeに、next_cursorはより新しいメッセージがある場合にafterに指定する
 type responseGetMessagesByChannelID struct {
-	MessageID string    `json:"message_id"`
-	ChannelID string    `json:"channel_id"`
-	UserName  string    `json:"user_name"`
-	IconURL   string    `json:"user_icon_image_url"`
-	Message   string    `json:"message"`
-	CreatedAt time.Time `json:"created_at"`
+	Messages   []responseMessage `json:"messages"`
+	PrevCursor *int64            `json:"prev_cursor"`
+	NextCursor *int64            `json:"next_cursor"`
+}
+
+type responseReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
+// 削除されたメッセージはdeletedをtrueにして本文を空にしたtombstoneとして返す
+// reply_countとlast_reply_atはチャンネルのメッセージの場合のみ設定される
+// seqはスレッドの返信の場合はnull
+// is_botがtrueの場合、user_nameとuser_icon_image_urlはbotの名前とアイコン
+// webhook_idはwebhookのメッセージの場合のみ設定され、user_nameとuser_icon_image_urlはwebhookの表示名とアイコン
+type responseMessage struct {
+	MessageID       string                  `json:"message_id"`
+	ChannelID       string                  `json:"channel_id"`
+	Seq             *int64                  `json:"seq"`
+	ParentMessageID *string                 `json:"parent_message_id"`
+	IsBot           bool                    `json:"is_bot"`
+	WebhookID       *string                 `json:"webhook_id"`
+	UserName        string                  `json:"user_name"`
+	IconURL         string                  `json:"user_icon_image_url"`
+	Message         string                  `json:"message"`
+	CreatedAt       time.Time               `json:"created_at"`
+	EditedAt        *time.Time              `json:"edited_at"`
+	Deleted         bool                    `json:"deleted"`
+	ReplyCount      int                     `json:"reply_count"`
+	LastReplyAt     *time.Time              `json:"last_reply_at"`
+	Reactions       []responseReactionCount `json:"reactions"`
+}
+
+func newResponseMessage(message entity.MessageWithUser) responseMessage {
+	reactions := make([]responseReactionCount, len(message.Reactions))
+	for i, reaction := range message.Reactions {
+		reactions[i] = responseReactionCount{
+			Emoji:   reaction.Emoji,
+			Count:   reaction.Count,
+			Reacted: reaction.Reacted,
+		}
+	}
+	var parentMessageID *string
+	if message.ParentMessageId != nil {
+		id := message.ParentMessageId.String()
+		parentMessageID = &id
+	}
+	var webhookID *string
+	if message.WebhookId != nil {
+		id := message.WebhookId.String()
+		webhookID = &id
+	}
+	return responseMessage{
+		MessageID:       message.Id.String(),
+		ChannelID:       message.ChannelId.String(),
+		Seq:             message.Seq,
+		ParentMessageID: parentMessageID,
+		IsBot:           message.IsBot,
+		WebhookID:       webhookID,
+		UserName:        message.UserName,
+		IconURL:         message.IconURL,
+		Message:         message.Message.Message,
+		CreatedAt:       message.CreatedAt,
+		EditedAt:        message.EditedAt,
+		Deleted:         message.DeletedAt != nil,
+		ReplyCount:      message.ReplyCount,
+		LastReplyAt:     message.LastReplyAt,
+		Reactions:       reactions,
+	}
 }
 
 func (handler *MessageHandler) GetMessagesByChannelID(c *gin.Context) {
@@ -442,6 +1913,11 @@ func (handler *MessageHandler) GetMessagesByChannelID(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	err = c.BindQuery(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
 	validator := validate.GetValidater()
 	err = validator.Struct(request)
 	if err != nil {
@@ -455,26 +1931,330 @@ func (handler *MessageHandler) GetMessagesByChannelID(c *gin.Context) {
 	}
 	getMessagesByChannelIDInputDTO := usecase.GetMessagesByChannelIDInputDTO{
 		ChannelId: channelId,
+		UserId:    request.UserId,
+		Before:    request.Before,
+		After:     request.After,
+		Around:    request.Around,
+		FromSeq:   request.FromSeq,
+		ToSeq:     request.ToSeq,
+		Limit:     defaultMessagesLimit,
+	}
+	if request.Limit != 0 {
+		getMessagesByChannelIDInputDTO.Limit = min(request.Limit, maxMessagesLimit)
 	}
-	messages, err := handler.usecase.GetMessagesByChannelID(c.Request.Context(), getMessagesByChannelIDInputDTO)
+	output, err := handler.usecase.GetMessagesByChannelID(c.Request.Context(), getMessagesByChannelIDInputDTO)
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		log.Printf("failed to get messages: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
 		return
 	}
-	var response []responseGetMessagesByChannelID
-	for _, message := range messages {
-		response = append(response, responseGetMessagesByChannelID{
-			MessageID: message.Id.String(),
-			ChannelID: message.ChannelId.String(),
-			UserName:  message.UserName,
-			IconURL:   message.IconURL,
-			Message:   message.Message.Message,
-			CreatedAt: message.CreatedAt,
-		})
+	response := responseGetMessagesByChannelID{
+		Messages:   make([]responseMessage, 0, len(output.Messages)),
+		PrevCursor: output.PrevCursor,
+		NextCursor: output.NextCursor,
+	}
+	for _, message := range output.Messages {
+		response.Messages = append(response.Messages, newResponseMessage(message))
+	}
+	c.JSON(200, response)
+}
+
+const (
+	defaultThreadRepliesLimit = 50
+	maxThreadRepliesLimit     = 100
+)
+
+// afterには前のページのnext_cursorを指定する
+type requestGetThreadReplies struct {
+	MessageId string `uri:"message_id" validate:"required,uuid"`
+	UserId    string `form:"user_id"`
+	After     string `form:"after" validate:"omitempty,uuid"`
+	Limit     int    `form:"limit" validate:"omitempty,min=1,max=100"`
+}
+
+// next_cursorは続きの返信がない場合はnull
+type responseGetThreadReplies struct {
+	Replies    []responseMessage `json:"replies"`
+	NextCursor *string           `json:"next_cursor"`
+}
+
+// GET /message/:message_id/thread?user_id={user_id}&after={message_id}&limit={limit}
+func (handler *MessageHandler) GetThreadReplies(c *gin.Context) {
+	var request requestGetThreadReplies
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = c.BindQuery(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	messageId, err := uuid.Parse(request.MessageId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	getThreadRepliesInputDTO := usecase.GetThreadRepliesInputDTO{
+		ParentMessageId: messageId,
+		UserId:          request.UserId,
+		Limit:           defaultThreadRepliesLimit,
+	}
+	if request.Limit != 0 {
+		getThreadRepliesInputDTO.Limit = min(request.Limit, maxThreadRepliesLimit)
+	}
+	if request.After != "" {
+		after, err := uuid.Parse(request.After)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		getThreadRepliesInputDTO.After = &after
+	}
+	replies, nextCursor, err := handler.usecase.GetThreadReplies(c.Request.Context(), getThreadRepliesInputDTO)
+	if err != nil {
+		log.Printf("failed to get thread replies: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	response := responseGetThreadReplies{Replies: make([]responseMessage, 0, len(replies))}
+	for _, reply := range replies {
+		response.Replies = append(response.Replies, newResponseMessage(reply))
+	}
+	if nextCursor != nil {
+		cursor := nextCursor.String()
+		response.NextCursor = &cursor
+	}
+	c.JSON(200, response)
+}
+
+// path paramとbodyの両方から値を受け取る
+// 編集するuserはAuthorizationヘッダのトークンのuserとする
+type requestEditMessage struct {
+	MessageId string `uri:"message_id" json:"-" validate:"required,uuid"`
+	Message   string `json:"message" validate:"required"`
+}
+
+type responseEditMessage struct {
+	MessageID string    `json:"message_id"`
+	ChannelID string    `json:"channel_id"`
+	Message   string    `json:"message"`
+	EditedAt  time.Time `json:"edited_at"`
+}
+
+func (handler *MessageHandler) EditMessage(c *gin.Context) {
+	var request requestEditMessage
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = c.BindJSON(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	messageId, err := uuid.Parse(request.MessageId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	editMessageInputDTO := usecase.EditMessageInputDTO{
+		MessageId: messageId,
+		UserId:    authenticatedUserId(c),
+		Message:   request.Message,
+	}
+	message, err := handler.usecase.EditMessage(c.Request.Context(), editMessageInputDTO)
+	if err != nil {
+		log.Printf("failed to edit message: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	response := responseEditMessage{
+		MessageID: message.Id.String(),
+		ChannelID: message.ChannelId.String(),
+		Message:   message.Message,
+		EditedAt:  *message.EditedAt,
+	}
+	c.JSON(200, response)
+}
+
+type requestDeleteMessage struct {
+	MessageId string `uri:"message_id" validate:"required,uuid"`
+}
+
+type responseDeleteMessage struct {
+	MessageID string    `json:"message_id"`
+	ChannelID string    `json:"channel_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// DELETE /message/:message_id
+//
+// 削除するuserはAuthorizationヘッダのトークンのuserとする
+func (handler *MessageHandler) DeleteMessage(c *gin.Context) {
+	var request requestDeleteMessage
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	messageId, err := uuid.Parse(request.MessageId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	deleteMessageInputDTO := usecase.DeleteMessageInputDTO{
+		MessageId: messageId,
+		UserId:    authenticatedUserId(c),
+	}
+	message, err := handler.usecase.DeleteMessage(c.Request.Context(), deleteMessageInputDTO)
+	if err != nil {
+		log.Printf("failed to delete message: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	response := responseDeleteMessage{
+		MessageID: message.Id.String(),
+		ChannelID: message.ChannelId.String(),
+		DeletedAt: *message.DeletedAt,
 	}
 	c.JSON(200, response)
 }
 
+type ReactionHandler struct {
+	usecase usecase.ReactionUsecaseInterface
+}
+
+func NewReactionHandler(usecase usecase.ReactionUsecaseInterface) *ReactionHandler {
+	return &ReactionHandler{usecase: usecase}
+}
+
+type requestAddReaction struct {
+	MessageId string `uri:"message_id" json:"-" validate:"required,uuid"`
+	UserId    string `json:"user_id" validate:"required"`
+	Emoji     string `json:"emoji" validate:"required,max=64"`
+}
+
+// POST /message/:message_id/reaction
+func (handler *ReactionHandler) AddReaction(c *gin.Context) {
+	var request requestAddReaction
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = c.BindJSON(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	messageId, err := uuid.Parse(request.MessageId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	reactionInputDTO := usecase.ReactionInputDTO{
+		MessageId: messageId,
+		UserId:    request.UserId,
+		Emoji:     request.Emoji,
+	}
+	err = handler.usecase.AddReaction(c.Request.Context(), reactionInputDTO)
+	if err != nil {
+		log.Printf("failed to add reaction: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "reaction added successfully"})
+}
+
+type requestRemoveReaction struct {
+	MessageId string `uri:"message_id" validate:"required,uuid"`
+	UserId    string `form:"user_id" validate:"required"`
+	Emoji     string `form:"emoji" validate:"required,max=64"`
+}
+
+// DELETE /message/:message_id/reaction?user_id={user_id}&emoji={emoji}
+func (handler *ReactionHandler) RemoveReaction(c *gin.Context) {
+	var request requestRemoveReaction
+	err := c.BindUri(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	err = c.BindQuery(&request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	validator := validate.GetValidater()
+	err = validator.Struct(request)
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("request validation failed:%s", err.Error())})
+		return
+	}
+	messageId, err := uuid.Parse(request.MessageId)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	reactionInputDTO := usecase.ReactionInputDTO{
+		MessageId: messageId,
+		UserId:    request.UserId,
+		Emoji:     request.Emoji,
+	}
+	err = handler.usecase.RemoveReaction(c.Request.Context(), reactionInputDTO)
+	if err != nil {
+		log.Printf("failed to remove reaction: %+v", err)
+		c.JSON(errorStatusCode(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "reaction removed successfully"})
+}
+
+// errorStatusCodeはusecaseから返されたエラーに対応するステータスコードを返す
+func errorStatusCode(err error) int {
+	switch {
+	case errors.Is(err, usecase.ErrForbidden):
+		return 403
+	case errors.Is(err, usecase.ErrNotFound):
+		return 404
+	case errors.Is(err, usecase.ErrInvalidArgument):
+		return 400
+	case errors.Is(err, usecase.ErrUnauthorized):
+		return 401
+	case errors.Is(err, usecase.ErrUnavailable):
+		return 503
+	default:
+		return 500
+	}
+}
+
 func Ping(c *gin.Context) {
 	c.JSON(200, gin.H{"message": "pong"})
 }
@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/hebitigo/CATechAccelChatApp/entity"
+	"github.com/hebitigo/CATechAccelChatApp/usecase"
+)
+
+// fakeAuthUsecaseはvalidTokenのみをuserIdのuserのトークンとして認証する
+type fakeAuthUsecase struct {
+	usecase.AuthUsecaseInterface
+	validToken string
+	userId     string
+	err        error
+}
+
+func (fake *fakeAuthUsecase) Authenticate(identityToken string) (string, error) {
+	if fake.err != nil {
+		return "", fake.err
+	}
+	if identityToken != fake.validToken {
+		return "", errors.Wrap(usecase.ErrUnauthorized, "invalid token")
+	}
+	return fake.userId, nil
+}
+
+// newAuthorizedRouterはNewAuthMiddlewareで認証したuserのIdを返すrouteを用意する
+// 認証が必要なrouteを追加できるようにgroupも返す
+func newAuthorizedRouter(authUsecase usecase.AuthUsecaseInterface) (*gin.Engine, *gin.RouterGroup) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	authorized := r.Group("")
+	authorized.Use(NewAuthMiddleware(authUsecase))
+	authorized.GET("/me", func(c *gin.Context) {
+		c.JSON(200, gin.H{"user_id": authenticatedUserId(c)})
+	})
+	return r, authorized
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	authUsecase := &fakeAuthUsecase{validToken: "valid", userId: "auth0|owner"}
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+		wantUserId    string
+	}{
+		{name: "valid token", authorization: "Bearer valid", wantStatus: 200, wantUserId: "auth0|owner"},
+		{name: "no authorization header", authorization: "", wantStatus: 401},
+		{name: "not a bearer token", authorization: "Basic valid", wantStatus: 401},
+		{name: "invalid token", authorization: "Bearer invalid", wantStatus: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/me?user_id=auth0|someone", nil)
+			if tt.authorization != "" {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			r, _ := newAuthorizedRouter(authUsecase)
+			r.ServeHTTP(recorder, request)
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d. body -> %s", recorder.Code, tt.wantStatus, recorder.Body.String())
+			}
+			if tt.wantStatus != 200 {
+				return
+			}
+			var response struct {
+				UserId string `json:"user_id"`
+			}
+			err := json.Unmarshal(recorder.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			//クエリパラメータのuser_idではなく、トークンのuserが使われる
+			if response.UserId != tt.wantUserId {
+				t.Errorf("user_id = %s, want %s", response.UserId, tt.wantUserId)
+			}
+		})
+	}
+}
+
+// IdPが設定されていない場合は認証が必要なrouteだけが503を返す
+func TestAuthMiddlewareWithoutIdentityProvider(t *testing.T) {
+	authUsecase := &fakeAuthUsecase{err: errors.Wrap(usecase.ErrUnavailable, "identity provider is not configured")}
+	request := httptest.NewRequest(http.MethodGet, "/me", nil)
+	request.Header.Set("Authorization", "Bearer valid")
+	recorder := httptest.NewRecorder()
+	r, _ := newAuthorizedRouter(authUsecase)
+	r.ServeHTTP(recorder, request)
+	if recorder.Code != 503 {
+		t.Errorf("status = %d, want 503", recorder.Code)
+	}
+}
+
+// fakeMessageUsecaseは受け取ったDTOを記録する
+type fakeMessageUsecase struct {
+	usecase.MessageUsecaseInterface
+	edited  usecase.EditMessageInputDTO
+	deleted usecase.DeleteMessageInputDTO
+}
+
+func (fake *fakeMessageUsecase) EditMessage(ctx context.Context, dto usecase.EditMessageInputDTO) (entity.Message, error) {
+	fake.edited = dto
+	editedAt := time.Now()
+	messageId := dto.MessageId
+	return entity.Message{Id: &messageId, Message: dto.Message, EditedAt: &editedAt}, nil
+}
+
+// 編集するuserはbodyのuser_idではなく、トークンのuserになる
+func TestEditMessageUsesAuthenticatedUser(t *testing.T) {
+	messageUsecase := &fakeMessageUsecase{}
+	r, authorized := newAuthorizedRouter(&fakeAuthUsecase{validToken: "valid", userId: "auth0|author"})
+	authorized.PATCH("/message/:message_id", NewMessageHandler(messageUsecase).EditMessage)
+
+	messageId := uuid.New()
+	request := httptest.NewRequest(http.MethodPatch, "/message/"+messageId.String(), strings.NewReader(`{"user_id":"auth0|someone","message":"edited"}`))
+	request.Header.Set("Authorization", "Bearer valid")
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	if recorder.Code != 200 {
+		t.Fatalf("status = %d, want 200. body -> %s", recorder.Code, recorder.Body.String())
+	}
+	if messageUsecase.edited.UserId != "auth0|author" || messageUsecase.edited.MessageId != messageId {
+		t.Errorf("EditMessage() called with %+v, want user auth0|author and message %s", messageUsecase.edited, messageId)
+	}
+}
+
+func (fake *fakeMessageUsecase) DeleteMessage(ctx context.Context, dto usecase.DeleteMessageInputDTO) (entity.Message, error) {
+	fake.deleted = dto
+	messageId := dto.MessageId
+	deletedAt := time.Now()
+	return entity.Message{Id: &messageId, DeletedAt: &deletedAt}, nil
+}
+
+// 削除するuserはクエリパラメータのuser_idではなく、トークンのuserになる
+func TestDeleteMessageUsesAuthenticatedUser(t *testing.T) {
+	messageUsecase := &fakeMessageUsecase{}
+	r, authorized := newAuthorizedRouter(&fakeAuthUsecase{validToken: "valid", userId: "auth0|moderator"})
+	authorized.DELETE("/message/:message_id", NewMessageHandler(messageUsecase).DeleteMessage)
+
+	messageId := uuid.New()
+	request := httptest.NewRequest(http.MethodDelete, "/message/"+messageId.String()+"?user_id=auth0|owner", nil)
+	request.Header.Set("Authorization", "Bearer valid")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	if recorder.Code != 200 {
+		t.Fatalf("status = %d, want 200. body -> %s", recorder.Code, recorder.Body.String())
+	}
+	if messageUsecase.deleted.UserId != "auth0|moderator" || messageUsecase.deleted.MessageId != messageId {
+		t.Errorf("DeleteMessage() called with %+v, want user auth0|moderator and message %s", messageUsecase.deleted, messageId)
+	}
+}
+
+// fakeServerBotEndpointUsecaseはbotを追加しようとしたuserを記録する
+type fakeServerBotEndpointUsecase struct {
+	usecase.ServerBotEndpointUsecaseInterface
+	installed usecase.ServerBotEndpointInputDTO
+}
+
+func (fake *fakeServerBotEndpointUsecase) InstallBot(ctx context.Context, dto usecase.ServerBotEndpointInputDTO) error {
+	fake.installed = dto
+	return nil
+}
+
+// botを追加するuserはbodyのuser_idではなく、トークンのuserになる
+func TestInstallBotUsesAuthenticatedUser(t *testing.T) {
+	serverBotEndpointUsecase := &fakeServerBotEndpointUsecase{}
+	r, authorized := newAuthorizedRouter(&fakeAuthUsecase{validToken: "valid", userId: "auth0|member"})
+	authorized.POST("/server/:server_id/bots", NewServerBotEndpointHandler(serverBotEndpointUsecase).InstallBot)
+
+	serverId := uuid.New()
+	botEndpointId := uuid.New()
+	body := `{"user_id":"auth0|owner","bot_endpoint_id":"` + botEndpointId.String() + `"}`
+	request := httptest.NewRequest(http.MethodPost, "/server/"+serverId.String()+"/bots", strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer valid")
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	if recorder.Code != 200 {
+		t.Fatalf("status = %d, want 200. body -> %s", recorder.Code, recorder.Body.String())
+	}
+	if serverBotEndpointUsecase.installed.UserId != "auth0|member" || serverBotEndpointUsecase.installed.ServerId != serverId {
+		t.Errorf("InstallBot() called with %+v, want user auth0|member and server %s", serverBotEndpointUsecase.installed, serverId)
+	}
+}
+
+// fakeWebhookUsecaseはwebhookを失効させようとしたuserを記録する
+type fakeWebhookUsecase struct {
+	usecase.WebhookUsecaseInterface
+	revoked usecase.RevokeWebhookInputDTO
+}
+
+func (fake *fakeWebhookUsecase) RevokeWebhook(ctx context.Context, dto usecase.RevokeWebhookInputDTO) error {
+	fake.revoked = dto
+	return nil
+}
+
+// webhookを失効させるuserはクエリパラメータのuser_idではなく、トークンのuserになる
+func TestRevokeWebhookUsesAuthenticatedUser(t *testing.T) {
+	webhookUsecase := &fakeWebhookUsecase{}
+	r, authorized := newAuthorizedRouter(&fakeAuthUsecase{validToken: "valid", userId: "auth0|member"})
+	authorized.DELETE("/server/:server_id/webhooks/:webhook_id", NewWebhookHandler(webhookUsecase).RevokeWebhook)
+
+	serverId := uuid.New()
+	webhookId := uuid.New()
+	request := httptest.NewRequest(http.MethodDelete, "/server/"+serverId.String()+"/webhooks/"+webhookId.String()+"?user_id=auth0|owner", nil)
+	request.Header.Set("Authorization", "Bearer valid")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	if recorder.Code != 200 {
+		t.Fatalf("status = %d, want 200. body -> %s", recorder.Code, recorder.Body.String())
+	}
+	if webhookUsecase.revoked.UserId != "auth0|member" || webhookUsecase.revoked.WebhookId != webhookId {
+		t.Errorf("RevokeWebhook() called with %+v, want user auth0|member and webhook %s", webhookUsecase.revoked, webhookId)
+	}
+}
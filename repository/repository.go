@@ -2,6 +2,8 @@ package repository
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"time"
@@ -9,6 +11,7 @@ import (
 	"github.com/cockroachdb/errors"
 	"github.com/google/uuid"
 	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
 
 	"github.com/hebitigo/CATechAccelChatApp/entity"
 )
@@ -26,28 +29,496 @@ func GetInsertQuery(ctx context.Context, db *bun.DB) *bun.InsertQuery {
 	return db.NewInsert()
 }
 
+func GetSelectQuery(ctx context.Context, db *bun.DB) *bun.SelectQuery {
+	if tx, ok := ctx.Value(txKey).(*bun.Tx); ok {
+		return tx.NewSelect()
+	}
+	return db.NewSelect()
+}
+
+func GetUpdateQuery(ctx context.Context, db *bun.DB) *bun.UpdateQuery {
+	if tx, ok := ctx.Value(txKey).(*bun.Tx); ok {
+		return tx.NewUpdate()
+	}
+	return db.NewUpdate()
+}
+
+func GetDeleteQuery(ctx context.Context, db *bun.DB) *bun.DeleteQuery {
+	if tx, ok := ctx.Value(txKey).(*bun.Tx); ok {
+		return tx.NewDelete()
+	}
+	return db.NewDelete()
+}
+
+func GetRawQuery(ctx context.Context, db *bun.DB, query string, args ...interface{}) *bun.RawQuery {
+	if tx, ok := ctx.Value(txKey).(*bun.Tx); ok {
+		return tx.NewRaw(query, args...)
+	}
+	return db.NewRaw(query, args...)
+}
+
 type BotEndpointRespositoryInterface interface {
-	Insert(e entity.BotEndpoint) error
+	Insert(ctx context.Context, e entity.BotEndpoint) (string, error)
+	GetBotEndpoint(ctx context.Context, botEndpointId string) (entity.BotEndpoint, error)
+	RotateSigningSecret(ctx context.Context, botEndpointId string, currentSecret string, newSecret string, previousExpiresAt time.Time) (bool, error)
+	GetBotEndpointsByOwnerUserID(ctx context.Context, ownerUserId string) ([]entity.BotEndpoint, error)
+	GetUnownedBotEndpoints(ctx context.Context) ([]entity.BotEndpoint, error)
+	AssignOwner(ctx context.Context, botEndpointId string, ownerUserId string) (bool, error)
+	Update(ctx context.Context, e entity.BotEndpoint) error
+	SoftDelete(ctx context.Context, botEndpointId string) error
+	SetVerified(ctx context.Context, botEndpointId string, endpoint string, verified bool) error
 }
 
-// TODO:メソッドの引数でcontext.Contextを受け取るようにする
 type BotEndpointRepository struct {
-	db  *bun.DB
-	ctx context.Context
+	db *bun.DB
+}
+
+func NewBotEndpointRepository(db *bun.DB) *BotEndpointRepository {
+	return &BotEndpointRepository{db: db}
+}
+
+func (repo *BotEndpointRepository) Insert(ctx context.Context, botEndpoint entity.BotEndpoint) (string, error) {
+	_, err := GetInsertQuery(ctx, repo.db).Model(&botEndpoint).Exec(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("failed to insert botEndpoint. name -> %s, endpoint -> %s:", botEndpoint.Name, botEndpoint.Endpoint))
+	}
+	return botEndpoint.Id, nil
+}
+
+// GetBotEndpointは削除されていないbotを取得する
+func (repo *BotEndpointRepository) GetBotEndpoint(ctx context.Context, botEndpointId string) (entity.BotEndpoint, error) {
+	var botEndpoint entity.BotEndpoint
+	err := GetSelectQuery(ctx, repo.db).Model(&botEndpoint).Where("id = ?", botEndpointId).Where("deleted_at IS NULL").Scan(ctx)
+	if err != nil {
+		return entity.BotEndpoint{}, errors.Wrap(err, fmt.Sprintf("failed to get botEndpoint by id. bot_endpoint_id -> %s", botEndpointId))
+	}
+	return botEndpoint, nil
+}
+
+// RotateSigningSecretは秘密鍵を新しいものに置き換えて、古い秘密鍵をpreviousExpiresAtまで残す
+// 同時にローテーションされた場合に片方だけが成功するように、秘密鍵がcurrentSecretのままの場合にのみ更新する
+// 更新した場合はtrueを返す
+func (repo *BotEndpointRepository) RotateSigningSecret(ctx context.Context, botEndpointId string, currentSecret string, newSecret string, previousExpiresAt time.Time) (bool, error) {
+	result, err := GetUpdateQuery(ctx, repo.db).Model((*entity.BotEndpoint)(nil)).
+		Set("previous_signing_secret = signing_secret").
+		Set("previous_signing_secret_expires_at = ?", previousExpiresAt).
+		Set("signing_secret = ?", newSecret).
+		Where("id = ?", botEndpointId).Where("signing_secret = ?", currentSecret).Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to rotate signing secret. bot_endpoint_id -> %s", botEndpointId))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get rows affected")
+	}
+	return affected > 0, nil
+}
+
+// GetBotEndpointsByOwnerUserIDはuserが所有している削除されていないbotを登録順に取得する
+func (repo *BotEndpointRepository) GetBotEndpointsByOwnerUserID(ctx context.Context, ownerUserId string) ([]entity.BotEndpoint, error) {
+	botEndpoints := []entity.BotEndpoint{}
+	err := GetSelectQuery(ctx, repo.db).Model(&botEndpoints).Where("owner_user_id = ?", ownerUserId).Where("deleted_at IS NULL").OrderExpr("created_at, id").Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to get botEndpoints by owner_user_id. owner_user_id -> %s", ownerUserId))
+	}
+	return botEndpoints, nil
+}
+
+// GetUnownedBotEndpointsは所有者がいない削除されていないbotを登録順に取得する
+func (repo *BotEndpointRepository) GetUnownedBotEndpoints(ctx context.Context) ([]entity.BotEndpoint, error) {
+	botEndpoints := []entity.BotEndpoint{}
+	err := GetSelectQuery(ctx, repo.db).Model(&botEndpoints).Where("owner_user_id IS NULL").Where("deleted_at IS NULL").OrderExpr("created_at, id").Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get unowned botEndpoints")
+	}
+	return botEndpoints, nil
 }
 
-func NewBotEndpointRepository(db *bun.DB, ctx context.Context) *BotEndpointRepository {
-	return &BotEndpointRepository{db: db, ctx: ctx}
+// AssignOwnerは所有者がいないbotの所有者を設定する
+// 同時に設定された場合に片方だけが成功するように、所有者がいない場合にのみ更新する
+// 更新した場合はtrueを返す
+func (repo *BotEndpointRepository) AssignOwner(ctx context.Context, botEndpointId string, ownerUserId string) (bool, error) {
+	result, err := GetUpdateQuery(ctx, repo.db).Model((*entity.BotEndpoint)(nil)).Set("owner_user_id = ?", ownerUserId).
+		Where("id = ?", botEndpointId).Where("owner_user_id IS NULL").Where("deleted_at IS NULL").Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to assign owner of botEndpoint. bot_endpoint_id -> %s, owner_user_id -> %s", botEndpointId, ownerUserId))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get rows affected")
+	}
+	return affected > 0, nil
 }
 
-func (repo *BotEndpointRepository) Insert(botEndpoint entity.BotEndpoint) error {
-	_, err := repo.db.NewInsert().Model(&botEndpoint).Exec(repo.ctx)
+// Updateはbotの名前、アイコン、エンドポイント、購読しているイベントと検証済みかどうかを更新する
+func (repo *BotEndpointRepository) Update(ctx context.Context, botEndpoint entity.BotEndpoint) error {
+	_, err := GetUpdateQuery(ctx, repo.db).Model(&botEndpoint).Column("name", "icon_url", "endpoint", "event_subscriptions", "verified").Where("id = ?", botEndpoint.Id).Where("deleted_at IS NULL").Exec(ctx)
 	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("failed to insert botEndpoint. botEndpoint -> %+v:", botEndpoint))
+		return errors.Wrap(err, fmt.Sprintf("failed to update botEndpoint. bot_endpoint_id -> %s", botEndpoint.Id))
 	}
 	return nil
 }
 
+// SetVerifiedはbotの検証結果を保存する
+// 検証している間にエンドポイントが変更された場合は、古いエンドポイントの検証結果を保存しないように更新しない
+func (repo *BotEndpointRepository) SetVerified(ctx context.Context, botEndpointId string, endpoint string, verified bool) error {
+	_, err := GetUpdateQuery(ctx, repo.db).Model((*entity.BotEndpoint)(nil)).Set("verified = ?", verified).Where("id = ?", botEndpointId).Where("endpoint = ?", endpoint).Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to set verified of botEndpoint. bot_endpoint_id -> %s", botEndpointId))
+	}
+	return nil
+}
+
+func (repo *BotEndpointRepository) SoftDelete(ctx context.Context, botEndpointId string) error {
+	_, err := GetUpdateQuery(ctx, repo.db).Model((*entity.BotEndpoint)(nil)).Set("deleted_at = current_timestamp").Where("id = ?", botEndpointId).Where("deleted_at IS NULL").Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to delete botEndpoint. bot_endpoint_id -> %s", botEndpointId))
+	}
+	return nil
+}
+
+type ServerBotEndpointRepositoryInterface interface {
+	Insert(ctx context.Context, e entity.ServerBotEndpoint) (bool, error)
+	Delete(ctx context.Context, serverId uuid.UUID, botEndpointId string) (bool, error)
+	DeleteByBotEndpointID(ctx context.Context, botEndpointId string) ([]uuid.UUID, error)
+	GetBotEndpointsByServerID(ctx context.Context, serverId uuid.UUID) ([]entity.BotEndpoint, error)
+	ExistServerBotEndpoint(ctx context.Context, serverId uuid.UUID, botEndpointId string) (bool, error)
+	GetServerIDsByBotEndpointID(ctx context.Context, botEndpointId string) ([]uuid.UUID, error)
+	SetEventSubscriptions(ctx context.Context, serverId uuid.UUID, botEndpointId string, eventTypes []string) (bool, error)
+}
+
+type ServerBotEndpointRepository struct {
+	db *bun.DB
+}
+
+func NewServerBotEndpointRepository(db *bun.DB) *ServerBotEndpointRepository {
+	return &ServerBotEndpointRepository{db: db}
+}
+
+// Insertはサーバーにbotを追加する。既に追加されている場合は何もせずにfalseを返す
+func (repo *ServerBotEndpointRepository) Insert(ctx context.Context, e entity.ServerBotEndpoint) (bool, error) {
+	result, err := GetInsertQuery(ctx, repo.db).Model(&e).On("CONFLICT (server_id, bot_endpoint_id) DO NOTHING").Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to insert serverBotEndpoint. serverBotEndpoint -> %+v:", e))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get rows affected")
+	}
+	return affected > 0, nil
+}
+
+// Deleteはサーバーからbotを削除する。追加されていなかった場合は何もせずにfalseを返す
+func (repo *ServerBotEndpointRepository) Delete(ctx context.Context, serverId uuid.UUID, botEndpointId string) (bool, error) {
+	result, err := GetDeleteQuery(ctx, repo.db).Model((*entity.ServerBotEndpoint)(nil)).Where("server_id = ?", serverId).Where("bot_endpoint_id = ?", botEndpointId).Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to delete serverBotEndpoint. server_id -> %s, bot_endpoint_id -> %s", serverId, botEndpointId))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get rows affected")
+	}
+	return affected > 0, nil
+}
+
+// DeleteByBotEndpointIDはbotを全てのサーバーから削除して、削除したサーバーのIdを返す
+func (repo *ServerBotEndpointRepository) DeleteByBotEndpointID(ctx context.Context, botEndpointId string) ([]uuid.UUID, error) {
+	serverIds := []uuid.UUID{}
+	_, err := GetDeleteQuery(ctx, repo.db).Model((*entity.ServerBotEndpoint)(nil)).Where("bot_endpoint_id = ?", botEndpointId).Returning("server_id").Exec(ctx, &serverIds)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to delete serverBotEndpoints by bot_endpoint_id. bot_endpoint_id -> %s", botEndpointId))
+	}
+	return serverIds, nil
+}
+
+// GetBotEndpointsByServerIDはサーバーに追加されているbotを取得する
+func (repo *ServerBotEndpointRepository) GetBotEndpointsByServerID(ctx context.Context, serverId uuid.UUID) ([]entity.BotEndpoint, error) {
+	botEndpoints := []entity.BotEndpoint{}
+	err := GetSelectQuery(ctx, repo.db).Model(&botEndpoints).
+		Join("INNER JOIN server_bot_endpoints AS sbe ON sbe.bot_endpoint_id = bot_endpoint.id").
+		Where("sbe.server_id = ?", serverId).Where("bot_endpoint.deleted_at IS NULL").OrderExpr("bot_endpoint.name").Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to get botEndpoints by server_id. server_id -> %s", serverId))
+	}
+	return botEndpoints, nil
+}
+
+func (repo *ServerBotEndpointRepository) ExistServerBotEndpoint(ctx context.Context, serverId uuid.UUID, botEndpointId string) (bool, error) {
+	exists, err := GetSelectQuery(ctx, repo.db).Model((*entity.ServerBotEndpoint)(nil)).Where("server_id = ?", serverId).Where("bot_endpoint_id = ?", botEndpointId).Exists(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to check if bot is added to server. server_id -> %s, bot_endpoint_id -> %s", serverId, botEndpointId))
+	}
+	return exists, nil
+}
+
+// GetServerIDsByBotEndpointIDはbotが追加されているサーバーのIdを取得する
+func (repo *ServerBotEndpointRepository) GetServerIDsByBotEndpointID(ctx context.Context, botEndpointId string) ([]uuid.UUID, error) {
+	serverIds := []uuid.UUID{}
+	err := GetSelectQuery(ctx, repo.db).Model((*entity.ServerBotEndpoint)(nil)).Column("server_id").Where("bot_endpoint_id = ?", botEndpointId).Scan(ctx, &serverIds)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to get server ids by bot_endpoint_id. bot_endpoint_id -> %s", botEndpointId))
+	}
+	return serverIds, nil
+}
+
+// SetEventSubscriptionsはサーバーでbotに送るイベントを設定する。eventTypesがnilの場合はbotが購読している全てのイベントを送る
+// botがサーバーに追加されていない場合はfalseを返す
+func (repo *ServerBotEndpointRepository) SetEventSubscriptions(ctx context.Context, serverId uuid.UUID, botEndpointId string, eventTypes []string) (bool, error) {
+	result, err := GetUpdateQuery(ctx, repo.db).Model((*entity.ServerBotEndpoint)(nil)).Set("event_subscriptions = ?", pgdialect.Array(eventTypes)).
+		Where("server_id = ?", serverId).Where("bot_endpoint_id = ?", botEndpointId).Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to set event subscriptions of serverBotEndpoint. server_id -> %s, bot_endpoint_id -> %s", serverId, botEndpointId))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get rows affected")
+	}
+	return affected > 0, nil
+}
+
+type BotTokenRepositoryInterface interface {
+	Insert(ctx context.Context, e entity.BotToken) (uuid.UUID, error)
+	GetBotEndpointByTokenHash(ctx context.Context, tokenHash string) (entity.BotEndpoint, uuid.UUID, error)
+	IsActive(ctx context.Context, botEndpointId uuid.UUID, tokenId uuid.UUID) (bool, error)
+	GetBotTokensByBotEndpointID(ctx context.Context, botEndpointId uuid.UUID) ([]entity.BotToken, error)
+	Revoke(ctx context.Context, botEndpointId uuid.UUID, tokenId uuid.UUID) (bool, error)
+}
+
+type BotTokenRepository struct {
+	db *bun.DB
+}
+
+func NewBotTokenRepository(db *bun.DB) *BotTokenRepository {
+	return &BotTokenRepository{db: db}
+}
+
+func (repo *BotTokenRepository) Insert(ctx context.Context, e entity.BotToken) (uuid.UUID, error) {
+	_, err := GetInsertQuery(ctx, repo.db).Model(&e).Exec(ctx)
+	if err != nil {
+		return uuid.Nil, errors.Wrap(err, fmt.Sprintf("failed to insert botToken. bot_endpoint_id -> %s", e.BotEndpointId))
+	}
+	return *e.Id, nil
+}
+
+// GetBotEndpointByTokenHashは失効していないトークンのbotとトークンのIdを取得する。botが削除されている場合は取得しない
+func (repo *BotTokenRepository) GetBotEndpointByTokenHash(ctx context.Context, tokenHash string) (entity.BotEndpoint, uuid.UUID, error) {
+	var botToken entity.BotToken
+	err := GetSelectQuery(ctx, repo.db).Model(&botToken).Where("token_hash = ?", tokenHash).Where("revoked_at IS NULL").Scan(ctx)
+	if err != nil {
+		return entity.BotEndpoint{}, uuid.Nil, errors.Wrap(err, "failed to get botToken by token")
+	}
+	var botEndpoint entity.BotEndpoint
+	err = GetSelectQuery(ctx, repo.db).Model(&botEndpoint).Where("id = ?", botToken.BotEndpointId).Where("deleted_at IS NULL").Scan(ctx)
+	if err != nil {
+		return entity.BotEndpoint{}, uuid.Nil, errors.Wrap(err, fmt.Sprintf("failed to get botEndpoint by token. token_id -> %s", botToken.Id))
+	}
+	return botEndpoint, *botToken.Id, nil
+}
+
+// IsActiveはbotのトークンが失効していないかどうかを確認する
+func (repo *BotTokenRepository) IsActive(ctx context.Context, botEndpointId uuid.UUID, tokenId uuid.UUID) (bool, error) {
+	exists, err := GetSelectQuery(ctx, repo.db).Model((*entity.BotToken)(nil)).Where("id = ?", tokenId).Where("bot_endpoint_id = ?", botEndpointId).Where("revoked_at IS NULL").Exists(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to check if botToken is active. bot_endpoint_id -> %s, token_id -> %s", botEndpointId, tokenId))
+	}
+	return exists, nil
+}
+
+// GetBotTokensByBotEndpointIDはbotの失効していないトークンを発行順に取得する
+func (repo *BotTokenRepository) GetBotTokensByBotEndpointID(ctx context.Context, botEndpointId uuid.UUID) ([]entity.BotToken, error) {
+	botTokens := []entity.BotToken{}
+	err := GetSelectQuery(ctx, repo.db).Model(&botTokens).Where("bot_endpoint_id = ?", botEndpointId).Where("revoked_at IS NULL").OrderExpr("created_at, id").Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to get botTokens by bot_endpoint_id. bot_endpoint_id -> %s", botEndpointId))
+	}
+	return botTokens, nil
+}
+
+// Revokeはトークンを失効させる。トークンが存在しないか既に失効している場合はfalseを返す
+func (repo *BotTokenRepository) Revoke(ctx context.Context, botEndpointId uuid.UUID, tokenId uuid.UUID) (bool, error) {
+	result, err := GetUpdateQuery(ctx, repo.db).Model((*entity.BotToken)(nil)).Set("revoked_at = current_timestamp").
+		Where("id = ?", tokenId).Where("bot_endpoint_id = ?", botEndpointId).Where("revoked_at IS NULL").Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to revoke botToken. token_id -> %s", tokenId))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get rows affected")
+	}
+	return affected > 0, nil
+}
+
+type BotCommandRepositoryInterface interface {
+	Insert(ctx context.Context, e []entity.BotCommand) error
+	DeleteByBotEndpointID(ctx context.Context, botEndpointId uuid.UUID) error
+	GetBotCommandsByBotEndpointIDs(ctx context.Context, botEndpointIds []uuid.UUID) ([]entity.BotCommand, error)
+}
+
+type BotCommandRepository struct {
+	db *bun.DB
+}
+
+func NewBotCommandRepository(db *bun.DB) *BotCommandRepository {
+	return &BotCommandRepository{db: db}
+}
+
+func (repo *BotCommandRepository) Insert(ctx context.Context, e []entity.BotCommand) error {
+	if len(e) == 0 {
+		return nil
+	}
+	_, err := GetInsertQuery(ctx, repo.db).Model(&e).Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to insert botCommands. botCommands -> %+v", e))
+	}
+	return nil
+}
+
+func (repo *BotCommandRepository) DeleteByBotEndpointID(ctx context.Context, botEndpointId uuid.UUID) error {
+	_, err := GetDeleteQuery(ctx, repo.db).Model((*entity.BotCommand)(nil)).Where("bot_endpoint_id = ?", botEndpointId).Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to delete botCommands by bot_endpoint_id. bot_endpoint_id -> %s", botEndpointId))
+	}
+	return nil
+}
+
+// GetBotCommandsByBotEndpointIDsはbotが登録したコマンドを名前順に取得する
+func (repo *BotCommandRepository) GetBotCommandsByBotEndpointIDs(ctx context.Context, botEndpointIds []uuid.UUID) ([]entity.BotCommand, error) {
+	botCommands := []entity.BotCommand{}
+	if len(botEndpointIds) == 0 {
+		return botCommands, nil
+	}
+	err := GetSelectQuery(ctx, repo.db).Model(&botCommands).Where("bot_endpoint_id IN (?)", bun.In(botEndpointIds)).OrderExpr("name, bot_endpoint_id").Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to get botCommands by bot_endpoint_ids. bot_endpoint_ids -> %v", botEndpointIds))
+	}
+	return botCommands, nil
+}
+
+type BotDeliveryRepositoryInterface interface {
+	EnqueueForServer(ctx context.Context, serverId uuid.UUID, channelId *uuid.UUID, parentMessageId *uuid.UUID, eventType string, payload []byte) (int64, error)
+	Claim(ctx context.Context, lease time.Duration) (entity.BotDelivery, error)
+	Delete(ctx context.Context, deliveryId uuid.UUID) error
+	MarkFailed(ctx context.Context, deliveryId uuid.UUID, lastError string, nextAttemptAt time.Time, dead bool) error
+	GetDeliveriesByBotEndpointID(ctx context.Context, botEndpointId uuid.UUID, status string, limit int) ([]entity.BotDelivery, error)
+	DeleteByBotEndpointID(ctx context.Context, botEndpointId uuid.UUID) error
+	Redrive(ctx context.Context, botEndpointId uuid.UUID, deliveryIds []uuid.UUID) (int64, error)
+}
+
+type BotDeliveryRepository struct {
+	db *bun.DB
+}
+
+func NewBotDeliveryRepository(db *bun.DB) *BotDeliveryRepository {
+	return &BotDeliveryRepository{db: db}
+}
+
+// EnqueueForServerはサーバーに追加されている検証済みのbotのうち、eventTypeのイベントを購読しているbotへの配信を追加して、追加した件数を返す
+// サーバーでbotに送るイベントが絞り込まれている場合は、そのイベントにも含まれている場合のみ追加する
+func (repo *BotDeliveryRepository) EnqueueForServer(ctx context.Context, serverId uuid.UUID, channelId *uuid.UUID, parentMessageId *uuid.UUID, eventType string, payload []byte) (int64, error) {
+	result, err := GetRawQuery(ctx, repo.db, `INSERT INTO bot_deliveries (bot_endpoint_id, server_id, channel_id, parent_message_id, event_type, payload)
+		SELECT sbe.bot_endpoint_id, sbe.server_id, ?, ?, ?, ? FROM server_bot_endpoints AS sbe
+		INNER JOIN bot_endpoints AS b ON b.id = sbe.bot_endpoint_id
+		WHERE sbe.server_id = ? AND b.verified AND b.deleted_at IS NULL
+		AND ? = ANY(b.event_subscriptions) AND (sbe.event_subscriptions IS NULL OR ? = ANY(sbe.event_subscriptions))`,
+		channelId, parentMessageId, eventType, json.RawMessage(payload), serverId, eventType, eventType).Exec(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("failed to enqueue bot deliveries. server_id -> %s, event_type -> %s", serverId, eventType))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get rows affected")
+	}
+	return affected, nil
+}
+
+// Claimは送信時刻になった配信を1件取得して、attemptsを増やしnext_attempt_atをlease後にする
+// 送信中にworkerが停止してもlease後に別のworkerが再送できる
+// 複数のレプリカのworkerが同じ配信を取得しないようにFOR UPDATE SKIP LOCKEDを使う
+// 送信する配信がない場合はsql.ErrNoRowsを返す
+func (repo *BotDeliveryRepository) Claim(ctx context.Context, lease time.Duration) (entity.BotDelivery, error) {
+	var delivery entity.BotDelivery
+	next := repo.db.NewSelect().Model((*entity.BotDelivery)(nil)).Column("id").
+		Where("status = ?", entity.BotDeliveryStatusPending).Where("next_attempt_at <= now()").
+		OrderExpr("next_attempt_at").Limit(1).For("UPDATE SKIP LOCKED")
+	_, err := repo.db.NewUpdate().Model(&delivery).
+		Set("attempts = attempts + 1").
+		Set("next_attempt_at = ?", time.Now().Add(lease)).
+		Where("id = (?)", next).Returning("*").Exec(ctx, &delivery)
+	if err != nil {
+		return entity.BotDelivery{}, errors.Wrap(err, "failed to claim bot delivery")
+	}
+	if delivery.Id == nil {
+		return entity.BotDelivery{}, errors.Wrap(sql.ErrNoRows, "no bot delivery to send")
+	}
+	return delivery, nil
+}
+
+func (repo *BotDeliveryRepository) Delete(ctx context.Context, deliveryId uuid.UUID) error {
+	_, err := repo.db.NewDelete().Model((*entity.BotDelivery)(nil)).Where("id = ?", deliveryId).Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to delete bot delivery. delivery_id -> %s", deliveryId))
+	}
+	return nil
+}
+
+// MarkFailedは送信に失敗した配信をnextAttemptAtに再送するようにする。deadの場合は再送しない
+func (repo *BotDeliveryRepository) MarkFailed(ctx context.Context, deliveryId uuid.UUID, lastError string, nextAttemptAt time.Time, dead bool) error {
+	status := entity.BotDeliveryStatusPending
+	if dead {
+		status = entity.BotDeliveryStatusDead
+	}
+	_, err := repo.db.NewUpdate().Model((*entity.BotDelivery)(nil)).
+		Set("status = ?", status).Set("last_error = ?", lastError).Set("next_attempt_at = ?", nextAttemptAt).
+		Where("id = ?", deliveryId).Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to mark bot delivery as failed. delivery_id -> %s", deliveryId))
+	}
+	return nil
+}
+
+// DeleteByBotEndpointIDはbotへの全ての配信を削除する
+func (repo *BotDeliveryRepository) DeleteByBotEndpointID(ctx context.Context, botEndpointId uuid.UUID) error {
+	_, err := GetDeleteQuery(ctx, repo.db).Model((*entity.BotDelivery)(nil)).Where("bot_endpoint_id = ?", botEndpointId).Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to delete bot deliveries. bot_endpoint_id -> %s", botEndpointId))
+	}
+	return nil
+}
+
+// GetDeliveriesByBotEndpointIDはbotへの未配信の配信を古い順に取得する。statusが空の場合は全てのstatusを取得する
+func (repo *BotDeliveryRepository) GetDeliveriesByBotEndpointID(ctx context.Context, botEndpointId uuid.UUID, status string, limit int) ([]entity.BotDelivery, error) {
+	deliveries := []entity.BotDelivery{}
+	query := repo.db.NewSelect().Model(&deliveries).Where("bot_endpoint_id = ?", botEndpointId)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	err := query.OrderExpr("created_at, id").Limit(limit).Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to get bot deliveries. bot_endpoint_id -> %s", botEndpointId))
+	}
+	return deliveries, nil
+}
+
+// Redriveはdeadになった配信をすぐに再送するようにして、再送する件数を返す
+// deliveryIdsが空の場合はbotの全てのdeadの配信を再送する
+func (repo *BotDeliveryRepository) Redrive(ctx context.Context, botEndpointId uuid.UUID, deliveryIds []uuid.UUID) (int64, error) {
+	query := repo.db.NewUpdate().Model((*entity.BotDelivery)(nil)).
+		Set("status = ?", entity.BotDeliveryStatusPending).Set("attempts = 0").Set("next_attempt_at = now()").
+		Where("bot_endpoint_id = ?", botEndpointId).Where("status = ?", entity.BotDeliveryStatusDead)
+	if len(deliveryIds) > 0 {
+		query = query.Where("id IN (?)", bun.In(deliveryIds))
+	}
+	result, err := query.Exec(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("failed to redrive bot deliveries. bot_endpoint_id -> %s", botEndpointId))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get rows affected")
+	}
+	return affected, nil
+}
+
 type ServerRepositoryInterface interface {
 	Insert(ctx context.Context, e entity.Server) (serverId uuid.UUID, err error)
 	GetServersByUserID(ctx context.Context, userId string) ([]entity.Server, error)
@@ -106,6 +577,10 @@ func (repo *ServerRepository) GetServer(ctx context.Context, serverId string) (e
 
 type UserServerRepositoryInterface interface {
 	Insert(ctx context.Context, e entity.UserServer) error
+	GetServerIDsByUserID(ctx context.Context, userId string) ([]uuid.UUID, error)
+	ExistUserServer(ctx context.Context, userId string, serverId uuid.UUID) (bool, error)
+	GetUserServer(ctx context.Context, userId string, serverId uuid.UUID) (entity.UserServer, error)
+	UpdateRole(ctx context.Context, userId string, serverId uuid.UUID, role string) (bool, error)
 }
 
 type UserServerRepository struct {
@@ -126,9 +601,57 @@ func (repo *UserServerRepository) Insert(ctx context.Context, e entity.UserServe
 	return nil
 }
 
+func (repo *UserServerRepository) GetServerIDsByUserID(ctx context.Context, userId string) ([]uuid.UUID, error) {
+	var userServers []entity.UserServer
+	err := repo.db.NewSelect().Model(&userServers).Where("user_id = ?", userId).Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to get userServer by user_id. user_id -> %s", userId))
+	}
+	serverIds := make([]uuid.UUID, len(userServers))
+	for i, userServer := range userServers {
+		serverIds[i] = userServer.ServerId
+	}
+	return serverIds, nil
+}
+
+func (repo *UserServerRepository) GetUserServer(ctx context.Context, userId string, serverId uuid.UUID) (entity.UserServer, error) {
+	var userServer entity.UserServer
+	err := repo.db.NewSelect().Model(&userServer).Where("user_id = ? AND server_id = ?", userId, serverId).Scan(ctx)
+	if err != nil {
+		return entity.UserServer{}, errors.Wrap(err, fmt.Sprintf("failed to get userServer. user_id -> %s, server_id -> %s", userId, serverId))
+	}
+	return userServer, nil
+}
+
+// UpdateRoleはサーバーでのuserの役割を変更する。userがサーバーに所属していない場合はfalseを返す
+func (repo *UserServerRepository) UpdateRole(ctx context.Context, userId string, serverId uuid.UUID, role string) (bool, error) {
+	result, err := GetUpdateQuery(ctx, repo.db).Model((*entity.UserServer)(nil)).Set("role = ?", role).
+		Where("user_id = ?", userId).Where("server_id = ?", serverId).Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to update role of userServer. user_id -> %s, server_id -> %s", userId, serverId))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get rows affected")
+	}
+	return affected > 0, nil
+}
+
+// userがサーバーに所属しているかどうかを確認する
+func (repo *UserServerRepository) ExistUserServer(ctx context.Context, userId string, serverId uuid.UUID) (bool, error) {
+	exists, err := repo.db.NewSelect().Model((*entity.UserServer)(nil)).Where("user_id = ? AND server_id = ?", userId, serverId).Exists(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to check userServer exists. user_id -> %s, server_id -> %s", userId, serverId))
+	}
+	return exists, nil
+}
+
 type ChannelRepositoryInterface interface {
 	Insert(ctx context.Context, e entity.Channel) (channelId uuid.UUID, err error)
 	GetChannelsByServerID(ctx context.Context, serverId uuid.UUID) ([]entity.Channel, error)
+	GetChannel(ctx context.Context, channelId uuid.UUID) (entity.Channel, error)
+	NextSeq(ctx context.Context, channelId uuid.UUID) (int64, error)
+	UpdateTopic(ctx context.Context, channelId uuid.UUID, topic string) error
 }
 
 type ChannelRepository struct {
@@ -158,6 +681,93 @@ func (repo *ChannelRepository) GetChannelsByServerID(ctx context.Context, server
 	return channels, nil
 }
 
+func (repo *ChannelRepository) GetChannel(ctx context.Context, channelId uuid.UUID) (entity.Channel, error) {
+	var channel entity.Channel
+	err := repo.db.NewSelect().Model(&channel).Where("id = ?", channelId).Scan(ctx)
+	if err != nil {
+		return entity.Channel{}, errors.Wrap(err, fmt.Sprintf("failed to get channel by id. channel_id -> %s", channelId))
+	}
+	return channel, nil
+}
+
+// NextSeqはチャンネルのメッセージのSeqを採番する
+// トランザクションの中で呼び出すと、トランザクションが終わるまでチャンネルの行がロックされるので、
+// 同時にメッセージが送られてもSeqが重複したり、コミットされる順番とSeqの順番が入れ替わったりしない
+func (repo *ChannelRepository) NextSeq(ctx context.Context, channelId uuid.UUID) (int64, error) {
+	var seq int64
+	_, err := GetUpdateQuery(ctx, repo.db).Model((*entity.Channel)(nil)).Set("last_seq = last_seq + 1").Where("id = ?", channelId).Returning("last_seq").Exec(ctx, &seq)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("failed to increment last_seq of channel. channel_id -> %s", channelId))
+	}
+	return seq, nil
+}
+
+func (repo *ChannelRepository) UpdateTopic(ctx context.Context, channelId uuid.UUID, topic string) error {
+	_, err := GetUpdateQuery(ctx, repo.db).Model((*entity.Channel)(nil)).Set("topic = ?", topic).Where("id = ?", channelId).Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to update topic of channel. channel_id -> %s", channelId))
+	}
+	return nil
+}
+
+type WebhookRepositoryInterface interface {
+	Insert(ctx context.Context, e entity.Webhook) (entity.Webhook, error)
+	GetWebhookByTokenHash(ctx context.Context, webhookId uuid.UUID, tokenHash string) (entity.Webhook, error)
+	GetWebhooksByServerID(ctx context.Context, serverId uuid.UUID) ([]entity.Webhook, error)
+	Revoke(ctx context.Context, serverId uuid.UUID, webhookId uuid.UUID) (bool, error)
+}
+
+type WebhookRepository struct {
+	db *bun.DB
+}
+
+func NewWebhookRepository(db *bun.DB) *WebhookRepository {
+	return &WebhookRepository{db: db}
+}
+
+func (repo *WebhookRepository) Insert(ctx context.Context, e entity.Webhook) (entity.Webhook, error) {
+	_, err := GetInsertQuery(ctx, repo.db).Model(&e).Returning("*").Exec(ctx)
+	if err != nil {
+		return entity.Webhook{}, errors.Wrap(err, fmt.Sprintf("failed to insert webhook. channel_id -> %s", e.ChannelId))
+	}
+	return e, nil
+}
+
+// GetWebhookByTokenHashは失効していないwebhookをIdとトークンのハッシュで取得する
+func (repo *WebhookRepository) GetWebhookByTokenHash(ctx context.Context, webhookId uuid.UUID, tokenHash string) (entity.Webhook, error) {
+	var webhook entity.Webhook
+	err := GetSelectQuery(ctx, repo.db).Model(&webhook).Where("id = ?", webhookId).Where("token_hash = ?", tokenHash).Where("revoked_at IS NULL").Scan(ctx)
+	if err != nil {
+		return entity.Webhook{}, errors.Wrap(err, fmt.Sprintf("failed to get webhook by token. webhook_id -> %s", webhookId))
+	}
+	return webhook, nil
+}
+
+// GetWebhooksByServerIDはサーバーの失効していないwebhookを作成順に取得する
+func (repo *WebhookRepository) GetWebhooksByServerID(ctx context.Context, serverId uuid.UUID) ([]entity.Webhook, error) {
+	webhooks := []entity.Webhook{}
+	err := GetSelectQuery(ctx, repo.db).Model(&webhooks).Where("server_id = ?", serverId).Where("revoked_at IS NULL").OrderExpr("created_at, id").Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to get webhooks by server_id. server_id -> %s", serverId))
+	}
+	return webhooks, nil
+}
+
+// Revokeはwebhookを失効させる。webhookが存在しないか既に失効している場合はfalseを返す
+// 失効したwebhookのメッセージが残るように、行自体は削除しない
+func (repo *WebhookRepository) Revoke(ctx context.Context, serverId uuid.UUID, webhookId uuid.UUID) (bool, error) {
+	result, err := GetUpdateQuery(ctx, repo.db).Model((*entity.Webhook)(nil)).Set("revoked_at = current_timestamp").
+		Where("id = ?", webhookId).Where("server_id = ?", serverId).Where("revoked_at IS NULL").Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to revoke webhook. webhook_id -> %s", webhookId))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get rows affected")
+	}
+	return affected > 0, nil
+}
+
 type TxRepositoryInterface interface {
 	DoInTx(ctx context.Context, f func(ctx context.Context) error) error
 }
@@ -246,7 +856,16 @@ func (repo *UserRepository) CheckUserExist(ctx context.Context, userId string) e
 
 type MessageRepositoryInterface interface {
 	Insert(ctx context.Context, e entity.Message) (time.Time, uuid.UUID, error)
-	GetMessagesWithUser(ctx context.Context, channelId uuid.UUID) ([]entity.MessageWithUser, error)
+	GetMessagesWithUser(ctx context.Context, channelId uuid.UUID, afterSeq *int64, beforeSeq *int64, limit int, newestFirst bool) ([]entity.MessageWithUser, error)
+	InsertOrGetByClientMsgID(ctx context.Context, e entity.Message) (entity.Message, bool, error)
+	GetThreadRepliesWithUser(ctx context.Context, parentMessageId uuid.UUID, after *uuid.UUID, limit int) ([]entity.MessageWithUser, error)
+	GetMissedMessagesWithUser(ctx context.Context, userId string, serverIds []uuid.UUID, channelCursors map[uuid.UUID]uuid.UUID, after *uuid.UUID, limit int) ([]entity.MessageWithUser, error)
+	GetMissedMessageChangesWithUser(ctx context.Context, userId string, serverIds []uuid.UUID, channelCursors map[uuid.UUID]uuid.UUID, after *uuid.UUID, limit int) ([]entity.MessageWithUser, error)
+	GetThreadParticipantIDs(ctx context.Context, parentMessageId uuid.UUID) ([]string, error)
+	GetMessage(ctx context.Context, messageId uuid.UUID) (entity.Message, error)
+	GetMessageForUpdate(ctx context.Context, messageId uuid.UUID) (entity.Message, error)
+	UpdateMessage(ctx context.Context, e entity.Message) error
+	SoftDeleteMessage(ctx context.Context, e entity.Message) error
 }
 
 type MessageRepository struct {
@@ -258,19 +877,321 @@ func NewMessageRepository(db *bun.DB) *MessageRepository {
 }
 
 func (repo *MessageRepository) Insert(ctx context.Context, e entity.Message) (time.Time, uuid.UUID, error) {
-	_, err := repo.db.NewInsert().Model(&e).Exec(ctx)
+	_, err := GetInsertQuery(ctx, repo.db).Model(&e).Exec(ctx)
 	if err != nil {
 		return time.Time{}, uuid.UUID{}, errors.Wrap(err, fmt.Sprintf("failed to insert message. message -> %+v:", e))
 	}
 	return e.CreatedAt, *e.Id, nil
 }
 
-func (repo *MessageRepository) GetMessagesWithUser(ctx context.Context, channelId uuid.UUID) ([]entity.MessageWithUser, error) {
+// InsertOrGetByClientMsgIDはClientMsgIdが設定されたメッセージを保存する
+// 同じuserが同じClientMsgIdのメッセージを既に保存している場合は保存せずに既存のメッセージを返す
+// 新たに保存した場合はtrueを返す
+func (repo *MessageRepository) InsertOrGetByClientMsgID(ctx context.Context, e entity.Message) (entity.Message, bool, error) {
+	result, err := GetInsertQuery(ctx, repo.db).Model(&e).On("CONFLICT (user_id, client_msg_id) WHERE client_msg_id IS NOT NULL DO NOTHING").Exec(ctx)
+	if err != nil {
+		return entity.Message{}, false, errors.Wrap(err, fmt.Sprintf("failed to insert message. message -> %+v:", e))
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return entity.Message{}, false, errors.Wrap(err, "failed to get rows affected")
+	}
+	if rowsAffected == 1 {
+		return e, true, nil
+	}
+	var message entity.Message
+	err = GetSelectQuery(ctx, repo.db).Model(&message).Where("user_id = ?", e.UserId).Where("client_msg_id = ?", *e.ClientMsgId).Scan(ctx)
+	if err != nil {
+		return entity.Message{}, false, errors.Wrap(err, fmt.Sprintf("failed to get message by client_msg_id. user_id -> %s, client_msg_id -> %s", e.UserId, *e.ClientMsgId))
+	}
+	return message, false, nil
+}
+
+// messagesWithUserQueryはメッセージと送信したuserの名前とアイコンを取得するクエリを返す
+// botのメッセージはuser_idがNULLなので、usersとbot_endpointsの両方をLEFT JOINしてbotの名前とアイコンを使う
+// webhookのメッセージはどちらもNULLなので、メッセージに保存した表示名とアイコンを使う
+func (repo *MessageRepository) messagesWithUserQuery() *bun.SelectQuery {
+	// return repo.db.NewSelect().Table("messages AS message").ColumnExpr("*").ColumnExpr("name as user_name,user.icon_image_url as user_icon_image_url").Join("JOIN users as user ON message.user_id = user.id")
+	return repo.db.NewSelect().TableExpr("messages AS message").ColumnExpr("message.*").
+		ColumnExpr("COALESCE(u.name, b.name, message.display_name, '') AS user_name, COALESCE(u.icon_image_url, b.icon_url, message.display_icon_url, '') AS user_icon_image_url").
+		Join("LEFT JOIN users AS u ON message.user_id = u.id").
+		Join("LEFT JOIN bot_endpoints AS b ON message.bot_endpoint_id = b.id")
+}
+
+// GetMessagesWithUserはチャンネルのスレッドの返信ではないメッセージを、スレッドの返信の数と最後の返信の日時と一緒に最大limit件取得する
+// afterSeqとbeforeSeqが指定されている場合は、Seqがその間にある(両端は含まない)メッセージのみ取得する
+// newestFirstがtrueの場合は新しい順に、falseの場合は古い順に取得する
+func (repo *MessageRepository) GetMessagesWithUser(ctx context.Context, channelId uuid.UUID, afterSeq *int64, beforeSeq *int64, limit int, newestFirst bool) ([]entity.MessageWithUser, error) {
 	var messages []entity.MessageWithUser
-	// err := repo.db.NewSelect().Table("messages AS message").ColumnExpr("*").ColumnExpr("name as user_name,user.icon_image_url as user_icon_image_url").Join("JOIN users as user ON message.user_id = user.id").Where("message.channel_id = ?", channelId).Scan(ctx, &messages)
-	err := repo.db.NewSelect().TableExpr("messages AS message").ColumnExpr("message.*").ColumnExpr("u.name as user_name,u.icon_image_url as user_icon_image_url").Join("INNER JOIN users AS u ON message.user_id = u.id").Where("message.channel_id = ?", channelId).Scan(ctx, &messages)
+	query := repo.messagesWithUserQuery().
+		ColumnExpr("(SELECT count(*) FROM messages AS reply WHERE reply.parent_message_id = message.id AND reply.deleted_at IS NULL) AS reply_count").
+		ColumnExpr("(SELECT max(reply.created_at) FROM messages AS reply WHERE reply.parent_message_id = message.id AND reply.deleted_at IS NULL) AS last_reply_at").
+		Where("message.channel_id = ?", channelId).Where("message.parent_message_id IS NULL")
+	if afterSeq != nil {
+		query = query.Where("message.seq > ?", *afterSeq)
+	}
+	if beforeSeq != nil {
+		query = query.Where("message.seq < ?", *beforeSeq)
+	}
+	if newestFirst {
+		query = query.OrderExpr("message.seq DESC")
+	} else {
+		query = query.OrderExpr("message.seq ASC")
+	}
+	err := query.Limit(limit).Scan(ctx, &messages)
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("failed to get messages by channel_id. channel_id -> %s", channelId))
 	}
 	return messages, nil
 }
+
+// GetThreadRepliesWithUserはスレッドの返信を古い順に最大limit件取得する
+// afterが指定されている場合はafterの返信より後の返信を取得する
+func (repo *MessageRepository) GetThreadRepliesWithUser(ctx context.Context, parentMessageId uuid.UUID, after *uuid.UUID, limit int) ([]entity.MessageWithUser, error) {
+	var messages []entity.MessageWithUser
+	query := repo.messagesWithUserQuery().Where("message.parent_message_id = ?", parentMessageId)
+	if after != nil {
+		//created_atは重複する可能性があるので、idと組み合わせて順序を決める
+		cursor := repo.db.NewSelect().Model((*entity.Message)(nil)).Column("created_at", "id").Where("id = ?", *after)
+		query = query.Where("(message.created_at, message.id) > (?)", cursor)
+	}
+	err := query.OrderExpr("message.created_at ASC, message.id ASC").Limit(limit).Scan(ctx, &messages)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to get thread replies. parent_message_id -> %s", parentMessageId))
+	}
+	return messages, nil
+}
+
+// GetMissedMessagesWithUserはuserが所属しているサーバーのチャンネルのメッセージのうち、
+// カーソルのメッセージより後のメッセージを古い順に最大limit件取得する
+// channelCursorsに含まれるチャンネルはチャンネルごとのカーソルを、それ以外のチャンネルはafterをカーソルとして使う
+// スレッドの返信はuserがスレッドに参加している場合のみ取得する
+func (repo *MessageRepository) GetMissedMessagesWithUser(ctx context.Context, userId string, serverIds []uuid.UUID, channelCursors map[uuid.UUID]uuid.UUID, after *uuid.UUID, limit int) ([]entity.MessageWithUser, error) {
+	var messages []entity.MessageWithUser
+	if len(serverIds) == 0 || (len(channelCursors) == 0 && after == nil) {
+		return messages, nil
+	}
+	const afterCursor = "(message.created_at, message.id) > (SELECT created_at, id FROM messages WHERE id = ?)"
+	err := repo.missedMessagesQuery(userId, serverIds).
+		Where("message.deleted_at IS NULL").
+		WhereGroup(" AND ", whereMissedCursors(channelCursors, after, afterCursor)).
+		OrderExpr("message.created_at ASC, message.id ASC").Limit(limit).Scan(ctx, &messages)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to get missed messages. user_id -> %s", userId))
+	}
+	return messages, nil
+}
+
+// GetMissedMessageChangesWithUserはGetMissedMessagesWithUserと同じカーソルで、
+// カーソルのメッセージまでに送信されたメッセージのうち、カーソルのメッセージより後に編集または削除されたメッセージを編集または削除された順に最大limit件取得する
+// カーソルより後に送信されたメッセージはGetMissedMessagesWithUserで編集後の本文を取得できるので含めない
+func (repo *MessageRepository) GetMissedMessageChangesWithUser(ctx context.Context, userId string, serverIds []uuid.UUID, channelCursors map[uuid.UUID]uuid.UUID, after *uuid.UUID, limit int) ([]entity.MessageWithUser, error) {
+	var messages []entity.MessageWithUser
+	if len(serverIds) == 0 || (len(channelCursors) == 0 && after == nil) {
+		return messages, nil
+	}
+	//GREATESTはNULLを無視するので、編集と削除のどちらか後の日時で比較する
+	const changedAfterCursor = "EXISTS (SELECT 1 FROM messages AS cm WHERE cm.id = ? AND (message.created_at, message.id) <= (cm.created_at, cm.id) AND GREATEST(message.edited_at, message.deleted_at) > cm.created_at)"
+	err := repo.missedMessagesQuery(userId, serverIds).
+		Where("message.edited_at IS NOT NULL OR message.deleted_at IS NOT NULL").
+		WhereGroup(" AND ", whereMissedCursors(channelCursors, after, changedAfterCursor)).
+		OrderExpr("GREATEST(message.edited_at, message.deleted_at) ASC, message.id ASC").Limit(limit).Scan(ctx, &messages)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to get missed message changes. user_id -> %s", userId))
+	}
+	return messages, nil
+}
+
+// missedMessagesQueryはuserが所属しているサーバーのチャンネルのメッセージを取得するクエリを返す
+// スレッドの返信はuserがスレッドに参加している場合のみ取得する
+func (repo *MessageRepository) missedMessagesQuery(userId string, serverIds []uuid.UUID) *bun.SelectQuery {
+	return repo.messagesWithUserQuery().ColumnExpr("c.server_id").
+		Join("INNER JOIN channels AS c ON message.channel_id = c.id").
+		Where("c.server_id IN (?)", bun.In(serverIds)).
+		Where("message.parent_message_id IS NULL OR EXISTS (SELECT 1 FROM messages AS p WHERE (p.id = message.parent_message_id OR p.parent_message_id = message.parent_message_id) AND p.user_id = ?)", userId)
+}
+
+// whereMissedCursorsはchannelCursorsに含まれるチャンネルはチャンネルごとのカーソルを、それ以外のチャンネルはafterをカーソルとして
+// cursorConditionで絞り込む。cursorConditionはカーソルのメッセージのIdを1つだけ受け取る
+func whereMissedCursors(channelCursors map[uuid.UUID]uuid.UUID, after *uuid.UUID, cursorCondition string) func(q *bun.SelectQuery) *bun.SelectQuery {
+	return func(q *bun.SelectQuery) *bun.SelectQuery {
+		channelIds := make([]uuid.UUID, 0, len(channelCursors))
+		for channelId, messageId := range channelCursors {
+			channelIds = append(channelIds, channelId)
+			q = q.WhereOr("message.channel_id = ? AND "+cursorCondition, channelId, messageId)
+		}
+		if after != nil {
+			if len(channelIds) == 0 {
+				q = q.WhereOr(cursorCondition, *after)
+			} else {
+				q = q.WhereOr("message.channel_id NOT IN (?) AND "+cursorCondition, bun.In(channelIds), *after)
+			}
+		}
+		return q
+	}
+}
+
+// GetThreadParticipantIDsはスレッドの返信先のメッセージとスレッドに返信したuserのIdを取得する
+// botとwebhookのメッセージはuser_idがNULLなので含めない
+func (repo *MessageRepository) GetThreadParticipantIDs(ctx context.Context, parentMessageId uuid.UUID) ([]string, error) {
+	var userIds []string
+	err := repo.db.NewSelect().Model((*entity.Message)(nil)).ColumnExpr("DISTINCT user_id").
+		Where("id = ? OR parent_message_id = ?", parentMessageId, parentMessageId).
+		Where("user_id IS NOT NULL").Scan(ctx, &userIds)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to get thread participants. parent_message_id -> %s", parentMessageId))
+	}
+	return userIds, nil
+}
+
+func (repo *MessageRepository) GetMessage(ctx context.Context, messageId uuid.UUID) (entity.Message, error) {
+	var message entity.Message
+	err := repo.db.NewSelect().Model(&message).Where("id = ?", messageId).Scan(ctx)
+	if err != nil {
+		return entity.Message{}, errors.Wrap(err, fmt.Sprintf("failed to get message by id. message_id -> %s", messageId))
+	}
+	return message, nil
+}
+
+// GetMessageForUpdateはトランザクションの中でメッセージを取得して、トランザクションが終わるまで行をロックする
+func (repo *MessageRepository) GetMessageForUpdate(ctx context.Context, messageId uuid.UUID) (entity.Message, error) {
+	var message entity.Message
+	err := GetSelectQuery(ctx, repo.db).Model(&message).Where("id = ?", messageId).For("UPDATE").Scan(ctx)
+	if err != nil {
+		return entity.Message{}, errors.Wrap(err, fmt.Sprintf("failed to get message by id. message_id -> %s", messageId))
+	}
+	return message, nil
+}
+
+// UpdateMessageはメッセージの本文と編集日時を更新する
+func (repo *MessageRepository) UpdateMessage(ctx context.Context, e entity.Message) error {
+	_, err := GetUpdateQuery(ctx, repo.db).Model(&e).Column("message", "edited_at").WherePK().Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to update message. message -> %+v:", e))
+	}
+	return nil
+}
+
+// SoftDeleteMessageはメッセージの本文を空にして削除日時を設定する
+func (repo *MessageRepository) SoftDeleteMessage(ctx context.Context, e entity.Message) error {
+	e.Message = ""
+	_, err := GetUpdateQuery(ctx, repo.db).Model(&e).Column("message", "deleted_at").WherePK().Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to soft delete message. message -> %+v:", e))
+	}
+	return nil
+}
+
+type MessageEditRepositoryInterface interface {
+	Insert(ctx context.Context, e entity.MessageEdit) error
+	DeleteByMessageID(ctx context.Context, messageId uuid.UUID) error
+}
+
+type MessageEditRepository struct {
+	db *bun.DB
+}
+
+func NewMessageEditRepository(db *bun.DB) *MessageEditRepository {
+	return &MessageEditRepository{db: db}
+}
+
+func (repo *MessageEditRepository) Insert(ctx context.Context, e entity.MessageEdit) error {
+	Insert := GetInsertQuery(ctx, repo.db)
+
+	_, err := Insert.Model(&e).Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to insert messageEdit. messageEdit -> %+v:", e))
+	}
+	return nil
+}
+
+func (repo *MessageEditRepository) DeleteByMessageID(ctx context.Context, messageId uuid.UUID) error {
+	_, err := GetDeleteQuery(ctx, repo.db).Model((*entity.MessageEdit)(nil)).Where("message_id = ?", messageId).Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to delete messageEdit by message_id. message_id -> %s", messageId))
+	}
+	return nil
+}
+
+type ReactionTypeRepositoryInterface interface {
+	Upsert(ctx context.Context, emoji string) (entity.ReactionType, error)
+}
+
+type ReactionTypeRepository struct {
+	db *bun.DB
+}
+
+func NewReactionTypeRepository(db *bun.DB) *ReactionTypeRepository {
+	return &ReactionTypeRepository{db: db}
+}
+
+// Upsertは絵文字に対応するリアクションの種類を返す。まだ登録されていない絵文字の場合は登録する
+func (repo *ReactionTypeRepository) Upsert(ctx context.Context, emoji string) (entity.ReactionType, error) {
+	reactionType := entity.ReactionType{Emoji: emoji}
+	//DO NOTHINGだと既に登録されている場合にidが返ってこないので、同じ値で更新してidを返させる
+	_, err := repo.db.NewInsert().Model(&reactionType).On("CONFLICT (emoji) DO UPDATE").Set("emoji = EXCLUDED.emoji").Returning("id").Exec(ctx)
+	if err != nil {
+		return entity.ReactionType{}, errors.Wrap(err, fmt.Sprintf("failed to upsert reactionType. emoji -> %s", emoji))
+	}
+	return reactionType, nil
+}
+
+type UserReactionRepositoryInterface interface {
+	Insert(ctx context.Context, e entity.UserReaction) (bool, error)
+	Delete(ctx context.Context, messageId uuid.UUID, userId string, emoji string) (bool, error)
+	GetReactionCounts(ctx context.Context, messageIds []uuid.UUID, userId string) ([]entity.ReactionCount, error)
+}
+
+type UserReactionRepository struct {
+	db *bun.DB
+}
+
+func NewUserReactionRepository(db *bun.DB) *UserReactionRepository {
+	return &UserReactionRepository{db: db}
+}
+
+// Insertはリアクションを追加する。既に同じリアクションをしている場合は何もせずにfalseを返す
+func (repo *UserReactionRepository) Insert(ctx context.Context, e entity.UserReaction) (bool, error) {
+	result, err := repo.db.NewInsert().Model(&e).On("CONFLICT (message_id, user_id, reaction_type_id) DO NOTHING").Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to insert userReaction. userReaction -> %+v:", e))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get rows affected")
+	}
+	return affected > 0, nil
+}
+
+// Deleteはリアクションを削除する。リアクションしていなかった場合は何もせずにfalseを返す
+func (repo *UserReactionRepository) Delete(ctx context.Context, messageId uuid.UUID, userId string, emoji string) (bool, error) {
+	reactionTypeIds := repo.db.NewSelect().Model((*entity.ReactionType)(nil)).Column("id").Where("emoji = ?", emoji)
+	result, err := repo.db.NewDelete().Model((*entity.UserReaction)(nil)).Where("message_id = ? AND user_id = ?", messageId, userId).Where("reaction_type_id IN (?)", reactionTypeIds).Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("failed to delete userReaction. message_id -> %s, user_id -> %s, emoji -> %s", messageId, userId, emoji))
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get rows affected")
+	}
+	return affected > 0, nil
+}
+
+// GetReactionCountsはメッセージごと、絵文字ごとのリアクションの数と、userIdのuserがリアクションしているかを取得する
+func (repo *UserReactionRepository) GetReactionCounts(ctx context.Context, messageIds []uuid.UUID, userId string) ([]entity.ReactionCount, error) {
+	var counts []entity.ReactionCount
+	if len(messageIds) == 0 {
+		return counts, nil
+	}
+	err := repo.db.NewSelect().TableExpr("user_reactions AS ur").
+		ColumnExpr("ur.message_id, rt.emoji, count(*) AS count, bool_or(ur.user_id = ?) AS reacted", userId).
+		Join("INNER JOIN reaction_types AS rt ON ur.reaction_type_id = rt.id").
+		Where("ur.message_id IN (?)", bun.In(messageIds)).
+		GroupExpr("ur.message_id, rt.emoji").
+		OrderExpr("ur.message_id, rt.emoji").
+		Scan(ctx, &counts)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to get reaction counts. message_ids -> %v", messageIds))
+	}
+	return counts, nil
+}
@@ -2,6 +2,11 @@ package router
 
 import (
 	"context"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -10,6 +15,7 @@ import (
 	"github.com/hebitigo/CATechAccelChatApp/handler"
 	"github.com/hebitigo/CATechAccelChatApp/repository"
 	"github.com/hebitigo/CATechAccelChatApp/usecase"
+	"github.com/hebitigo/CATechAccelChatApp/webhook"
 	"github.com/hebitigo/CATechAccelChatApp/ws"
 )
 
@@ -24,41 +30,146 @@ func InitRouter(db *bun.DB, ctx context.Context) *gin.Engine {
 
 	//TODO:https://github.com/code-kakitai/code-kakitai/blob/main/app/server/route/route.go#L79
 	//を参考にして、handler毎に分けてrouteを初期化する
-	botEndpointRepository := repository.NewBotEndpointRepository(db, ctx)
-	botEndpointUsecase := usecase.NewBotEndpointUsecase(botEndpointRepository)
-	botEndpointHandler := handler.NewBotEndpointHandler(botEndpointUsecase)
-	r.POST("/bot_endpoint", botEndpointHandler.RegisterBotEndpoint)
+	botEndpointRepository := repository.NewBotEndpointRepository(db)
+	botDeliveryRepository := repository.NewBotDeliveryRepository(db)
+	//開発環境でlocalhostのbotを使う場合はBOT_ENDPOINT_ALLOW_PRIVATE=trueを設定する
+	botClient := webhook.NewClient(10*time.Second, os.Getenv("BOT_ENDPOINT_ALLOW_PRIVATE") == "true")
+
+	//複数のレプリカでbackendを動かす場合はWS_BACKPLANE=postgresを設定して、
+	//DBのLISTEN/NOTIFYを経由して全てのレプリカのHubにイベントを配信する
+	var backplane ws.Backplane = ws.NewMemoryBackplane()
+	if os.Getenv("WS_BACKPLANE") == "postgres" {
+		backplane = ws.NewPostgresBackplane(db, "ws_hub_events")
+	}
+	hub := ws.NewHub(backplane)
+	go hub.Run()
 
 	serverRepository := repository.NewServerRepository(db)
 	channelRepository := repository.NewChannelRepository(db)
 	userServerRepository := repository.NewUserServerRepository(db)
+	serverBotEndpointRepository := repository.NewServerBotEndpointRepository(db)
+	botTokenRepository := repository.NewBotTokenRepository(db)
+	botCommandRepository := repository.NewBotCommandRepository(db)
 	txRepository := repository.NewTxRepository(db)
 	userRepostiory := repository.NewUserRepository(db)
-	serverUsecase := usecase.NewServerUsecase(serverRepository, channelRepository, userServerRepository, txRepository, userRepostiory)
+	messageRepository := repository.NewMessageRepository(db)
+
+	//websocketのトークンとauthorizedのrouteは、フロントエンドがログインに使っているauth0のjwtを検証してuserを認証する
+	//AUTH0_DOMAINとAUTH0_AUDIENCEが設定されていない場合も起動はするが、認証が必要なrouteは503を返す
+	identityProvider, err := usecase.NewIdentityProvider(ctx, os.Getenv("AUTH0_DOMAIN"), os.Getenv("AUTH0_AUDIENCE"))
+	if err != nil {
+		log.Printf("identity provider is not configured, so authenticated routes are unavailable: %+v", err)
+	}
+	authUsecase := usecase.NewAuthUsecase(userRepostiory, botTokenRepository, identityProvider)
+	authHandler := handler.NewAuthHandler(authUsecase)
+	r.POST("/ws/token", authHandler.CreateWebsocketToken)
+	//権限を確認するrouteはリクエストのuser_idではなく、ここで認証したuserで確認する
+	authorized := r.Group("")
+	authorized.Use(handler.NewAuthMiddleware(authUsecase))
+
+	//botのエンドポイントへの送信はキューに追加して、workerがイベントの発生とは非同期で行う
+	//メッセージ以外のイベントもbotに送るので、他のusecaseより先に作成する
+	botEventUsecase := usecase.NewBotEventUsecase(botEndpointRepository, serverBotEndpointRepository, botDeliveryRepository, botTokenRepository, messageRepository, channelRepository, txRepository, hub, botClient)
+	botEventUsecase.RunDeliveryWorkers(ctx, botDeliveryWorkers())
+	botEventHandler := handler.NewBotEventHandler(botEventUsecase)
+	r.POST("/bot/callback", botEventHandler.PostCallbackMessage)
+
+	serverUsecase := usecase.NewServerUsecase(serverRepository, channelRepository, userServerRepository, txRepository, userRepostiory, hub, botEventUsecase)
 	serverHandler := handler.NewServerHandler(serverUsecase)
 	r.POST("/server", serverHandler.RegisterServer)
 	r.POST("/server/create/invitation", serverHandler.CreateInvitationByJWT)
 	r.POST("/server/join", serverHandler.JoinServerByInvitation)
 	r.GET("/servers/:user_id", serverHandler.GetServersByUserID)
+	authorized.PUT("/server/:server_id/members/:user_id/role", serverHandler.SetMemberRole)
+
+	botEndpointUsecase := usecase.NewBotEndpointUsecase(botEndpointRepository, botDeliveryRepository, serverBotEndpointRepository, botTokenRepository, botCommandRepository, userRepostiory, txRepository, hub, botClient, botAdminUserIds())
+	botEndpointHandler := handler.NewBotEndpointHandler(botEndpointUsecase)
+	authorized.POST("/bot_endpoint", botEndpointHandler.RegisterBotEndpoint)
+	authorized.GET("/bot_endpoints", botEndpointHandler.GetBotEndpoints)
+	authorized.GET("/bot_endpoints/unowned", botEndpointHandler.GetUnownedBotEndpoints)
+	authorized.GET("/bot_endpoint/:bot_endpoint_id", botEndpointHandler.GetBotEndpoint)
+	authorized.PATCH("/bot_endpoint/:bot_endpoint_id", botEndpointHandler.UpdateBotEndpoint)
+	authorized.DELETE("/bot_endpoint/:bot_endpoint_id", botEndpointHandler.DeleteBotEndpoint)
+	authorized.POST("/bot_endpoint/:bot_endpoint_id/verify", botEndpointHandler.VerifyBotEndpoint)
+	authorized.PUT("/bot_endpoint/:bot_endpoint_id/owner", botEndpointHandler.AssignBotEndpointOwner)
+	authorized.POST("/bot_endpoint/:bot_endpoint_id/secret/rotate", botEndpointHandler.RotateSigningSecret)
+	authorized.GET("/bot_endpoint/:bot_endpoint_id/deliveries", botEndpointHandler.GetBotDeliveries)
+	authorized.POST("/bot_endpoint/:bot_endpoint_id/deliveries/redrive", botEndpointHandler.RedriveBotDeliveries)
+	authorized.POST("/bot_endpoint/:bot_endpoint_id/tokens", botEndpointHandler.CreateBotToken)
+	authorized.GET("/bot_endpoint/:bot_endpoint_id/tokens", botEndpointHandler.GetBotTokens)
+	authorized.DELETE("/bot_endpoint/:bot_endpoint_id/tokens/:token_id", botEndpointHandler.RevokeBotToken)
+	authorized.PUT("/bot_endpoint/:bot_endpoint_id/commands", botEndpointHandler.SetBotCommands)
+	authorized.GET("/bot_endpoint/:bot_endpoint_id/commands", botEndpointHandler.GetBotCommands)
 
-	userUsecase := usecase.NewUserUsecase(userRepostiory)
+	serverBotEndpointUsecase := usecase.NewServerBotEndpointUsecase(serverBotEndpointRepository, botEndpointRepository, userServerRepository, hub)
+	serverBotEndpointHandler := handler.NewServerBotEndpointHandler(serverBotEndpointUsecase)
+	authorized.POST("/server/:server_id/bots", serverBotEndpointHandler.InstallBot)
+	authorized.GET("/server/:server_id/bots", serverBotEndpointHandler.GetInstalledBots)
+	authorized.DELETE("/server/:server_id/bots/:bot_endpoint_id", serverBotEndpointHandler.UninstallBot)
+	authorized.PUT("/server/:server_id/bots/:bot_endpoint_id/events", serverBotEndpointHandler.SetBotEventSubscriptions)
+
+	userUsecase := usecase.NewUserUsecase(userRepostiory, userServerRepository, hub)
 	userHandler := handler.NewUserHandler(userUsecase)
 	r.POST("/user/upsert", userHandler.UpsertUser)
 
-	channelUsecase := usecase.NewChannelUsecase(channelRepository)
+	channelUsecase := usecase.NewChannelUsecase(channelRepository, hub, botEventUsecase)
 	channelHandler := handler.NewChannelHandler(channelUsecase)
 	r.POST("/channel", channelHandler.RegisterChannel)
 	r.GET("/channels/:server_id", channelHandler.GetChannelsByServerID)
 
-	hub := ws.NewHub()
-	go hub.Run()
-	messageRepository := repository.NewMessageRepository(db)
-	wsHandler := ws.NewHandler(hub, messageRepository, userRepostiory)
-	r.GET("/ws/:user_id", wsHandler.JoinChannel)
-
-	messageUseCase := usecase.NewMessageUsecase(messageRepository)
+	messageEditRepository := repository.NewMessageEditRepository(db)
+	userReactionRepository := repository.NewUserReactionRepository(db)
+	messageUseCase := usecase.NewMessageUsecase(messageRepository, messageEditRepository, channelRepository, userRepostiory, userServerRepository, userReactionRepository, txRepository, hub, botEventUsecase)
 	messageHandler := handler.NewMessageHandler(messageUseCase)
 	r.GET("/messages/:channel_id", messageHandler.GetMessagesByChannelID)
+	authorized.PATCH("/message/:message_id", messageHandler.EditMessage)
+	authorized.DELETE("/message/:message_id", messageHandler.DeleteMessage)
+	r.GET("/message/:message_id/thread", messageHandler.GetThreadReplies)
+
+	reactionTypeRepository := repository.NewReactionTypeRepository(db)
+	reactionUsecase := usecase.NewReactionUsecase(messageRepository, channelRepository, userServerRepository, reactionTypeRepository, userReactionRepository, hub, botEventUsecase)
+	reactionHandler := handler.NewReactionHandler(reactionUsecase)
+	r.POST("/message/:message_id/reaction", reactionHandler.AddReaction)
+	r.DELETE("/message/:message_id/reaction", reactionHandler.RemoveReaction)
+
+	webhookRepository := repository.NewWebhookRepository(db)
+	webhookUsecase := usecase.NewWebhookUsecase(webhookRepository, messageRepository, channelRepository, userServerRepository, txRepository, hub, botEventUsecase)
+	webhookHandler := handler.NewWebhookHandler(webhookUsecase)
+	authorized.POST("/server/:server_id/webhooks", webhookHandler.CreateWebhook)
+	authorized.GET("/server/:server_id/webhooks", webhookHandler.GetWebhooks)
+	authorized.DELETE("/server/:server_id/webhooks/:webhook_id", webhookHandler.RevokeWebhook)
+	//CIや監視システムがwebhookのurlにPOSTしてメッセージを投稿する。urlのトークンで認証する
+	r.POST("/webhooks/:webhook_id/:token", webhookHandler.ExecuteWebhook)
+
+	//"/"から始まるメッセージは組み込みのコマンドかサーバーに追加されているbotのコマンドとして実行する
+	commandUsecase := usecase.NewCommandUsecase(messageUseCase, serverUsecase, botEventUsecase, channelRepository, userRepostiory, userServerRepository, serverBotEndpointRepository, botCommandRepository, hub)
+	commandHandler := handler.NewCommandHandler(commandUsecase)
+	r.GET("/server/:server_id/commands", commandHandler.GetCommands)
+
+	wsHandler := ws.NewHandler(hub, authUsecase, messageUseCase, reactionUsecase, botEventUsecase, commandUsecase, messageRepository, userRepostiory, userServerRepository, serverBotEndpointRepository, channelRepository)
+	r.GET("/ws", wsHandler.JoinChannel)
+	r.GET("/ws/:user_id", wsHandler.JoinChannel)
 
 	return r
 }
+
+// botDeliveryWorkersはbotへの配信を送信するworkerの数をBOT_DELIVERY_WORKERSから取得する
+func botDeliveryWorkers() int {
+	workers, err := strconv.Atoi(os.Getenv("BOT_DELIVERY_WORKERS"))
+	if err != nil || workers <= 0 {
+		return 4
+	}
+	return workers
+}
+
+// botAdminUserIdsは所有者がいないbotに所有者を設定できるuserのIdをBOT_ADMIN_USER_IDSからカンマ区切りで取得する
+func botAdminUserIds() []string {
+	userIds := []string{}
+	for _, userId := range strings.Split(os.Getenv("BOT_ADMIN_USER_IDS"), ",") {
+		userId = strings.TrimSpace(userId)
+		if userId != "" {
+			userIds = append(userIds, userId)
+		}
+	}
+	return userIds
+}
@@ -1,11 +1,23 @@
 package usecase
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"log"
+	mathrand "math/rand"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/cockroachdb/errors"
 	"github.com/google/uuid"
@@ -17,27 +29,1870 @@ import (
 	"github.com/hebitigo/CATechAccelChatApp/repository"
 )
 
+// ErrForbiddenはuserに操作する権限がない場合に返す
+var ErrForbidden = errors.New("forbidden")
+
+// ErrNotFoundは操作対象が存在しない、または削除済みの場合に返す
+var ErrNotFound = errors.New("not found")
+
+// ErrInvalidArgumentは入力の組み合わせが不正な場合に返す
+var ErrInvalidArgument = errors.New("invalid argument")
+
+// ErrUnauthorizedはトークンが不正または有効期限切れの場合に返す
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrUnavailableは操作に必要な設定がされていない場合に返す
+var ErrUnavailable = errors.New("unavailable")
+
+// HubInterfaceはwebsocketで接続しているuserへの通知を行う
+// wsパッケージのHubが実装する
+type HubInterface interface {
+	JoinServer(userId string, serverId uuid.UUID)
+	NotifyChannelAdded(channel entity.Channel)
+	NotifyUserActivate(userId string, serverIds []uuid.UUID, active bool)
+	NotifyMessagePosted(serverId uuid.UUID, message entity.MessageWithUser)
+	NotifyThreadReplied(serverId uuid.UUID, message entity.MessageWithUser, participantIds []string)
+	NotifyMessageEdited(serverId uuid.UUID, message entity.Message)
+	NotifyMessageDeleted(serverId uuid.UUID, message entity.Message)
+	NotifyReactionAdded(serverId uuid.UUID, message entity.Message, userId string, emoji string)
+	NotifyReactionRemoved(serverId uuid.UUID, message entity.Message, userId string, emoji string)
+	NotifyBotInstalled(serverId uuid.UUID, botEndpoint entity.BotEndpoint)
+	NotifyBotUninstalled(serverId uuid.UUID, botEndpointId string)
+	DisconnectBot(botEndpointId string, tokenId *uuid.UUID)
+	NotifyChannelTopicChanged(channel entity.Channel)
+	NotifyEphemeral(userId string, sessionId string, message EphemeralMessage)
+}
+
 type BotEndpointUsecaseInterface interface {
-	RegisterBotEndpoint(dto RegisterBotEndpointInputDTO) error
+	RegisterBotEndpoint(ctx context.Context, dto RegisterBotEndpointInputDTO) (RegisterBotEndpointOutputDTO, error)
+	RotateSigningSecret(ctx context.Context, dto RotateSigningSecretInputDTO) (RotateSigningSecretOutputDTO, error)
+	GetBotDeliveries(ctx context.Context, dto GetBotDeliveriesInputDTO) ([]entity.BotDelivery, error)
+	RedriveBotDeliveries(ctx context.Context, dto RedriveBotDeliveriesInputDTO) (int64, error)
+	GetBotEndpoints(ctx context.Context, dto GetBotEndpointsInputDTO) ([]entity.BotEndpoint, error)
+	GetUnownedBotEndpoints(ctx context.Context, dto GetBotEndpointsInputDTO) ([]entity.BotEndpoint, error)
+	AssignBotEndpointOwner(ctx context.Context, dto AssignBotEndpointOwnerInputDTO) error
+	GetBotEndpoint(ctx context.Context, dto BotEndpointOwnerInputDTO) (entity.BotEndpoint, error)
+	UpdateBotEndpoint(ctx context.Context, dto UpdateBotEndpointInputDTO) (entity.BotEndpoint, error)
+	DeleteBotEndpoint(ctx context.Context, dto BotEndpointOwnerInputDTO) error
+	VerifyBotEndpoint(ctx context.Context, dto BotEndpointOwnerInputDTO) error
+	CreateBotToken(ctx context.Context, dto BotEndpointOwnerInputDTO) (CreateBotTokenOutputDTO, error)
+	GetBotTokens(ctx context.Context, dto BotEndpointOwnerInputDTO) ([]entity.BotToken, error)
+	RevokeBotToken(ctx context.Context, dto RevokeBotTokenInputDTO) error
+	SetBotCommands(ctx context.Context, dto SetBotCommandsInputDTO) ([]entity.BotCommand, error)
+	GetBotCommands(ctx context.Context, dto BotEndpointOwnerInputDTO) ([]entity.BotCommand, error)
+}
+
+const (
+	signingSecretBytes = 32
+	//ローテーション後に古い秘密鍵でも署名を続ける期間
+	DefaultSigningSecretGracePeriod = time.Hour * 24
+	MaxSigningSecretGracePeriod     = time.Hour * 24 * 7
+	botTokenBytes                   = 32
+	//botのトークンにはprefixを付けて、websocketの接続時にuserのjwtと区別する
+	BotTokenPrefix = "cbt_"
+)
+
+type BotEndpointUsecase struct {
+	repo                  repository.BotEndpointRespositoryInterface
+	botDeliveryRepo       repository.BotDeliveryRepositoryInterface
+	serverBotEndpointRepo repository.ServerBotEndpointRepositoryInterface
+	botTokenRepo          repository.BotTokenRepositoryInterface
+	botCommandRepo        repository.BotCommandRepositoryInterface
+	userRepo              repository.UserRepositoryInterface
+	txRepo                repository.TxRepositoryInterface
+	hub                   HubInterface
+	botClient             BotClientInterface
+	//所有者がいないbotに所有者を設定できるuser
+	adminUserIds []string
+}
+
+func NewBotEndpointUsecase(repo repository.BotEndpointRespositoryInterface, botDeliveryRepo repository.BotDeliveryRepositoryInterface, serverBotEndpointRepo repository.ServerBotEndpointRepositoryInterface, botTokenRepo repository.BotTokenRepositoryInterface, botCommandRepo repository.BotCommandRepositoryInterface, userRepo repository.UserRepositoryInterface, txRepo repository.TxRepositoryInterface, hub HubInterface, botClient BotClientInterface, adminUserIds []string) *BotEndpointUsecase {
+	return &BotEndpointUsecase{repo: repo, botDeliveryRepo: botDeliveryRepo, serverBotEndpointRepo: serverBotEndpointRepo, botTokenRepo: botTokenRepo, botCommandRepo: botCommandRepo, userRepo: userRepo, txRepo: txRepo, hub: hub, botClient: botClient, adminUserIds: adminUserIds}
+}
+
+// UserIdのログインしているuserがbotの所有者になる
+// websocketで接続するbotはEndpointを空にできる。その場合はイベントをPOSTしない
+// EventSubscriptionsがnilの場合はDefaultBotEventSubscriptionsのイベントを購読する
+type RegisterBotEndpointInputDTO struct {
+	UserId             string
+	Name               string
+	IconURL            string
+	Endpoint           string
+	EventSubscriptions []string
+}
+
+// SigningSecretは登録時にのみ返すので、botの運用者が保存しておく必要がある
+// challengeに失敗した場合もbotは登録され、VerificationErrorに失敗した理由を返す
+type RegisterBotEndpointOutputDTO struct {
+	BotEndpointId     string
+	SigningSecret     string
+	Verified          bool
+	VerificationError string
+}
+
+func (usecase *BotEndpointUsecase) RegisterBotEndpoint(ctx context.Context, dto RegisterBotEndpointInputDTO) (RegisterBotEndpointOutputDTO, error) {
+	secret, err := generateSigningSecret()
+	if err != nil {
+		return RegisterBotEndpointOutputDTO{}, err
+	}
+	err = usecase.userRepo.CheckUserExist(ctx, dto.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RegisterBotEndpointOutputDTO{}, errors.Wrap(ErrNotFound, err.Error())
+	}
+	if err != nil {
+		return RegisterBotEndpointOutputDTO{}, err
+	}
+	if dto.Endpoint != "" {
+		err = usecase.validateEndpoint(ctx, dto.Endpoint)
+		if err != nil {
+			return RegisterBotEndpointOutputDTO{}, err
+		}
+	}
+	eventSubscriptions := dto.EventSubscriptions
+	if eventSubscriptions == nil {
+		eventSubscriptions = DefaultBotEventSubscriptions
+	}
+	err = validateBotEventTypes(eventSubscriptions)
+	if err != nil {
+		return RegisterBotEndpointOutputDTO{}, err
+	}
+	botEndpoint := entity.BotEndpoint{Name: dto.Name, IconURL: dto.IconURL, Endpoint: dto.Endpoint, OwnerUserId: dto.UserId, SigningSecret: secret, EventSubscriptions: eventSubscriptions}
+	botEndpoint.Id, err = usecase.repo.Insert(ctx, botEndpoint)
+	if err != nil {
+		return RegisterBotEndpointOutputDTO{}, err
+	}
+	output := RegisterBotEndpointOutputDTO{BotEndpointId: botEndpoint.Id, SigningSecret: secret}
+	if botEndpoint.Endpoint == "" {
+		return output, nil
+	}
+	err = usecase.verify(ctx, botEndpoint)
+	if err != nil {
+		log.Printf("failed to verify bot endpoint: %+v", err)
+		output.VerificationError = err.Error()
+		return output, nil
+	}
+	output.Verified = true
+	return output, nil
+}
+
+const botEventURLVerification = "url_verification"
+
+// botChallengeはbotのエンドポイントを検証するためにPOSTするリクエスト
+// botはレスポンスのボディで同じchallengeを返す
+type botChallenge struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+}
+
+// validateEndpointはendpointがbotのエンドポイントとして使えるURLであることを確認する
+func (usecase *BotEndpointUsecase) validateEndpoint(ctx context.Context, endpoint string) error {
+	err := usecase.botClient.ValidateEndpoint(ctx, endpoint)
+	if err != nil {
+		return errors.Wrap(ErrInvalidArgument, err.Error())
+	}
+	return nil
+}
+
+// verifyはbotのエンドポイントにランダムなchallengeをPOSTして、同じchallengeが返ってきた場合にbotを検証済みにする
+// 失敗した場合は検証されていない状態にする
+func (usecase *BotEndpointUsecase) verify(ctx context.Context, botEndpoint entity.BotEndpoint) error {
+	verifyErr := usecase.challenge(ctx, botEndpoint)
+	err := usecase.repo.SetVerified(ctx, botEndpoint.Id, botEndpoint.Endpoint, verifyErr == nil)
+	if err != nil {
+		return err
+	}
+	return verifyErr
+}
+
+func (usecase *BotEndpointUsecase) challenge(ctx context.Context, botEndpoint entity.BotEndpoint) error {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate challenge")
+	}
+	request := botChallenge{Type: botEventURLVerification, Challenge: hex.EncodeToString(nonce)}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to marshal challenge. challenge -> %+v", request))
+	}
+	ctx, cancel := context.WithTimeout(ctx, botDispatchTimeout)
+	defer cancel()
+	body, err := usecase.botClient.Send(ctx, botEndpoint.Endpoint, payload, signingSecrets(botEndpoint, time.Now()))
+	if err != nil {
+		return errors.Wrap(ErrInvalidArgument, err.Error())
+	}
+	var response botChallenge
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return errors.Wrap(ErrInvalidArgument, fmt.Sprintf("bot responded to challenge with invalid json. bot_endpoint_id -> %s: %s", botEndpoint.Id, err.Error()))
+	}
+	if subtle.ConstantTimeCompare([]byte(response.Challenge), []byte(request.Challenge)) != 1 {
+		return errors.Wrap(ErrInvalidArgument, fmt.Sprintf("bot did not echo the challenge. bot_endpoint_id -> %s", botEndpoint.Id))
+	}
+	return nil
+}
+
+// VerifyBotEndpointはbotのエンドポイントを検証し直す。botの所有者のみ検証できる
+func (usecase *BotEndpointUsecase) VerifyBotEndpoint(ctx context.Context, dto BotEndpointOwnerInputDTO) error {
+	botEndpoint, err := usecase.getOwnedBotEndpoint(ctx, dto.UserId, dto.BotEndpointId)
+	if err != nil {
+		return err
+	}
+	if botEndpoint.Endpoint == "" {
+		return errors.Wrap(ErrInvalidArgument, fmt.Sprintf("bot has no endpoint to verify. bot_endpoint_id -> %s", botEndpoint.Id))
+	}
+	return usecase.verify(ctx, botEndpoint)
+}
+
+// UserIdのログインしているuserがbotの所有者であることを確認してからローテーションする
+// 秘密鍵を知らない所有者もローテーションすることで新しい秘密鍵を取得できる
+type RotateSigningSecretInputDTO struct {
+	BotEndpointId uuid.UUID
+	UserId        string
+	GracePeriod   time.Duration
+}
+
+type RotateSigningSecretOutputDTO struct {
+	SigningSecret           string
+	PreviousSecretExpiresAt time.Time
+}
+
+// RotateSigningSecretは新しい秘密鍵を発行する
+// GracePeriodの間は古い秘密鍵と新しい秘密鍵の両方で署名するので、botはその間に秘密鍵を切り替える
+func (usecase *BotEndpointUsecase) RotateSigningSecret(ctx context.Context, dto RotateSigningSecretInputDTO) (RotateSigningSecretOutputDTO, error) {
+	if dto.GracePeriod < 0 || dto.GracePeriod > MaxSigningSecretGracePeriod {
+		return RotateSigningSecretOutputDTO{}, errors.Wrap(ErrInvalidArgument, fmt.Sprintf("grace period must be between 0 and %s. grace_period -> %s", MaxSigningSecretGracePeriod, dto.GracePeriod))
+	}
+	botEndpoint, err := usecase.getOwnedBotEndpoint(ctx, dto.UserId, dto.BotEndpointId)
+	if err != nil {
+		return RotateSigningSecretOutputDTO{}, err
+	}
+	secret, err := generateSigningSecret()
+	if err != nil {
+		return RotateSigningSecretOutputDTO{}, err
+	}
+	expiresAt := time.Now().Add(dto.GracePeriod)
+	rotated, err := usecase.repo.RotateSigningSecret(ctx, botEndpoint.Id, botEndpoint.SigningSecret, secret, expiresAt)
+	if err != nil {
+		return RotateSigningSecretOutputDTO{}, err
+	}
+	//検証してから更新するまでの間に別のリクエストでローテーションされた
+	if !rotated {
+		return RotateSigningSecretOutputDTO{}, errors.Wrap(ErrInvalidArgument, fmt.Sprintf("signing secret was rotated by another request. bot_endpoint_id -> %s", dto.BotEndpointId))
+	}
+	return RotateSigningSecretOutputDTO{SigningSecret: secret, PreviousSecretExpiresAt: expiresAt}, nil
+}
+
+type GetBotEndpointsInputDTO struct {
+	UserId string
+}
+
+// GetBotEndpointsはuserが所有しているbotを取得する
+func (usecase *BotEndpointUsecase) GetBotEndpoints(ctx context.Context, dto GetBotEndpointsInputDTO) ([]entity.BotEndpoint, error) {
+	return usecase.repo.GetBotEndpointsByOwnerUserID(ctx, dto.UserId)
+}
+
+// GetUnownedBotEndpointsは所有者を設定する前に登録されたbotを取得する。管理者のみ取得できる
+func (usecase *BotEndpointUsecase) GetUnownedBotEndpoints(ctx context.Context, dto GetBotEndpointsInputDTO) ([]entity.BotEndpoint, error) {
+	err := usecase.authorizeAdmin(dto.UserId)
+	if err != nil {
+		return nil, err
+	}
+	return usecase.repo.GetUnownedBotEndpoints(ctx)
+}
+
+// AdminUserIdのuserが管理者であることを確認してから、OwnerUserIdのuserをbotの所有者にする
+type AssignBotEndpointOwnerInputDTO struct {
+	AdminUserId   string
+	BotEndpointId uuid.UUID
+	OwnerUserId   string
+}
+
+// AssignBotEndpointOwnerは所有者を設定する前に登録されたbotに所有者を設定する。管理者のみ設定できる
+// 所有者はbotを検証し直したり、秘密鍵をローテーションできるようになる
+// 既に所有者がいるbotの所有者は変更できない
+func (usecase *BotEndpointUsecase) AssignBotEndpointOwner(ctx context.Context, dto AssignBotEndpointOwnerInputDTO) error {
+	err := usecase.authorizeAdmin(dto.AdminUserId)
+	if err != nil {
+		return err
+	}
+	err = usecase.userRepo.CheckUserExist(ctx, dto.OwnerUserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrap(ErrNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	botEndpoint, err := usecase.repo.GetBotEndpoint(ctx, dto.BotEndpointId.String())
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrap(ErrNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if botEndpoint.OwnerUserId != "" {
+		return errors.Wrap(ErrInvalidArgument, fmt.Sprintf("bot already has an owner. bot_endpoint_id -> %s", dto.BotEndpointId))
+	}
+	assigned, err := usecase.repo.AssignOwner(ctx, botEndpoint.Id, dto.OwnerUserId)
+	if err != nil {
+		return err
+	}
+	//確認してから更新するまでの間に別のリクエストで所有者が設定された
+	if !assigned {
+		return errors.Wrap(ErrInvalidArgument, fmt.Sprintf("owner of bot was assigned by another request. bot_endpoint_id -> %s", dto.BotEndpointId))
+	}
+	return nil
+}
+
+// authorizeAdminはuserIdのuserが管理者であることを確認する
+func (usecase *BotEndpointUsecase) authorizeAdmin(userId string) error {
+	if !slices.Contains(usecase.adminUserIds, userId) {
+		return errors.Wrap(ErrForbidden, fmt.Sprintf("user is not an admin. user_id -> %s", userId))
+	}
+	return nil
+}
+
+type BotEndpointOwnerInputDTO struct {
+	UserId        string
+	BotEndpointId uuid.UUID
+}
+
+func (usecase *BotEndpointUsecase) GetBotEndpoint(ctx context.Context, dto BotEndpointOwnerInputDTO) (entity.BotEndpoint, error) {
+	return usecase.getOwnedBotEndpoint(ctx, dto.UserId, dto.BotEndpointId)
+}
+
+// 変更しない項目はnilにする。EventSubscriptionsを空にするとどのイベントも送らない
+type UpdateBotEndpointInputDTO struct {
+	UserId             string
+	BotEndpointId      uuid.UUID
+	Name               *string
+	IconURL            *string
+	Endpoint           *string
+	EventSubscriptions *[]string
+}
+
+func (usecase *BotEndpointUsecase) UpdateBotEndpoint(ctx context.Context, dto UpdateBotEndpointInputDTO) (entity.BotEndpoint, error) {
+	botEndpoint, err := usecase.getOwnedBotEndpoint(ctx, dto.UserId, dto.BotEndpointId)
+	if err != nil {
+		return entity.BotEndpoint{}, err
+	}
+	if dto.Name != nil {
+		botEndpoint.Name = *dto.Name
+	}
+	if dto.IconURL != nil {
+		botEndpoint.IconURL = *dto.IconURL
+	}
+	if dto.EventSubscriptions != nil {
+		err = validateBotEventTypes(*dto.EventSubscriptions)
+		if err != nil {
+			return entity.BotEndpoint{}, err
+		}
+		botEndpoint.EventSubscriptions = *dto.EventSubscriptions
+	}
+	//エンドポイントを変更した場合は、新しいエンドポイントを検証するまでイベントを送らない
+	endpointChanged := dto.Endpoint != nil && *dto.Endpoint != botEndpoint.Endpoint
+	if endpointChanged {
+		err = usecase.validateEndpoint(ctx, *dto.Endpoint)
+		if err != nil {
+			return entity.BotEndpoint{}, err
+		}
+		botEndpoint.Endpoint = *dto.Endpoint
+		botEndpoint.Verified = false
+	}
+	err = usecase.repo.Update(ctx, botEndpoint)
+	if err != nil {
+		return entity.BotEndpoint{}, err
+	}
+	if endpointChanged {
+		err = usecase.verify(ctx, botEndpoint)
+		if err != nil {
+			log.Printf("failed to verify bot endpoint: %+v", err)
+		}
+		botEndpoint.Verified = err == nil
+	}
+	return botEndpoint, nil
+}
+
+// DeleteBotEndpointはbotを削除して、botが追加されていた全てのサーバーから削除する
+// 送信していない配信も削除する。botが投稿したメッセージは残す
+func (usecase *BotEndpointUsecase) DeleteBotEndpoint(ctx context.Context, dto BotEndpointOwnerInputDTO) error {
+	botEndpoint, err := usecase.getOwnedBotEndpoint(ctx, dto.UserId, dto.BotEndpointId)
+	if err != nil {
+		return err
+	}
+	var serverIds []uuid.UUID
+	err = usecase.txRepo.DoInTx(ctx, func(ctx context.Context) error {
+		serverIds, err = usecase.serverBotEndpointRepo.DeleteByBotEndpointID(ctx, botEndpoint.Id)
+		if err != nil {
+			return err
+		}
+		err = usecase.botDeliveryRepo.DeleteByBotEndpointID(ctx, dto.BotEndpointId)
+		if err != nil {
+			return err
+		}
+		return usecase.repo.SoftDelete(ctx, botEndpoint.Id)
+	})
+	if err != nil {
+		return err
+	}
+	for _, serverId := range serverIds {
+		usecase.hub.NotifyBotUninstalled(serverId, botEndpoint.Id)
+	}
+	//削除したbotがwebsocketで接続している場合は、どのトークンで接続していても切断する
+	usecase.hub.DisconnectBot(botEndpoint.Id, nil)
+	return nil
+}
+
+// getOwnedBotEndpointはuserが所有しているbotを取得する
+func (usecase *BotEndpointUsecase) getOwnedBotEndpoint(ctx context.Context, userId string, botEndpointId uuid.UUID) (entity.BotEndpoint, error) {
+	botEndpoint, err := usecase.repo.GetBotEndpoint(ctx, botEndpointId.String())
+	if errors.Is(err, sql.ErrNoRows) {
+		return entity.BotEndpoint{}, errors.Wrap(ErrNotFound, err.Error())
+	}
+	if err != nil {
+		return entity.BotEndpoint{}, err
+	}
+	if botEndpoint.OwnerUserId == "" || botEndpoint.OwnerUserId != userId {
+		return entity.BotEndpoint{}, errors.Wrap(ErrForbidden, fmt.Sprintf("user is not the owner of bot. user_id -> %s, bot_endpoint_id -> %s", userId, botEndpointId))
+	}
+	return botEndpoint, nil
+}
+
+// Statusが空の場合は全てのstatusの配信を取得する
+// 配信にはメッセージの本文やcallback_tokenが含まれるので、UserIdのログインしているuserがbotの所有者であることを確認する
+type GetBotDeliveriesInputDTO struct {
+	BotEndpointId uuid.UUID
+	UserId        string
+	Status        string
+	Limit         int
+}
+
+// GetBotDeliveriesはbotにまだ届いていない配信を古い順に取得する。botの所有者のみ取得できる
+func (usecase *BotEndpointUsecase) GetBotDeliveries(ctx context.Context, dto GetBotDeliveriesInputDTO) ([]entity.BotDelivery, error) {
+	_, err := usecase.getOwnedBotEndpoint(ctx, dto.UserId, dto.BotEndpointId)
+	if err != nil {
+		return nil, err
+	}
+	return usecase.botDeliveryRepo.GetDeliveriesByBotEndpointID(ctx, dto.BotEndpointId, dto.Status, dto.Limit)
+}
+
+// DeliveryIdsが空の場合はbotの全てのdeadの配信を再送する
+type RedriveBotDeliveriesInputDTO struct {
+	BotEndpointId uuid.UUID
+	UserId        string
+	DeliveryIds   []uuid.UUID
+}
+
+// RedriveBotDeliveriesはdeadになった配信を再送するようにして、再送する件数を返す。botの所有者のみ再送できる
+func (usecase *BotEndpointUsecase) RedriveBotDeliveries(ctx context.Context, dto RedriveBotDeliveriesInputDTO) (int64, error) {
+	_, err := usecase.getOwnedBotEndpoint(ctx, dto.UserId, dto.BotEndpointId)
+	if err != nil {
+		return 0, err
+	}
+	return usecase.botDeliveryRepo.Redrive(ctx, dto.BotEndpointId, dto.DeliveryIds)
+}
+
+// トークンは発行時にのみ返すので、botの運用者が保存しておく必要がある
+type CreateBotTokenOutputDTO struct {
+	TokenId uuid.UUID
+	Token   string
+}
+
+// CreateBotTokenはbotがwebsocketで接続するためのトークンを発行する。botの所有者のみ発行できる
+func (usecase *BotEndpointUsecase) CreateBotToken(ctx context.Context, dto BotEndpointOwnerInputDTO) (CreateBotTokenOutputDTO, error) {
+	_, err := usecase.getOwnedBotEndpoint(ctx, dto.UserId, dto.BotEndpointId)
+	if err != nil {
+		return CreateBotTokenOutputDTO{}, err
+	}
+	secret := make([]byte, botTokenBytes)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return CreateBotTokenOutputDTO{}, errors.Wrap(err, "failed to generate bot token")
+	}
+	token := BotTokenPrefix + hex.EncodeToString(secret)
+	tokenId, err := usecase.botTokenRepo.Insert(ctx, entity.BotToken{BotEndpointId: dto.BotEndpointId, TokenHash: hashToken(token)})
+	if err != nil {
+		return CreateBotTokenOutputDTO{}, err
+	}
+	return CreateBotTokenOutputDTO{TokenId: tokenId, Token: token}, nil
+}
+
+// GetBotTokensはbotの失効していないトークンを取得する。トークン自体は返さない
+func (usecase *BotEndpointUsecase) GetBotTokens(ctx context.Context, dto BotEndpointOwnerInputDTO) ([]entity.BotToken, error) {
+	_, err := usecase.getOwnedBotEndpoint(ctx, dto.UserId, dto.BotEndpointId)
+	if err != nil {
+		return nil, err
+	}
+	return usecase.botTokenRepo.GetBotTokensByBotEndpointID(ctx, dto.BotEndpointId)
+}
+
+type RevokeBotTokenInputDTO struct {
+	UserId        string
+	BotEndpointId uuid.UUID
+	TokenId       uuid.UUID
+}
+
+// RevokeBotTokenはトークンを失効させる。接続中のwebsocketは切断されるまでそのまま使える
+func (usecase *BotEndpointUsecase) RevokeBotToken(ctx context.Context, dto RevokeBotTokenInputDTO) error {
+	_, err := usecase.getOwnedBotEndpoint(ctx, dto.UserId, dto.BotEndpointId)
+	if err != nil {
+		return err
+	}
+	revoked, err := usecase.botTokenRepo.Revoke(ctx, dto.BotEndpointId, dto.TokenId)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return errors.Wrap(ErrNotFound, fmt.Sprintf("bot token is not found. bot_endpoint_id -> %s, token_id -> %s", dto.BotEndpointId, dto.TokenId))
+	}
+	//失効させたトークンで接続しているwebsocketは切断する
+	usecase.hub.DisconnectBot(dto.BotEndpointId.String(), &dto.TokenId)
+	return nil
+}
+
+// Commandsでbotのコマンドを全て置き換える。空の場合はbotのコマンドを全て削除する
+type SetBotCommandsInputDTO struct {
+	UserId        string
+	BotEndpointId uuid.UUID
+	Commands      []entity.BotCommand
+}
+
+// SetBotCommandsはbotのコマンドを登録する。botの所有者のみ登録できる
+// コマンドはbotのエンドポイントに送るので、エンドポイントがないbotは登録できない
+func (usecase *BotEndpointUsecase) SetBotCommands(ctx context.Context, dto SetBotCommandsInputDTO) ([]entity.BotCommand, error) {
+	botEndpoint, err := usecase.getOwnedBotEndpoint(ctx, dto.UserId, dto.BotEndpointId)
+	if err != nil {
+		return nil, err
+	}
+	if botEndpoint.Endpoint == "" {
+		return nil, errors.Wrap(ErrInvalidArgument, fmt.Sprintf("bot without endpoint cannot have commands. bot_endpoint_id -> %s", botEndpoint.Id))
+	}
+	if len(dto.Commands) > maxBotCommands {
+		return nil, errors.Wrap(ErrInvalidArgument, fmt.Sprintf("bot can have at most %d commands", maxBotCommands))
+	}
+	commands := make([]entity.BotCommand, 0, len(dto.Commands))
+	for _, command := range dto.Commands {
+		command.Name = strings.TrimPrefix(command.Name, commandPrefix)
+		if !botCommandNamePattern.MatchString(command.Name) {
+			return nil, errors.Wrap(ErrInvalidArgument, fmt.Sprintf("command name must match %s. name -> %s", botCommandNamePattern, command.Name))
+		}
+		if isBuiltinCommand(command.Name) {
+			return nil, errors.Wrap(ErrInvalidArgument, fmt.Sprintf("command name is reserved. name -> %s", command.Name))
+		}
+		if slices.ContainsFunc(commands, func(c entity.BotCommand) bool { return c.Name == command.Name }) {
+			return nil, errors.Wrap(ErrInvalidArgument, fmt.Sprintf("command name is duplicated. name -> %s", command.Name))
+		}
+		command.BotEndpointId = dto.BotEndpointId
+		commands = append(commands, command)
+	}
+	err = usecase.txRepo.DoInTx(ctx, func(ctx context.Context) error {
+		err := usecase.botCommandRepo.DeleteByBotEndpointID(ctx, dto.BotEndpointId)
+		if err != nil {
+			return err
+		}
+		return usecase.botCommandRepo.Insert(ctx, commands)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+// GetBotCommandsはbotが登録しているコマンドを取得する。botの所有者のみ取得できる
+func (usecase *BotEndpointUsecase) GetBotCommands(ctx context.Context, dto BotEndpointOwnerInputDTO) ([]entity.BotCommand, error) {
+	_, err := usecase.getOwnedBotEndpoint(ctx, dto.UserId, dto.BotEndpointId)
+	if err != nil {
+		return nil, err
+	}
+	return usecase.botCommandRepo.GetBotCommandsByBotEndpointIDs(ctx, []uuid.UUID{dto.BotEndpointId})
+}
+
+// hashTokenはDBに保存するbotやwebhookのトークンのハッシュを返す
+// トークンは十分にランダムなのでsaltは付けない
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func generateSigningSecret() (string, error) {
+	secret := make([]byte, signingSecretBytes)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to generate signing secret")
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// signingSecretsはbotへのリクエストの署名に使う秘密鍵を返す
+// ローテーション後の猶予期間中は古い秘密鍵も含める
+func signingSecrets(botEndpoint entity.BotEndpoint, now time.Time) []string {
+	secrets := []string{botEndpoint.SigningSecret}
+	if botEndpoint.PreviousSigningSecret != nil && botEndpoint.PreviousSigningSecretExpiresAt != nil && now.Before(*botEndpoint.PreviousSigningSecretExpiresAt) {
+		secrets = append(secrets, *botEndpoint.PreviousSigningSecret)
+	}
+	return secrets
+}
+
+// BotClientInterfaceはbotのエンドポイントにsigningSecretsで署名したリクエストを送る
+// webhookパッケージのClientが実装する
+type BotClientInterface interface {
+	Send(ctx context.Context, endpoint string, payload []byte, signingSecrets []string) ([]byte, error)
+	ValidateEndpoint(ctx context.Context, endpoint string) error
+}
+
+// BotDispatcherInterfaceはサーバーで起きたイベントを、サーバーに追加されていてイベントを購読しているbotに送る
+type BotDispatcherInterface interface {
+	EnqueueMessageCreated(ctx context.Context, serverId uuid.UUID, message entity.MessageWithUser) error
+	WakeDeliveryWorkers()
+	DispatchMessageEdited(serverId uuid.UUID, message entity.Message)
+	DispatchMessageDeleted(serverId uuid.UUID, message entity.Message)
+	DispatchReactionAdded(serverId uuid.UUID, message entity.Message, userId string, emoji string)
+	DispatchChannelCreated(channel entity.Channel)
+	DispatchMemberJoined(serverId uuid.UUID, user entity.User)
+}
+
+type BotEventUsecaseInterface interface {
+	BotDispatcherInterface
+	PostCallbackMessage(ctx context.Context, dto PostCallbackMessageInputDTO) (entity.MessageWithUser, error)
+	PostBotMessage(ctx context.Context, dto PostBotMessageInputDTO) (entity.MessageWithUser, error)
+	BotCommandInvokerInterface
+}
+
+// BotEventVersionはbotに送るイベントの形式のバージョン
+// フィールドの追加では上げずに、フィールドの削除や意味の変更をした場合にのみ上げるので、botは知らないフィールドを無視する
+const BotEventVersion = 1
+
+// botが購読できるイベントの種類。commandはコマンドを登録したbotにのみ送るので購読はできない
+const (
+	botEventMessageCreated = "message_created"
+	botEventMessageEdited  = "message_edited"
+	botEventMessageDeleted = "message_deleted"
+	botEventReactionAdded  = "reaction_added"
+	botEventChannelCreated = "channel_created"
+	botEventMemberJoined   = "member_joined"
+)
+
+var botEventTypes = []string{botEventMessageCreated, botEventMessageEdited, botEventMessageDeleted, botEventReactionAdded, botEventChannelCreated, botEventMemberJoined}
+
+// DefaultBotEventSubscriptionsは購読するイベントを指定せずに登録したbotが購読するイベント
+var DefaultBotEventSubscriptions = []string{botEventMessageCreated}
+
+// validateBotEventTypesはeventTypesが購読できるイベントの種類のみで、重複していないことを確認する
+func validateBotEventTypes(eventTypes []string) error {
+	for i, eventType := range eventTypes {
+		if !slices.Contains(botEventTypes, eventType) {
+			return errors.Wrap(ErrInvalidArgument, fmt.Sprintf("unknown event type. event_type -> %s, available event types -> %v", eventType, botEventTypes))
+		}
+		if slices.Contains(eventTypes[:i], eventType) {
+			return errors.Wrap(ErrInvalidArgument, fmt.Sprintf("event type is duplicated. event_type -> %s", eventType))
+		}
+	}
+	return nil
+}
+
+const (
+	botEventCommand = "command"
+	//botがイベントを受け取った後に、非同期でメッセージを投稿するためのトークンのaudience
+	botCallbackTokenAudience = "bot_callback"
+	botCallbackTokenTTL      = time.Minute * 15
+	//botへの1回の送信とbotの応答の保存にかける最大の時間
+	botDispatchTimeout = time.Second * 10
+	botEnqueueTimeout  = time.Second * 5
+	//送信中のworkerが停止した場合に、別のworkerが再送するまでの時間
+	botDeliveryLease        = time.Minute
+	botDeliveryPollInterval = time.Second * 5
+	botDeliveryBaseBackoff  = time.Second * 5
+	botDeliveryMaxBackoff   = time.Hour
+	//この回数送信に失敗した配信はdeadにしてredriveされるまで再送しない
+	maxBotDeliveryAttempts = 8
+)
+
+// BotEventはbotのエンドポイントにPOSTするイベント
+// Typeによって、Message、Reaction、Channel、Memberのうちイベントに関係するものだけが設定される
+// EventIdはイベントごとに一意で、再送しても変わらないので、botは重複して届いたイベントを無視できる
+// botはCallbackTokenを使って、後からPOST /bot/callbackでイベントが起きたチャンネルにメッセージを投稿できる
+// member_joinedのようにチャンネルがないイベントにはChannelIdとCallbackTokenは設定されない
+type BotEvent struct {
+	Version       int               `json:"version"`
+	EventId       uuid.UUID         `json:"event_id"`
+	Type          string            `json:"type"`
+	OccurredAt    time.Time         `json:"occurred_at"`
+	ServerId      uuid.UUID         `json:"server_id"`
+	ChannelId     *uuid.UUID        `json:"channel_id,omitempty"`
+	CallbackToken string            `json:"callback_token,omitempty"`
+	Message       *BotEventMessage  `json:"message,omitempty"`
+	Reaction      *BotEventReaction `json:"reaction,omitempty"`
+	Channel       *BotEventChannel  `json:"channel,omitempty"`
+	Member        *BotEventMember   `json:"member,omitempty"`
+}
+
+// webhookのメッセージの場合はUserIdが空で、WebhookIdとUserNameにwebhookの表示名が設定される
+// message_editedとmessage_deletedではUserNameは設定されない。message_deletedではMessageは空
+type BotEventMessage struct {
+	MessageId       uuid.UUID  `json:"message_id"`
+	UserId          string     `json:"user_id"`
+	BotEndpointId   *uuid.UUID `json:"bot_endpoint_id,omitempty"`
+	WebhookId       *uuid.UUID `json:"webhook_id,omitempty"`
+	UserName        string     `json:"user_name,omitempty"`
+	Message         string     `json:"message"`
+	ParentMessageId *uuid.UUID `json:"parent_message_id"`
+	Seq             *int64     `json:"seq"`
+	CreatedAt       time.Time  `json:"created_at"`
+	EditedAt        *time.Time `json:"edited_at,omitempty"`
+	DeletedAt       *time.Time `json:"deleted_at,omitempty"`
+}
+
+// BotEventReactionはreaction_addedでリアクションを付けたuserと絵文字。リアクションが付いたメッセージはMessageに設定される
+type BotEventReaction struct {
+	UserId string `json:"user_id"`
+	Emoji  string `json:"emoji"`
+}
+
+type BotEventChannel struct {
+	ChannelId uuid.UUID `json:"channel_id"`
+	Name      string    `json:"name"`
+}
+
+type BotEventMember struct {
+	UserId       string `json:"user_id"`
+	UserName     string `json:"user_name"`
+	IconImageURL string `json:"icon_image_url"`
+}
+
+func newBotEventMessage(message entity.Message) *BotEventMessage {
+	return &BotEventMessage{
+		MessageId:       *message.Id,
+		UserId:          message.UserId,
+		BotEndpointId:   message.BotEndpointId,
+		WebhookId:       message.WebhookId,
+		Message:         message.Message,
+		ParentMessageId: message.ParentMessageId,
+		Seq:             message.Seq,
+		CreatedAt:       message.CreatedAt,
+		EditedAt:        message.EditedAt,
+		DeletedAt:       message.DeletedAt,
+	}
+}
+
+// botEventResponseはbotがレスポンスのボディで返すメッセージ
+// messageが空の場合はメッセージを投稿しない
+type botEventResponse struct {
+	Message string `json:"message"`
+}
+
+type BotEventUsecase struct {
+	botEndpointRepo       repository.BotEndpointRespositoryInterface
+	serverBotEndpointRepo repository.ServerBotEndpointRepositoryInterface
+	botDeliveryRepo       repository.BotDeliveryRepositoryInterface
+	botTokenRepo          repository.BotTokenRepositoryInterface
+	channelRepo           repository.ChannelRepositoryInterface
+	botClient             BotClientInterface
+	hub                   HubInterface
+	poster                *messagePoster
+	//配信が追加されたことをworkerに知らせて、ポーリングの間隔を待たずに送信する
+	wake chan struct{}
+}
+
+func NewBotEventUsecase(botEndpointRepo repository.BotEndpointRespositoryInterface, serverBotEndpointRepo repository.ServerBotEndpointRepositoryInterface, botDeliveryRepo repository.BotDeliveryRepositoryInterface, botTokenRepo repository.BotTokenRepositoryInterface, messageRepo repository.MessageRepositoryInterface, channelRepo repository.ChannelRepositoryInterface, txRepo repository.TxRepositoryInterface, hub HubInterface, botClient BotClientInterface) *BotEventUsecase {
+	return &BotEventUsecase{
+		botEndpointRepo:       botEndpointRepo,
+		serverBotEndpointRepo: serverBotEndpointRepo,
+		botDeliveryRepo:       botDeliveryRepo,
+		botTokenRepo:          botTokenRepo,
+		channelRepo:           channelRepo,
+		botClient:             botClient,
+		hub:                   hub,
+		poster:                newMessagePoster(messageRepo, channelRepo, txRepo, hub),
+		wake:                  make(chan struct{}, 1),
+	}
+}
+
+// EnqueueMessageCreatedはサーバーに追加されているbotへの配信をキューに追加する
+// メッセージを保存するトランザクションの中で呼び出すことで、メッセージが保存された場合は必ず配信も保存されるようにする
+// コミットした後にWakeDeliveryWorkersを呼び出してworkerに知らせる
+// botへの送信はworkerが行うので、遅いbotがいても呼び出し元はブロックされない
+// botのメッセージはbot同士で応答し続けないように送らない
+func (usecase *BotEventUsecase) EnqueueMessageCreated(ctx context.Context, serverId uuid.UUID, message entity.MessageWithUser) error {
+	if message.IsBot {
+		return nil
+	}
+	eventMessage := newBotEventMessage(message.Message)
+	eventMessage.UserName = message.UserName
+	//スレッドの返信に対するbotの応答は同じスレッドに投稿する
+	_, err := usecase.enqueue(ctx, BotEvent{Type: botEventMessageCreated, ServerId: serverId, ChannelId: &message.ChannelId, Message: eventMessage}, message.ParentMessageId)
+	return err
+}
+
+// WakeDeliveryWorkersは配信が追加されたことをworkerに知らせて、ポーリングの間隔を待たずに送信させる
+func (usecase *BotEventUsecase) WakeDeliveryWorkers() {
+	select {
+	case usecase.wake <- struct{}{}:
+	default:
+	}
+}
+
+// DispatchMessageEditedはメッセージが編集されたことをmessage_editedを購読しているbotに送る
+func (usecase *BotEventUsecase) DispatchMessageEdited(serverId uuid.UUID, message entity.Message) {
+	usecase.dispatch(BotEvent{Type: botEventMessageEdited, ServerId: serverId, ChannelId: &message.ChannelId, Message: newBotEventMessage(message)}, message.ParentMessageId)
+}
+
+// DispatchMessageDeletedはメッセージが削除されたことをmessage_deletedを購読しているbotに送る
+func (usecase *BotEventUsecase) DispatchMessageDeleted(serverId uuid.UUID, message entity.Message) {
+	usecase.dispatch(BotEvent{Type: botEventMessageDeleted, ServerId: serverId, ChannelId: &message.ChannelId, Message: newBotEventMessage(message)}, message.ParentMessageId)
+}
+
+// DispatchReactionAddedはメッセージにリアクションが付いたことをreaction_addedを購読しているbotに送る
+func (usecase *BotEventUsecase) DispatchReactionAdded(serverId uuid.UUID, message entity.Message, userId string, emoji string) {
+	usecase.dispatch(BotEvent{
+		Type:      botEventReactionAdded,
+		ServerId:  serverId,
+		ChannelId: &message.ChannelId,
+		Message:   newBotEventMessage(message),
+		Reaction:  &BotEventReaction{UserId: userId, Emoji: emoji},
+	}, message.ParentMessageId)
+}
+
+// DispatchChannelCreatedはチャンネルが作成されたことをchannel_createdを購読しているbotに送る
+// botの応答は作成されたチャンネルに投稿する
+func (usecase *BotEventUsecase) DispatchChannelCreated(channel entity.Channel) {
+	usecase.dispatch(BotEvent{
+		Type:      botEventChannelCreated,
+		ServerId:  channel.ServerId,
+		ChannelId: channel.Id,
+		Channel:   &BotEventChannel{ChannelId: *channel.Id, Name: channel.Name},
+	}, nil)
+}
+
+// DispatchMemberJoinedはuserがサーバーに参加したことをmember_joinedを購読しているbotに送る
+// 投稿するチャンネルが決まらないので、botの応答は投稿しない
+func (usecase *BotEventUsecase) DispatchMemberJoined(serverId uuid.UUID, user entity.User) {
+	usecase.dispatch(BotEvent{
+		Type:     botEventMemberJoined,
+		ServerId: serverId,
+		Member:   &BotEventMember{UserId: user.Id, UserName: user.Name, IconImageURL: user.IconImageURL},
+	}, nil)
+}
+
+// dispatchはイベントを購読しているbotへの配信をキューに追加して、workerに知らせる
+func (usecase *BotEventUsecase) dispatch(event BotEvent, parentMessageId *uuid.UUID) {
+	ctx, cancel := context.WithTimeout(context.Background(), botEnqueueTimeout)
+	defer cancel()
+	enqueued, err := usecase.enqueue(ctx, event, parentMessageId)
+	if err != nil {
+		log.Printf("failed to enqueue bot deliveries: %+v", err)
+		return
+	}
+	if enqueued > 0 {
+		usecase.WakeDeliveryWorkers()
+	}
+}
+
+// enqueueはイベントを購読しているbotへの配信をキューに追加して、追加した件数を返す
+func (usecase *BotEventUsecase) enqueue(ctx context.Context, event BotEvent, parentMessageId *uuid.UUID) (int64, error) {
+	event.Version = BotEventVersion
+	event.EventId = uuid.New()
+	event.OccurredAt = time.Now()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("failed to marshal bot event. event -> %+v", event))
+	}
+	return usecase.botDeliveryRepo.EnqueueForServer(ctx, event.ServerId, event.ChannelId, parentMessageId, event.Type, payload)
+}
+
+// RunDeliveryWorkersはctxがキャンセルされるまでworkers個のworkerでキューの配信をbotに送信する
+// 複数のレプリカで実行しても同じ配信を重複して送信しない
+func (usecase *BotEventUsecase) RunDeliveryWorkers(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go usecase.runDeliveryWorker(ctx)
+	}
+}
+
+func (usecase *BotEventUsecase) runDeliveryWorker(ctx context.Context) {
+	ticker := time.NewTicker(botDeliveryPollInterval)
+	defer ticker.Stop()
+	for {
+		delivery, err := usecase.botDeliveryRepo.Claim(ctx, botDeliveryLease)
+		if err == nil {
+			usecase.deliver(ctx, delivery)
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("failed to claim bot delivery: %+v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-usecase.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverは配信を1回送信して、成功した場合は削除し、失敗した場合は再送を予約する
+func (usecase *BotEventUsecase) deliver(ctx context.Context, delivery entity.BotDelivery) {
+	response, err := usecase.send(ctx, delivery)
+	if err != nil {
+		dead := delivery.Attempts >= maxBotDeliveryAttempts
+		nextAttemptAt := time.Now().Add(botDeliveryBackoff(delivery.Attempts))
+		log.Printf("failed to deliver bot event. delivery_id -> %s, attempts -> %d, dead -> %t: %+v", delivery.Id, delivery.Attempts, dead, err)
+		err = usecase.botDeliveryRepo.MarkFailed(ctx, *delivery.Id, err.Error(), nextAttemptAt, dead)
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+		return
+	}
+	err = usecase.botDeliveryRepo.Delete(ctx, *delivery.Id)
+	if err != nil {
+		log.Printf("%+v", err)
+	}
+	//チャンネルがないイベントへの応答は投稿するチャンネルがないので無視する
+	if response == nil || response.Message == "" || delivery.ChannelId == nil {
+		return
+	}
+	//botの応答の保存に失敗しても、botに再送すると同じイベントを重複して処理させてしまうので再送はしない
+	postCtx, cancel := context.WithTimeout(ctx, botDispatchTimeout)
+	defer cancel()
+	botEndpoint, err := usecase.botEndpointRepo.GetBotEndpoint(postCtx, delivery.BotEndpointId.String())
+	if err != nil {
+		log.Printf("%+v", err)
+		return
+	}
+	_, err = usecase.postBotMessage(postCtx, botEndpoint, delivery.ServerId, *delivery.ChannelId, delivery.ParentMessageId, response.Message)
+	if err != nil {
+		log.Printf("failed to post bot response: %+v", err)
+	}
+}
+
+// sendは送信する度に新しいcallback_tokenを付けてbotのエンドポイントにPOSTする
+func (usecase *BotEventUsecase) send(ctx context.Context, delivery entity.BotDelivery) (*botEventResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, botDispatchTimeout)
+	defer cancel()
+	botEndpoint, err := usecase.botEndpointRepo.GetBotEndpoint(ctx, delivery.BotEndpointId.String())
+	if err != nil {
+		return nil, err
+	}
+	//キューに追加した後にエンドポイントが変更されて、まだ検証されていない
+	if !botEndpoint.Verified {
+		return nil, errors.New(fmt.Sprintf("bot endpoint is not verified. bot_endpoint_id -> %s", botEndpoint.Id))
+	}
+	var event BotEvent
+	err = json.Unmarshal(delivery.Payload, &event)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to unmarshal bot event. delivery_id -> %s", delivery.Id))
+	}
+	//versionを付ける前にキューに追加された配信はmessage_createdのみで、形式はversion 1と同じ
+	if event.Version == 0 {
+		event.Version = BotEventVersion
+	}
+	if delivery.ChannelId != nil {
+		callbackToken, err := createBotCallbackToken(botEndpoint.Id, delivery.ServerId, *delivery.ChannelId, delivery.ParentMessageId)
+		if err != nil {
+			return nil, err
+		}
+		event.CallbackToken = string(callbackToken)
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to marshal bot event. event -> %+v", event))
+	}
+	body, err := usecase.botClient.Send(ctx, botEndpoint.Endpoint, payload, signingSecrets(botEndpoint, time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, nil
+	}
+	var response botEventResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to unmarshal response from bot. bot_endpoint_id -> %s", botEndpoint.Id))
+	}
+	return &response, nil
+}
+
+// botDeliveryBackoffはattempts回目の送信に失敗した後に再送するまでの時間を返す
+// 同時に失敗した配信が一斉に再送されないように、指数関数的に増やした時間の半分から全体の間でランダムにする
+func botDeliveryBackoff(attempts int) time.Duration {
+	backoff := botDeliveryMaxBackoff
+	if attempts < 32 {
+		backoff = min(botDeliveryBaseBackoff<<(attempts-1), botDeliveryMaxBackoff)
+	}
+	return backoff/2 + time.Duration(mathrand.Int63n(int64(backoff/2)+1))
+}
+
+// createBotCallbackTokenはbotがイベントの後にメッセージを投稿するためのjwtを発行する
+// 投稿できるのはイベントが発生したチャンネル(スレッドの場合はスレッド)のみ
+func createBotCallbackToken(botEndpointId string, serverId uuid.UUID, channelId uuid.UUID, parentMessageId *uuid.UUID) ([]byte, error) {
+	builder := jwt.NewBuilder().Subject(botEndpointId).Audience([]string{botCallbackTokenAudience}).
+		Claim("server_id", serverId.String()).Claim("channel_id", channelId.String()).
+		IssuedAt(time.Now()).Expiration(time.Now().Add(botCallbackTokenTTL))
+	if parentMessageId != nil {
+		builder = builder.Claim("parent_message_id", parentMessageId.String())
+	}
+	token, err := builder.Build()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build bot callback token")
+	}
+	secKey, err := parsePEMKeyFromEnv("PRIVATE_PEM_KEY")
+	if err != nil {
+		return nil, err
+	}
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.RS256, secKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign bot callback token")
+	}
+	return signed, nil
+}
+
+// uuidClaimはjwtのprivate claimからuuidを取得する
+func uuidClaim(token jwt.Token, name string) (*uuid.UUID, error) {
+	value, ok := token.Get(name)
+	if !ok {
+		return nil, nil
+	}
+	str, ok := value.(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("claim is not string. claim -> %s", name))
+	}
+	id, err := uuid.Parse(str)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("cant parse claim. claim -> %s", name))
+	}
+	return &id, nil
+}
+
+type PostCallbackMessageInputDTO struct {
+	Token   []byte
+	Message string
+}
+
+// PostCallbackMessageはイベントと一緒に送ったトークンを検証して、botのメッセージを投稿する
+// botがサーバーから削除されている場合は投稿できない
+func (usecase *BotEventUsecase) PostCallbackMessage(ctx context.Context, dto PostCallbackMessageInputDTO) (entity.MessageWithUser, error) {
+	pubKey, err := parsePEMKeyFromEnv("PUBLIC_PEM_KEY")
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	token, err := jwt.Parse(dto.Token, jwt.WithKey(jwa.RS256, pubKey), jwt.WithAudience(botCallbackTokenAudience))
+	if err != nil {
+		return entity.MessageWithUser{}, errors.Wrap(ErrUnauthorized, err.Error())
+	}
+	serverId, err := uuidClaim(token, "server_id")
+	if err != nil || serverId == nil {
+		return entity.MessageWithUser{}, errors.Wrap(ErrUnauthorized, "server_id claim is required")
+	}
+	channelId, err := uuidClaim(token, "channel_id")
+	if err != nil || channelId == nil {
+		return entity.MessageWithUser{}, errors.Wrap(ErrUnauthorized, "channel_id claim is required")
+	}
+	parentMessageId, err := uuidClaim(token, "parent_message_id")
+	if err != nil {
+		return entity.MessageWithUser{}, errors.Wrap(ErrUnauthorized, err.Error())
+	}
+	botEndpoint, err := usecase.botEndpointRepo.GetBotEndpoint(ctx, token.Subject())
+	if errors.Is(err, sql.ErrNoRows) {
+		return entity.MessageWithUser{}, errors.Wrap(ErrForbidden, err.Error())
+	}
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	if !botEndpoint.Verified {
+		return entity.MessageWithUser{}, errors.Wrap(ErrForbidden, fmt.Sprintf("bot endpoint is not verified. bot_endpoint_id -> %s", botEndpoint.Id))
+	}
+	exists, err := usecase.serverBotEndpointRepo.ExistServerBotEndpoint(ctx, *serverId, botEndpoint.Id)
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	if !exists {
+		return entity.MessageWithUser{}, errors.Wrap(ErrForbidden, fmt.Sprintf("bot is not added to server. bot_endpoint_id -> %s, server_id -> %s", botEndpoint.Id, serverId))
+	}
+	return usecase.postBotMessage(ctx, botEndpoint, *serverId, *channelId, parentMessageId, dto.Message)
+}
+
+// BotCommandEventはbotのコマンドが実行された時にbotのエンドポイントにPOSTするイベント
+// Version、EventId、OccurredAtはBotEventと同じ
+type BotCommandEvent struct {
+	Version         int             `json:"version"`
+	EventId         uuid.UUID       `json:"event_id"`
+	Type            string          `json:"type"`
+	OccurredAt      time.Time       `json:"occurred_at"`
+	ServerId        uuid.UUID       `json:"server_id"`
+	ChannelId       uuid.UUID       `json:"channel_id"`
+	ParentMessageId *uuid.UUID      `json:"parent_message_id"`
+	CallbackToken   string          `json:"callback_token"`
+	Command         BotEventCommand `json:"command"`
+}
+
+// Argsはコマンドの名前の後を空白で区切ったもの、Textは名前の後の文字列をそのまま設定する
+type BotEventCommand struct {
+	Name     string   `json:"name"`
+	Args     []string `json:"args"`
+	Text     string   `json:"text"`
+	UserId   string   `json:"user_id"`
+	UserName string   `json:"user_name"`
+}
+
+// botCommandResponseはbotがコマンドに対してレスポンスのボディで返すメッセージ
+// ephemeralがtrueの場合はコマンドを実行したセッションにのみ送り、保存しない
+type botCommandResponse struct {
+	Message   string `json:"message"`
+	Ephemeral bool   `json:"ephemeral"`
+}
+
+type InvokeBotCommandInputDTO struct {
+	BotEndpoint     entity.BotEndpoint
+	Name            string
+	Args            []string
+	Text            string
+	UserId          string
+	UserName        string
+	SessionId       string
+	ServerId        uuid.UUID
+	ChannelId       uuid.UUID
+	ParentMessageId *uuid.UUID
+}
+
+// InvokeBotCommandはコマンドをbotのエンドポイントに送り、botの応答を投稿するかセッションに送る
+// コマンドはuserが応答を待っているので、キューには追加せずにすぐに1回だけ送る
+// 失敗した場合はコマンドを実行したセッションに知らせる
+func (usecase *BotEventUsecase) InvokeBotCommand(dto InvokeBotCommandInputDTO) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), botDispatchTimeout)
+		defer cancel()
+		response, err := usecase.sendCommand(ctx, dto)
+		if err != nil {
+			log.Printf("failed to invoke bot command: %+v", err)
+			usecase.hub.NotifyEphemeral(dto.UserId, dto.SessionId, EphemeralMessage{
+				ServerId:      dto.ServerId,
+				ChannelId:     dto.ChannelId,
+				BotEndpointId: dto.BotEndpoint.Id,
+				BotName:       dto.BotEndpoint.Name,
+				Message:       fmt.Sprintf("/%s failed: %s did not respond", dto.Name, dto.BotEndpoint.Name),
+			})
+			return
+		}
+		if response == nil || response.Message == "" {
+			return
+		}
+		if response.Ephemeral {
+			usecase.hub.NotifyEphemeral(dto.UserId, dto.SessionId, EphemeralMessage{
+				ServerId:      dto.ServerId,
+				ChannelId:     dto.ChannelId,
+				BotEndpointId: dto.BotEndpoint.Id,
+				BotName:       dto.BotEndpoint.Name,
+				Message:       response.Message,
+			})
+			return
+		}
+		_, err = usecase.postBotMessage(ctx, dto.BotEndpoint, dto.ServerId, dto.ChannelId, dto.ParentMessageId, response.Message)
+		if err != nil {
+			log.Printf("failed to post bot command response: %+v", err)
+		}
+	}()
+}
+
+func (usecase *BotEventUsecase) sendCommand(ctx context.Context, dto InvokeBotCommandInputDTO) (*botCommandResponse, error) {
+	if dto.BotEndpoint.Endpoint == "" || !dto.BotEndpoint.Verified {
+		return nil, errors.New(fmt.Sprintf("bot endpoint is not verified. bot_endpoint_id -> %s", dto.BotEndpoint.Id))
+	}
+	callbackToken, err := createBotCallbackToken(dto.BotEndpoint.Id, dto.ServerId, dto.ChannelId, dto.ParentMessageId)
+	if err != nil {
+		return nil, err
+	}
+	event := BotCommandEvent{
+		Version:         BotEventVersion,
+		EventId:         uuid.New(),
+		Type:            botEventCommand,
+		OccurredAt:      time.Now(),
+		ServerId:        dto.ServerId,
+		ChannelId:       dto.ChannelId,
+		ParentMessageId: dto.ParentMessageId,
+		CallbackToken:   string(callbackToken),
+		Command: BotEventCommand{
+			Name:     dto.Name,
+			Args:     dto.Args,
+			Text:     dto.Text,
+			UserId:   dto.UserId,
+			UserName: dto.UserName,
+		},
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to marshal bot command event. event -> %+v", event))
+	}
+	body, err := usecase.botClient.Send(ctx, dto.BotEndpoint.Endpoint, payload, signingSecrets(dto.BotEndpoint, time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, nil
+	}
+	var response botCommandResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to unmarshal command response from bot. bot_endpoint_id -> %s", dto.BotEndpoint.Id))
+	}
+	return &response, nil
 }
 
-type BotEndpointUsecase struct {
-	repo repository.BotEndpointRespositoryInterface
+// TokenIdはbotがwebsocketの接続に使ったトークンのId
+type PostBotMessageInputDTO struct {
+	BotEndpointId   string
+	TokenId         uuid.UUID
+	ServerId        uuid.UUID
+	ChannelId       uuid.UUID
+	ParentMessageId *uuid.UUID
+	Message         string
 }
 
-func NewBotEndpointUsecase(repo repository.BotEndpointRespositoryInterface) *BotEndpointUsecase {
-	return &BotEndpointUsecase{repo: repo}
+// PostBotMessageはwebsocketで接続しているbotのメッセージを投稿する
+// 接続している間にbotが削除されたり、トークンが失効したり、サーバーから削除されている場合は投稿できない
+func (usecase *BotEventUsecase) PostBotMessage(ctx context.Context, dto PostBotMessageInputDTO) (entity.MessageWithUser, error) {
+	botEndpoint, err := usecase.botEndpointRepo.GetBotEndpoint(ctx, dto.BotEndpointId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entity.MessageWithUser{}, errors.Wrap(ErrForbidden, err.Error())
+	}
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	botEndpointId, err := uuid.Parse(botEndpoint.Id)
+	if err != nil {
+		return entity.MessageWithUser{}, errors.Wrap(err, fmt.Sprintf("cant parse botEndpointId. bot_endpoint_id -> %s", botEndpoint.Id))
+	}
+	active, err := usecase.botTokenRepo.IsActive(ctx, botEndpointId, dto.TokenId)
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	if !active {
+		return entity.MessageWithUser{}, errors.Wrap(ErrUnauthorized, fmt.Sprintf("bot token is revoked. bot_endpoint_id -> %s, token_id -> %s", botEndpoint.Id, dto.TokenId))
+	}
+	exists, err := usecase.serverBotEndpointRepo.ExistServerBotEndpoint(ctx, dto.ServerId, botEndpoint.Id)
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	if !exists {
+		return entity.MessageWithUser{}, errors.Wrap(ErrForbidden, fmt.Sprintf("bot is not added to server. bot_endpoint_id -> %s, server_id -> %s", botEndpoint.Id, dto.ServerId))
+	}
+	return usecase.postBotMessage(ctx, botEndpoint, dto.ServerId, dto.ChannelId, dto.ParentMessageId, dto.Message)
 }
 
-type RegisterBotEndpointInputDTO struct {
-	Name     string
-	IconURL  string
-	Endpoint string
+// postBotMessageはbotのメッセージを保存して、チャンネルのサーバーのメンバーに送る
+func (usecase *BotEventUsecase) postBotMessage(ctx context.Context, botEndpoint entity.BotEndpoint, serverId uuid.UUID, channelId uuid.UUID, parentMessageId *uuid.UUID, text string) (entity.MessageWithUser, error) {
+	botEndpointId, err := uuid.Parse(botEndpoint.Id)
+	if err != nil {
+		return entity.MessageWithUser{}, errors.Wrap(err, fmt.Sprintf("cant parse botEndpointId. bot_endpoint_id -> %s", botEndpoint.Id))
+	}
+	channel, err := usecase.channelRepo.GetChannel(ctx, channelId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entity.MessageWithUser{}, errors.Wrap(ErrNotFound, err.Error())
+	}
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	if channel.ServerId != serverId {
+		return entity.MessageWithUser{}, errors.Wrap(ErrForbidden, fmt.Sprintf("channel is not in server. channel_id -> %s, server_id -> %s", channelId, serverId))
+	}
+	if parentMessageId != nil {
+		err = usecase.poster.validateParentMessage(ctx, *parentMessageId, channelId)
+		if err != nil {
+			return entity.MessageWithUser{}, err
+		}
+	}
+	message := entity.Message{
+		ChannelId:       channelId,
+		IsBot:           true,
+		Message:         text,
+		BotEndpointId:   &botEndpointId,
+		ParentMessageId: parentMessageId,
+	}
+	//botのメッセージはbotに送らないので、配信はキューに追加しない
+	stored, _, err := usecase.poster.store(ctx, message, nil)
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	messageWithUser := entity.MessageWithUser{Message: stored, UserName: botEndpoint.Name, IconURL: botEndpoint.IconURL}
+	err = usecase.poster.notify(ctx, serverId, messageWithUser)
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	return messageWithUser, nil
+}
+
+type ServerBotEndpointUsecaseInterface interface {
+	InstallBot(ctx context.Context, dto ServerBotEndpointInputDTO) error
+	UninstallBot(ctx context.Context, dto ServerBotEndpointInputDTO) error
+	GetInstalledBots(ctx context.Context, dto GetInstalledBotsInputDTO) ([]entity.BotEndpoint, error)
+	SetBotEventSubscriptions(ctx context.Context, dto SetBotEventSubscriptionsInputDTO) error
+}
+
+type ServerBotEndpointUsecase struct {
+	serverBotEndpointRepo repository.ServerBotEndpointRepositoryInterface
+	botEndpointRepo       repository.BotEndpointRespositoryInterface
+	userServerRepo        repository.UserServerRepositoryInterface
+	hub                   HubInterface
+}
+
+func NewServerBotEndpointUsecase(serverBotEndpointRepo repository.ServerBotEndpointRepositoryInterface, botEndpointRepo repository.BotEndpointRespositoryInterface, userServerRepo repository.UserServerRepositoryInterface, hub HubInterface) *ServerBotEndpointUsecase {
+	return &ServerBotEndpointUsecase{serverBotEndpointRepo: serverBotEndpointRepo, botEndpointRepo: botEndpointRepo, userServerRepo: userServerRepo, hub: hub}
+}
+
+type ServerBotEndpointInputDTO struct {
+	UserId        string
+	ServerId      uuid.UUID
+	BotEndpointId uuid.UUID
+}
+
+// InstallBotはサーバーにbotを追加して、サーバーのメンバーに知らせる
+// botを追加できるのはサーバーのownerのみ
+func (usecase *ServerBotEndpointUsecase) InstallBot(ctx context.Context, dto ServerBotEndpointInputDTO) error {
+	err := authorizeServerOwner(ctx, usecase.userServerRepo, dto.UserId, dto.ServerId)
+	if err != nil {
+		return err
+	}
+	botEndpoint, err := usecase.botEndpointRepo.GetBotEndpoint(ctx, dto.BotEndpointId.String())
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrap(ErrNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	//websocketで接続するbotはエンドポイントがないので検証しない
+	if botEndpoint.Endpoint != "" && !botEndpoint.Verified {
+		return errors.Wrap(ErrInvalidArgument, fmt.Sprintf("bot endpoint is not verified. bot_endpoint_id -> %s", botEndpoint.Id))
+	}
+	installed, err := usecase.serverBotEndpointRepo.Insert(ctx, entity.ServerBotEndpoint{ServerId: dto.ServerId.String(), BotEndpointId: botEndpoint.Id})
+	if err != nil {
+		return err
+	}
+	//既に追加されている場合は変更がないので知らせない
+	if installed {
+		usecase.hub.NotifyBotInstalled(dto.ServerId, botEndpoint)
+	}
+	return nil
+}
+
+// UninstallBotはサーバーからbotを削除して、サーバーのメンバーに知らせる
+// botを削除できるのはサーバーのownerのみ
+func (usecase *ServerBotEndpointUsecase) UninstallBot(ctx context.Context, dto ServerBotEndpointInputDTO) error {
+	err := authorizeServerOwner(ctx, usecase.userServerRepo, dto.UserId, dto.ServerId)
+	if err != nil {
+		return err
+	}
+	uninstalled, err := usecase.serverBotEndpointRepo.Delete(ctx, dto.ServerId, dto.BotEndpointId.String())
+	if err != nil {
+		return err
+	}
+	if !uninstalled {
+		return errors.Wrap(ErrNotFound, fmt.Sprintf("bot is not added to server. server_id -> %s, bot_endpoint_id -> %s", dto.ServerId, dto.BotEndpointId))
+	}
+	usecase.hub.NotifyBotUninstalled(dto.ServerId, dto.BotEndpointId.String())
+	return nil
+}
+
+type GetInstalledBotsInputDTO struct {
+	UserId   string
+	ServerId uuid.UUID
+}
+
+// GetInstalledBotsはサーバーに追加されているbotを取得する。サーバーのメンバーであれば取得できる
+func (usecase *ServerBotEndpointUsecase) GetInstalledBots(ctx context.Context, dto GetInstalledBotsInputDTO) ([]entity.BotEndpoint, error) {
+	exists, err := usecase.userServerRepo.ExistUserServer(ctx, dto.UserId, dto.ServerId)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.Wrap(ErrForbidden, fmt.Sprintf("user is not a member of server. user_id -> %s, server_id -> %s", dto.UserId, dto.ServerId))
+	}
+	return usecase.serverBotEndpointRepo.GetBotEndpointsByServerID(ctx, dto.ServerId)
+}
+
+// EventTypesがnilの場合は絞り込みをやめて、botが購読している全てのイベントを送る
+type SetBotEventSubscriptionsInputDTO struct {
+	UserId        string
+	ServerId      uuid.UUID
+	BotEndpointId uuid.UUID
+	EventTypes    []string
+}
+
+// SetBotEventSubscriptionsはサーバーでbotに送るイベントを絞り込む。サーバーのownerのみ設定できる
+// botに送るのはbotが購読しているイベントとEventTypesの両方に含まれるイベントのみ
+func (usecase *ServerBotEndpointUsecase) SetBotEventSubscriptions(ctx context.Context, dto SetBotEventSubscriptionsInputDTO) error {
+	err := authorizeServerOwner(ctx, usecase.userServerRepo, dto.UserId, dto.ServerId)
+	if err != nil {
+		return err
+	}
+	err = validateBotEventTypes(dto.EventTypes)
+	if err != nil {
+		return err
+	}
+	updated, err := usecase.serverBotEndpointRepo.SetEventSubscriptions(ctx, dto.ServerId, dto.BotEndpointId.String(), dto.EventTypes)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return errors.Wrap(ErrNotFound, fmt.Sprintf("bot is not added to server. server_id -> %s, bot_endpoint_id -> %s", dto.ServerId, dto.BotEndpointId))
+	}
+	return nil
+}
+
+// authorizeServerOwnerはuserがサーバーのownerであることを確認する
+// botやwebhookのようにサーバーの外からメッセージを投稿できるものや、メンバーの役割はownerのみ管理できる
+func authorizeServerOwner(ctx context.Context, userServerRepo repository.UserServerRepositoryInterface, userId string, serverId uuid.UUID) error {
+	userServer, err := userServerRepo.GetUserServer(ctx, userId, serverId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrap(ErrForbidden, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if userServer.Role != entity.ServerRoleOwner {
+		return errors.Wrap(ErrForbidden, fmt.Sprintf("only server owner can manage the server. user_id -> %s, server_id -> %s", userId, serverId))
+	}
+	return nil
+}
+
+type WebhookUsecaseInterface interface {
+	CreateWebhook(ctx context.Context, dto CreateWebhookInputDTO) (CreateWebhookOutputDTO, error)
+	GetWebhooks(ctx context.Context, dto GetWebhooksInputDTO) ([]entity.Webhook, error)
+	RevokeWebhook(ctx context.Context, dto RevokeWebhookInputDTO) error
+	ExecuteWebhook(ctx context.Context, dto ExecuteWebhookInputDTO) (entity.MessageWithUser, error)
+}
+
+const webhookTokenBytes = 32
+
+type WebhookUsecase struct {
+	webhookRepo    repository.WebhookRepositoryInterface
+	channelRepo    repository.ChannelRepositoryInterface
+	userServerRepo repository.UserServerRepositoryInterface
+	botDispatcher  BotDispatcherInterface
+	poster         *messagePoster
+}
+
+func NewWebhookUsecase(webhookRepo repository.WebhookRepositoryInterface, messageRepo repository.MessageRepositoryInterface, channelRepo repository.ChannelRepositoryInterface, userServerRepo repository.UserServerRepositoryInterface, txRepo repository.TxRepositoryInterface, hub HubInterface, botDispatcher BotDispatcherInterface) *WebhookUsecase {
+	return &WebhookUsecase{
+		webhookRepo:    webhookRepo,
+		channelRepo:    channelRepo,
+		userServerRepo: userServerRepo,
+		botDispatcher:  botDispatcher,
+		poster:         newMessagePoster(messageRepo, channelRepo, txRepo, hub),
+	}
+}
+
+// NameとIconURLはwebhookのメッセージのデフォルトの表示名とアイコン
+type CreateWebhookInputDTO struct {
+	UserId    string
+	ServerId  uuid.UUID
+	ChannelId uuid.UUID
+	Name      string
+	IconURL   string
+}
+
+type CreateWebhookOutputDTO struct {
+	Webhook entity.Webhook
+	Token   string
+}
+
+// CreateWebhookはチャンネルにメッセージを投稿するwebhookを作成する。サーバーのownerのみ作成できる
+// トークンはこの時にしか返さないので、失くした場合は作り直す
+func (usecase *WebhookUsecase) CreateWebhook(ctx context.Context, dto CreateWebhookInputDTO) (CreateWebhookOutputDTO, error) {
+	err := authorizeServerOwner(ctx, usecase.userServerRepo, dto.UserId, dto.ServerId)
+	if err != nil {
+		return CreateWebhookOutputDTO{}, err
+	}
+	channel, err := usecase.channelRepo.GetChannel(ctx, dto.ChannelId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return CreateWebhookOutputDTO{}, errors.Wrap(ErrNotFound, err.Error())
+	}
+	if err != nil {
+		return CreateWebhookOutputDTO{}, err
+	}
+	if channel.ServerId != dto.ServerId {
+		return CreateWebhookOutputDTO{}, errors.Wrap(ErrNotFound, fmt.Sprintf("channel is not in server. channel_id -> %s, server_id -> %s", dto.ChannelId, dto.ServerId))
+	}
+	secret := make([]byte, webhookTokenBytes)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return CreateWebhookOutputDTO{}, errors.Wrap(err, "failed to generate webhook token")
+	}
+	token := hex.EncodeToString(secret)
+	webhook, err := usecase.webhookRepo.Insert(ctx, entity.Webhook{
+		ServerId:        dto.ServerId,
+		ChannelId:       dto.ChannelId,
+		Name:            dto.Name,
+		IconURL:         dto.IconURL,
+		TokenHash:       hashToken(token),
+		CreatedByUserId: dto.UserId,
+	})
+	if err != nil {
+		return CreateWebhookOutputDTO{}, err
+	}
+	return CreateWebhookOutputDTO{Webhook: webhook, Token: token}, nil
+}
+
+type GetWebhooksInputDTO struct {
+	UserId   string
+	ServerId uuid.UUID
+}
+
+// GetWebhooksはサーバーの失効していないwebhookを取得する。サーバーのownerのみ取得できる
+func (usecase *WebhookUsecase) GetWebhooks(ctx context.Context, dto GetWebhooksInputDTO) ([]entity.Webhook, error) {
+	err := authorizeServerOwner(ctx, usecase.userServerRepo, dto.UserId, dto.ServerId)
+	if err != nil {
+		return nil, err
+	}
+	return usecase.webhookRepo.GetWebhooksByServerID(ctx, dto.ServerId)
+}
+
+type RevokeWebhookInputDTO struct {
+	UserId    string
+	ServerId  uuid.UUID
+	WebhookId uuid.UUID
+}
+
+// RevokeWebhookはwebhookを失効させる。サーバーのownerのみ失効させられる
+// 失効したwebhookが投稿したメッセージはそのまま残る
+func (usecase *WebhookUsecase) RevokeWebhook(ctx context.Context, dto RevokeWebhookInputDTO) error {
+	err := authorizeServerOwner(ctx, usecase.userServerRepo, dto.UserId, dto.ServerId)
+	if err != nil {
+		return err
+	}
+	revoked, err := usecase.webhookRepo.Revoke(ctx, dto.ServerId, dto.WebhookId)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return errors.Wrap(ErrNotFound, fmt.Sprintf("webhook is not found. server_id -> %s, webhook_id -> %s", dto.ServerId, dto.WebhookId))
+	}
+	return nil
+}
+
+// NameとIconURLが空の場合はwebhookのデフォルトの表示名とアイコンを使う
+type ExecuteWebhookInputDTO struct {
+	WebhookId uuid.UUID
+	Token     string
+	Message   string
+	Name      string
+	IconURL   string
+}
+
+// ExecuteWebhookはwebhookのチャンネルにメッセージを投稿して、userのメッセージと同じくサーバーのメンバーとbotに送る
+func (usecase *WebhookUsecase) ExecuteWebhook(ctx context.Context, dto ExecuteWebhookInputDTO) (entity.MessageWithUser, error) {
+	webhook, err := usecase.webhookRepo.GetWebhookByTokenHash(ctx, dto.WebhookId, hashToken(dto.Token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return entity.MessageWithUser{}, errors.Wrap(ErrUnauthorized, err.Error())
+	}
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	name := webhook.Name
+	if dto.Name != "" {
+		name = dto.Name
+	}
+	iconURL := webhook.IconURL
+	if dto.IconURL != "" {
+		iconURL = dto.IconURL
+	}
+	message := entity.Message{
+		ChannelId:      webhook.ChannelId,
+		IsBot:          false,
+		Message:        dto.Message,
+		WebhookId:      webhook.Id,
+		DisplayName:    name,
+		DisplayIconURL: iconURL,
+	}
+	stored, _, err := usecase.poster.store(ctx, message, func(ctx context.Context, stored entity.Message) error {
+		return usecase.botDispatcher.EnqueueMessageCreated(ctx, webhook.ServerId, entity.MessageWithUser{Message: stored, UserName: name, IconURL: iconURL})
+	})
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	usecase.botDispatcher.WakeDeliveryWorkers()
+	messageWithUser := entity.MessageWithUser{Message: stored, UserName: name, IconURL: iconURL}
+	err = usecase.poster.notify(ctx, webhook.ServerId, messageWithUser)
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	return messageWithUser, nil
+}
+
+// EphemeralMessageはコマンドを実行したセッションにのみ送るメッセージ。DBには保存しない
+// botの応答の場合はBotEndpointIdとBotNameを設定する
+type EphemeralMessage struct {
+	ServerId      uuid.UUID
+	ChannelId     uuid.UUID
+	BotEndpointId string
+	BotName       string
+	Message       string
+}
+
+// Commandはサーバーで使えるスラッシュコマンド。botのコマンドの場合のみBotEndpointIdとBotNameを設定する
+type Command struct {
+	Name          string
+	Description   string
+	Usage         string
+	BotEndpointId string
+	BotName       string
+}
+
+const (
+	commandPrefix = "/"
+	//"//"から始まるメッセージはコマンドとして扱わず、先頭の"/"を1つ取り除いて投稿する
+	commandEscapePrefix = "//"
+	maxTopicLength      = 250
+	maxReminderDelay    = time.Hour * 24
+	maxBotCommands      = 50
+)
+
+// 組み込みのコマンド。botのコマンドと名前が重複した場合は組み込みのコマンドを優先する
+var builtinCommands = []Command{
+	{Name: "me", Description: "Post a message as an action", Usage: "/me {text}"},
+	{Name: "shrug", Description: `Append ¯\_(ツ)_/¯ to your message`, Usage: "/shrug [text]"},
+	{Name: "topic", Description: "Show or change the topic of the channel", Usage: "/topic [text]"},
+	{Name: "invite", Description: "Create an invitation token for this server", Usage: "/invite"},
+	{Name: "remind", Description: "Remind you after the duration. e.g. /remind 10m check the build", Usage: "/remind {duration} {text}"},
+}
+
+var botCommandNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+func isBuiltinCommand(name string) bool {
+	return slices.ContainsFunc(builtinCommands, func(command Command) bool {
+		return command.Name == name
+	})
+}
+
+// parseCommandは"/{name} {args}"をコマンドの名前と引数に分ける
+// argTextは名前の後の文字列をそのまま、argsは空白で区切ったものを返す
+func parseCommand(text string) (name string, args []string, argText string) {
+	body := strings.TrimPrefix(text, commandPrefix)
+	i := strings.IndexFunc(body, unicode.IsSpace)
+	if i < 0 {
+		return strings.ToLower(body), []string{}, ""
+	}
+	argText = strings.TrimSpace(body[i:])
+	return strings.ToLower(body[:i]), strings.Fields(argText), argText
+}
+
+type CommandUsecaseInterface interface {
+	ExecuteCommand(ctx context.Context, dto ExecuteCommandInputDTO) (ExecuteCommandOutputDTO, error)
+	GetCommands(ctx context.Context, dto GetCommandsInputDTO) ([]Command, error)
+}
+
+// BotCommandInvokerInterfaceはbotのコマンドをbotのエンドポイントに送る
+type BotCommandInvokerInterface interface {
+	InvokeBotCommand(dto InvokeBotCommandInputDTO)
+}
+
+type CommandUsecase struct {
+	messageUsecase        MessageUsecaseInterface
+	serverUsecase         ServerUsecaseInterface
+	botCommandInvoker     BotCommandInvokerInterface
+	channelRepo           repository.ChannelRepositoryInterface
+	userRepo              repository.UserRepositoryInterface
+	userServerRepo        repository.UserServerRepositoryInterface
+	serverBotEndpointRepo repository.ServerBotEndpointRepositoryInterface
+	botCommandRepo        repository.BotCommandRepositoryInterface
+	hub                   HubInterface
+}
+
+func NewCommandUsecase(messageUsecase MessageUsecaseInterface, serverUsecase ServerUsecaseInterface, botCommandInvoker BotCommandInvokerInterface, channelRepo repository.ChannelRepositoryInterface, userRepo repository.UserRepositoryInterface, userServerRepo repository.UserServerRepositoryInterface, serverBotEndpointRepo repository.ServerBotEndpointRepositoryInterface, botCommandRepo repository.BotCommandRepositoryInterface, hub HubInterface) *CommandUsecase {
+	return &CommandUsecase{messageUsecase: messageUsecase, serverUsecase: serverUsecase, botCommandInvoker: botCommandInvoker, channelRepo: channelRepo, userRepo: userRepo, userServerRepo: userServerRepo, serverBotEndpointRepo: serverBotEndpointRepo, botCommandRepo: botCommandRepo, hub: hub}
+}
+
+// SessionIdはephemeralな応答を送るセッション
+// userがチャンネルのサーバーに所属していることは呼び出し元で確認する
+type ExecuteCommandInputDTO struct {
+	UserId          string
+	SessionId       string
+	ServerId        uuid.UUID
+	ChannelId       uuid.UUID
+	ParentMessageId *uuid.UUID
+	ClientMsgId     *string
+	Text            string
+}
+
+// Messageはコマンドによってメッセージを投稿した場合に、Ephemeralはセッションにのみ応答を返す場合に設定する
+// botのコマンドはbotの応答を待たずに返すので、どちらも設定しない
+type ExecuteCommandOutputDTO struct {
+	Message   *entity.MessageWithUser
+	Ephemeral string
+}
+
+// ExecuteCommandは"/"から始まるメッセージをコマンドとして実行する
+func (usecase *CommandUsecase) ExecuteCommand(ctx context.Context, dto ExecuteCommandInputDTO) (ExecuteCommandOutputDTO, error) {
+	if text, ok := strings.CutPrefix(dto.Text, commandEscapePrefix); ok {
+		return usecase.post(ctx, dto, commandPrefix+text)
+	}
+	name, args, argText := parseCommand(dto.Text)
+	switch name {
+	case "me":
+		if argText == "" {
+			return ExecuteCommandOutputDTO{}, errors.Wrap(ErrInvalidArgument, "usage: /me {text}")
+		}
+		return usecase.post(ctx, dto, "_"+argText+"_")
+	case "shrug":
+		return usecase.post(ctx, dto, strings.TrimSpace(argText+` ¯\_(ツ)_/¯`))
+	case "topic":
+		return usecase.topic(ctx, dto, argText)
+	case "invite":
+		token, err := usecase.serverUsecase.CreateInvitationByJWT(CreateInvitationByJWTInputDTO{ServerId: dto.ServerId.String(), UserId: dto.UserId})
+		if err != nil {
+			return ExecuteCommandOutputDTO{}, err
+		}
+		return ExecuteCommandOutputDTO{Ephemeral: fmt.Sprintf("Invitation token (valid for 30 minutes): %s", token)}, nil
+	case "remind":
+		return usecase.remind(dto, args, argText)
+	}
+	commands, botEndpoints, err := usecase.commandsForServer(ctx, dto.ServerId)
+	if err != nil {
+		return ExecuteCommandOutputDTO{}, err
+	}
+	index := slices.IndexFunc(commands, func(command Command) bool {
+		return command.Name == name && command.BotEndpointId != ""
+	})
+	if index < 0 {
+		return ExecuteCommandOutputDTO{Ephemeral: fmt.Sprintf("Unknown command /%s. Start the message with // to post it as is.", name)}, nil
+	}
+	user, err := usecase.userRepo.GetUser(ctx, dto.UserId)
+	if err != nil {
+		return ExecuteCommandOutputDTO{}, err
+	}
+	usecase.botCommandInvoker.InvokeBotCommand(InvokeBotCommandInputDTO{
+		BotEndpoint:     botEndpoints[commands[index].BotEndpointId],
+		Name:            name,
+		Args:            args,
+		Text:            argText,
+		UserId:          user.Id,
+		UserName:        user.Name,
+		SessionId:       dto.SessionId,
+		ServerId:        dto.ServerId,
+		ChannelId:       dto.ChannelId,
+		ParentMessageId: dto.ParentMessageId,
+	})
+	return ExecuteCommandOutputDTO{}, nil
+}
+
+// postはコマンドで変換したメッセージを通常のメッセージとして投稿する
+func (usecase *CommandUsecase) post(ctx context.Context, dto ExecuteCommandInputDTO, text string) (ExecuteCommandOutputDTO, error) {
+	message, err := usecase.messageUsecase.PostMessage(ctx, PostMessageInputDTO{
+		UserId:          dto.UserId,
+		ChannelId:       dto.ChannelId,
+		Message:         text,
+		ParentMessageId: dto.ParentMessageId,
+		ClientMsgId:     dto.ClientMsgId,
+	})
+	if err != nil {
+		return ExecuteCommandOutputDTO{}, err
+	}
+	return ExecuteCommandOutputDTO{Message: &message}, nil
+}
+
+// topicはトピックが指定されていない場合は現在のトピックを返し、指定された場合はトピックを変更してサーバーのメンバーに知らせる
+func (usecase *CommandUsecase) topic(ctx context.Context, dto ExecuteCommandInputDTO, topic string) (ExecuteCommandOutputDTO, error) {
+	channel, err := usecase.channelRepo.GetChannel(ctx, dto.ChannelId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ExecuteCommandOutputDTO{}, errors.Wrap(ErrNotFound, err.Error())
+	}
+	if err != nil {
+		return ExecuteCommandOutputDTO{}, err
+	}
+	if topic == "" {
+		if channel.Topic == "" {
+			return ExecuteCommandOutputDTO{Ephemeral: "This channel has no topic."}, nil
+		}
+		return ExecuteCommandOutputDTO{Ephemeral: fmt.Sprintf("Topic: %s", channel.Topic)}, nil
+	}
+	if len([]rune(topic)) > maxTopicLength {
+		return ExecuteCommandOutputDTO{}, errors.Wrap(ErrInvalidArgument, fmt.Sprintf("topic must be at most %d characters", maxTopicLength))
+	}
+	err = usecase.channelRepo.UpdateTopic(ctx, dto.ChannelId, topic)
+	if err != nil {
+		return ExecuteCommandOutputDTO{}, err
+	}
+	channel.Topic = topic
+	usecase.hub.NotifyChannelTopicChanged(channel)
+	return ExecuteCommandOutputDTO{Ephemeral: fmt.Sprintf("Topic set to: %s", topic)}, nil
+}
+
+// remindは指定された時間の後にコマンドを実行したセッションにリマインドを送る
+// リマインドはこのプロセスのタイマーで送るので、サーバーが再起動したりセッションが切断された場合は送られない
+func (usecase *CommandUsecase) remind(dto ExecuteCommandInputDTO, args []string, argText string) (ExecuteCommandOutputDTO, error) {
+	if len(args) < 2 {
+		return ExecuteCommandOutputDTO{}, errors.Wrap(ErrInvalidArgument, "usage: /remind {duration} {text}")
+	}
+	delay, err := time.ParseDuration(args[0])
+	if err != nil {
+		return ExecuteCommandOutputDTO{}, errors.Wrap(ErrInvalidArgument, err.Error())
+	}
+	if delay <= 0 || delay > maxReminderDelay {
+		return ExecuteCommandOutputDTO{}, errors.Wrap(ErrInvalidArgument, fmt.Sprintf("duration must be between 0 and %s", maxReminderDelay))
+	}
+	text := strings.TrimSpace(strings.TrimPrefix(argText, args[0]))
+	reminder := EphemeralMessage{ServerId: dto.ServerId, ChannelId: dto.ChannelId, Message: fmt.Sprintf("Reminder: %s", text)}
+	time.AfterFunc(delay, func() {
+		usecase.hub.NotifyEphemeral(dto.UserId, dto.SessionId, reminder)
+	})
+	return ExecuteCommandOutputDTO{Ephemeral: fmt.Sprintf("I will remind you in %s.", delay)}, nil
+}
+
+type GetCommandsInputDTO struct {
+	UserId   string
+	ServerId uuid.UUID
+}
+
+// GetCommandsはサーバーで使えるコマンドを返す。サーバーのメンバーであれば取得できる
+func (usecase *CommandUsecase) GetCommands(ctx context.Context, dto GetCommandsInputDTO) ([]Command, error) {
+	exists, err := usecase.userServerRepo.ExistUserServer(ctx, dto.UserId, dto.ServerId)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.Wrap(ErrForbidden, fmt.Sprintf("user is not a member of server. user_id -> %s, server_id -> %s", dto.UserId, dto.ServerId))
+	}
+	commands, _, err := usecase.commandsForServer(ctx, dto.ServerId)
+	return commands, err
 }
 
-func (usecase *BotEndpointUsecase) RegisterBotEndpoint(dto RegisterBotEndpointInputDTO) error {
-	botEndpoint := entity.BotEndpoint{Name: dto.Name, IconURL: dto.IconURL, Endpoint: dto.Endpoint}
-	return usecase.repo.Insert(botEndpoint)
+// commandsForServerは組み込みのコマンドと、サーバーに追加されているbotのコマンドを返す
+// 同じ名前のコマンドが複数ある場合は、組み込みのコマンド、botの名前順で最初のコマンドだけを返す
+func (usecase *CommandUsecase) commandsForServer(ctx context.Context, serverId uuid.UUID) ([]Command, map[string]entity.BotEndpoint, error) {
+	installed, err := usecase.serverBotEndpointRepo.GetBotEndpointsByServerID(ctx, serverId)
+	if err != nil {
+		return nil, nil, err
+	}
+	botEndpoints := make(map[string]entity.BotEndpoint, len(installed))
+	botEndpointIds := make([]uuid.UUID, 0, len(installed))
+	for _, botEndpoint := range installed {
+		botEndpointId, err := uuid.Parse(botEndpoint.Id)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, fmt.Sprintf("cant parse botEndpointId. bot_endpoint_id -> %s", botEndpoint.Id))
+		}
+		botEndpoints[botEndpoint.Id] = botEndpoint
+		botEndpointIds = append(botEndpointIds, botEndpointId)
+	}
+	botCommands, err := usecase.botCommandRepo.GetBotCommandsByBotEndpointIDs(ctx, botEndpointIds)
+	if err != nil {
+		return nil, nil, err
+	}
+	commands := slices.Clone(builtinCommands)
+	//botは名前順に並んでいるので、botの順にコマンドを追加する
+	for _, botEndpoint := range installed {
+		for _, botCommand := range botCommands {
+			if botCommand.BotEndpointId.String() != botEndpoint.Id {
+				continue
+			}
+			if slices.ContainsFunc(commands, func(command Command) bool { return command.Name == botCommand.Name }) {
+				continue
+			}
+			commands = append(commands, Command{
+				Name:          botCommand.Name,
+				Description:   botCommand.Description,
+				Usage:         botCommand.Usage,
+				BotEndpointId: botEndpoint.Id,
+				BotName:       botEndpoint.Name,
+			})
+		}
+	}
+	return commands, botEndpoints, nil
 }
 
 func RegisterMessage() {
@@ -55,6 +1910,7 @@ type ServerUsecaseInterface interface {
 	GetServersByUserID(ctx context.Context, dto GetServersByUserIDInputDTO) ([]entity.Server, error)
 	CreateInvitationByJWT(dto CreateInvitationByJWTInputDTO) ([]byte, error)
 	AuthAndAddUser(ctx context.Context, dto AuthAndAddUserInputDTO) (*entity.Server, error)
+	SetMemberRole(ctx context.Context, dto SetMemberRoleInputDTO) error
 }
 
 type ServerUsecase struct {
@@ -63,10 +1919,12 @@ type ServerUsecase struct {
 	userServerRepo repository.UserServerRepositoryInterface
 	userRepo       repository.UserRepositoryInterface
 	txRepo         repository.TxRepositoryInterface
+	hub            HubInterface
+	botDispatcher  BotDispatcherInterface
 }
 
-func NewServerUsecase(serverRepo repository.ServerRepositoryInterface, channelRepo repository.ChannelRepositoryInterface, userServerRepo repository.UserServerRepositoryInterface, txRepo repository.TxRepositoryInterface, userRepo repository.UserRepositoryInterface) *ServerUsecase {
-	return &ServerUsecase{serverRepo: serverRepo, channelRepo: channelRepo, userServerRepo: userServerRepo, txRepo: txRepo, userRepo: userRepo}
+func NewServerUsecase(serverRepo repository.ServerRepositoryInterface, channelRepo repository.ChannelRepositoryInterface, userServerRepo repository.UserServerRepositoryInterface, txRepo repository.TxRepositoryInterface, userRepo repository.UserRepositoryInterface, hub HubInterface, botDispatcher BotDispatcherInterface) *ServerUsecase {
+	return &ServerUsecase{serverRepo: serverRepo, channelRepo: channelRepo, userServerRepo: userServerRepo, txRepo: txRepo, userRepo: userRepo, hub: hub, botDispatcher: botDispatcher}
 }
 
 type CreateInvitationByJWTInputDTO struct {
@@ -80,14 +1938,9 @@ func (usecase *ServerUsecase) CreateInvitationByJWT(dto CreateInvitationByJWTInp
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to build token")
 	}
-	//pemファイルを生成して
-	//perl -p -e 's/\n/\\n/' secret.pem
-	//で改行をエスケープして環境変数に設定しておく
-	key := os.Getenv("PRIVATE_PEM_KEY")
-	key = strings.Replace(key, "\\n", "\n", -1)
-	secKey, err := jwk.ParseKey([]byte(key), jwk.WithPEM(true))
+	secKey, err := parsePEMKeyFromEnv("PRIVATE_PEM_KEY")
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse key")
+		return nil, err
 	}
 	signed, err := jwt.Sign(token, jwt.WithKey(jwa.RS256, secKey))
 	if err != nil {
@@ -96,6 +1949,19 @@ func (usecase *ServerUsecase) CreateInvitationByJWT(dto CreateInvitationByJWTInp
 	return signed, nil
 }
 
+// pemファイルを生成して
+// perl -p -e 's/\n/\\n/' secret.pem
+// で改行をエスケープして環境変数に設定しておく
+func parsePEMKeyFromEnv(name string) (jwk.Key, error) {
+	key := os.Getenv(name)
+	key = strings.Replace(key, "\\n", "\n", -1)
+	parsed, err := jwk.ParseKey([]byte(key), jwk.WithPEM(true))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse key")
+	}
+	return parsed, nil
+}
+
 type AuthAndAddUserInputDTO struct {
 	Token  []byte
 	UserId string
@@ -109,14 +1975,9 @@ func (usecase *ServerUsecase) AuthAndAddUser(ctx context.Context, dto AuthAndAdd
 	// if err != nil {
 	// 	return nil, errors.Wrap(err, "failed to read key file")
 	// }
-	//pemファイルを生成して
-	//perl -p -e 's/\n/\\n/' secret.pem
-	//で改行をエスケープして環境変数に設定しておく
-	key := os.Getenv("PUBLIC_PEM_KEY")
-	key = strings.Replace(key, "\\n", "\n", -1)
-	pubKey, err := jwk.ParseKey([]byte(key), jwk.WithPEM(true))
+	pubKey, err := parsePEMKeyFromEnv("PUBLIC_PEM_KEY")
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse key")
+		return nil, err
 	}
 
 	//https://pkg.go.dev/github.com/lestrrat-go/jwx/v2@v2.0.19/jwt#Parse
@@ -172,6 +2033,12 @@ func (usecase *ServerUsecase) AuthAndAddUser(ctx context.Context, dto AuthAndAdd
 	if err != nil {
 		return nil, err
 	}
+	usecase.hub.JoinServer(dto.UserId, serverUUID)
+	user, err := usecase.userRepo.GetUser(ctx, dto.UserId)
+	if err != nil {
+		return nil, err
+	}
+	usecase.botDispatcher.DispatchMemberJoined(serverUUID, user)
 	server, err := usecase.serverRepo.GetServer(ctx, serverId)
 	if err != nil {
 		return nil, err
@@ -193,7 +2060,7 @@ func (usecase *ServerUsecase) RegisterServer(ctx context.Context, dto RegisterSe
 		if err != nil {
 			return err
 		}
-		userServer := entity.UserServer{UserId: dto.UserId, ServerId: serverId}
+		userServer := entity.UserServer{UserId: dto.UserId, ServerId: serverId, Role: entity.ServerRoleOwner}
 		err = usecase.userServerRepo.Insert(ctx, userServer)
 		if err != nil {
 			return err
@@ -210,10 +2077,49 @@ func (usecase *ServerUsecase) RegisterServer(ctx context.Context, dto RegisterSe
 	if err != nil {
 		return "", err
 	}
+	usecase.hub.JoinServer(dto.UserId, serverId)
 
 	return serverId.String(), nil
 }
 
+// UserIdはログインしているuser、MemberUserIdは役割を変更するメンバー
+type SetMemberRoleInputDTO struct {
+	UserId       string
+	ServerId     uuid.UUID
+	MemberUserId string
+	Role         string
+}
+
+// SetMemberRoleはサーバーのメンバーの役割をmoderatorかmemberに変更する。サーバーのownerのみ変更できる
+// サーバーからownerがいなくならないように、ownerの役割の変更やownerの譲渡はできない
+func (usecase *ServerUsecase) SetMemberRole(ctx context.Context, dto SetMemberRoleInputDTO) error {
+	if dto.Role != entity.ServerRoleModerator && dto.Role != entity.ServerRoleMember {
+		return errors.Wrap(ErrInvalidArgument, fmt.Sprintf("role must be %s or %s. role -> %s", entity.ServerRoleModerator, entity.ServerRoleMember, dto.Role))
+	}
+	err := authorizeServerOwner(ctx, usecase.userServerRepo, dto.UserId, dto.ServerId)
+	if err != nil {
+		return err
+	}
+	member, err := usecase.userServerRepo.GetUserServer(ctx, dto.MemberUserId, dto.ServerId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrap(ErrNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if member.Role == entity.ServerRoleOwner {
+		return errors.Wrap(ErrInvalidArgument, fmt.Sprintf("role of server owner cannot be changed. user_id -> %s, server_id -> %s", dto.MemberUserId, dto.ServerId))
+	}
+	updated, err := usecase.userServerRepo.UpdateRole(ctx, dto.MemberUserId, dto.ServerId, dto.Role)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return errors.Wrap(ErrNotFound, fmt.Sprintf("user is not a member of server. user_id -> %s, server_id -> %s", dto.MemberUserId, dto.ServerId))
+	}
+	return nil
+}
+
 type GetServersByUserIDInputDTO struct {
 	UserId string
 }
@@ -238,11 +2144,13 @@ type UserUsecaseInterface interface {
 }
 
 type UserUsecase struct {
-	userRepo repository.UserRepositoryInterface
+	userRepo       repository.UserRepositoryInterface
+	userServerRepo repository.UserServerRepositoryInterface
+	hub            HubInterface
 }
 
-func NewUserUsecase(userRepo repository.UserRepositoryInterface) *UserUsecase {
-	return &UserUsecase{userRepo: userRepo}
+func NewUserUsecase(userRepo repository.UserRepositoryInterface, userServerRepo repository.UserServerRepositoryInterface, hub HubInterface) *UserUsecase {
+	return &UserUsecase{userRepo: userRepo, userServerRepo: userServerRepo, hub: hub}
 }
 
 func (usecase *UserUsecase) UpsertUser(ctx context.Context, dto UpsertUserInputDTO) error {
@@ -251,20 +2159,155 @@ func (usecase *UserUsecase) UpsertUser(ctx context.Context, dto UpsertUserInputD
 	if err != nil {
 		return err
 	}
+	//userと同じサーバーに所属しているuserのメンバー一覧を更新するためにオンライン状態を知らせる
+	serverIds, err := usecase.userServerRepo.GetServerIDsByUserID(ctx, dto.Id)
+	if err != nil {
+		return err
+	}
+	usecase.hub.NotifyUserActivate(dto.Id, serverIds, dto.Active)
 	return nil
 }
 
+// websocketの接続時に使うトークンのaudience
+// サーバーの招待用のjwtをwebsocketの接続に使えないようにするために設定する
+const websocketTokenAudience = "websocket"
+
+type AuthUsecaseInterface interface {
+	Authenticate(identityToken string) (string, error)
+	CreateWebsocketToken(ctx context.Context, dto CreateWebsocketTokenInputDTO) ([]byte, error)
+	VerifyWebsocketToken(token []byte) (string, error)
+	VerifyBotToken(ctx context.Context, token string) (entity.BotEndpoint, uuid.UUID, error)
+}
+
+type AuthUsecase struct {
+	userRepo         repository.UserRepositoryInterface
+	botTokenRepo     repository.BotTokenRepositoryInterface
+	identityProvider IdentityProvider
+}
+
+func NewAuthUsecase(userRepo repository.UserRepositoryInterface, botTokenRepo repository.BotTokenRepositoryInterface, identityProvider IdentityProvider) *AuthUsecase {
+	return &AuthUsecase{userRepo: userRepo, botTokenRepo: botTokenRepo, identityProvider: identityProvider}
+}
+
+// IdentityProviderはフロントエンドのログインに使っているIdP(auth0)が発行したjwtを検証するための設定
+type IdentityProvider struct {
+	Issuer   string
+	Audience string
+	KeySet   jwk.Set
+}
+
+// NewIdentityProviderはIdPのドメインの/.well-known/jwks.jsonから署名の検証に使う公開鍵を取得する
+// 公開鍵はキャッシュして、IdPが鍵をローテーションした場合に備えて定期的に取得し直す
+func NewIdentityProvider(ctx context.Context, domain string, audience string) (IdentityProvider, error) {
+	if domain == "" || audience == "" {
+		return IdentityProvider{}, errors.New("domain and audience of identity provider are required")
+	}
+	issuer := fmt.Sprintf("https://%s/", domain)
+	jwksURL := issuer + ".well-known/jwks.json"
+	cache := jwk.NewCache(ctx)
+	err := cache.Register(jwksURL, jwk.WithMinRefreshInterval(time.Minute*15))
+	if err != nil {
+		return IdentityProvider{}, errors.Wrap(err, fmt.Sprintf("failed to register jwks url -> %s", jwksURL))
+	}
+	return IdentityProvider{Issuer: issuer, Audience: audience, KeySet: jwk.NewCachedSet(cache, jwksURL)}, nil
+}
+
+// verifyはIdPが発行したjwtの署名、issuer、audience、有効期限を検証して、ログインしているuserのIdを返す
+func (idp IdentityProvider) verify(token string) (string, error) {
+	if idp.KeySet == nil {
+		return "", errors.Wrap(ErrUnavailable, "identity provider is not configured. set AUTH0_DOMAIN and AUTH0_AUDIENCE")
+	}
+	payload, err := jwt.Parse([]byte(token), jwt.WithKeySet(idp.KeySet), jwt.WithIssuer(idp.Issuer), jwt.WithAudience(idp.Audience))
+	if err != nil {
+		return "", errors.Wrap(ErrUnauthorized, fmt.Sprintf("failed to verify identity provider token: %s", err.Error()))
+	}
+	if payload.Subject() == "" {
+		return "", errors.Wrap(ErrUnauthorized, "identity provider token has no subject")
+	}
+	return payload.Subject(), nil
+}
+
+// AuthenticateはIdPが発行したjwtを検証して、ログインしているuserのIdを返す
+// REST APIで権限を確認する場合は、リクエストで指定されたuser_idではなくこのIdを使う
+func (usecase *AuthUsecase) Authenticate(identityToken string) (string, error) {
+	return usecase.identityProvider.verify(identityToken)
+}
+
+type CreateWebsocketTokenInputDTO struct {
+	IdentityToken string
+}
+
+// CreateWebsocketTokenはwebsocketの接続時にuserを認証するための有効期限の短いjwtを発行する
+// トークンのsubjectにはIdPが発行したjwtのsubjectを使うので、ログインしているuserのトークンしか発行できない
+func (usecase *AuthUsecase) CreateWebsocketToken(ctx context.Context, dto CreateWebsocketTokenInputDTO) ([]byte, error) {
+	userId, err := usecase.identityProvider.verify(dto.IdentityToken)
+	if err != nil {
+		return nil, err
+	}
+	err = usecase.userRepo.CheckUserExist(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	token, err := jwt.NewBuilder().Subject(userId).Audience([]string{websocketTokenAudience}).IssuedAt(time.Now()).Expiration(time.Now().Add(time.Minute * 5)).Build()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build token")
+	}
+	secKey, err := parsePEMKeyFromEnv("PRIVATE_PEM_KEY")
+	if err != nil {
+		return nil, err
+	}
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.RS256, secKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign token")
+	}
+	return signed, nil
+}
+
+// VerifyWebsocketTokenはトークンの署名と有効期限を検証して、トークンが発行されたuserのIdを返す
+func (usecase *AuthUsecase) VerifyWebsocketToken(token []byte) (string, error) {
+	pubKey, err := parsePEMKeyFromEnv("PUBLIC_PEM_KEY")
+	if err != nil {
+		return "", err
+	}
+	payload, err := jwt.Parse(token, jwt.WithKey(jwa.RS256, pubKey), jwt.WithAudience(websocketTokenAudience))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to verify jwt")
+	}
+	if payload.Subject() == "" {
+		return "", errors.New("failed to get userId from jwt")
+	}
+	return payload.Subject(), nil
+}
+
+// VerifyBotTokenはbotのトークンを検証して、トークンが発行されたbotとトークンのIdを返す
+// 失効したトークンや削除されたbotのトークンは使えない
+func (usecase *AuthUsecase) VerifyBotToken(ctx context.Context, token string) (entity.BotEndpoint, uuid.UUID, error) {
+	if !strings.HasPrefix(token, BotTokenPrefix) {
+		return entity.BotEndpoint{}, uuid.Nil, errors.Wrap(ErrUnauthorized, "token is not a bot token")
+	}
+	botEndpoint, tokenId, err := usecase.botTokenRepo.GetBotEndpointByTokenHash(ctx, hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return entity.BotEndpoint{}, uuid.Nil, errors.Wrap(ErrUnauthorized, err.Error())
+	}
+	if err != nil {
+		return entity.BotEndpoint{}, uuid.Nil, err
+	}
+	return botEndpoint, tokenId, nil
+}
+
 type ChannelUsecaseInterface interface {
 	GetChannelsByServerID(ctx context.Context, dto GetChannelsByServerIDInputDTO) ([]entity.Channel, error)
 	RegisterChannel(ctx context.Context, dto RegisterChannelInputDTO) (string, error)
 }
 
 type ChannelUsecase struct {
-	channelRepo repository.ChannelRepositoryInterface
+	channelRepo   repository.ChannelRepositoryInterface
+	hub           HubInterface
+	botDispatcher BotDispatcherInterface
 }
 
-func NewChannelUsecase(channelRepo repository.ChannelRepositoryInterface) *ChannelUsecase {
-	return &ChannelUsecase{channelRepo: channelRepo}
+func NewChannelUsecase(channelRepo repository.ChannelRepositoryInterface, hub HubInterface, botDispatcher BotDispatcherInterface) *ChannelUsecase {
+	return &ChannelUsecase{channelRepo: channelRepo, hub: hub, botDispatcher: botDispatcher}
 }
 
 // UserId以外のIdを元にデータを取得する際は、entityのIdの型を参考にしてInputDTOのIdの型を決める
@@ -294,29 +2337,551 @@ func (usecase *ChannelUsecase) RegisterChannel(ctx context.Context, dto Register
 	if err != nil {
 		return "", err
 	}
+	channel.Id = &channelId
+	usecase.hub.NotifyChannelAdded(channel)
+	usecase.botDispatcher.DispatchChannelCreated(channel)
 	return channelId.String(), nil
 }
 
 type MessageUsecaseInterface interface {
-	GetMessagesByChannelID(ctx context.Context, dto GetMessagesByChannelIDInputDTO) ([]entity.MessageWithUser, error)
+	PostMessage(ctx context.Context, dto PostMessageInputDTO) (entity.MessageWithUser, error)
+	GetMessagesByChannelID(ctx context.Context, dto GetMessagesByChannelIDInputDTO) (GetMessagesByChannelIDOutputDTO, error)
+	GetThreadReplies(ctx context.Context, dto GetThreadRepliesInputDTO) ([]entity.MessageWithUser, *uuid.UUID, error)
+	EditMessage(ctx context.Context, dto EditMessageInputDTO) (entity.Message, error)
+	DeleteMessage(ctx context.Context, dto DeleteMessageInputDTO) (entity.Message, error)
 }
 
 type MessageUsecase struct {
+	messageRepo      repository.MessageRepositoryInterface
+	messageEditRepo  repository.MessageEditRepositoryInterface
+	channelRepo      repository.ChannelRepositoryInterface
+	userRepo         repository.UserRepositoryInterface
+	userServerRepo   repository.UserServerRepositoryInterface
+	userReactionRepo repository.UserReactionRepositoryInterface
+	txRepo           repository.TxRepositoryInterface
+	hub              HubInterface
+	botDispatcher    BotDispatcherInterface
+	poster           *messagePoster
+}
+
+func NewMessageUsecase(messageRepo repository.MessageRepositoryInterface, messageEditRepo repository.MessageEditRepositoryInterface, channelRepo repository.ChannelRepositoryInterface, userRepo repository.UserRepositoryInterface, userServerRepo repository.UserServerRepositoryInterface, userReactionRepo repository.UserReactionRepositoryInterface, txRepo repository.TxRepositoryInterface, hub HubInterface, botDispatcher BotDispatcherInterface) *MessageUsecase {
+	return &MessageUsecase{messageRepo: messageRepo, messageEditRepo: messageEditRepo, channelRepo: channelRepo, userRepo: userRepo, userServerRepo: userServerRepo, userReactionRepo: userReactionRepo, txRepo: txRepo, hub: hub, botDispatcher: botDispatcher, poster: newMessagePoster(messageRepo, channelRepo, txRepo, hub)}
+}
+
+// ParentMessageIdはスレッドに返信する場合にのみ設定する
+// ClientMsgIdが設定されている場合は、同じClientMsgIdで再送されたメッセージを重複して保存しない
+type PostMessageInputDTO struct {
+	UserId          string
+	ChannelId       uuid.UUID
+	Message         string
+	ParentMessageId *uuid.UUID
+	ClientMsgId     *string
+}
+
+// PostMessageはメッセージを保存して、チャンネルのサーバーのメンバーに送る
+// スレッドの返信の場合はスレッドに参加しているuserにのみ送る
+// userがチャンネルのサーバーに所属しているかどうかは呼び出し側で確認する
+func (usecase *MessageUsecase) PostMessage(ctx context.Context, dto PostMessageInputDTO) (entity.MessageWithUser, error) {
+	channel, err := usecase.channelRepo.GetChannel(ctx, dto.ChannelId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entity.MessageWithUser{}, errors.Wrap(ErrNotFound, err.Error())
+	}
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	if dto.ParentMessageId != nil {
+		err = usecase.poster.validateParentMessage(ctx, *dto.ParentMessageId, dto.ChannelId)
+		if err != nil {
+			return entity.MessageWithUser{}, err
+		}
+	}
+	user, err := usecase.userRepo.GetUser(ctx, dto.UserId)
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	message := entity.Message{
+		UserId:          user.Id,
+		ChannelId:       dto.ChannelId,
+		IsBot:           false,
+		Message:         dto.Message,
+		BotEndpointId:   nil,
+		ParentMessageId: dto.ParentMessageId,
+		ClientMsgId:     dto.ClientMsgId,
+	}
+	//botへの配信はメッセージと同じトランザクションでキューに追加する
+	stored, created, err := usecase.poster.store(ctx, message, func(ctx context.Context, stored entity.Message) error {
+		return usecase.botDispatcher.EnqueueMessageCreated(ctx, channel.ServerId, entity.MessageWithUser{Message: stored, UserName: user.Name, IconURL: user.IconImageURL})
+	})
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	//再送されたメッセージは既に送信済みなので、保存済みのメッセージを返して再度broadcastはしない
+	if !created {
+		if stored.ChannelId != dto.ChannelId {
+			return entity.MessageWithUser{}, errors.Wrap(ErrInvalidArgument, fmt.Sprintf("client_msg_id is already used in another channel. client_msg_id -> %s", *dto.ClientMsgId))
+		}
+		return entity.MessageWithUser{Message: stored, UserName: user.Name, IconURL: user.IconImageURL}, nil
+	}
+	//botのエンドポイントへの送信は非同期で行うので、botの応答を待たずに返す
+	usecase.botDispatcher.WakeDeliveryWorkers()
+	messageWithUser := entity.MessageWithUser{Message: stored, UserName: user.Name, IconURL: user.IconImageURL}
+	err = usecase.poster.notify(ctx, channel.ServerId, messageWithUser)
+	if err != nil {
+		return entity.MessageWithUser{}, err
+	}
+	return messageWithUser, nil
+}
+
+// messagePosterはuserとbotのどちらのメッセージでも共通の、メッセージの保存と通知を行う
+type messagePoster struct {
 	messageRepo repository.MessageRepositoryInterface
+	channelRepo repository.ChannelRepositoryInterface
+	txRepo      repository.TxRepositoryInterface
+	hub         HubInterface
+}
+
+func newMessagePoster(messageRepo repository.MessageRepositoryInterface, channelRepo repository.ChannelRepositoryInterface, txRepo repository.TxRepositoryInterface, hub HubInterface) *messagePoster {
+	return &messagePoster{messageRepo: messageRepo, channelRepo: channelRepo, txRepo: txRepo, hub: hub}
+}
+
+// notifyはメッセージをチャンネルのサーバーのメンバーに送る
+// スレッドの返信の場合はスレッドに参加しているuserにのみ送る
+func (poster *messagePoster) notify(ctx context.Context, serverId uuid.UUID, message entity.MessageWithUser) error {
+	if message.ParentMessageId == nil {
+		poster.hub.NotifyMessagePosted(serverId, message)
+		return nil
+	}
+	participantIds, err := poster.messageRepo.GetThreadParticipantIDs(ctx, *message.ParentMessageId)
+	if err != nil {
+		return err
+	}
+	poster.hub.NotifyThreadReplied(serverId, message, participantIds)
+	return nil
+}
+
+// errDuplicateMessageはClientMsgIdが同じメッセージが既に保存されていた場合に、採番したSeqを戻すためにトランザクションをロールバックする
+var errDuplicateMessage = errors.New("duplicate message")
+
+// storeはメッセージにSeqを採番して保存する
+// ClientMsgIdが同じメッセージが既に保存されている場合は保存せずに既存のメッセージとfalseを返す
+// その場合は採番したSeqをロールバックするので、Seqに欠番はできない
+// onStoredはメッセージを保存した同じトランザクションの中で呼び出すので、エラーを返すとメッセージも保存されない
+func (poster *messagePoster) store(ctx context.Context, message entity.Message, onStored func(ctx context.Context, stored entity.Message) error) (entity.Message, bool, error) {
+	var stored entity.Message
+	err := poster.txRepo.DoInTx(ctx, func(ctx context.Context) error {
+		if message.ParentMessageId == nil {
+			seq, err := poster.channelRepo.NextSeq(ctx, message.ChannelId)
+			if err != nil {
+				return err
+			}
+			message.Seq = &seq
+		}
+		if message.ClientMsgId == nil {
+			createdAt, messageId, err := poster.messageRepo.Insert(ctx, message)
+			if err != nil {
+				return err
+			}
+			message.Id = &messageId
+			message.CreatedAt = createdAt
+			stored = message
+		} else {
+			var created bool
+			var err error
+			stored, created, err = poster.messageRepo.InsertOrGetByClientMsgID(ctx, message)
+			if err != nil {
+				return err
+			}
+			if !created {
+				return errDuplicateMessage
+			}
+		}
+		if onStored == nil {
+			return nil
+		}
+		return onStored(ctx, stored)
+	})
+	if errors.Is(err, errDuplicateMessage) {
+		return stored, false, nil
+	}
+	if err != nil {
+		return entity.Message{}, false, err
+	}
+	return stored, true, nil
 }
 
-func NewMessageUsecase(messageRepo repository.MessageRepositoryInterface) *MessageUsecase {
-	return &MessageUsecase{messageRepo: messageRepo}
+// validateParentMessageは返信先のメッセージが同じチャンネルの削除されていないメッセージで、
+// それ自体がスレッドの返信ではないことを確認する
+func (poster *messagePoster) validateParentMessage(ctx context.Context, parentMessageId uuid.UUID, channelId uuid.UUID) error {
+	parent, err := poster.messageRepo.GetMessage(ctx, parentMessageId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrap(ErrNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if parent.DeletedAt != nil {
+		return errors.Wrap(ErrNotFound, fmt.Sprintf("parent message is deleted. parent_message_id -> %s", parentMessageId))
+	}
+	if parent.ChannelId != channelId {
+		return errors.Wrap(ErrInvalidArgument, fmt.Sprintf("parent message is in another channel. parent_message_id -> %s, channel_id -> %s", parentMessageId, channelId))
+	}
+	//スレッドの返信にさらに返信することはできない
+	if parent.ParentMessageId != nil {
+		return errors.Wrap(ErrInvalidArgument, fmt.Sprintf("parent message is a thread reply. parent_message_id -> %s", parentMessageId))
+	}
+	return nil
 }
 
+// UserIdはリアクションの集計で、そのuserがリアクションしているかどうかを判定するために使う
+// Before、After、Aroundにはメッセージのseqを指定し、最大1つだけ指定できる。どれも指定しない場合は最新のメッセージを取得する
+// FromSeqとToSeqは取得するメッセージのSeqの範囲で、どちらも省略でき、Before、After、Aroundとは併用できない
 type GetMessagesByChannelIDInputDTO struct {
 	ChannelId uuid.UUID
+	UserId    string
+	Before    *int64
+	After     *int64
+	Around    *int64
+	FromSeq   *int64
+	ToSeq     *int64
+	Limit     int
+}
+
+// Messagesは古い順に並んでいる
+// PrevCursorはより古いメッセージがある場合にBeforeに、NextCursorはより新しいメッセージがある場合にAfterに指定するseq
+type GetMessagesByChannelIDOutputDTO struct {
+	Messages   []entity.MessageWithUser
+	PrevCursor *int64
+	NextCursor *int64
 }
 
-func (usecase *MessageUsecase) GetMessagesByChannelID(ctx context.Context, dto GetMessagesByChannelIDInputDTO) ([]entity.MessageWithUser, error) {
-	messages, err := usecase.messageRepo.GetMessagesWithUser(ctx, dto.ChannelId)
+// GetMessagesByChannelIDはチャンネルのメッセージをseqの順に最大Limit件取得する
+func (usecase *MessageUsecase) GetMessagesByChannelID(ctx context.Context, dto GetMessagesByChannelIDInputDTO) (GetMessagesByChannelIDOutputDTO, error) {
+	channel, err := usecase.channelRepo.GetChannel(ctx, dto.ChannelId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return GetMessagesByChannelIDOutputDTO{}, errors.Wrap(ErrNotFound, err.Error())
+	}
 	if err != nil {
-		return nil, err
+		return GetMessagesByChannelIDOutputDTO{}, err
+	}
+	var messages []entity.MessageWithUser
+	if dto.Around != nil {
+		//Aroundのメッセージより前を半分、Aroundのメッセージ以降を残りの件数取得する
+		//limitが0の場合はbunがLIMITを付けずに全件取得してしまうので、limitが1の場合は前のメッセージを取得しない
+		var older []entity.MessageWithUser
+		if dto.Limit/2 > 0 {
+			older, err = usecase.messageRepo.GetMessagesWithUser(ctx, dto.ChannelId, nil, dto.Around, dto.Limit/2, true)
+			if err != nil {
+				return GetMessagesByChannelIDOutputDTO{}, err
+			}
+		}
+		after := *dto.Around - 1
+		newer, err := usecase.messageRepo.GetMessagesWithUser(ctx, dto.ChannelId, &after, nil, dto.Limit-dto.Limit/2, false)
+		if err != nil {
+			return GetMessagesByChannelIDOutputDTO{}, err
+		}
+		slices.Reverse(older)
+		messages = append(older, newer...)
+	} else {
+		var afterSeq, beforeSeq *int64
+		newestFirst := true
+		switch {
+		case dto.After != nil:
+			afterSeq = dto.After
+			newestFirst = false
+		case dto.Before != nil:
+			beforeSeq = dto.Before
+		case dto.FromSeq != nil || dto.ToSeq != nil:
+			if dto.FromSeq != nil {
+				from := *dto.FromSeq - 1
+				afterSeq = &from
+				newestFirst = false
+			}
+			if dto.ToSeq != nil {
+				to := *dto.ToSeq + 1
+				beforeSeq = &to
+			}
+		}
+		messages, err = usecase.messageRepo.GetMessagesWithUser(ctx, dto.ChannelId, afterSeq, beforeSeq, dto.Limit, newestFirst)
+		if err != nil {
+			return GetMessagesByChannelIDOutputDTO{}, err
+		}
+		if newestFirst {
+			slices.Reverse(messages)
+		}
+	}
+	err = usecase.attachReactions(ctx, messages, dto.UserId)
+	if err != nil {
+		return GetMessagesByChannelIDOutputDTO{}, err
+	}
+	output := GetMessagesByChannelIDOutputDTO{Messages: messages}
+	if len(messages) == 0 {
+		return output, nil
+	}
+	//スレッドの返信ではないメッセージのseqは1からLastSeqまで連番になっているので、端のseqから前後のメッセージがあるかどうかが分かる
+	if first := messages[0].Seq; first != nil && *first > 1 {
+		output.PrevCursor = first
+	}
+	if last := messages[len(messages)-1].Seq; last != nil && *last < channel.LastSeq {
+		output.NextCursor = last
+	}
+	return output, nil
+}
+
+type GetThreadRepliesInputDTO struct {
+	ParentMessageId uuid.UUID
+	UserId          string
+	//Afterが設定されている場合はAfterの返信より後の返信を取得する
+	After *uuid.UUID
+	Limit int
+}
+
+// GetThreadRepliesはスレッドの返信を古い順に取得する
+// 続きの返信がある場合は、次のページを取得するためのカーソルとして最後の返信のIdを返す
+func (usecase *MessageUsecase) GetThreadReplies(ctx context.Context, dto GetThreadRepliesInputDTO) ([]entity.MessageWithUser, *uuid.UUID, error) {
+	parent, err := usecase.messageRepo.GetMessage(ctx, dto.ParentMessageId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, errors.Wrap(ErrNotFound, err.Error())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if parent.ParentMessageId != nil {
+		return nil, nil, errors.Wrap(ErrInvalidArgument, fmt.Sprintf("message is a thread reply. message_id -> %s", dto.ParentMessageId))
+	}
+	//続きがあるかどうかを判定するために1件多く取得する
+	replies, err := usecase.messageRepo.GetThreadRepliesWithUser(ctx, dto.ParentMessageId, dto.After, dto.Limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	var nextCursor *uuid.UUID
+	if len(replies) > dto.Limit {
+		replies = replies[:dto.Limit]
+		nextCursor = replies[len(replies)-1].Id
+	}
+	err = usecase.attachReactions(ctx, replies, dto.UserId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return replies, nextCursor, nil
+}
+
+// attachReactionsはメッセージに絵文字ごとに集計したリアクションを設定する
+func (usecase *MessageUsecase) attachReactions(ctx context.Context, messages []entity.MessageWithUser, userId string) error {
+	messageIds := make([]uuid.UUID, len(messages))
+	for i, message := range messages {
+		messageIds[i] = *message.Id
+	}
+	counts, err := usecase.userReactionRepo.GetReactionCounts(ctx, messageIds, userId)
+	if err != nil {
+		return err
+	}
+	reactions := make(map[uuid.UUID][]entity.ReactionCount)
+	for _, count := range counts {
+		reactions[count.MessageId] = append(reactions[count.MessageId], count)
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[*messages[i].Id]
+	}
+	return nil
+}
+
+type EditMessageInputDTO struct {
+	MessageId uuid.UUID
+	UserId    string
+	Message   string
+}
+
+// EditMessageはメッセージの本文を更新して、編集前の本文を編集履歴に保存する
+// メッセージを編集できるのはメッセージを送信したuserのみ
+func (usecase *MessageUsecase) EditMessage(ctx context.Context, dto EditMessageInputDTO) (entity.Message, error) {
+	var message entity.Message
+	err := usecase.txRepo.DoInTx(ctx, func(ctx context.Context) error {
+		var err error
+		message, err = usecase.messageRepo.GetMessageForUpdate(ctx, dto.MessageId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.Wrap(ErrNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		if message.DeletedAt != nil {
+			return errors.Wrap(ErrNotFound, fmt.Sprintf("message is deleted. message_id -> %s", dto.MessageId))
+		}
+		if message.IsBot || message.UserId != dto.UserId {
+			return errors.Wrap(ErrForbidden, fmt.Sprintf("only the author can edit the message. message_id -> %s, user_id -> %s", dto.MessageId, dto.UserId))
+		}
+		editedAt := time.Now()
+		messageEdit := entity.MessageEdit{MessageId: *message.Id, Message: message.Message, EditedAt: editedAt}
+		err = usecase.messageEditRepo.Insert(ctx, messageEdit)
+		if err != nil {
+			return err
+		}
+		message.Message = dto.Message
+		message.EditedAt = &editedAt
+		return usecase.messageRepo.UpdateMessage(ctx, message)
+	})
+	if err != nil {
+		return entity.Message{}, err
+	}
+	channel, err := usecase.channelRepo.GetChannel(ctx, message.ChannelId)
+	if err != nil {
+		return entity.Message{}, err
+	}
+	usecase.hub.NotifyMessageEdited(channel.ServerId, message)
+	usecase.botDispatcher.DispatchMessageEdited(channel.ServerId, message)
+	return message, nil
+}
+
+type DeleteMessageInputDTO struct {
+	MessageId uuid.UUID
+	UserId    string
+}
+
+// DeleteMessageはメッセージを論理削除する
+// 自分のメッセージはメッセージを送信したuserが、他のuserやbotのメッセージはサーバーのownerとmoderatorが削除できる
+func (usecase *MessageUsecase) DeleteMessage(ctx context.Context, dto DeleteMessageInputDTO) (entity.Message, error) {
+	var message entity.Message
+	var channel entity.Channel
+	var alreadyDeleted bool
+	err := usecase.txRepo.DoInTx(ctx, func(ctx context.Context) error {
+		var err error
+		message, err = usecase.messageRepo.GetMessageForUpdate(ctx, dto.MessageId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.Wrap(ErrNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		channel, err = usecase.channelRepo.GetChannel(ctx, message.ChannelId)
+		if err != nil {
+			return err
+		}
+		if message.IsBot || message.UserId != dto.UserId {
+			userServer, err := usecase.userServerRepo.GetUserServer(ctx, dto.UserId, channel.ServerId)
+			//サーバーに所属していないuserは削除できない
+			if errors.Is(err, sql.ErrNoRows) {
+				return errors.Wrap(ErrForbidden, err.Error())
+			}
+			if err != nil {
+				return err
+			}
+			if userServer.Role != entity.ServerRoleOwner && userServer.Role != entity.ServerRoleModerator {
+				return errors.Wrap(ErrForbidden, fmt.Sprintf("only the author or a moderator can delete the message. message_id -> %s, user_id -> %s", dto.MessageId, dto.UserId))
+			}
+		}
+		//削除済みのメッセージを再度削除しようとした場合は何もしない
+		if message.DeletedAt != nil {
+			alreadyDeleted = true
+			return nil
+		}
+		deletedAt := time.Now()
+		message.Message = ""
+		message.DeletedAt = &deletedAt
+		err = usecase.messageRepo.SoftDeleteMessage(ctx, message)
+		if err != nil {
+			return err
+		}
+		//編集履歴にも削除前の本文が残っているので削除する
+		return usecase.messageEditRepo.DeleteByMessageID(ctx, *message.Id)
+	})
+	if err != nil {
+		return entity.Message{}, err
+	}
+	if !alreadyDeleted {
+		usecase.hub.NotifyMessageDeleted(channel.ServerId, message)
+		usecase.botDispatcher.DispatchMessageDeleted(channel.ServerId, message)
+	}
+	return message, nil
+}
+
+type ReactionUsecaseInterface interface {
+	AddReaction(ctx context.Context, dto ReactionInputDTO) error
+	RemoveReaction(ctx context.Context, dto ReactionInputDTO) error
+}
+
+type ReactionUsecase struct {
+	messageRepo      repository.MessageRepositoryInterface
+	channelRepo      repository.ChannelRepositoryInterface
+	userServerRepo   repository.UserServerRepositoryInterface
+	reactionTypeRepo repository.ReactionTypeRepositoryInterface
+	userReactionRepo repository.UserReactionRepositoryInterface
+	hub              HubInterface
+	botDispatcher    BotDispatcherInterface
+}
+
+func NewReactionUsecase(messageRepo repository.MessageRepositoryInterface, channelRepo repository.ChannelRepositoryInterface, userServerRepo repository.UserServerRepositoryInterface, reactionTypeRepo repository.ReactionTypeRepositoryInterface, userReactionRepo repository.UserReactionRepositoryInterface, hub HubInterface, botDispatcher BotDispatcherInterface) *ReactionUsecase {
+	return &ReactionUsecase{messageRepo: messageRepo, channelRepo: channelRepo, userServerRepo: userServerRepo, reactionTypeRepo: reactionTypeRepo, userReactionRepo: userReactionRepo, hub: hub, botDispatcher: botDispatcher}
+}
+
+type ReactionInputDTO struct {
+	MessageId uuid.UUID
+	UserId    string
+	Emoji     string
+}
+
+// AddReactionはメッセージにリアクションを追加する
+// 既に同じリアクションをしている場合は何もしないので、何度呼び出しても結果は同じになる
+func (usecase *ReactionUsecase) AddReaction(ctx context.Context, dto ReactionInputDTO) error {
+	message, channel, err := usecase.getReactableMessage(ctx, dto.MessageId, dto.UserId)
+	if err != nil {
+		return err
+	}
+	reactionType, err := usecase.reactionTypeRepo.Upsert(ctx, dto.Emoji)
+	if err != nil {
+		return err
+	}
+	userReaction := entity.UserReaction{MessageId: message.Id.String(), UserId: dto.UserId, ReactionTypeId: reactionType.Id}
+	added, err := usecase.userReactionRepo.Insert(ctx, userReaction)
+	if err != nil {
+		return err
+	}
+	if added {
+		usecase.hub.NotifyReactionAdded(channel.ServerId, message, dto.UserId, dto.Emoji)
+		usecase.botDispatcher.DispatchReactionAdded(channel.ServerId, message, dto.UserId, dto.Emoji)
+	}
+	return nil
+}
+
+// RemoveReactionはメッセージからリアクションを削除する
+// リアクションしていない場合は何もしないので、何度呼び出しても結果は同じになる
+func (usecase *ReactionUsecase) RemoveReaction(ctx context.Context, dto ReactionInputDTO) error {
+	message, channel, err := usecase.getReactableMessage(ctx, dto.MessageId, dto.UserId)
+	if err != nil {
+		return err
+	}
+	removed, err := usecase.userReactionRepo.Delete(ctx, *message.Id, dto.UserId, dto.Emoji)
+	if err != nil {
+		return err
+	}
+	if removed {
+		usecase.hub.NotifyReactionRemoved(channel.ServerId, message, dto.UserId, dto.Emoji)
+	}
+	return nil
+}
+
+// getReactableMessageはリアクションの対象のメッセージが削除されておらず、
+// userがメッセージのチャンネルのサーバーに所属していることを確認する
+func (usecase *ReactionUsecase) getReactableMessage(ctx context.Context, messageId uuid.UUID, userId string) (entity.Message, entity.Channel, error) {
+	message, err := usecase.messageRepo.GetMessage(ctx, messageId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entity.Message{}, entity.Channel{}, errors.Wrap(ErrNotFound, err.Error())
+	}
+	if err != nil {
+		return entity.Message{}, entity.Channel{}, err
+	}
+	if message.DeletedAt != nil {
+		return entity.Message{}, entity.Channel{}, errors.Wrap(ErrNotFound, fmt.Sprintf("message is deleted. message_id -> %s", messageId))
+	}
+	channel, err := usecase.channelRepo.GetChannel(ctx, message.ChannelId)
+	if err != nil {
+		return entity.Message{}, entity.Channel{}, err
+	}
+	exists, err := usecase.userServerRepo.ExistUserServer(ctx, userId, channel.ServerId)
+	if err != nil {
+		return entity.Message{}, entity.Channel{}, err
+	}
+	if !exists {
+		return entity.Message{}, entity.Channel{}, errors.Wrap(ErrForbidden, fmt.Sprintf("user is not a member of the server. user_id -> %s, server_id -> %s", userId, channel.ServerId))
 	}
-	return messages, nil
+	return message, channel, nil
 }
@@ -0,0 +1,690 @@
+package usecase
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/uuid"
+
+	"github.com/hebitigo/CATechAccelChatApp/entity"
+	"github.com/hebitigo/CATechAccelChatApp/repository"
+	"github.com/hebitigo/CATechAccelChatApp/webhook"
+)
+
+// テストで使うrepositoryとHubのfake
+// インターフェースを埋め込んでいるので、テストで使わないメソッドを呼び出すとpanicする
+
+type fakeBotEndpointRepo struct {
+	repository.BotEndpointRespositoryInterface
+	botEndpoint entity.BotEndpoint
+}
+
+func (repo *fakeBotEndpointRepo) GetBotEndpoint(ctx context.Context, botEndpointId string) (entity.BotEndpoint, error) {
+	return repo.botEndpoint, nil
+}
+
+// RotateSigningSecretはBotEndpointRepositoryと同じように、currentSecretが現在の秘密鍵の場合のみ置き換える
+func (repo *fakeBotEndpointRepo) RotateSigningSecret(ctx context.Context, botEndpointId string, currentSecret string, newSecret string, previousExpiresAt time.Time) (bool, error) {
+	if repo.botEndpoint.SigningSecret != currentSecret {
+		return false, nil
+	}
+	repo.botEndpoint.PreviousSigningSecret = &currentSecret
+	repo.botEndpoint.PreviousSigningSecretExpiresAt = &previousExpiresAt
+	repo.botEndpoint.SigningSecret = newSecret
+	return true, nil
+}
+
+type markFailedCall struct {
+	deliveryId    uuid.UUID
+	nextAttemptAt time.Time
+	dead          bool
+}
+
+type fakeBotDeliveryRepo struct {
+	repository.BotDeliveryRepositoryInterface
+	deleted []uuid.UUID
+	failed  []markFailedCall
+}
+
+func (repo *fakeBotDeliveryRepo) Delete(ctx context.Context, deliveryId uuid.UUID) error {
+	repo.deleted = append(repo.deleted, deliveryId)
+	return nil
+}
+
+func (repo *fakeBotDeliveryRepo) MarkFailed(ctx context.Context, deliveryId uuid.UUID, lastError string, nextAttemptAt time.Time, dead bool) error {
+	repo.failed = append(repo.failed, markFailedCall{deliveryId: deliveryId, nextAttemptAt: nextAttemptAt, dead: dead})
+	return nil
+}
+
+type fakeChannelRepo struct {
+	repository.ChannelRepositoryInterface
+	channel entity.Channel
+}
+
+func (repo *fakeChannelRepo) GetChannel(ctx context.Context, channelId uuid.UUID) (entity.Channel, error) {
+	return repo.channel, nil
+}
+
+func (repo *fakeChannelRepo) NextSeq(ctx context.Context, channelId uuid.UUID) (int64, error) {
+	repo.channel.LastSeq++
+	return repo.channel.LastSeq, nil
+}
+
+// fakeMessageRepoはチャンネルのseqが1からlen(messages)までのメッセージを保存している
+type fakeMessageRepo struct {
+	repository.MessageRepositoryInterface
+	messages []entity.MessageWithUser
+	inserted []entity.Message
+}
+
+func (repo *fakeMessageRepo) Insert(ctx context.Context, message entity.Message) (time.Time, uuid.UUID, error) {
+	repo.inserted = append(repo.inserted, message)
+	return time.Now(), uuid.New(), nil
+}
+
+// GetMessagesWithUserはMessageRepositoryと同じ条件でメッセージを返す
+// limitが0の場合はbunと同じようにLIMITを付けずに全て返す
+func (repo *fakeMessageRepo) GetMessagesWithUser(ctx context.Context, channelId uuid.UUID, afterSeq *int64, beforeSeq *int64, limit int, newestFirst bool) ([]entity.MessageWithUser, error) {
+	matched := []entity.MessageWithUser{}
+	for _, message := range repo.messages {
+		if afterSeq != nil && *message.Seq <= *afterSeq {
+			continue
+		}
+		if beforeSeq != nil && *message.Seq >= *beforeSeq {
+			continue
+		}
+		matched = append(matched, message)
+	}
+	if newestFirst {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
+		}
+	}
+	if limit > 0 && len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return matched, nil
+}
+
+type fakeUserReactionRepo struct {
+	repository.UserReactionRepositoryInterface
+}
+
+func (repo *fakeUserReactionRepo) GetReactionCounts(ctx context.Context, messageIds []uuid.UUID, userId string) ([]entity.ReactionCount, error) {
+	return nil, nil
+}
+
+type fakeTxRepo struct{}
+
+func (repo *fakeTxRepo) DoInTx(ctx context.Context, f func(ctx context.Context) error) error {
+	return f(ctx)
+}
+
+type fakeHub struct {
+	HubInterface
+	posted []entity.MessageWithUser
+}
+
+func (hub *fakeHub) NotifyMessagePosted(serverId uuid.UUID, message entity.MessageWithUser) {
+	hub.posted = append(hub.posted, message)
+}
+
+// setPrivateKeyはcallback_tokenの署名に使う秘密鍵を設定する
+func setPrivateKey(t *testing.T) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	t.Setenv("PRIVATE_PEM_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+}
+
+type deliverTest struct {
+	usecase      *BotEventUsecase
+	deliveryRepo *fakeBotDeliveryRepo
+	messageRepo  *fakeMessageRepo
+	hub          *fakeHub
+	botEndpoint  entity.BotEndpoint
+	delivery     entity.BotDelivery
+	received     chan *http.Request
+}
+
+// newDeliverTestはstatusとresponseBodyを返すbotへの配信を用意する
+func newDeliverTest(t *testing.T, status int, responseBody string) *deliverTest {
+	t.Helper()
+	setPrivateKey(t)
+	received := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+		received <- r
+		w.WriteHeader(status)
+		io.WriteString(w, responseBody)
+	}))
+	t.Cleanup(server.Close)
+
+	serverId := uuid.New()
+	channelId := uuid.New()
+	botEndpoint := entity.BotEndpoint{
+		Id:            uuid.NewString(),
+		Endpoint:      server.URL,
+		Name:          "echo",
+		Verified:      true,
+		SigningSecret: "secret",
+	}
+	payload, err := json.Marshal(BotEvent{Version: BotEventVersion, EventId: uuid.New(), Type: botEventMessageCreated, ServerId: serverId, ChannelId: &channelId})
+	if err != nil {
+		t.Fatalf("failed to marshal event: %v", err)
+	}
+	deliveryId := uuid.New()
+	test := &deliverTest{
+		deliveryRepo: &fakeBotDeliveryRepo{},
+		messageRepo:  &fakeMessageRepo{},
+		hub:          &fakeHub{},
+		botEndpoint:  botEndpoint,
+		delivery: entity.BotDelivery{
+			Id:            &deliveryId,
+			BotEndpointId: uuid.MustParse(botEndpoint.Id),
+			ServerId:      serverId,
+			ChannelId:     &channelId,
+			EventType:     botEventMessageCreated,
+			Payload:       payload,
+			Attempts:      1,
+		},
+		received: received,
+	}
+	channelRepo := &fakeChannelRepo{channel: entity.Channel{Id: &channelId, ServerId: serverId}}
+	test.usecase = NewBotEventUsecase(&fakeBotEndpointRepo{botEndpoint: botEndpoint}, nil, test.deliveryRepo, nil, test.messageRepo, channelRepo, &fakeTxRepo{}, test.hub, webhook.NewClient(5*time.Second, true))
+	return test
+}
+
+func TestDeliverPostsBotResponse(t *testing.T) {
+	test := newDeliverTest(t, http.StatusOK, `{"message":"pong"}`)
+
+	test.usecase.deliver(context.Background(), test.delivery)
+
+	request := <-test.received
+	body, _ := io.ReadAll(request.Body)
+	var event BotEvent
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		t.Fatalf("bot received invalid event: %v", err)
+	}
+	if event.CallbackToken == "" {
+		t.Errorf("event must have callback_token when it has a channel")
+	}
+	timestamp, _ := strconv.ParseInt(request.Header.Get(webhook.TimestampHeader), 10, 64)
+	if request.Header.Get(webhook.SignatureHeader) != webhook.Sign("secret", timestamp, body) {
+		t.Errorf("signature does not match the signing secret")
+	}
+	if len(test.deliveryRepo.deleted) != 1 || test.deliveryRepo.deleted[0] != *test.delivery.Id {
+		t.Errorf("delivered delivery must be deleted. deleted -> %v", test.deliveryRepo.deleted)
+	}
+	if len(test.deliveryRepo.failed) != 0 {
+		t.Errorf("delivered delivery must not be marked as failed")
+	}
+	if len(test.messageRepo.inserted) != 1 {
+		t.Fatalf("bot response must be stored. inserted -> %d", len(test.messageRepo.inserted))
+	}
+	stored := test.messageRepo.inserted[0]
+	if !stored.IsBot || stored.Message != "pong" || stored.BotEndpointId == nil || stored.BotEndpointId.String() != test.botEndpoint.Id {
+		t.Errorf("stored message = %+v", stored)
+	}
+	if stored.ChannelId != *test.delivery.ChannelId || stored.Seq == nil || *stored.Seq != 1 {
+		t.Errorf("bot response must be posted to the channel of the event with the next seq. message -> %+v", stored)
+	}
+	if len(test.hub.posted) != 1 || test.hub.posted[0].UserName != "echo" {
+		t.Errorf("bot response must be broadcast. posted -> %+v", test.hub.posted)
+	}
+}
+
+// 秘密鍵のローテーション中は古い秘密鍵の署名も送る
+func TestDeliverSignsWithPreviousSecretDuringRotation(t *testing.T) {
+	test := newDeliverTest(t, http.StatusOK, "")
+	previous := "previous"
+	expiresAt := time.Now().Add(time.Hour)
+	test.botEndpoint.PreviousSigningSecret = &previous
+	test.botEndpoint.PreviousSigningSecretExpiresAt = &expiresAt
+	test.usecase.botEndpointRepo = &fakeBotEndpointRepo{botEndpoint: test.botEndpoint}
+
+	test.usecase.deliver(context.Background(), test.delivery)
+
+	request := <-test.received
+	body, _ := io.ReadAll(request.Body)
+	timestamp, _ := strconv.ParseInt(request.Header.Get(webhook.TimestampHeader), 10, 64)
+	want := webhook.Sign("secret", timestamp, body) + "," + webhook.Sign("previous", timestamp, body)
+	if request.Header.Get(webhook.SignatureHeader) != want {
+		t.Errorf("signature header = %s, want %s", request.Header.Get(webhook.SignatureHeader), want)
+	}
+}
+
+func TestDeliverWithoutResponseMessage(t *testing.T) {
+	test := newDeliverTest(t, http.StatusNoContent, "")
+
+	test.usecase.deliver(context.Background(), test.delivery)
+
+	<-test.received
+	if len(test.deliveryRepo.deleted) != 1 {
+		t.Errorf("delivered delivery must be deleted")
+	}
+	if len(test.messageRepo.inserted) != 0 || len(test.hub.posted) != 0 {
+		t.Errorf("nothing must be posted when bot returns no message")
+	}
+}
+
+// チャンネルがないイベントへの応答は投稿しない
+func TestDeliverIgnoresResponseToEventWithoutChannel(t *testing.T) {
+	test := newDeliverTest(t, http.StatusOK, `{"message":"welcome"}`)
+	test.delivery.ChannelId = nil
+
+	test.usecase.deliver(context.Background(), test.delivery)
+
+	request := <-test.received
+	body, _ := io.ReadAll(request.Body)
+	var event BotEvent
+	json.Unmarshal(body, &event)
+	if event.CallbackToken != "" {
+		t.Errorf("event without channel must not have callback_token")
+	}
+	if len(test.deliveryRepo.deleted) != 1 {
+		t.Errorf("delivered delivery must be deleted")
+	}
+	if len(test.messageRepo.inserted) != 0 {
+		t.Errorf("response to event without channel must not be posted")
+	}
+}
+
+func TestDeliverSchedulesRetryOnFailure(t *testing.T) {
+	test := newDeliverTest(t, http.StatusInternalServerError, "")
+	test.delivery.Attempts = 2
+
+	before := time.Now()
+	test.usecase.deliver(context.Background(), test.delivery)
+
+	<-test.received
+	if len(test.deliveryRepo.deleted) != 0 {
+		t.Errorf("failed delivery must not be deleted")
+	}
+	if len(test.deliveryRepo.failed) != 1 {
+		t.Fatalf("failed delivery must be marked as failed")
+	}
+	failed := test.deliveryRepo.failed[0]
+	if failed.dead {
+		t.Errorf("delivery must be retried until maxBotDeliveryAttempts")
+	}
+	//2回目の失敗の後は5秒*2の半分から全体の間で再送する
+	if failed.nextAttemptAt.Before(before.Add(5*time.Second)) || failed.nextAttemptAt.After(time.Now().Add(10*time.Second)) {
+		t.Errorf("next attempt must be after backoff. next_attempt_at -> %s", failed.nextAttemptAt.Sub(before))
+	}
+	if len(test.messageRepo.inserted) != 0 {
+		t.Errorf("nothing must be posted when delivery failed")
+	}
+}
+
+func TestDeliverMarksDeadAfterMaxAttempts(t *testing.T) {
+	test := newDeliverTest(t, http.StatusInternalServerError, "")
+	test.delivery.Attempts = maxBotDeliveryAttempts
+
+	test.usecase.deliver(context.Background(), test.delivery)
+
+	<-test.received
+	if len(test.deliveryRepo.failed) != 1 || !test.deliveryRepo.failed[0].dead {
+		t.Errorf("delivery must be dead after maxBotDeliveryAttempts. failed -> %+v", test.deliveryRepo.failed)
+	}
+}
+
+// 検証されていないエンドポイントには送らずに再送を予約する
+func TestDeliverDoesNotSendToUnverifiedEndpoint(t *testing.T) {
+	test := newDeliverTest(t, http.StatusOK, "")
+	test.botEndpoint.Verified = false
+	test.usecase.botEndpointRepo = &fakeBotEndpointRepo{botEndpoint: test.botEndpoint}
+
+	test.usecase.deliver(context.Background(), test.delivery)
+
+	select {
+	case <-test.received:
+		t.Errorf("unverified endpoint must not receive events")
+	default:
+	}
+	if len(test.deliveryRepo.failed) != 1 {
+		t.Errorf("delivery to unverified endpoint must be retried")
+	}
+}
+
+func TestBotDeliveryBackoff(t *testing.T) {
+	for attempts := 1; attempts <= 40; attempts++ {
+		backoff := botDeliveryMaxBackoff
+		if attempts < 13 {
+			backoff = min(botDeliveryBaseBackoff*time.Duration(1<<(attempts-1)), botDeliveryMaxBackoff)
+		}
+		for i := 0; i < 100; i++ {
+			got := botDeliveryBackoff(attempts)
+			if got < backoff/2 || got > backoff {
+				t.Fatalf("botDeliveryBackoff(%d) = %s, want between %s and %s", attempts, got, backoff/2, backoff)
+			}
+		}
+	}
+}
+
+// 同時に失敗した配信が一斉に再送されないように、同じ回数でも再送までの時間はばらつく
+func TestBotDeliveryBackoffJitter(t *testing.T) {
+	seen := make(map[time.Duration]struct{})
+	for i := 0; i < 100; i++ {
+		seen[botDeliveryBackoff(3)] = struct{}{}
+	}
+	if len(seen) < 2 {
+		t.Errorf("botDeliveryBackoff must be randomized")
+	}
+}
+
+// newMessageUsecaseWithMessagesはseqが1からcountまでのメッセージがあるチャンネルを用意する
+func newMessageUsecaseWithMessages(count int) (*MessageUsecase, uuid.UUID) {
+	channelId := uuid.New()
+	messageRepo := &fakeMessageRepo{}
+	for seq := int64(1); seq <= int64(count); seq++ {
+		id := uuid.New()
+		s := seq
+		messageRepo.messages = append(messageRepo.messages, entity.MessageWithUser{Message: entity.Message{Id: &id, ChannelId: channelId, Seq: &s}})
+	}
+	channelRepo := &fakeChannelRepo{channel: entity.Channel{Id: &channelId, LastSeq: int64(count)}}
+	return NewMessageUsecase(messageRepo, nil, channelRepo, nil, nil, &fakeUserReactionRepo{}, &fakeTxRepo{}, &fakeHub{}, nil), channelId
+}
+
+func seqs(messages []entity.MessageWithUser) []int64 {
+	seqs := make([]int64, len(messages))
+	for i, message := range messages {
+		seqs[i] = *message.Seq
+	}
+	return seqs
+}
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+func TestGetMessagesByChannelIDCursors(t *testing.T) {
+	tests := []struct {
+		name     string
+		dto      GetMessagesByChannelIDInputDTO
+		wantSeqs []int64
+		wantPrev *int64
+		wantNext *int64
+	}{
+		{
+			name:     "latest",
+			dto:      GetMessagesByChannelIDInputDTO{Limit: 3},
+			wantSeqs: []int64{8, 9, 10},
+			wantPrev: int64Ptr(8),
+		},
+		{
+			name:     "before",
+			dto:      GetMessagesByChannelIDInputDTO{Before: int64Ptr(8), Limit: 3},
+			wantSeqs: []int64{5, 6, 7},
+			wantPrev: int64Ptr(5),
+			wantNext: int64Ptr(7),
+		},
+		{
+			name:     "before reaches the first message",
+			dto:      GetMessagesByChannelIDInputDTO{Before: int64Ptr(3), Limit: 3},
+			wantSeqs: []int64{1, 2},
+			wantNext: int64Ptr(2),
+		},
+		{
+			name:     "after",
+			dto:      GetMessagesByChannelIDInputDTO{After: int64Ptr(2), Limit: 3},
+			wantSeqs: []int64{3, 4, 5},
+			wantPrev: int64Ptr(3),
+			wantNext: int64Ptr(5),
+		},
+		{
+			name:     "after reaches the last message",
+			dto:      GetMessagesByChannelIDInputDTO{After: int64Ptr(8), Limit: 3},
+			wantSeqs: []int64{9, 10},
+			wantPrev: int64Ptr(9),
+		},
+		{
+			name:     "around",
+			dto:      GetMessagesByChannelIDInputDTO{Around: int64Ptr(5), Limit: 4},
+			wantSeqs: []int64{3, 4, 5, 6},
+			wantPrev: int64Ptr(3),
+			wantNext: int64Ptr(6),
+		},
+		{
+			name:     "around with odd limit",
+			dto:      GetMessagesByChannelIDInputDTO{Around: int64Ptr(5), Limit: 3},
+			wantSeqs: []int64{4, 5, 6},
+			wantPrev: int64Ptr(4),
+			wantNext: int64Ptr(6),
+		},
+		{
+			//limitが1の場合に前のメッセージを全て取得しない
+			name:     "around with limit 1",
+			dto:      GetMessagesByChannelIDInputDTO{Around: int64Ptr(5), Limit: 1},
+			wantSeqs: []int64{5},
+			wantPrev: int64Ptr(5),
+			wantNext: int64Ptr(5),
+		},
+		{
+			name:     "from and to",
+			dto:      GetMessagesByChannelIDInputDTO{FromSeq: int64Ptr(4), ToSeq: int64Ptr(6), Limit: 50},
+			wantSeqs: []int64{4, 5, 6},
+			wantPrev: int64Ptr(4),
+			wantNext: int64Ptr(6),
+		},
+		{
+			name:     "from only",
+			dto:      GetMessagesByChannelIDInputDTO{FromSeq: int64Ptr(9), Limit: 50},
+			wantSeqs: []int64{9, 10},
+			wantPrev: int64Ptr(9),
+		},
+		{
+			name:     "to only",
+			dto:      GetMessagesByChannelIDInputDTO{ToSeq: int64Ptr(2), Limit: 50},
+			wantSeqs: []int64{1, 2},
+			wantNext: int64Ptr(2),
+		},
+		{
+			name:     "after the last message",
+			dto:      GetMessagesByChannelIDInputDTO{After: int64Ptr(10), Limit: 3},
+			wantSeqs: []int64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usecase, channelId := newMessageUsecaseWithMessages(10)
+			tt.dto.ChannelId = channelId
+			output, err := usecase.GetMessagesByChannelID(context.Background(), tt.dto)
+			if err != nil {
+				t.Fatalf("GetMessagesByChannelID() error = %v", err)
+			}
+			got := seqs(output.Messages)
+			if len(got) != len(tt.wantSeqs) {
+				t.Fatalf("seqs = %v, want %v", got, tt.wantSeqs)
+			}
+			for i := range got {
+				if got[i] != tt.wantSeqs[i] {
+					t.Fatalf("seqs = %v, want %v", got, tt.wantSeqs)
+				}
+			}
+			if !equalCursor(output.PrevCursor, tt.wantPrev) {
+				t.Errorf("PrevCursor = %v, want %v", formatCursor(output.PrevCursor), formatCursor(tt.wantPrev))
+			}
+			if !equalCursor(output.NextCursor, tt.wantNext) {
+				t.Errorf("NextCursor = %v, want %v", formatCursor(output.NextCursor), formatCursor(tt.wantNext))
+			}
+		})
+	}
+}
+
+func equalCursor(a *int64, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func formatCursor(cursor *int64) string {
+	if cursor == nil {
+		return "nil"
+	}
+	return strconv.FormatInt(*cursor, 10)
+}
+
+func newRotateSigningSecretTest() (*BotEndpointUsecase, *fakeBotEndpointRepo) {
+	repo := &fakeBotEndpointRepo{botEndpoint: entity.BotEndpoint{Id: uuid.NewString(), OwnerUserId: "auth0|owner", SigningSecret: "secret"}}
+	return NewBotEndpointUsecase(repo, nil, nil, nil, nil, nil, nil, &fakeHub{}, nil, nil), repo
+}
+
+// 秘密鍵を知らない所有者もローテーションして新しい秘密鍵を取得できる
+func TestRotateSigningSecretByOwner(t *testing.T) {
+	usecase, repo := newRotateSigningSecretTest()
+
+	before := time.Now()
+	output, err := usecase.RotateSigningSecret(context.Background(), RotateSigningSecretInputDTO{
+		BotEndpointId: uuid.MustParse(repo.botEndpoint.Id),
+		UserId:        "auth0|owner",
+		GracePeriod:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("RotateSigningSecret() error = %v", err)
+	}
+	if output.SigningSecret == "" || output.SigningSecret == "secret" || repo.botEndpoint.SigningSecret != output.SigningSecret {
+		t.Errorf("signing secret must be replaced with the returned secret. returned -> %s, stored -> %s", output.SigningSecret, repo.botEndpoint.SigningSecret)
+	}
+	if output.PreviousSecretExpiresAt.Before(before.Add(time.Hour)) {
+		t.Errorf("previous secret must be valid during the grace period. expires_at -> %s", output.PreviousSecretExpiresAt)
+	}
+	secrets := signingSecrets(repo.botEndpoint, time.Now())
+	if len(secrets) != 2 || secrets[0] != output.SigningSecret || secrets[1] != "secret" {
+		t.Errorf("both secrets must be used during the grace period. secrets -> %v", secrets)
+	}
+	if len(signingSecrets(repo.botEndpoint, output.PreviousSecretExpiresAt.Add(time.Second))) != 1 {
+		t.Errorf("previous secret must not be used after the grace period")
+	}
+}
+
+func TestRotateSigningSecretByNonOwner(t *testing.T) {
+	usecase, repo := newRotateSigningSecretTest()
+
+	_, err := usecase.RotateSigningSecret(context.Background(), RotateSigningSecretInputDTO{
+		BotEndpointId: uuid.MustParse(repo.botEndpoint.Id),
+		UserId:        "auth0|someone",
+		GracePeriod:   time.Hour,
+	})
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("RotateSigningSecret() by non-owner error = %v, want ErrForbidden", err)
+	}
+	if repo.botEndpoint.SigningSecret != "secret" {
+		t.Errorf("signing secret must not be rotated by non-owner")
+	}
+}
+
+// 配信の取得と再送はbotの所有者のみできる。所有者でない場合は配信のrepositoryに触れない
+func TestBotDeliveriesByNonOwner(t *testing.T) {
+	usecase, repo := newRotateSigningSecretTest()
+	botEndpointId := uuid.MustParse(repo.botEndpoint.Id)
+
+	_, err := usecase.GetBotDeliveries(context.Background(), GetBotDeliveriesInputDTO{BotEndpointId: botEndpointId, UserId: "auth0|someone"})
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("GetBotDeliveries() by non-owner error = %v, want ErrForbidden", err)
+	}
+	_, err = usecase.RedriveBotDeliveries(context.Background(), RedriveBotDeliveriesInputDTO{BotEndpointId: botEndpointId, UserId: "auth0|someone"})
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("RedriveBotDeliveries() by non-owner error = %v, want ErrForbidden", err)
+	}
+}
+
+// fakeUserServerRepoはuserIdごとのサーバーでの役割を保持する
+type fakeUserServerRepo struct {
+	repository.UserServerRepositoryInterface
+	roles map[string]string
+}
+
+func (repo *fakeUserServerRepo) GetUserServer(ctx context.Context, userId string, serverId uuid.UUID) (entity.UserServer, error) {
+	role, ok := repo.roles[userId]
+	if !ok {
+		return entity.UserServer{}, sql.ErrNoRows
+	}
+	return entity.UserServer{UserId: userId, ServerId: serverId, Role: role}, nil
+}
+
+func (repo *fakeUserServerRepo) UpdateRole(ctx context.Context, userId string, serverId uuid.UUID, role string) (bool, error) {
+	if _, ok := repo.roles[userId]; !ok {
+		return false, nil
+	}
+	repo.roles[userId] = role
+	return true, nil
+}
+
+func TestSetMemberRole(t *testing.T) {
+	tests := []struct {
+		name         string
+		userId       string
+		memberUserId string
+		role         string
+		wantErr      error
+		wantRole     string
+	}{
+		{name: "owner promotes member", userId: "auth0|owner", memberUserId: "auth0|member", role: entity.ServerRoleModerator, wantRole: entity.ServerRoleModerator},
+		{name: "non-owner cannot change role", userId: "auth0|moderator", memberUserId: "auth0|member", role: entity.ServerRoleModerator, wantErr: ErrForbidden, wantRole: entity.ServerRoleMember},
+		{name: "non-member cannot change role", userId: "auth0|someone", memberUserId: "auth0|member", role: entity.ServerRoleModerator, wantErr: ErrForbidden, wantRole: entity.ServerRoleMember},
+		{name: "owner cannot be assigned", userId: "auth0|owner", memberUserId: "auth0|member", role: entity.ServerRoleOwner, wantErr: ErrInvalidArgument, wantRole: entity.ServerRoleMember},
+		{name: "member not found", userId: "auth0|owner", memberUserId: "auth0|someone", role: entity.ServerRoleModerator, wantErr: ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &fakeUserServerRepo{roles: map[string]string{
+				"auth0|owner":     entity.ServerRoleOwner,
+				"auth0|moderator": entity.ServerRoleModerator,
+				"auth0|member":    entity.ServerRoleMember,
+			}}
+			usecase := NewServerUsecase(nil, nil, repo, nil, nil, &fakeHub{}, nil)
+			err := usecase.SetMemberRole(context.Background(), SetMemberRoleInputDTO{
+				UserId:       tt.userId,
+				ServerId:     uuid.New(),
+				MemberUserId: tt.memberUserId,
+				Role:         tt.role,
+			})
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("SetMemberRole() error = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SetMemberRole() error = %v, want %v", err, tt.wantErr)
+			}
+			if repo.roles[tt.memberUserId] != tt.wantRole {
+				t.Errorf("role = %s, want %s", repo.roles[tt.memberUserId], tt.wantRole)
+			}
+		})
+	}
+}
+
+// ownerの役割を変更するとサーバーからownerがいなくなるので変更できない
+func TestSetMemberRoleOfOwner(t *testing.T) {
+	repo := &fakeUserServerRepo{roles: map[string]string{"auth0|owner": entity.ServerRoleOwner}}
+	usecase := NewServerUsecase(nil, nil, repo, nil, nil, &fakeHub{}, nil)
+	err := usecase.SetMemberRole(context.Background(), SetMemberRoleInputDTO{
+		UserId:       "auth0|owner",
+		ServerId:     uuid.New(),
+		MemberUserId: "auth0|owner",
+		Role:         entity.ServerRoleMember,
+	})
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("SetMemberRole() error = %v, want ErrInvalidArgument", err)
+	}
+	if repo.roles["auth0|owner"] != entity.ServerRoleOwner {
+		t.Errorf("owner must stay owner. role -> %s", repo.roles["auth0|owner"])
+	}
+}
@@ -0,0 +1,148 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// botのレスポンスが大きすぎる場合に読み込みすぎないようにする
+const maxResponseBodySize = 64 * 1024
+
+const (
+	// TimestampHeaderはリクエストを送信した時刻(unix秒)
+	// botはこの時刻が古すぎるリクエストを拒否することで、リクエストの再送による攻撃を防ぐ
+	TimestampHeader = "X-Bot-Request-Timestamp"
+	// SignatureHeaderは"v1="に続けて"v1:{timestamp}:{body}"のHMAC-SHA256を16進数で表したもの
+	// 秘密鍵のローテーション中は新しい秘密鍵と古い秘密鍵の署名をカンマ区切りで送るので、botはどちらか一方が一致すれば受け入れる
+	SignatureHeader  = "X-Bot-Signature"
+	signatureVersion = "v1"
+)
+
+// Clientはbotのエンドポイントにイベントを送信する
+// usecaseのBotClientInterfaceを実装する
+type Client struct {
+	httpClient   *http.Client
+	allowPrivate bool
+}
+
+// timeoutはリクエスト1回あたりの最大の時間で、ctxのタイムアウトとは別に設定する
+// allowPrivateがfalseの場合は、プライベートアドレスやループバックアドレスには接続しない
+func NewClient(timeout time.Duration, allowPrivate bool) *Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		//登録時の検証の後にDNSの応答が変わっても内部のサービスに接続しないように、接続する時にもアドレスを確認する
+		dialer.Control = func(network string, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("cant split address. address -> %s", address))
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || isDisallowedIP(ip) {
+				return errors.Wrap(ErrInvalidEndpoint, fmt.Sprintf("connecting to private address is not allowed. address -> %s", address))
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	if !allowPrivate {
+		//プロキシを経由するとdialer.Controlではプロキシのアドレスしか確認できないので、プロキシは使わない
+		transport.Proxy = nil
+	}
+	return &Client{httpClient: &http.Client{Timeout: timeout, Transport: transport}, allowPrivate: allowPrivate}
+}
+
+// ErrInvalidEndpointはエンドポイントがbotのエンドポイントとして使えないURLの場合に返す
+var ErrInvalidEndpoint = errors.New("invalid bot endpoint")
+
+// cgnatはキャリアグレードNATのアドレス。net.IP.IsPrivateに含まれないので別に確認する
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isDisallowedIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || cgnat.Contains(ip)
+}
+
+// ValidateEndpointはendpointがhttpまたはhttpsの絶対URLであることを確認する
+// プライベートアドレスが許可されていない場合は、ホストの全てのアドレスがパブリックなアドレスであることも確認する
+func (client *Client) ValidateEndpoint(ctx context.Context, endpoint string) error {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return errors.Wrap(ErrInvalidEndpoint, fmt.Sprintf("cant parse endpoint. endpoint -> %s: %s", endpoint, err.Error()))
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return errors.Wrap(ErrInvalidEndpoint, fmt.Sprintf("endpoint must be http or https. endpoint -> %s", endpoint))
+	}
+	if parsed.Hostname() == "" {
+		return errors.Wrap(ErrInvalidEndpoint, fmt.Sprintf("endpoint must have host. endpoint -> %s", endpoint))
+	}
+	if parsed.User != nil {
+		return errors.Wrap(ErrInvalidEndpoint, fmt.Sprintf("endpoint must not have userinfo. endpoint -> %s", endpoint))
+	}
+	if client.allowPrivate {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, parsed.Hostname())
+	if err != nil {
+		return errors.Wrap(ErrInvalidEndpoint, fmt.Sprintf("cant resolve host of endpoint. endpoint -> %s: %s", endpoint, err.Error()))
+	}
+	for _, addr := range addrs {
+		if isDisallowedIP(addr.IP) {
+			return errors.Wrap(ErrInvalidEndpoint, fmt.Sprintf("endpoint resolves to private address. endpoint -> %s, address -> %s", endpoint, addr.IP))
+		}
+	}
+	return nil
+}
+
+// SendはpayloadをsigningSecretsのそれぞれで署名してendpointにPOSTし、2xxのレスポンスのボディを返す
+// 2xx以外のレスポンスはエラーとして扱う
+func (client *Client) Send(ctx context.Context, endpoint string, payload []byte, signingSecrets []string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to create request to bot. endpoint -> %s", endpoint))
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "CATechAccelChatApp-Bot/1.0")
+	timestamp := time.Now().Unix()
+	signatures := make([]string, 0, len(signingSecrets))
+	for _, secret := range signingSecrets {
+		signatures = append(signatures, Sign(secret, timestamp, payload))
+	}
+	request.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(SignatureHeader, strings.Join(signatures, ","))
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to send request to bot. endpoint -> %s", endpoint))
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxResponseBodySize))
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to read response from bot. endpoint -> %s", endpoint))
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, errors.New(fmt.Sprintf("bot responded with unexpected status. endpoint -> %s, status -> %d", endpoint, response.StatusCode))
+	}
+	return body, nil
+}
+
+// Signはpayloadの署名をSignatureHeaderの形式で返す
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s:%d:", signatureVersion, timestamp)
+	mac.Write(payload)
+	return signatureVersion + "=" + hex.EncodeToString(mac.Sum(nil))
+}
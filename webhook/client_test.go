@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+func TestSign(t *testing.T) {
+	payload := []byte(`{"type":"message_created"}`)
+	timestamp := int64(1700000000)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(fmt.Sprintf("v1:%d:%s", timestamp, payload)))
+	want := "v1=" + hex.EncodeToString(mac.Sum(nil))
+
+	got := Sign("secret", timestamp, payload)
+	if got != want {
+		t.Errorf("Sign() = %s, want %s", got, want)
+	}
+	if Sign("another", timestamp, payload) == got {
+		t.Errorf("Sign() with another secret must differ")
+	}
+	if Sign("secret", timestamp+1, payload) == got {
+		t.Errorf("Sign() with another timestamp must differ")
+	}
+}
+
+// receivedRequestはテスト用のbotが受け取ったリクエスト
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func newBotServer(t *testing.T, status int, responseBody string) (*httptest.Server, chan receivedRequest) {
+	t.Helper()
+	received := make(chan receivedRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read request body: %v", err)
+		}
+		received <- receivedRequest{header: r.Header.Clone(), body: body}
+		w.WriteHeader(status)
+		io.WriteString(w, responseBody)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+// verifySignaturesはbotと同じ方法で、secretsのそれぞれの署名が順番に送られていることを確認する
+func verifySignatures(t *testing.T, request receivedRequest, secrets ...string) {
+	t.Helper()
+	timestamp, err := strconv.ParseInt(request.header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		t.Fatalf("invalid %s header: %v", TimestampHeader, err)
+	}
+	if diff := time.Since(time.Unix(timestamp, 0)); diff < 0 || diff > time.Minute {
+		t.Errorf("timestamp is not the time of sending. timestamp -> %d", timestamp)
+	}
+	signatures := strings.Split(request.header.Get(SignatureHeader), ",")
+	if len(signatures) != len(secrets) {
+		t.Fatalf("got %d signatures, want %d. header -> %s", len(signatures), len(secrets), request.header.Get(SignatureHeader))
+	}
+	for i, secret := range secrets {
+		want := Sign(secret, timestamp, request.body)
+		if !hmac.Equal([]byte(signatures[i]), []byte(want)) {
+			t.Errorf("signature[%d] = %s, want %s", i, signatures[i], want)
+		}
+	}
+}
+
+func TestClientSend(t *testing.T) {
+	server, received := newBotServer(t, http.StatusOK, `{"message":"pong"}`)
+	client := NewClient(5*time.Second, true)
+	payload := []byte(`{"type":"message_created"}`)
+
+	body, err := client.Send(context.Background(), server.URL, payload, []string{"secret"})
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if string(body) != `{"message":"pong"}` {
+		t.Errorf("Send() body = %s", body)
+	}
+	request := <-received
+	if string(request.body) != string(payload) {
+		t.Errorf("bot received %s, want %s", request.body, payload)
+	}
+	if request.header.Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type = %s", request.header.Get("Content-Type"))
+	}
+	verifySignatures(t, request, "secret")
+}
+
+// 秘密鍵のローテーション中は新しい秘密鍵と古い秘密鍵の両方で署名する
+func TestClientSendSignsWithEverySecretDuringRotation(t *testing.T) {
+	server, received := newBotServer(t, http.StatusOK, "")
+	client := NewClient(5*time.Second, true)
+
+	_, err := client.Send(context.Background(), server.URL, []byte(`{}`), []string{"new-secret", "old-secret"})
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	verifySignatures(t, <-received, "new-secret", "old-secret")
+}
+
+func TestClientSendFailsOnNon2xx(t *testing.T) {
+	server, received := newBotServer(t, http.StatusInternalServerError, "error")
+	client := NewClient(5*time.Second, true)
+
+	_, err := client.Send(context.Background(), server.URL, []byte(`{}`), []string{"secret"})
+	if err == nil {
+		t.Fatalf("Send() must fail when bot responds with 500")
+	}
+	<-received
+}
+
+func TestClientSendRejectsPrivateAddress(t *testing.T) {
+	server, _ := newBotServer(t, http.StatusOK, "")
+	client := NewClient(5*time.Second, false)
+
+	_, err := client.Send(context.Background(), server.URL, []byte(`{}`), []string{"secret"})
+	if !errors.Is(err, ErrInvalidEndpoint) {
+		t.Errorf("Send() to loopback address error = %v, want ErrInvalidEndpoint", err)
+	}
+}
+
+// プロキシを経由するとアドレスの確認をすり抜けるので、プライベートアドレスを許可しない場合はプロキシを使わない
+func TestNewClientDisablesProxyWhenPrivateIsNotAllowed(t *testing.T) {
+	transport := NewClient(time.Second, false).httpClient.Transport.(*http.Transport)
+	if transport.Proxy != nil {
+		t.Errorf("proxy must be disabled when private addresses are not allowed")
+	}
+	transport = NewClient(time.Second, true).httpClient.Transport.(*http.Transport)
+	if transport.Proxy == nil {
+		t.Errorf("proxy from environment must be used when private addresses are allowed")
+	}
+}
@@ -0,0 +1,168 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+// Backplaneは複数のbackendのレプリカで動いているHubの間でイベントを共有するためのもの
+// Publishされたイベントは、PublishしたHub自身も含めてSubscribeしている全てのHubに配信される
+type Backplane interface {
+	Publish(ctx context.Context, event []byte) error
+	Subscribe(ctx context.Context) (<-chan []byte, error)
+	Close() error
+}
+
+// MemoryBackplaneはプロセス内のHubにのみイベントを配信する
+// backendを1台で動かす場合に使用する
+type MemoryBackplane struct {
+	mu          sync.Mutex
+	subscribers []chan []byte
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{}
+}
+
+func (b *MemoryBackplane) Publish(ctx context.Context, event []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, subscriber := range b.subscribers {
+		select {
+		case subscriber <- event:
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "failed to publish event to memory backplane")
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(ctx context.Context) (<-chan []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subscriber := make(chan []byte, 256)
+	b.subscribers = append(b.subscribers, subscriber)
+	return subscriber, nil
+}
+
+func (b *MemoryBackplane) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, subscriber := range b.subscribers {
+		close(subscriber)
+	}
+	b.subscribers = nil
+	return nil
+}
+
+// NOTIFYのpayloadは8000byte未満にする必要がある
+// https://www.postgresql.org/docs/current/sql-notify.html
+const maxNotifyPayloadSize = 8000
+
+// NOTIFYで送れない大きさのイベントはws_hub_event_payloadsテーブルに保存して、
+// NOTIFYではprefixを付けた行のIdだけを送る。hubEventのJSONは"{"から始まるので区別できる
+const (
+	storedEventPrefix = "ref:"
+	//全てのレプリカが取得し終わった後に削除されるように、保存したイベントは一定時間残す
+	storedEventRetention    = time.Minute * 5
+	storedEventFetchTimeout = time.Second * 5
+)
+
+// PostgresBackplaneはPostgreSQLのLISTEN/NOTIFYを使ってレプリカ間でイベントを配信する
+// 既存のDBをそのまま使うので、Redisなどの新しいインフラを用意する必要がない
+type PostgresBackplane struct {
+	db       *bun.DB
+	channel  string
+	listener *pgdriver.Listener
+}
+
+func NewPostgresBackplane(db *bun.DB, channel string) *PostgresBackplane {
+	return &PostgresBackplane{db: db, channel: channel}
+}
+
+func (b *PostgresBackplane) Publish(ctx context.Context, event []byte) error {
+	payload := string(event)
+	if len(event) >= maxNotifyPayloadSize {
+		var err error
+		payload, err = b.store(ctx, event)
+		if err != nil {
+			return err
+		}
+	}
+	err := pgdriver.Notify(ctx, b.db, b.channel, payload)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to notify event. channel -> %s", b.channel))
+	}
+	return nil
+}
+
+// storeはNOTIFYで送れないイベントをテーブルに保存して、NOTIFYで代わりに送るpayloadを返す
+// 保存期間が過ぎたイベントもここで削除する
+func (b *PostgresBackplane) store(ctx context.Context, event []byte) (string, error) {
+	_, err := b.db.ExecContext(ctx, `DELETE FROM ws_hub_event_payloads WHERE created_at < ?`, time.Now().Add(-storedEventRetention))
+	if err != nil {
+		log.Printf("failed to delete expired hub events: %+v", errors.Wrap(err, "failed to delete expired hub events"))
+	}
+	var id string
+	err = b.db.NewRaw(`INSERT INTO ws_hub_event_payloads (payload) VALUES (?) RETURNING id`, string(event)).Scan(ctx, &id)
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("failed to store hub event. size -> %d", len(event)))
+	}
+	return storedEventPrefix + id, nil
+}
+
+// loadはテーブルに保存されたイベントを取得する
+func (b *PostgresBackplane) load(id string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storedEventFetchTimeout)
+	defer cancel()
+	var payload string
+	err := b.db.NewRaw(`SELECT payload FROM ws_hub_event_payloads WHERE id = ?`, id).Scan(ctx, &payload)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to load stored hub event. id -> %s", id))
+	}
+	return []byte(payload), nil
+}
+
+func (b *PostgresBackplane) Subscribe(ctx context.Context) (<-chan []byte, error) {
+	b.listener = pgdriver.NewListener(b.db)
+	err := b.listener.Listen(ctx, b.channel)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to listen channel. channel -> %s", b.channel))
+	}
+	events := make(chan []byte, 256)
+	go func() {
+		defer close(events)
+		//接続が切れた場合はListenerが再接続してLISTENし直してくれる
+		for notification := range b.listener.Channel() {
+			id, stored := strings.CutPrefix(notification.Payload, storedEventPrefix)
+			if !stored {
+				events <- []byte(notification.Payload)
+				continue
+			}
+			//NOTIFYの順番通りに届けるために、取得し終わるまで次のイベントは待たせる
+			event, err := b.load(id)
+			if err != nil {
+				log.Printf("%+v", err)
+				continue
+			}
+			events <- event
+		}
+		log.Printf("postgres backplane listener is closed. channel -> %s", b.channel)
+	}()
+	return events, nil
+}
+
+func (b *PostgresBackplane) Close() error {
+	if b.listener == nil {
+		return nil
+	}
+	return b.listener.Close()
+}
@@ -0,0 +1,122 @@
+package ws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Publishしたイベントは、Publishした側も含めて全てのsubscriberに届く
+func TestMemoryBackplanePublishToAllSubscribers(t *testing.T) {
+	backplane := newTestBackplane(t)
+	subscriber1, err := backplane.Subscribe(context.Background())
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	subscriber2, err := backplane.Subscribe(context.Background())
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	err = backplane.Publish(context.Background(), []byte(`{"broadcast":{}}`))
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	for i, subscriber := range []<-chan []byte{subscriber1, subscriber2} {
+		select {
+		case event := <-subscriber:
+			if string(event) != `{"broadcast":{}}` {
+				t.Errorf("subscriber %d received %s", i, event)
+			}
+		case <-time.After(receiveTimeout):
+			t.Errorf("subscriber %d did not receive event", i)
+		}
+	}
+}
+
+func TestMemoryBackplaneCloseClosesSubscribers(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	subscriber, err := backplane.Subscribe(context.Background())
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	backplane.Close()
+	if _, ok := <-subscriber; ok {
+		t.Errorf("subscriber must be closed")
+	}
+}
+
+// あるレプリカのHubでbroadcastしたイベントは、他のレプリカのHubに接続しているサーバーのメンバーにも届く
+func TestBroadcastAcrossHubs(t *testing.T) {
+	backplane := newTestBackplane(t)
+	hub1 := newTestHub(t, backplane)
+	hub2 := newTestHub(t, backplane)
+	server := uuid.New()
+	local := connectTestUser(hub1, "auth0|local", server)
+	remote := connectTestUser(hub2, "auth0|remote", server)
+	outsider := connectTestUser(hub2, "auth0|outsider", uuid.New())
+
+	err := hub1.broadcastToServer(server, testChatMessage(t, "m1"))
+	if err != nil {
+		t.Fatalf("broadcastToServer() error = %v", err)
+	}
+	receiveChatMessage(t, local, "m1")
+	receiveChatMessage(t, remote, "m1")
+	expectNoAction(t, outsider, chatMessageAction)
+}
+
+// 他のレプリカで参加したサーバーのイベントも、接続しているHubで届くようになる
+func TestJoinServerAcrossHubs(t *testing.T) {
+	backplane := newTestBackplane(t)
+	hub1 := newTestHub(t, backplane)
+	hub2 := newTestHub(t, backplane)
+	server := uuid.New()
+	user := connectTestUser(hub2, "auth0|user")
+
+	hub1.JoinServer(user.UserID, server)
+	err := hub1.broadcastToServer(server, testChatMessage(t, "m1"))
+	if err != nil {
+		t.Fatalf("broadcastToServer() error = %v", err)
+	}
+	receiveChatMessage(t, user, "m1")
+}
+
+// 複数のレプリカに接続しているuserは、あるレプリカのセッションが全て切断されてもオンラインのまま
+// 切断を受け取ったHubはオンラインを知らせ直さないので、オフラインとオンラインが交互に届くことはない
+func TestPresenceAcrossHubs(t *testing.T) {
+	backplane := newTestBackplane(t)
+	hub1 := newTestHub(t, backplane)
+	hub2 := newTestHub(t, backplane)
+	server := uuid.New()
+	observer1 := connectTestUser(hub1, "auth0|observer1", server)
+	observer2 := connectTestUser(hub2, "auth0|observer2", server)
+
+	session1 := connectTestUser(hub1, "auth0|user", server)
+	for _, observer := range []*User{observer1, observer2} {
+		if !receivePresence(t, observer, session1.UserID) {
+			t.Fatalf("%s must see user online", observer.UserID)
+		}
+	}
+	session2 := connectTestUser(hub2, "auth0|user", server)
+	//hub2で最初のセッションが接続したことも知らせるので、両方のHubに届くまで待つ
+	for _, observer := range []*User{observer1, observer2} {
+		if !receivePresence(t, observer, session2.UserID) {
+			t.Fatalf("%s must see user online", observer.UserID)
+		}
+	}
+
+	hub1.unregister <- session1
+	expectClosed(t, session1)
+	expectNoPresence(t, observer1, session1.UserID)
+	expectNoPresence(t, observer2, session1.UserID)
+
+	hub2.unregister <- session2
+	for _, observer := range []*User{observer1, observer2} {
+		if receivePresence(t, observer, session2.UserID) {
+			t.Errorf("%s must see user offline after the last session disconnects", observer.UserID)
+		}
+		expectNoPresence(t, observer, session2.UserID)
+	}
+}
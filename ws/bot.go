@@ -0,0 +1,92 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/hebitigo/CATechAccelChatApp/entity"
+)
+
+// websocketで接続しているbotをHubでuserと同じように管理するために、botのIdにprefixを付けてuserIdとして使う
+// userのIdはauth0のsubなので"bot:"から始まることはない
+const botUserIdPrefix = "bot:"
+
+func botUserId(botEndpointId string) string {
+	return botUserIdPrefix + botEndpointId
+}
+
+func isBotUserId(uid userId) bool {
+	return strings.HasPrefix(string(uid), botUserIdPrefix)
+}
+
+// botInfoはサーバーに追加、削除されたbot。削除された場合はNameとIconURLは空
+type botInfo struct {
+	ServerId      string `json:"server_id"`
+	BotEndpointId string `json:"bot_endpoint_id"`
+	Name          string `json:"name,omitempty"`
+	IconURL       string `json:"icon_url,omitempty"`
+}
+
+// NotifyBotInstalledはサーバーにbotが追加されたことをサーバーのメンバーに知らせる
+// botがwebsocketで接続している場合は、以降そのサーバーのイベントがbotにも届く
+func (h *Hub) NotifyBotInstalled(sid uuid.UUID, botEndpoint entity.BotEndpoint) {
+	h.JoinServer(botUserId(botEndpoint.Id), sid)
+	h.notifyBot(botInstalledAction, sid, botInfo{
+		ServerId:      sid.String(),
+		BotEndpointId: botEndpoint.Id,
+		Name:          botEndpoint.Name,
+		IconURL:       botEndpoint.IconURL,
+	})
+}
+
+// NotifyBotUninstalledはサーバーからbotが削除されたことをサーバーのメンバーに知らせる
+// botがwebsocketで接続している場合は、以降そのサーバーのイベントはbotに届かない
+func (h *Hub) NotifyBotUninstalled(sid uuid.UUID, botEndpointId string) {
+	defer h.LeaveServer(botUserId(botEndpointId), sid)
+	h.notifyBot(botUninstalledAction, sid, botInfo{
+		ServerId:      sid.String(),
+		BotEndpointId: botEndpointId,
+	})
+}
+
+// botDisconnectは切断するbotのセッション。TokenIdが設定されている場合はそのトークンで接続しているセッションのみ切断する
+type botDisconnect struct {
+	BotEndpointId string     `json:"bot_endpoint_id"`
+	TokenId       *uuid.UUID `json:"token_id,omitempty"`
+}
+
+// DisconnectBotはbotのトークンが失効したり、botが削除された場合に、websocketで接続しているbotのセッションを切断する
+// tokenIdがnilの場合はbotの全てのセッションを切断する
+func (h *Hub) DisconnectBot(botEndpointId string, tokenId *uuid.UUID) {
+	err := h.publish(hubEvent{DisconnectBot: &botDisconnect{BotEndpointId: botEndpointId, TokenId: tokenId}})
+	if err != nil {
+		log.Printf("failed to publish disconnect bot event: %+v", err)
+	}
+}
+
+// disconnectBotはこのHubに接続しているbotのセッションのsendを閉じて、writePumpに接続を閉じさせる
+func (h *Hub) disconnectBot(disconnect *botDisconnect) {
+	for _, user := range h.UserPresence[userId(botUserId(disconnect.BotEndpointId))] {
+		if disconnect.TokenId != nil && user.botTokenId != *disconnect.TokenId {
+			continue
+		}
+		h.removeSession(user)
+	}
+}
+
+func (h *Hub) notifyBot(at actionType, sid uuid.UUID, info botInfo) {
+	bytes, err := json.Marshal(returnSendMessage[botInfo](at, info))
+	if err != nil {
+		log.Printf("cant marshal botInfo: %+v", errors.Wrap(err, fmt.Sprintf("botInfo -> %+v", info)))
+		return
+	}
+	err = h.broadcastToServer(sid, bytes)
+	if err != nil {
+		log.Printf("failed to broadcast bot event: %+v", err)
+	}
+}
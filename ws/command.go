@@ -0,0 +1,74 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/pkg/errors"
+
+	"github.com/hebitigo/CATechAccelChatApp/entity"
+	"github.com/hebitigo/CATechAccelChatApp/usecase"
+)
+
+// ephemeralInfoはコマンドを実行したセッションにのみ送られるメッセージ
+// botの応答の場合のみbot_endpoint_idとbot_nameが設定される
+type ephemeralInfo struct {
+	ServerId      string `json:"server_id"`
+	ChannelId     string `json:"channel_id"`
+	BotEndpointId string `json:"bot_endpoint_id,omitempty"`
+	BotName       string `json:"bot_name,omitempty"`
+	Message       string `json:"message"`
+}
+
+// NotifyEphemeralはuserのsessionIdのセッションにのみメッセージを送る
+// セッションが既に切断されている場合は送らない
+func (h *Hub) NotifyEphemeral(uid string, sid string, message usecase.EphemeralMessage) {
+	info := ephemeralInfo{
+		ServerId:      message.ServerId.String(),
+		ChannelId:     message.ChannelId.String(),
+		BotEndpointId: message.BotEndpointId,
+		BotName:       message.BotName,
+		Message:       message.Message,
+	}
+	bytes, err := json.Marshal(returnSendMessage[ephemeralInfo](ephemeralAction, info))
+	if err != nil {
+		log.Printf("cant marshal ephemeralInfo: %+v", errors.Wrap(err, fmt.Sprintf("ephemeralInfo -> %+v", info)))
+		return
+	}
+	h.direct <- &sessionMessage{userId: userId(uid), sessionId: sessionId(sid), payload: bytes}
+}
+
+// handleCommandは"/"から始まるメッセージをコマンドとして実行する
+// コマンドでメッセージを投稿した場合は通常のメッセージと同じくackを返し、
+// ephemeralな応答はこのセッションにのみ送る
+func (u *User) handleCommand(channel entity.Channel, postMessageInputDTO usecase.PostMessageInputDTO) {
+	output, err := u.commandUsecase.ExecuteCommand(u.ctx, usecase.ExecuteCommandInputDTO{
+		UserId:          u.UserID,
+		SessionId:       u.SessionID,
+		ServerId:        channel.ServerId,
+		ChannelId:       *channel.Id,
+		ParentMessageId: postMessageInputDTO.ParentMessageId,
+		ClientMsgId:     postMessageInputDTO.ClientMsgId,
+		Text:            postMessageInputDTO.Message,
+	})
+	if err != nil {
+		log.Printf("failed to execute command provided by websocket: %+v", err)
+		u.sendError(err)
+		return
+	}
+	if output.Message != nil {
+		clientMsgId := ""
+		if postMessageInputDTO.ClientMsgId != nil {
+			clientMsgId = *postMessageInputDTO.ClientMsgId
+		}
+		u.sendChatMessageAck(clientMsgId, output.Message.Message)
+	}
+	if output.Ephemeral != "" {
+		u.hub.NotifyEphemeral(u.UserID, u.SessionID, usecase.EphemeralMessage{
+			ServerId:  channel.ServerId,
+			ChannelId: *channel.Id,
+			Message:   output.Ephemeral,
+		})
+	}
+}
@@ -4,22 +4,33 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 
 	"github.com/hebitigo/CATechAccelChatApp/repository"
+	"github.com/hebitigo/CATechAccelChatApp/usecase"
 )
 
 type Handler struct {
-	hub         *Hub
-	messageRepo repository.MessageRepositoryInterface
-	userRepo    repository.UserRepositoryInterface
+	hub                   *Hub
+	authUsecase           usecase.AuthUsecaseInterface
+	messageUsecase        usecase.MessageUsecaseInterface
+	reactionUsecase       usecase.ReactionUsecaseInterface
+	botEventUsecase       usecase.BotEventUsecaseInterface
+	commandUsecase        usecase.CommandUsecaseInterface
+	messageRepo           repository.MessageRepositoryInterface
+	userRepo              repository.UserRepositoryInterface
+	userServerRepo        repository.UserServerRepositoryInterface
+	serverBotEndpointRepo repository.ServerBotEndpointRepositoryInterface
+	channelRepo           repository.ChannelRepositoryInterface
 }
 
-func NewHandler(hub *Hub, messageRepo repository.MessageRepositoryInterface, userRepo repository.UserRepositoryInterface) *Handler {
-	return &Handler{hub: hub, messageRepo: messageRepo, userRepo: userRepo}
+func NewHandler(hub *Hub, authUsecase usecase.AuthUsecaseInterface, messageUsecase usecase.MessageUsecaseInterface, reactionUsecase usecase.ReactionUsecaseInterface, botEventUsecase usecase.BotEventUsecaseInterface, commandUsecase usecase.CommandUsecaseInterface, messageRepo repository.MessageRepositoryInterface, userRepo repository.UserRepositoryInterface, userServerRepo repository.UserServerRepositoryInterface, serverBotEndpointRepo repository.ServerBotEndpointRepositoryInterface, channelRepo repository.ChannelRepositoryInterface) *Handler {
+	return &Handler{hub: hub, authUsecase: authUsecase, messageUsecase: messageUsecase, reactionUsecase: reactionUsecase, botEventUsecase: botEventUsecase, commandUsecase: commandUsecase, messageRepo: messageRepo, userRepo: userRepo, userServerRepo: userServerRepo, serverBotEndpointRepo: serverBotEndpointRepo, channelRepo: channelRepo}
 }
 
 var upgrader = websocket.Upgrader{
@@ -30,27 +41,140 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
+// ブラウザのWebSocket APIではヘッダを設定できないので、
+// new WebSocket(url, ["bearer", token])のようにSec-WebSocket-Protocolでトークンを送れるようにする
+const bearerSubprotocol = "bearer"
+
+// bearerTokenはクエリパラメータのtoken、Authorizationヘッダ、Sec-WebSocket-Protocolヘッダの順にトークンを探す
+// Sec-WebSocket-Protocolで送られてきた場合は、レスポンスで返すサブプロトコルも返す
+func bearerToken(r *http.Request) (token string, subprotocol string) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token, ""
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+		return token, ""
+	}
+	protocols := websocket.Subprotocols(r)
+	if len(protocols) == 2 && protocols[0] == bearerSubprotocol {
+		return protocols[1], bearerSubprotocol
+	}
+	return "", ""
+}
+
 func (handler *Handler) JoinChannel(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	//upgradeする前にトークンを検証して、認証できない場合はwebsocketの接続を確立しない
+	token, subprotocol := bearerToken(c.Request)
+	if token == "" {
+		c.JSON(401, gin.H{"message": "bearer token is required"})
+		return
+	}
+	//botのトークンの場合はbotとして接続する
+	if strings.HasPrefix(token, usecase.BotTokenPrefix) {
+		handler.joinAsBot(c, token, subprotocol)
+		return
+	}
+	uid, err := handler.authUsecase.VerifyWebsocketToken([]byte(token))
 	if err != nil {
-		err := errors.Wrap(err, "failed to upgrade http to websocket")
-		log.Printf("%+v", err)
+		log.Printf("failed to verify websocket token: %+v", err)
+		c.JSON(401, gin.H{"message": err.Error()})
+		return
+	}
+	//以前のクライアントとの互換性のためにpath paramのuser_idも受け付けるが、トークンのuserと一致する必要がある
+	if pathUserId := c.Param("user_id"); pathUserId != "" && pathUserId != uid {
+		c.JSON(403, gin.H{"message": "user_id does not match the token"})
+		return
+	}
+
+	//再接続時に取りこぼしたメッセージを送るためのカーソル
+	cursor, err := parseReplayCursor(c.Request)
+	if err != nil {
+		c.JSON(400, gin.H{"message": err.Error()})
+		return
+	}
+
+	//Hubでbroadcast先を絞り込むために、接続時にuserが所属しているサーバーを取得しておく
+	serverIds, err := handler.userServerRepo.GetServerIDsByUserID(c.Request.Context(), uid)
+	if err != nil {
+		log.Printf("failed to get servers of user: %+v", err)
 		c.JSON(500, gin.H{"message": err.Error()})
 		return
 	}
 
-	user := &User{
-		UserID:      c.Param("user_id"),
-		hub:         handler.hub,
-		conn:        conn,
-		send:        make(chan []byte, 256),
-		ctx:         context.Background(),
-		messageRepo: handler.messageRepo,
-		userRepo:    handler.userRepo,
+	conn, err := upgrade(c, subprotocol)
+	if err != nil {
+		return
 	}
 
+	user := handler.newUser(conn, uid, serverIds)
+
 	handler.hub.register <- user
-	go user.writePump()
+	//Hubに登録してからwritePumpでreplayすることで、replay中に送られたメッセージを取りこぼさない
+	go user.writePump(cursor)
 	go user.readPump()
 
 }
+
+// joinAsBotはbotのトークンを検証して、botとして接続する
+// botはbotが追加されているサーバーのイベントを受け取る。再接続時のreplayには対応しない
+func (handler *Handler) joinAsBot(c *gin.Context, token string, subprotocol string) {
+	botEndpoint, tokenId, err := handler.authUsecase.VerifyBotToken(c.Request.Context(), token)
+	if err != nil {
+		log.Printf("failed to verify bot token: %+v", err)
+		c.JSON(401, gin.H{"message": err.Error()})
+		return
+	}
+	serverIds, err := handler.serverBotEndpointRepo.GetServerIDsByBotEndpointID(c.Request.Context(), botEndpoint.Id)
+	if err != nil {
+		log.Printf("failed to get servers of bot: %+v", err)
+		c.JSON(500, gin.H{"message": err.Error()})
+		return
+	}
+	conn, err := upgrade(c, subprotocol)
+	if err != nil {
+		return
+	}
+	user := handler.newUser(conn, botUserId(botEndpoint.Id), serverIds)
+	user.botEndpointId = botEndpoint.Id
+	user.botTokenId = tokenId
+
+	handler.hub.register <- user
+	go user.writePump(nil)
+	go user.readPump()
+}
+
+// upgradeはhttpの接続をwebsocketにupgradeする。失敗した場合はレスポンスを返す
+func upgrade(c *gin.Context, subprotocol string) (*websocket.Conn, error) {
+	var responseHeader http.Header
+	if subprotocol != "" {
+		responseHeader = http.Header{"Sec-WebSocket-Protocol": []string{subprotocol}}
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, responseHeader)
+	if err != nil {
+		err := errors.Wrap(err, "failed to upgrade http to websocket")
+		log.Printf("%+v", err)
+		c.JSON(500, gin.H{"message": err.Error()})
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (handler *Handler) newUser(conn *websocket.Conn, uid string, serverIds []uuid.UUID) *User {
+	return &User{
+		UserID:          uid,
+		SessionID:       uuid.NewString(),
+		hub:             handler.hub,
+		conn:            conn,
+		send:            make(chan []byte, 256),
+		ctx:             context.Background(),
+		serverIds:       serverIds,
+		messageRepo:     handler.messageRepo,
+		messageUsecase:  handler.messageUsecase,
+		reactionUsecase: handler.reactionUsecase,
+		botEventUsecase: handler.botEventUsecase,
+		commandUsecase:  handler.commandUsecase,
+		userRepo:        handler.userRepo,
+		userServerRepo:  handler.userServerRepo,
+		channelRepo:     handler.channelRepo,
+		typing:          make(map[uuid.UUID]*typingState),
+	}
+}
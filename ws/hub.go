@@ -1,49 +1,411 @@
 package ws
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/hebitigo/CATechAccelChatApp/entity"
+)
+
 type userId string
 
+type serverId string
+
+type sessionId string
+
 type Hub struct {
-	UserPresence map[userId]*User
-	broadcast    chan []byte
-	register     chan *User
-	unregister   chan *User
+	//1人のuserが複数のタブや端末から接続できるように、userごとに接続(セッション)を管理する
+	UserPresence map[userId]map[sessionId]*User
+	// 接続中のuserが所属しているサーバーと、サーバー毎の接続中のメンバーを管理する
+	userServers   map[userId]map[serverId]struct{}
+	serverMembers map[serverId]map[userId]struct{}
+	register      chan *User
+	unregister    chan *User
+	//特定のセッションにだけ送るメッセージ。セッションはこのHubに接続しているのでbackplaneは経由しない
+	direct chan *sessionMessage
+	//他のレプリカのHubにもイベントを届けるために、broadcastなどは全てbackplaneを経由する
+	backplane Backplane
+	//presenceEventを送ったHubを区別するためのId
+	id string
+	//他のレプリカのHubのうち、userのセッションが接続しているHubのId
+	//最後のセッションが切断されたことを知らせるpresenceEventを受け取った際に、他のHubにセッションが残っているかを判定するために使う
+	remoteSessions map[userId]map[string]struct{}
+}
+
+// hubEventはBackplaneを経由して全てのHubに配信されるイベント
+// どれか1つのフィールドだけが設定される
+type hubEvent struct {
+	Broadcast   *broadcastMessage `json:"broadcast,omitempty"`
+	JoinServer  *serverMember     `json:"join_server,omitempty"`
+	LeaveServer *serverMember     `json:"leave_server,omitempty"`
+	Presence    *presenceEvent    `json:"presence,omitempty"`
+	//Hubに接続しているbotのセッションを切断する
+	DisconnectBot *botDisconnect `json:"disconnect_bot,omitempty"`
+}
+
+// broadcastMessageはServerIdのサーバーに所属しているuserにのみ送信される
+// ExcludeUserIdが設定されている場合はそのuserには送信しない
+// UserIdsが設定されている場合はサーバーのメンバーのうちUserIdsのuserにのみ送信する
+type broadcastMessage struct {
+	ServerId      serverId        `json:"server_id"`
+	ExcludeUserId userId          `json:"exclude_user_id,omitempty"`
+	UserIds       []userId        `json:"user_ids,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+type sessionMessage struct {
+	userId    userId
+	sessionId sessionId
+	payload   []byte
+}
+
+type serverMember struct {
+	UserId   userId   `json:"user_id"`
+	ServerId serverId `json:"server_id"`
 }
 
-func NewHub() *Hub {
+// presenceEventはuserのオンライン状態の変化をuserと同じサーバーに所属しているuserに知らせる
+type presenceEvent struct {
+	UserId    userId     `json:"user_id"`
+	ServerIds []serverId `json:"server_ids"`
+	Active    bool       `json:"active"`
+	//websocketの最後のセッションが切断されたことでオフラインになった場合はtrue
+	Disconnected bool `json:"disconnected"`
+	//websocketのセッションの接続や切断で送った場合は、送ったHubのId
+	HubId string `json:"hub_id,omitempty"`
+}
+
+func NewHub(backplane Backplane) *Hub {
 	return &Hub{
-		broadcast:    make(chan []byte),
-		register:     make(chan *User),
-		unregister:   make(chan *User),
-		UserPresence: make(map[userId]*User),
+		register:       make(chan *User),
+		unregister:     make(chan *User),
+		direct:         make(chan *sessionMessage),
+		UserPresence:   make(map[userId]map[sessionId]*User),
+		userServers:    make(map[userId]map[serverId]struct{}),
+		serverMembers:  make(map[serverId]map[userId]struct{}),
+		backplane:      backplane,
+		id:             uuid.NewString(),
+		remoteSessions: make(map[userId]map[string]struct{}),
+	}
+}
+
+func (h *Hub) publish(event hubEvent) error {
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("cant marshal hubEvent. hubEvent -> %+v", event))
+	}
+	err = h.backplane.Publish(context.Background(), bytes)
+	if err != nil {
+		return errors.Wrap(err, "failed to publish hubEvent")
+	}
+	return nil
+}
+
+// broadcastToServerはpayloadをサーバーに所属している全てのuserに送信する
+func (h *Hub) broadcastToServer(sid uuid.UUID, payload []byte) error {
+	return h.publish(hubEvent{Broadcast: &broadcastMessage{ServerId: serverId(sid.String()), Payload: payload}})
+}
+
+// broadcastToServerExceptはpayloadをサーバーに所属しているuidのuser以外の全てのuserに送信する
+func (h *Hub) broadcastToServerExcept(sid uuid.UUID, uid string, payload []byte) error {
+	return h.publish(hubEvent{Broadcast: &broadcastMessage{ServerId: serverId(sid.String()), ExcludeUserId: userId(uid), Payload: payload}})
+}
+
+// broadcastToServerMembersはpayloadをサーバーに所属しているuidsのuserにのみ送信する
+func (h *Hub) broadcastToServerMembers(sid uuid.UUID, uids []string, payload []byte) error {
+	members := make([]userId, len(uids))
+	for i, uid := range uids {
+		members[i] = userId(uid)
+	}
+	return h.publish(hubEvent{Broadcast: &broadcastMessage{ServerId: serverId(sid.String()), UserIds: members, Payload: payload}})
+}
+
+// sendToSessionはpayloadをuserのこのセッションにのみ送信する
+func (h *Hub) sendToSession(user *User, payload []byte) {
+	h.direct <- &sessionMessage{userId: userId(user.UserID), sessionId: sessionId(user.SessionID), payload: payload}
+}
+
+// JoinServerは接続中のuserが新たにサーバーに参加した際に呼び出して、
+// 以降そのサーバー宛のメッセージがuserに届くようにする
+func (h *Hub) JoinServer(uid string, sid uuid.UUID) {
+	err := h.publish(hubEvent{JoinServer: &serverMember{UserId: userId(uid), ServerId: serverId(sid.String())}})
+	if err != nil {
+		log.Printf("failed to publish join server event: %+v", err)
+	}
+}
+
+// LeaveServerは接続中のuserがサーバーから抜けた際に呼び出して、
+// 以降そのサーバー宛のメッセージがuserに届かないようにする
+func (h *Hub) LeaveServer(uid string, sid uuid.UUID) {
+	err := h.publish(hubEvent{LeaveServer: &serverMember{UserId: userId(uid), ServerId: serverId(sid.String())}})
+	if err != nil {
+		log.Printf("failed to publish leave server event: %+v", err)
+	}
+}
+
+// NotifyChannelAddedはサーバーにチャンネルが追加されたことをサーバーのメンバーに知らせる
+func (h *Hub) NotifyChannelAdded(channel entity.Channel) {
+	bytes, err := json.Marshal(returnSendMessage[channelInfo](addChannelAction, channelInfo{
+		Name:      channel.Name,
+		ServerId:  channel.ServerId.String(),
+		ChannelId: channel.Id.String(),
+	}))
+	if err != nil {
+		log.Printf("cant marshal channelInfo: %+v", errors.Wrap(err, fmt.Sprintf("channel -> %+v", channel)))
+		return
+	}
+	err = h.broadcastToServer(channel.ServerId, bytes)
+	if err != nil {
+		log.Printf("failed to broadcast add channel event: %+v", err)
 	}
 }
 
-// userが参加しているサーバー、チャンネルはメッセージには含むがbackend側ではその情報を元に
-// broadcastするサーバー、チャンネルを絞る混む事はしない
-// backend側ではuserがオンラインかどうか、websocketで接続しているかどうかをHubで管理し、
+// NotifyChannelTopicChangedはチャンネルのトピックが変更されたことをサーバーのメンバーに知らせる
+func (h *Hub) NotifyChannelTopicChanged(channel entity.Channel) {
+	topicInfo := channelTopicInfo{
+		ServerId:  channel.ServerId.String(),
+		ChannelId: channel.Id.String(),
+		Topic:     channel.Topic,
+	}
+	bytes, err := json.Marshal(returnSendMessage[channelTopicInfo](channelTopicAction, topicInfo))
+	if err != nil {
+		log.Printf("cant marshal channelTopicInfo: %+v", errors.Wrap(err, fmt.Sprintf("channelTopicInfo -> %+v", topicInfo)))
+		return
+	}
+	err = h.broadcastToServer(channel.ServerId, bytes)
+	if err != nil {
+		log.Printf("failed to broadcast channel topic event: %+v", err)
+	}
+}
+
+// NotifyUserActivateはuserのオンライン状態をuserが所属しているサーバーのメンバーに知らせる
+func (h *Hub) NotifyUserActivate(uid string, serverIds []uuid.UUID, active bool) {
+	sids := make([]serverId, len(serverIds))
+	for i, sid := range serverIds {
+		sids[i] = serverId(sid.String())
+	}
+	h.publishPresence(&presenceEvent{UserId: userId(uid), ServerIds: sids, Active: active})
+}
+
+func (h *Hub) publishPresence(presence *presenceEvent) {
+	err := h.publish(hubEvent{Presence: presence})
+	if err != nil {
+		log.Printf("failed to publish presence event: %+v", err)
+	}
+}
+
+// userがオンラインかどうか、websocketで接続しているかどうかと、
+// 接続中のuserがどのサーバーに所属しているかをHubで管理し、
 // なんらかの情報がフロントエンドのwebscoketから送られてきた場合には、
-// Hubに登録されている全てのuserに対してbroadcastする
+// 送信先のサーバーに所属しているuserに対してのみbroadcastする
 func (h *Hub) Run() {
+	events, err := h.backplane.Subscribe(context.Background())
+	if err != nil {
+		log.Fatalf("failed to subscribe backplane: %+v", err)
+	}
 	for {
 		select {
 		case user := <-h.register:
-			h.UserPresence[userId(user.UserID)] = user
+			uid := userId(user.UserID)
+			if _, ok := h.UserPresence[uid]; !ok {
+				h.UserPresence[uid] = make(map[sessionId]*User)
+				//最初のセッションが接続した時点でオンラインになったことを知らせる
+				//Runの中でbackplaneにpublishするとHub自身のsubscribeとデッドロックする可能性があるのでgoroutineで行う
+				//botはuserではないのでオンライン状態を知らせない
+				if !isBotUserId(uid) {
+					sids := make([]serverId, len(user.serverIds))
+					for i, sid := range user.serverIds {
+						sids[i] = serverId(sid.String())
+					}
+					go h.publishPresence(&presenceEvent{UserId: uid, ServerIds: sids, Active: true, HubId: h.id})
+				}
+			}
+			h.UserPresence[uid][sessionId(user.SessionID)] = user
+			for _, sid := range user.serverIds {
+				h.addServerMember(uid, serverId(sid.String()))
+			}
 		case user := <-h.unregister:
-			if _, ok := h.UserPresence[userId(user.UserID)]; ok {
-				delete(h.UserPresence, userId(user.UserID))
-				close(user.send)
-			}
-		case broadcastInfo := <-h.broadcast:
-			for _, user := range h.UserPresence {
-				select {
-				case user.send <- broadcastInfo:
-				//user.sendが閉じてる場合のブロッキングを防ぐためにdefaultを設定
-				default:
-					close(user.send)
-					delete(h.UserPresence, userId(user.UserID))
+			h.removeSession(user)
+		case message := <-h.direct:
+			//既に切断されたセッションのsendは閉じているので送らない
+			user, ok := h.UserPresence[message.userId][message.sessionId]
+			if !ok {
+				continue
+			}
+			select {
+			case user.send <- message.payload:
+			default:
+				h.removeSession(user)
+			}
+		case bytes, ok := <-events:
+			if !ok {
+				log.Printf("backplane subscription is closed")
+				return
+			}
+			var event hubEvent
+			err := json.Unmarshal(bytes, &event)
+			if err != nil {
+				err = errors.Wrap(err, fmt.Sprintf("cant unmarshal hubEvent from backplane. bytes -> %s", bytes))
+				log.Printf("%+v", err)
+				continue
+			}
+			switch {
+			case event.Broadcast != nil:
+				h.deliver(event.Broadcast)
+			case event.JoinServer != nil:
+				//接続していないuserの所属は次回接続時にDBから取得するので管理しない
+				if _, ok := h.UserPresence[event.JoinServer.UserId]; ok {
+					h.addServerMember(event.JoinServer.UserId, event.JoinServer.ServerId)
 				}
+			case event.LeaveServer != nil:
+				h.removeServerMember(event.LeaveServer.UserId, event.LeaveServer.ServerId)
+			case event.Presence != nil:
+				h.deliverPresence(event.Presence)
+			case event.DisconnectBot != nil:
+				h.disconnectBot(event.DisconnectBot)
 			}
+		}
+	}
+}
+
+// deliverはこのHubに接続しているセッションのうち、送信先のサーバーのメンバーのものにmessageを送る
+func (h *Hub) deliver(message *broadcastMessage) {
+	members := h.serverMembers[message.ServerId]
+	if message.UserIds != nil {
+		for _, uid := range message.UserIds {
+			if _, ok := members[uid]; ok {
+				h.sendToUser(uid, message.Payload)
+			}
+		}
+		return
+	}
+	for uid := range members {
+		if uid == message.ExcludeUserId {
+			continue
+		}
+		h.sendToUser(uid, message.Payload)
+	}
+}
+
+// deliverPresenceはuserと同じサーバーに所属しているこのHubのuserにuser_activateを送る
+// 複数のサーバーを共有しているuserにも1回だけ送る
+// 受け取ったpresenceEventはこのHubのuserに送るだけで、backplaneにpublishし直さない
+func (h *Hub) deliverPresence(presence *presenceEvent) {
+	if presence.HubId != "" && presence.HubId != h.id {
+		h.trackRemoteSession(presence)
+	}
+	//あるHubで最後のセッションが切断されても、他のHubにセッションが残っている場合はオンラインのままなので知らせない
+	if presence.Disconnected {
+		if _, ok := h.UserPresence[presence.UserId]; ok {
+			return
+		}
+		if len(h.remoteSessions[presence.UserId]) > 0 {
+			return
+		}
+	}
+	bytes, err := json.Marshal(returnSendMessage[userActivateInfo](userActivateAction, userActivateInfo{
+		UserId: string(presence.UserId),
+		Active: presence.Active,
+	}))
+	if err != nil {
+		log.Printf("cant marshal userActivateInfo: %+v", errors.Wrap(err, fmt.Sprintf("presence -> %+v", presence)))
+		return
+	}
+	recipients := make(map[userId]struct{})
+	for _, sid := range presence.ServerIds {
+		for uid := range h.serverMembers[sid] {
+			recipients[uid] = struct{}{}
+		}
+	}
+	for uid := range recipients {
+		h.sendToUser(uid, bytes)
+	}
+}
 
+// trackRemoteSessionは他のHubから届いたセッションの接続と切断で、userのセッションが接続しているHubを更新する
+// Hubが停止して切断を知らせられなかった場合は、そのHubにセッションが残っているものとして扱う
+func (h *Hub) trackRemoteSession(presence *presenceEvent) {
+	uid := presence.UserId
+	if presence.Disconnected {
+		delete(h.remoteSessions[uid], presence.HubId)
+		if len(h.remoteSessions[uid]) == 0 {
+			delete(h.remoteSessions, uid)
 		}
+		return
+	}
+	if _, ok := h.remoteSessions[uid]; !ok {
+		h.remoteSessions[uid] = make(map[string]struct{})
+	}
+	h.remoteSessions[uid][presence.HubId] = struct{}{}
+}
+
+// sendToUserはuserの全てのセッションにpayloadを送る
+func (h *Hub) sendToUser(uid userId, payload []byte) {
+	for _, user := range h.UserPresence[uid] {
+		select {
+		case user.send <- payload:
+		//user.sendが閉じてる場合のブロッキングを防ぐためにdefaultを設定
+		default:
+			h.removeSession(user)
+		}
+	}
+}
+
+func (h *Hub) addServerMember(uid userId, sid serverId) {
+	if _, ok := h.userServers[uid]; !ok {
+		h.userServers[uid] = make(map[serverId]struct{})
+	}
+	h.userServers[uid][sid] = struct{}{}
+	if _, ok := h.serverMembers[sid]; !ok {
+		h.serverMembers[sid] = make(map[userId]struct{})
+	}
+	h.serverMembers[sid][uid] = struct{}{}
+}
+
+func (h *Hub) removeServerMember(uid userId, sid serverId) {
+	delete(h.userServers[uid], sid)
+	delete(h.serverMembers[sid], uid)
+	if len(h.serverMembers[sid]) == 0 {
+		delete(h.serverMembers, sid)
+	}
+}
+
+// removeSessionはセッションを削除してsendを閉じる
+// userの最後のセッションが削除された場合はuserをオフラインとして扱う
+func (h *Hub) removeSession(user *User) {
+	uid := userId(user.UserID)
+	sessions, ok := h.UserPresence[uid]
+	if !ok {
+		return
+	}
+	if _, ok := sessions[sessionId(user.SessionID)]; !ok {
+		return
+	}
+	delete(sessions, sessionId(user.SessionID))
+	close(user.send)
+	if len(sessions) == 0 {
+		h.removeUser(uid)
+	}
+}
+
+func (h *Hub) removeUser(uid userId) {
+	sids := make([]serverId, 0, len(h.userServers[uid]))
+	for sid := range h.userServers[uid] {
+		sids = append(sids, sid)
+		delete(h.serverMembers[sid], uid)
+		if len(h.serverMembers[sid]) == 0 {
+			delete(h.serverMembers, sid)
+		}
+	}
+	delete(h.userServers, uid)
+	delete(h.UserPresence, uid)
+	if isBotUserId(uid) {
+		return
 	}
+	go h.publishPresence(&presenceEvent{UserId: uid, ServerIds: sids, Active: false, Disconnected: true, HubId: h.id})
 }
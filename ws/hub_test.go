@@ -0,0 +1,312 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// テストでイベントが届くのを待つ時間と、届かないことを確認するために待つ時間
+const (
+	receiveTimeout = time.Second
+	silenceWait    = 200 * time.Millisecond
+)
+
+// newTestHubはbackplaneを使うHubを起動する。Hubはbackplaneが閉じられると止まる
+func newTestHub(t *testing.T, backplane Backplane) *Hub {
+	t.Helper()
+	hub := NewHub(backplane)
+	go hub.Run()
+	return hub
+}
+
+// newTestBackplaneはテストの終了時に閉じるMemoryBackplaneを作る
+func newTestBackplane(t *testing.T) *MemoryBackplane {
+	t.Helper()
+	backplane := NewMemoryBackplane()
+	t.Cleanup(func() { backplane.Close() })
+	return backplane
+}
+
+// connectTestUserはconnを持たないセッションをHubに登録する。Hubから届いたイベントはsendから読み出す
+// registerはRunが受け取るまで待つので、登録した後はHubがbackplaneをsubscribeしている
+func connectTestUser(hub *Hub, uid string, serverIds ...uuid.UUID) *User {
+	user := &User{
+		UserID:    uid,
+		SessionID: uuid.NewString(),
+		hub:       hub,
+		send:      make(chan []byte, 256),
+		ctx:       context.Background(),
+		serverIds: serverIds,
+		typing:    make(map[uuid.UUID]*typingState),
+	}
+	hub.register <- user
+	return user
+}
+
+type testEvent struct {
+	ActionType actionType      `json:"action_type"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// receiveActionはuserにatのイベントが届くまで待ってpayloadを返す。他のactionのイベントは読み飛ばす
+func receiveAction(t *testing.T, user *User, at actionType) json.RawMessage {
+	t.Helper()
+	timeout := time.After(receiveTimeout)
+	for {
+		select {
+		case bytes, ok := <-user.send:
+			if !ok {
+				t.Fatalf("send of %s is closed while waiting for %s", user.UserID, at)
+			}
+			var event testEvent
+			err := json.Unmarshal(bytes, &event)
+			if err != nil {
+				t.Fatalf("invalid event: %v. event -> %s", err, bytes)
+			}
+			if event.ActionType == at {
+				return event.Payload
+			}
+		case <-timeout:
+			t.Fatalf("%s did not receive %s", user.UserID, at)
+		}
+	}
+}
+
+// expectNoActionはsilenceWaitの間にuserにatのイベントが届かないことを確認する
+func expectNoAction(t *testing.T, user *User, at actionType) {
+	t.Helper()
+	timeout := time.After(silenceWait)
+	for {
+		select {
+		case bytes, ok := <-user.send:
+			if !ok {
+				return
+			}
+			var event testEvent
+			err := json.Unmarshal(bytes, &event)
+			if err != nil {
+				t.Fatalf("invalid event: %v. event -> %s", err, bytes)
+			}
+			if event.ActionType == at {
+				t.Fatalf("%s received unexpected %s. payload -> %s", user.UserID, at, event.Payload)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// testChatMessageはbroadcastするchat_messageのpayloadを作る
+func testChatMessage(t *testing.T, messageId string) []byte {
+	t.Helper()
+	bytes, err := json.Marshal(returnSendMessage[outgoingChatMessageInfo](chatMessageAction, outgoingChatMessageInfo{MessageId: messageId}))
+	if err != nil {
+		t.Fatalf("cant marshal chat message: %v", err)
+	}
+	return bytes
+}
+
+func receiveChatMessage(t *testing.T, user *User, messageId string) {
+	t.Helper()
+	var message outgoingChatMessageInfo
+	err := json.Unmarshal(receiveAction(t, user, chatMessageAction), &message)
+	if err != nil {
+		t.Fatalf("invalid chat message: %v", err)
+	}
+	if message.MessageId != messageId {
+		t.Fatalf("%s received message %s, want %s", user.UserID, message.MessageId, messageId)
+	}
+}
+
+// サーバー宛のイベントはそのサーバーに所属しているuserにのみ届く
+func TestBroadcastToServerRoutesOnlyToMembers(t *testing.T) {
+	hub := newTestHub(t, newTestBackplane(t))
+	server1 := uuid.New()
+	server2 := uuid.New()
+	member := connectTestUser(hub, "auth0|member", server1)
+	other := connectTestUser(hub, "auth0|other", server2)
+	both := connectTestUser(hub, "auth0|both", server1, server2)
+
+	err := hub.broadcastToServer(server1, testChatMessage(t, "m1"))
+	if err != nil {
+		t.Fatalf("broadcastToServer() error = %v", err)
+	}
+	receiveChatMessage(t, member, "m1")
+	receiveChatMessage(t, both, "m1")
+	expectNoAction(t, other, chatMessageAction)
+}
+
+func TestBroadcastToServerExcept(t *testing.T) {
+	hub := newTestHub(t, newTestBackplane(t))
+	server := uuid.New()
+	sender := connectTestUser(hub, "auth0|sender", server)
+	member := connectTestUser(hub, "auth0|member", server)
+
+	err := hub.broadcastToServerExcept(server, sender.UserID, testChatMessage(t, "m1"))
+	if err != nil {
+		t.Fatalf("broadcastToServerExcept() error = %v", err)
+	}
+	receiveChatMessage(t, member, "m1")
+	expectNoAction(t, sender, chatMessageAction)
+}
+
+// UserIdsを指定した場合も、サーバーのメンバーでないuserには届かない
+func TestBroadcastToServerMembers(t *testing.T) {
+	hub := newTestHub(t, newTestBackplane(t))
+	server1 := uuid.New()
+	server2 := uuid.New()
+	participant := connectTestUser(hub, "auth0|participant", server1)
+	member := connectTestUser(hub, "auth0|member", server1)
+	outsider := connectTestUser(hub, "auth0|outsider", server2)
+
+	err := hub.broadcastToServerMembers(server1, []string{participant.UserID, outsider.UserID}, testChatMessage(t, "m1"))
+	if err != nil {
+		t.Fatalf("broadcastToServerMembers() error = %v", err)
+	}
+	receiveChatMessage(t, participant, "m1")
+	expectNoAction(t, member, chatMessageAction)
+	expectNoAction(t, outsider, chatMessageAction)
+}
+
+// 接続中にサーバーに参加したuserには以降のイベントが届き、抜けたuserには届かなくなる
+func TestJoinAndLeaveServer(t *testing.T) {
+	hub := newTestHub(t, newTestBackplane(t))
+	server := uuid.New()
+	user := connectTestUser(hub, "auth0|user")
+
+	hub.JoinServer(user.UserID, server)
+	err := hub.broadcastToServer(server, testChatMessage(t, "after-join"))
+	if err != nil {
+		t.Fatalf("broadcastToServer() error = %v", err)
+	}
+	receiveChatMessage(t, user, "after-join")
+
+	hub.LeaveServer(user.UserID, server)
+	err = hub.broadcastToServer(server, testChatMessage(t, "after-leave"))
+	if err != nil {
+		t.Fatalf("broadcastToServer() error = %v", err)
+	}
+	expectNoAction(t, user, chatMessageAction)
+}
+
+// receivePresenceはuserにuidのuser_activateが届くまで待って、オンラインかどうかを返す
+func receivePresence(t *testing.T, user *User, uid string) bool {
+	t.Helper()
+	for {
+		var activate userActivateInfo
+		err := json.Unmarshal(receiveAction(t, user, userActivateAction), &activate)
+		if err != nil {
+			t.Fatalf("invalid user_activate: %v", err)
+		}
+		if activate.UserId == uid {
+			return activate.Active
+		}
+	}
+}
+
+// expectNoPresenceはsilenceWaitの間にuserにuidのuser_activateが届かないことを確認する
+func expectNoPresence(t *testing.T, user *User, uid string) {
+	t.Helper()
+	timeout := time.After(silenceWait)
+	for {
+		select {
+		case bytes, ok := <-user.send:
+			if !ok {
+				return
+			}
+			var event testEvent
+			err := json.Unmarshal(bytes, &event)
+			if err != nil {
+				t.Fatalf("invalid event: %v. event -> %s", err, bytes)
+			}
+			if event.ActionType != userActivateAction {
+				continue
+			}
+			var activate userActivateInfo
+			err = json.Unmarshal(event.Payload, &activate)
+			if err != nil {
+				t.Fatalf("invalid user_activate: %v", err)
+			}
+			if activate.UserId == uid {
+				t.Fatalf("%s received unexpected user_activate of %s. active -> %v", user.UserID, uid, activate.Active)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// expectClosedはuserのsendに残っているイベントを読み飛ばして、sendが閉じられていることを確認する
+func expectClosed(t *testing.T, user *User) {
+	t.Helper()
+	timeout := time.After(receiveTimeout)
+	for {
+		select {
+		case _, ok := <-user.send:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("send of %s must be closed", user.UserID)
+		}
+	}
+}
+
+// 同じuserの複数のセッションにはそれぞれイベントが届く
+func TestBroadcastToAllSessionsOfUser(t *testing.T) {
+	hub := newTestHub(t, newTestBackplane(t))
+	server := uuid.New()
+	tab1 := connectTestUser(hub, "auth0|user", server)
+	tab2 := connectTestUser(hub, "auth0|user", server)
+
+	err := hub.broadcastToServer(server, testChatMessage(t, "m1"))
+	if err != nil {
+		t.Fatalf("broadcastToServer() error = %v", err)
+	}
+	receiveChatMessage(t, tab1, "m1")
+	receiveChatMessage(t, tab2, "m1")
+}
+
+// sendToSessionは指定したセッションにのみ届き、同じuserの他のセッションには届かない
+func TestSendToSession(t *testing.T) {
+	hub := newTestHub(t, newTestBackplane(t))
+	server := uuid.New()
+	tab1 := connectTestUser(hub, "auth0|user", server)
+	tab2 := connectTestUser(hub, "auth0|user", server)
+
+	hub.sendToSession(tab1, testChatMessage(t, "ack"))
+	receiveChatMessage(t, tab1, "ack")
+	expectNoAction(t, tab2, chatMessageAction)
+}
+
+// 一部のセッションが切断されてもuserはオンラインのままで、残りのセッションにイベントが届く
+// 最後のセッションが切断された時にのみオフラインになる
+func TestUserStaysOnlineUntilLastSessionDisconnects(t *testing.T) {
+	hub := newTestHub(t, newTestBackplane(t))
+	server := uuid.New()
+	observer := connectTestUser(hub, "auth0|observer", server)
+	tab1 := connectTestUser(hub, "auth0|user", server)
+	if !receivePresence(t, observer, tab1.UserID) {
+		t.Fatalf("user must become online when the first session connects")
+	}
+	tab2 := connectTestUser(hub, "auth0|user", server)
+	expectNoPresence(t, observer, tab1.UserID)
+
+	hub.unregister <- tab1
+	expectClosed(t, tab1)
+	expectNoPresence(t, observer, tab1.UserID)
+	err := hub.broadcastToServer(server, testChatMessage(t, "m1"))
+	if err != nil {
+		t.Fatalf("broadcastToServer() error = %v", err)
+	}
+	receiveChatMessage(t, tab2, "m1")
+
+	hub.unregister <- tab2
+	if receivePresence(t, observer, tab2.UserID) {
+		t.Errorf("user must become offline when the last session disconnects")
+	}
+}
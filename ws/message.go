@@ -0,0 +1,305 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/hebitigo/CATechAccelChatApp/entity"
+	"github.com/hebitigo/CATechAccelChatApp/usecase"
+)
+
+type incomingMessageEditInfo struct {
+	MessageId string `json:"message_id" validate:"required,uuid"`
+	Message   string `json:"message" validate:"required"`
+}
+
+type incomingMessageDeleteInfo struct {
+	MessageId string `json:"message_id" validate:"required,uuid"`
+}
+
+type outgoingMessageDeleteInfo struct {
+	MessageId string    `json:"message_id"`
+	ServerId  string    `json:"server_id"`
+	ChannelId string    `json:"channel_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type outgoingMessageEditInfo struct {
+	MessageId string    `json:"message_id"`
+	ServerId  string    `json:"server_id"`
+	ChannelId string    `json:"channel_id"`
+	Message   string    `json:"message"`
+	EditedAt  time.Time `json:"edited_at"`
+}
+
+func (u *User) handleMessageEdit(payload json.RawMessage) {
+	var editInfo incomingMessageEditInfo
+	err := decodePayload(payload, &editInfo)
+	if err != nil {
+		log.Printf("%+v", err)
+		u.sendError(err)
+		return
+	}
+	messageId, err := uuid.Parse(editInfo.MessageId)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("cant parse messageId. messageId -> %s", editInfo.MessageId))
+		log.Printf("%+v", err)
+		u.sendError(err)
+		return
+	}
+	//編集したメッセージはusecaseからHub経由でチャンネルのメンバーに送られる
+	_, err = u.messageUsecase.EditMessage(u.ctx, usecase.EditMessageInputDTO{
+		MessageId: messageId,
+		UserId:    u.UserID,
+		Message:   editInfo.Message,
+	})
+	if err != nil {
+		log.Printf("failed to edit message provided by websocket: %+v", err)
+		u.sendError(err)
+		return
+	}
+}
+
+func (u *User) handleMessageDelete(payload json.RawMessage) {
+	var deleteInfo incomingMessageDeleteInfo
+	err := decodePayload(payload, &deleteInfo)
+	if err != nil {
+		log.Printf("%+v", err)
+		u.sendError(err)
+		return
+	}
+	messageId, err := uuid.Parse(deleteInfo.MessageId)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("cant parse messageId. messageId -> %s", deleteInfo.MessageId))
+		log.Printf("%+v", err)
+		u.sendError(err)
+		return
+	}
+	_, err = u.messageUsecase.DeleteMessage(u.ctx, usecase.DeleteMessageInputDTO{
+		MessageId: messageId,
+		UserId:    u.UserID,
+	})
+	if err != nil {
+		log.Printf("failed to delete message provided by websocket: %+v", err)
+		u.sendError(err)
+		return
+	}
+}
+
+func newOutgoingMessageEditInfo(sid uuid.UUID, message entity.Message) outgoingMessageEditInfo {
+	return outgoingMessageEditInfo{
+		MessageId: message.Id.String(),
+		ServerId:  sid.String(),
+		ChannelId: message.ChannelId.String(),
+		Message:   message.Message,
+		EditedAt:  *message.EditedAt,
+	}
+}
+
+func newOutgoingMessageDeleteInfo(sid uuid.UUID, message entity.Message) outgoingMessageDeleteInfo {
+	return outgoingMessageDeleteInfo{
+		MessageId: message.Id.String(),
+		ServerId:  sid.String(),
+		ChannelId: message.ChannelId.String(),
+		DeletedAt: *message.DeletedAt,
+	}
+}
+
+// NotifyMessageEditedはメッセージが編集されたことをサーバーのメンバーに知らせる
+func (h *Hub) NotifyMessageEdited(sid uuid.UUID, message entity.Message) {
+	editInfo := newOutgoingMessageEditInfo(sid, message)
+	bytes, err := json.Marshal(returnSendMessage[outgoingMessageEditInfo](messageEditAction, editInfo))
+	if err != nil {
+		log.Printf("cant marshal messageEditInfo: %+v", errors.Wrap(err, fmt.Sprintf("messageEditInfo -> %+v", editInfo)))
+		return
+	}
+	err = h.broadcastToServer(sid, bytes)
+	if err != nil {
+		log.Printf("failed to broadcast message edit event: %+v", err)
+	}
+}
+
+// NotifyMessageDeletedはメッセージが削除されたことをサーバーのメンバーに知らせる
+func (h *Hub) NotifyMessageDeleted(sid uuid.UUID, message entity.Message) {
+	deleteInfo := newOutgoingMessageDeleteInfo(sid, message)
+	bytes, err := json.Marshal(returnSendMessage[outgoingMessageDeleteInfo](messageDeleteAction, deleteInfo))
+	if err != nil {
+		log.Printf("cant marshal messageDeleteInfo: %+v", errors.Wrap(err, fmt.Sprintf("messageDeleteInfo -> %+v", deleteInfo)))
+		return
+	}
+	err = h.broadcastToServer(sid, bytes)
+	if err != nil {
+		log.Printf("failed to broadcast message delete event: %+v", err)
+	}
+}
+
+func (u *User) handleChatMessage(payload json.RawMessage) {
+	var chatMessageInfo incomingChatMessageInfo
+	err := decodePayload(payload, &chatMessageInfo)
+	if err != nil {
+		log.Printf("%+v", err)
+		u.sendError(err)
+		return
+	}
+	if u.botEndpointId != "" {
+		u.handleBotChatMessage(chatMessageInfo)
+		return
+	}
+	channel, err := u.authorizeChannel(chatMessageInfo.ServerId, chatMessageInfo.ChannelId)
+	if err != nil {
+		log.Printf("%+v", err)
+		u.sendError(err)
+		return
+	}
+	postMessageInputDTO := usecase.PostMessageInputDTO{
+		UserId:    u.UserID,
+		ChannelId: *channel.Id,
+		Message:   chatMessageInfo.Message,
+	}
+	if chatMessageInfo.ParentMessageId != "" {
+		parentMessageId, err := uuid.Parse(chatMessageInfo.ParentMessageId)
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("cant parse parentMessageId. parentMessageId -> %s", chatMessageInfo.ParentMessageId))
+			log.Printf("%+v", err)
+			u.sendError(err)
+			return
+		}
+		postMessageInputDTO.ParentMessageId = &parentMessageId
+	}
+	if chatMessageInfo.ClientMsgId != "" {
+		postMessageInputDTO.ClientMsgId = &chatMessageInfo.ClientMsgId
+	}
+	//メッセージを送信したので入力中の表示を消す
+	u.stopTyping(*channel.Id)
+	if strings.HasPrefix(chatMessageInfo.Message, "/") {
+		u.handleCommand(channel, postMessageInputDTO)
+		return
+	}
+	//送信したメッセージはusecaseからHub経由でサーバーのメンバーに送られる
+	message, err := u.messageUsecase.PostMessage(u.ctx, postMessageInputDTO)
+	if err != nil {
+		log.Printf("failed to post message provided by websocket: %+v", err)
+		u.sendError(err)
+		return
+	}
+	//再送の場合も保存済みのメッセージのIdを返すので、クライアントは仮表示しているメッセージと対応付けられる
+	u.sendChatMessageAck(chatMessageInfo.ClientMsgId, message.Message)
+}
+
+// handleBotChatMessageはbotとして接続しているセッションから送られてきたメッセージを、
+// userではなくbotのメッセージとして投稿する
+// botのメッセージはuser_idがNULLなので、client_msg_idによる重複の排除は行わない
+func (u *User) handleBotChatMessage(chatMessageInfo incomingChatMessageInfo) {
+	serverId, err := uuid.Parse(chatMessageInfo.ServerId)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("cant parse serverId. serverId -> %s", chatMessageInfo.ServerId))
+		log.Printf("%+v", err)
+		u.sendError(err)
+		return
+	}
+	channelId, err := uuid.Parse(chatMessageInfo.ChannelId)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("cant parse channelId. channelId -> %s", chatMessageInfo.ChannelId))
+		log.Printf("%+v", err)
+		u.sendError(err)
+		return
+	}
+	postBotMessageInputDTO := usecase.PostBotMessageInputDTO{
+		BotEndpointId: u.botEndpointId,
+		TokenId:       u.botTokenId,
+		ServerId:      serverId,
+		ChannelId:     channelId,
+		Message:       chatMessageInfo.Message,
+	}
+	if chatMessageInfo.ParentMessageId != "" {
+		parentMessageId, err := uuid.Parse(chatMessageInfo.ParentMessageId)
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("cant parse parentMessageId. parentMessageId -> %s", chatMessageInfo.ParentMessageId))
+			log.Printf("%+v", err)
+			u.sendError(err)
+			return
+		}
+		postBotMessageInputDTO.ParentMessageId = &parentMessageId
+	}
+	message, err := u.botEventUsecase.PostBotMessage(u.ctx, postBotMessageInputDTO)
+	if err != nil {
+		log.Printf("failed to post bot message provided by websocket: %+v", err)
+		u.sendError(err)
+		return
+	}
+	u.sendChatMessageAck(chatMessageInfo.ClientMsgId, message.Message)
+}
+
+// sendChatMessageAckはメッセージを送信したセッションにのみ保存したメッセージを知らせる
+func (u *User) sendChatMessageAck(clientMsgId string, message entity.Message) {
+	ackInfo := chatMessageAckInfo{
+		ClientMsgId: clientMsgId,
+		MessageId:   message.Id.String(),
+		ChannelId:   message.ChannelId.String(),
+		Seq:         message.Seq,
+		CreatedAt:   message.CreatedAt,
+	}
+	bytes, err := json.Marshal(returnSendMessage[chatMessageAckInfo](chatMessageAckAction, ackInfo))
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("cant marshal ackInfo. ackInfo -> %+v", ackInfo))
+		log.Printf("%+v", err)
+		u.sendError(err)
+		return
+	}
+	u.hub.sendToSession(u, bytes)
+}
+
+func newOutgoingChatMessageInfo(sid uuid.UUID, message entity.MessageWithUser) outgoingChatMessageInfo {
+	chatMessageInfo := outgoingChatMessageInfo{
+		MessageId:        message.Id.String(),
+		IsBot:            message.IsBot,
+		UserName:         message.UserName,
+		UserIconImageURL: message.IconURL,
+		ServerId:         sid.String(),
+		ChannelId:        message.ChannelId.String(),
+		Seq:              message.Seq,
+		Message:          message.Message.Message,
+		CreatedAt:        message.CreatedAt,
+	}
+	if message.ParentMessageId != nil {
+		chatMessageInfo.ParentMessageId = message.ParentMessageId.String()
+	}
+	if message.WebhookId != nil {
+		chatMessageInfo.WebhookId = message.WebhookId.String()
+	}
+	return chatMessageInfo
+}
+
+// NotifyMessagePostedは送信されたメッセージをサーバーのメンバーに知らせる
+func (h *Hub) NotifyMessagePosted(sid uuid.UUID, message entity.MessageWithUser) {
+	chatMessageInfo := newOutgoingChatMessageInfo(sid, message)
+	bytes, err := json.Marshal(returnSendMessage[outgoingChatMessageInfo](chatMessageAction, chatMessageInfo))
+	if err != nil {
+		log.Printf("cant marshal chatMessageInfo: %+v", errors.Wrap(err, fmt.Sprintf("chatMessageInfo -> %+v", chatMessageInfo)))
+		return
+	}
+	err = h.broadcastToServer(sid, bytes)
+	if err != nil {
+		log.Printf("failed to broadcast chat message: %+v", err)
+	}
+}
+
+// NotifyThreadRepliedはスレッドへの返信をスレッドに参加しているuserにのみ知らせる
+func (h *Hub) NotifyThreadReplied(sid uuid.UUID, message entity.MessageWithUser, participantIds []string) {
+	chatMessageInfo := newOutgoingChatMessageInfo(sid, message)
+	bytes, err := json.Marshal(returnSendMessage[outgoingChatMessageInfo](threadReplyAction, chatMessageInfo))
+	if err != nil {
+		log.Printf("cant marshal chatMessageInfo: %+v", errors.Wrap(err, fmt.Sprintf("chatMessageInfo -> %+v", chatMessageInfo)))
+		return
+	}
+	err = h.broadcastToServerMembers(sid, participantIds, bytes)
+	if err != nil {
+		log.Printf("failed to broadcast thread reply: %+v", err)
+	}
+}
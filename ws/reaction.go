@@ -0,0 +1,88 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/hebitigo/CATechAccelChatApp/entity"
+	"github.com/hebitigo/CATechAccelChatApp/usecase"
+)
+
+type incomingReactionInfo struct {
+	MessageId string `json:"message_id" validate:"required,uuid"`
+	Emoji     string `json:"emoji" validate:"required,max=64"`
+}
+
+type outgoingReactionInfo struct {
+	MessageId string `json:"message_id"`
+	ServerId  string `json:"server_id"`
+	ChannelId string `json:"channel_id"`
+	UserId    string `json:"user_id"`
+	Emoji     string `json:"emoji"`
+}
+
+func (u *User) handleReaction(at actionType, payload json.RawMessage) {
+	var reactionInfo incomingReactionInfo
+	err := decodePayload(payload, &reactionInfo)
+	if err != nil {
+		log.Printf("%+v", err)
+		u.sendError(err)
+		return
+	}
+	messageId, err := uuid.Parse(reactionInfo.MessageId)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("cant parse messageId. messageId -> %s", reactionInfo.MessageId))
+		log.Printf("%+v", err)
+		u.sendError(err)
+		return
+	}
+	reactionInputDTO := usecase.ReactionInputDTO{
+		MessageId: messageId,
+		UserId:    u.UserID,
+		Emoji:     reactionInfo.Emoji,
+	}
+	//リアクションの変更はusecaseからHub経由でチャンネルのメンバーに送られる
+	if at == reactionAddAction {
+		err = u.reactionUsecase.AddReaction(u.ctx, reactionInputDTO)
+	} else {
+		err = u.reactionUsecase.RemoveReaction(u.ctx, reactionInputDTO)
+	}
+	if err != nil {
+		log.Printf("failed to update reaction provided by websocket: %+v", err)
+		u.sendError(err)
+		return
+	}
+}
+
+// NotifyReactionAddedはメッセージにリアクションが追加されたことをサーバーのメンバーに知らせる
+func (h *Hub) NotifyReactionAdded(sid uuid.UUID, message entity.Message, uid string, emoji string) {
+	h.notifyReaction(reactionAddAction, sid, message, uid, emoji)
+}
+
+// NotifyReactionRemovedはメッセージからリアクションが削除されたことをサーバーのメンバーに知らせる
+func (h *Hub) NotifyReactionRemoved(sid uuid.UUID, message entity.Message, uid string, emoji string) {
+	h.notifyReaction(reactionRemoveAction, sid, message, uid, emoji)
+}
+
+func (h *Hub) notifyReaction(at actionType, sid uuid.UUID, message entity.Message, uid string, emoji string) {
+	reactionInfo := outgoingReactionInfo{
+		MessageId: message.Id.String(),
+		ServerId:  sid.String(),
+		ChannelId: message.ChannelId.String(),
+		UserId:    uid,
+		Emoji:     emoji,
+	}
+	bytes, err := json.Marshal(returnSendMessage[outgoingReactionInfo](at, reactionInfo))
+	if err != nil {
+		log.Printf("cant marshal reactionInfo: %+v", errors.Wrap(err, fmt.Sprintf("reactionInfo -> %+v", reactionInfo)))
+		return
+	}
+	err = h.broadcastToServer(sid, bytes)
+	if err != nil {
+		log.Printf("failed to broadcast reaction event: %+v", err)
+	}
+}
@@ -0,0 +1,261 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"github.com/hebitigo/CATechAccelChatApp/entity"
+)
+
+const (
+	//再接続時に送る取りこぼしたメッセージと、取りこぼしたメッセージの編集や削除のそれぞれの最大件数
+	//これより多い場合はreplay_completeのtruncatedをtrueにして、REST APIで取得し直してもらう
+	maxReplayMessages = 500
+	//replayしたメッセージがHubからも届いた場合に重複して送らないようにする期間
+	replayDedupeWindow = 30 * time.Second
+	//replay中にHubから届いたイベントを溜めておく最大件数
+	//これを超える場合は接続を切って、クライアントに再接続してもらう
+	maxHeldLiveEvents = 1000
+)
+
+// replayCursorは再接続時にクライアントが最後に受け取ったメッセージを表す
+// ?cursor={channel_id}:{message_id}でチャンネルごとに、?last_message_id={message_id}で全てのチャンネルに対して指定する
+// 両方指定された場合は、cursorで指定されていないチャンネルにlast_message_idを使う
+type replayCursor struct {
+	channelCursors map[uuid.UUID]uuid.UUID
+	lastMessageId  *uuid.UUID
+}
+
+// Countはreplayした新しいメッセージの件数、Changesはreplayした編集と削除の件数
+type replayCompleteInfo struct {
+	Count     int  `json:"count"`
+	Changes   int  `json:"changes"`
+	Truncated bool `json:"truncated"`
+}
+
+// parseReplayCursorはクエリパラメータからカーソルを取得する
+// カーソルが指定されていない場合はnilを返す
+func parseReplayCursor(r *http.Request) (*replayCursor, error) {
+	query := r.URL.Query()
+	cursor := &replayCursor{channelCursors: make(map[uuid.UUID]uuid.UUID)}
+	for _, value := range query["cursor"] {
+		channel, message, ok := strings.Cut(value, ":")
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("cursor must be {channel_id}:{message_id}. cursor -> %s", value))
+		}
+		channelId, err := uuid.Parse(channel)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("cant parse channelId of cursor. cursor -> %s", value))
+		}
+		messageId, err := uuid.Parse(message)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("cant parse messageId of cursor. cursor -> %s", value))
+		}
+		cursor.channelCursors[channelId] = messageId
+	}
+	if value := query.Get("last_message_id"); value != "" {
+		messageId, err := uuid.Parse(value)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("cant parse last_message_id. last_message_id -> %s", value))
+		}
+		cursor.lastMessageId = &messageId
+	}
+	if len(cursor.channelCursors) == 0 && cursor.lastMessageId == nil {
+		return nil, nil
+	}
+	return cursor, nil
+}
+
+// replayはwritePumpの最初にカーソルより後のメッセージをconnに書き込む
+// Hubへの登録を先に行っているので、replay中にHubから届いたイベントはsendから読み出してheldに溜めておき、replayの後に送る
+// sendを読み続けることで、replayに時間がかかってもsendが詰まってHubから切断されないようにする
+// replayしたメッセージと同じメッセージが溜まっている場合は読み飛ばす
+// 接続を続けられない場合はfalseを返す
+func (u *User) replay(cursor *replayCursor) bool {
+	replayMessages := make(chan []byte)
+	done := make(chan struct{})
+	defer close(done)
+	var replayErr error
+	go func() {
+		//replayErrはreplayMessagesをcloseする前に設定するので、closeを検知した後に読み出せる
+		replayErr = u.loadReplay(cursor, replayMessages, done)
+		close(replayMessages)
+	}()
+	var held [][]byte
+	for {
+		select {
+		case payload, ok := <-replayMessages:
+			if !ok {
+				if replayErr != nil {
+					log.Printf("failed to replay missed messages: %+v", replayErr)
+					u.writeError(replayErr)
+				}
+				for _, payload := range held {
+					if u.isReplayed(payload) {
+						continue
+					}
+					err := u.writeDirect(payload)
+					if err != nil {
+						log.Printf("%+v", err)
+						return false
+					}
+				}
+				return true
+			}
+			err := u.writeDirect(payload)
+			if err != nil {
+				log.Printf("%+v", err)
+				return false
+			}
+		case payload, ok := <-u.send:
+			if !ok {
+				u.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				u.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return false
+			}
+			if len(held) >= maxHeldLiveEvents {
+				u.writeError(errors.New("too many events arrived during replay. reconnect with the latest cursor"))
+				return false
+			}
+			held = append(held, payload)
+		}
+	}
+}
+
+// loadReplayはカーソルより後のメッセージを取得して、送信するpayloadをreplayMessagesに送る
+// カーソルまでに送信されたメッセージがカーソルより後に編集または削除されていた場合は、message_editとmessage_deleteを先に送る
+// 最後にreplay_completeを送る。doneがcloseされた場合は途中でやめる
+func (u *User) loadReplay(cursor *replayCursor, replayMessages chan<- []byte, done <-chan struct{}) error {
+	changes, err := u.messageRepo.GetMissedMessageChangesWithUser(u.ctx, u.UserID, u.serverIds, cursor.channelCursors, cursor.lastMessageId, maxReplayMessages+1)
+	if err != nil {
+		return err
+	}
+	messages, err := u.messageRepo.GetMissedMessagesWithUser(u.ctx, u.UserID, u.serverIds, cursor.channelCursors, cursor.lastMessageId, maxReplayMessages+1)
+	if err != nil {
+		return err
+	}
+	truncated := len(messages) > maxReplayMessages || len(changes) > maxReplayMessages
+	if len(changes) > maxReplayMessages {
+		changes = changes[:maxReplayMessages]
+	}
+	if len(messages) > maxReplayMessages {
+		messages = messages[:maxReplayMessages]
+	}
+	u.replayed = make(map[string]struct{}, len(messages))
+	u.replayDedupeUntil = time.Now().Add(replayDedupeWindow)
+	payloads := make([][]byte, 0, len(changes)+len(messages)+1)
+	for _, change := range changes {
+		bytes, err := marshalMessageChange(change)
+		if err != nil {
+			return err
+		}
+		payloads = append(payloads, bytes)
+	}
+	for _, message := range messages {
+		at := chatMessageAction
+		if message.ParentMessageId != nil {
+			at = threadReplyAction
+		}
+		chatMessageInfo := newOutgoingChatMessageInfo(message.ServerId, message)
+		bytes, err := json.Marshal(returnSendMessage[outgoingChatMessageInfo](at, chatMessageInfo))
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("cant marshal chatMessageInfo. chatMessageInfo -> %+v", chatMessageInfo))
+		}
+		payloads = append(payloads, bytes)
+		u.replayed[chatMessageInfo.MessageId] = struct{}{}
+	}
+	bytes, err := json.Marshal(returnSendMessage[replayCompleteInfo](replayCompleteAction, replayCompleteInfo{
+		Count:     len(messages),
+		Changes:   len(changes),
+		Truncated: truncated,
+	}))
+	if err != nil {
+		return errors.Wrap(err, "cant marshal replayCompleteInfo")
+	}
+	payloads = append(payloads, bytes)
+	for _, payload := range payloads {
+		select {
+		case replayMessages <- payload:
+		case <-done:
+			return nil
+		}
+	}
+	return nil
+}
+
+// marshalMessageChangeは編集または削除されたメッセージを、Hubから送る場合と同じmessage_editかmessage_deleteにする
+// 編集した後に削除されたメッセージは削除のみ送る
+func marshalMessageChange(message entity.MessageWithUser) ([]byte, error) {
+	if message.DeletedAt != nil {
+		deleteInfo := newOutgoingMessageDeleteInfo(message.ServerId, message.Message)
+		bytes, err := json.Marshal(returnSendMessage[outgoingMessageDeleteInfo](messageDeleteAction, deleteInfo))
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("cant marshal messageDeleteInfo. messageDeleteInfo -> %+v", deleteInfo))
+		}
+		return bytes, nil
+	}
+	editInfo := newOutgoingMessageEditInfo(message.ServerId, message.Message)
+	bytes, err := json.Marshal(returnSendMessage[outgoingMessageEditInfo](messageEditAction, editInfo))
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("cant marshal messageEditInfo. messageEditInfo -> %+v", editInfo))
+	}
+	return bytes, nil
+}
+
+// writeDirectはreplay中にconnに直接書き込む
+// replayはwritePumpの中で行うので、connに書き込むのはwritePumpのみになる
+func (u *User) writeDirect(bytes []byte) error {
+	u.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	err := u.conn.WriteMessage(websocket.TextMessage, bytes)
+	if err != nil {
+		return errors.Wrap(err, "failed to write replay message to websocket")
+	}
+	return nil
+}
+
+// writeErrorはreplay中にエラーをconnに直接書き込む
+func (u *User) writeError(err error) {
+	bytes, ok := marshalWebsocketError(err)
+	if !ok {
+		return
+	}
+	err = u.writeDirect(bytes)
+	if err != nil {
+		log.Printf("%+v", err)
+	}
+}
+
+// isReplayedはpayloadがreplayで送信済みのメッセージかどうかを判定する
+// writePumpからのみ呼び出す
+func (u *User) isReplayed(payload []byte) bool {
+	if u.replayed == nil {
+		return false
+	}
+	if time.Now().After(u.replayDedupeUntil) {
+		u.replayed = nil
+		return false
+	}
+	var message struct {
+		ActionType actionType `json:"action_type"`
+		Payload    struct {
+			MessageId string `json:"message_id"`
+		} `json:"payload"`
+	}
+	err := json.Unmarshal(payload, &message)
+	if err != nil {
+		return false
+	}
+	if message.ActionType != chatMessageAction && message.ActionType != threadReplyAction {
+		return false
+	}
+	_, ok := u.replayed[message.Payload.MessageId]
+	return ok
+}
@@ -0,0 +1,297 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/hebitigo/CATechAccelChatApp/entity"
+	"github.com/hebitigo/CATechAccelChatApp/repository"
+)
+
+// fakeMessageRepoはカーソルに関係なくmessagesとchangesを取りこぼしたメッセージとして返す
+type fakeMessageRepo struct {
+	repository.MessageRepositoryInterface
+	messages []entity.MessageWithUser
+	changes  []entity.MessageWithUser
+	//設定されている場合はcloseされるまでGetMissedMessagesWithUserを待たせる
+	release chan struct{}
+}
+
+func (repo *fakeMessageRepo) GetMissedMessagesWithUser(ctx context.Context, userId string, serverIds []uuid.UUID, channelCursors map[uuid.UUID]uuid.UUID, after *uuid.UUID, limit int) ([]entity.MessageWithUser, error) {
+	if repo.release != nil {
+		<-repo.release
+	}
+	return repo.messages[:min(len(repo.messages), limit)], nil
+}
+
+func (repo *fakeMessageRepo) GetMissedMessageChangesWithUser(ctx context.Context, userId string, serverIds []uuid.UUID, channelCursors map[uuid.UUID]uuid.UUID, after *uuid.UUID, limit int) ([]entity.MessageWithUser, error) {
+	return repo.changes[:min(len(repo.changes), limit)], nil
+}
+
+// newTestConnはwebsocketで接続して、サーバー側とクライアント側のconnを返す
+func newTestConn(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn := <-conns
+	t.Cleanup(func() { conn.Close() })
+	return conn, client
+}
+
+// newReplayTestUserはrepoから取りこぼしたメッセージを取得するセッションと、そのセッションのクライアント側のconnを返す
+func newReplayTestUser(t *testing.T, repo *fakeMessageRepo) (*User, *websocket.Conn) {
+	t.Helper()
+	conn, client := newTestConn(t)
+	user := &User{
+		UserID:      "auth0|user",
+		SessionID:   uuid.NewString(),
+		conn:        conn,
+		send:        make(chan []byte, 256),
+		ctx:         context.Background(),
+		serverIds:   []uuid.UUID{uuid.New()},
+		messageRepo: repo,
+	}
+	return user, client
+}
+
+func newTestReplayCursor() *replayCursor {
+	lastMessageId := uuid.New()
+	return &replayCursor{channelCursors: make(map[uuid.UUID]uuid.UUID), lastMessageId: &lastMessageId}
+}
+
+func newTestMessage(serverId uuid.UUID) entity.MessageWithUser {
+	id := uuid.New()
+	return entity.MessageWithUser{
+		Message:  entity.Message{Id: &id, ChannelId: uuid.New(), Message: "message", CreatedAt: time.Now()},
+		ServerId: serverId,
+	}
+}
+
+// readClientはクライアントに届いたイベントを読み込む
+func readClient(t *testing.T, client *websocket.Conn) testEvent {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(receiveTimeout))
+	_, bytes, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read from websocket: %v", err)
+	}
+	var event testEvent
+	err = json.Unmarshal(bytes, &event)
+	if err != nil {
+		t.Fatalf("invalid event: %v. event -> %s", err, bytes)
+	}
+	return event
+}
+
+func readClientMessageId(t *testing.T, client *websocket.Conn, at actionType) string {
+	t.Helper()
+	event := readClient(t, client)
+	if event.ActionType != at {
+		t.Fatalf("action_type = %s, want %s. payload -> %s", event.ActionType, at, event.Payload)
+	}
+	var payload struct {
+		MessageId string `json:"message_id"`
+	}
+	err := json.Unmarshal(event.Payload, &payload)
+	if err != nil {
+		t.Fatalf("invalid %s: %v", at, err)
+	}
+	return payload.MessageId
+}
+
+func readReplayComplete(t *testing.T, client *websocket.Conn) replayCompleteInfo {
+	t.Helper()
+	event := readClient(t, client)
+	if event.ActionType != replayCompleteAction {
+		t.Fatalf("action_type = %s, want %s. payload -> %s", event.ActionType, replayCompleteAction, event.Payload)
+	}
+	var complete replayCompleteInfo
+	err := json.Unmarshal(event.Payload, &complete)
+	if err != nil {
+		t.Fatalf("invalid replay_complete: %v", err)
+	}
+	return complete
+}
+
+// expectClientSilentはクライアントにsilenceWaitの間何も届かないことを確認する
+func expectClientSilent(t *testing.T, client *websocket.Conn) {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(silenceWait))
+	_, bytes, err := client.ReadMessage()
+	if err == nil {
+		t.Fatalf("unexpected event: %s", bytes)
+	}
+}
+
+// replay中にHubから届いたイベントはreplay_completeの後に送り、replayしたメッセージと同じものは送らない
+func TestReplayHoldsLiveEventsUntilComplete(t *testing.T) {
+	serverId := uuid.New()
+	m1 := newTestMessage(serverId)
+	m2 := newTestMessage(serverId)
+	repo := &fakeMessageRepo{messages: []entity.MessageWithUser{m1, m2}, release: make(chan struct{})}
+	user, client := newReplayTestUser(t, repo)
+
+	result := make(chan bool, 1)
+	go func() { result <- user.replay(newTestReplayCursor()) }()
+	live := uuid.NewString()
+	user.send <- testChatMessage(t, m2.Id.String())
+	user.send <- testChatMessage(t, live)
+	//replayがsendから読み出してheldに溜めるまで待つ
+	for len(user.send) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(repo.release)
+
+	if id := readClientMessageId(t, client, chatMessageAction); id != m1.Id.String() {
+		t.Errorf("first replayed message = %s, want %s", id, m1.Id)
+	}
+	if id := readClientMessageId(t, client, chatMessageAction); id != m2.Id.String() {
+		t.Errorf("second replayed message = %s, want %s", id, m2.Id)
+	}
+	complete := readReplayComplete(t, client)
+	if complete.Count != 2 || complete.Truncated {
+		t.Errorf("replay_complete = %+v, want count 2 and not truncated", complete)
+	}
+	if id := readClientMessageId(t, client, chatMessageAction); id != live {
+		t.Errorf("held message = %s, want %s", id, live)
+	}
+	expectClientSilent(t, client)
+	if !<-result {
+		t.Errorf("replay() = false, want true")
+	}
+}
+
+// replayの後もreplayDedupeWindowの間は、replayしたメッセージがHubから届いても読み飛ばす
+func TestReplayDedupesReplayedMessages(t *testing.T) {
+	serverId := uuid.New()
+	replayed := newTestMessage(serverId)
+	user, client := newReplayTestUser(t, &fakeMessageRepo{messages: []entity.MessageWithUser{replayed}})
+
+	if !user.replay(newTestReplayCursor()) {
+		t.Fatalf("replay() = false, want true")
+	}
+	readClientMessageId(t, client, chatMessageAction)
+	readReplayComplete(t, client)
+
+	if !user.isReplayed(testChatMessage(t, replayed.Id.String())) {
+		t.Errorf("replayed message must be skipped during the dedupe window")
+	}
+	if user.isReplayed(testChatMessage(t, uuid.NewString())) {
+		t.Errorf("message that is not replayed must not be skipped")
+	}
+	user.replayDedupeUntil = time.Now().Add(-time.Second)
+	if user.isReplayed(testChatMessage(t, replayed.Id.String())) {
+		t.Errorf("replayed message must not be skipped after the dedupe window")
+	}
+	if user.replayed != nil {
+		t.Errorf("replayed ids must be released after the dedupe window")
+	}
+}
+
+// カーソルまでに送信されたメッセージの編集と削除は、新しいメッセージより先に送る
+func TestReplaySendsChangesBeforeMissedMessages(t *testing.T) {
+	serverId := uuid.New()
+	editedAt := time.Now()
+	edited := newTestMessage(serverId)
+	edited.EditedAt = &editedAt
+	deletedAt := time.Now()
+	deleted := newTestMessage(serverId)
+	deleted.EditedAt = &editedAt
+	deleted.DeletedAt = &deletedAt
+	missed := newTestMessage(serverId)
+	repo := &fakeMessageRepo{messages: []entity.MessageWithUser{missed}, changes: []entity.MessageWithUser{edited, deleted}}
+	user, client := newReplayTestUser(t, repo)
+
+	if !user.replay(newTestReplayCursor()) {
+		t.Fatalf("replay() = false, want true")
+	}
+	if id := readClientMessageId(t, client, messageEditAction); id != edited.Id.String() {
+		t.Errorf("edited message = %s, want %s", id, edited.Id)
+	}
+	//編集した後に削除されたメッセージは削除のみ送る
+	if id := readClientMessageId(t, client, messageDeleteAction); id != deleted.Id.String() {
+		t.Errorf("deleted message = %s, want %s", id, deleted.Id)
+	}
+	if id := readClientMessageId(t, client, chatMessageAction); id != missed.Id.String() {
+		t.Errorf("missed message = %s, want %s", id, missed.Id)
+	}
+	complete := readReplayComplete(t, client)
+	if complete.Count != 1 || complete.Changes != 2 || complete.Truncated {
+		t.Errorf("replay_complete = %+v, want count 1, changes 2 and not truncated", complete)
+	}
+}
+
+// 取りこぼしたメッセージがmaxReplayMessagesより多い場合は、truncatedにしてREST APIで取得し直してもらう
+func TestReplayTruncatesTooManyMessages(t *testing.T) {
+	serverId := uuid.New()
+	messages := make([]entity.MessageWithUser, maxReplayMessages+1)
+	for i := range messages {
+		messages[i] = newTestMessage(serverId)
+	}
+	user, client := newReplayTestUser(t, &fakeMessageRepo{messages: messages})
+
+	go user.replay(newTestReplayCursor())
+	for i := 0; i < maxReplayMessages; i++ {
+		readClientMessageId(t, client, chatMessageAction)
+	}
+	complete := readReplayComplete(t, client)
+	if complete.Count != maxReplayMessages || !complete.Truncated {
+		t.Errorf("replay_complete = %+v, want count %d and truncated", complete, maxReplayMessages)
+	}
+}
+
+// replay中にHubから届いたイベントが多すぎる場合は、エラーを送って接続を切る
+func TestReplayGivesUpWhenTooManyLiveEventsAreHeld(t *testing.T) {
+	repo := &fakeMessageRepo{release: make(chan struct{})}
+	defer close(repo.release)
+	user, client := newReplayTestUser(t, repo)
+
+	result := make(chan bool, 1)
+	go func() { result <- user.replay(newTestReplayCursor()) }()
+	payload := testChatMessage(t, uuid.NewString())
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 0; i <= maxHeldLiveEvents; i++ {
+			select {
+			case user.send <- payload:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	event := readClient(t, client)
+	if event.ActionType != errorAction {
+		t.Errorf("action_type = %s, want %s", event.ActionType, errorAction)
+	}
+	select {
+	case ok := <-result:
+		if ok {
+			t.Errorf("replay() = true, want false")
+		}
+	case <-time.After(receiveTimeout):
+		t.Errorf("replay() did not return")
+	}
+}
@@ -0,0 +1,138 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// テストで短くできるように変数にしている
+var (
+	//typing_startを他のメンバーに送る間隔の最小値
+	typingThrottle = 3 * time.Second
+	//typing_startの後にtyping_stopもtyping_startも送られてこない場合に自動でtyping_stopを送るまでの時間
+	typingTimeout = 6 * time.Second
+)
+
+// typingStateはセッションがチャンネルで入力中であることを管理する
+// 入力中の状態はDBには保存しない
+type typingState struct {
+	serverId uuid.UUID
+	lastSent time.Time
+	timer    *time.Timer
+}
+
+type incomingTypingInfo struct {
+	ServerId  string `json:"server_id" validate:"required,uuid"`
+	ChannelId string `json:"channel_id" validate:"required,uuid"`
+}
+
+type outgoingTypingInfo struct {
+	UserId    string `json:"user_id"`
+	ServerId  string `json:"server_id"`
+	ChannelId string `json:"channel_id"`
+}
+
+func (u *User) handleTyping(at actionType, payload json.RawMessage) {
+	var typingInfo incomingTypingInfo
+	err := decodePayload(payload, &typingInfo)
+	if err != nil {
+		log.Printf("%+v", err)
+		u.sendError(err)
+		return
+	}
+	channelId, err := uuid.Parse(typingInfo.ChannelId)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("cant parse channelId. channelId -> %s", typingInfo.ChannelId))
+		log.Printf("%+v", err)
+		u.sendError(err)
+		return
+	}
+	if at == typingStopAction {
+		u.stopTyping(channelId)
+		return
+	}
+
+	u.typingMu.Lock()
+	state, ok := u.typing[channelId]
+	u.typingMu.Unlock()
+	//入力中のチャンネルは既に確認済みなので、typing_startのたびにDBを参照しないようにする
+	if !ok {
+		channel, err := u.authorizeChannel(typingInfo.ServerId, typingInfo.ChannelId)
+		if err != nil {
+			log.Printf("%+v", err)
+			u.sendError(err)
+			return
+		}
+		state = &typingState{serverId: channel.ServerId}
+	}
+	u.startTyping(channelId, state)
+}
+
+func (u *User) startTyping(channelId uuid.UUID, state *typingState) {
+	u.typingMu.Lock()
+	defer u.typingMu.Unlock()
+	if current, ok := u.typing[channelId]; ok {
+		state = current
+		state.timer.Reset(typingTimeout)
+	} else {
+		state.timer = time.AfterFunc(typingTimeout, func() {
+			u.stopTyping(channelId)
+		})
+		u.typing[channelId] = state
+	}
+	if time.Since(state.lastSent) < typingThrottle {
+		return
+	}
+	state.lastSent = time.Now()
+	u.broadcastTyping(typingStartAction, channelId, state.serverId)
+}
+
+// stopTypingはチャンネルで入力中の場合はtyping_stopを他のメンバーに送る
+func (u *User) stopTyping(channelId uuid.UUID) {
+	u.typingMu.Lock()
+	defer u.typingMu.Unlock()
+	state, ok := u.typing[channelId]
+	if !ok {
+		return
+	}
+	state.timer.Stop()
+	delete(u.typing, channelId)
+	u.broadcastTyping(typingStopAction, channelId, state.serverId)
+}
+
+// stopAllTypingは切断時に入力中の全てのチャンネルでtyping_stopを送る
+func (u *User) stopAllTyping() {
+	u.typingMu.Lock()
+	channelIds := make([]uuid.UUID, 0, len(u.typing))
+	for channelId := range u.typing {
+		channelIds = append(channelIds, channelId)
+	}
+	u.typingMu.Unlock()
+	for _, channelId := range channelIds {
+		u.stopTyping(channelId)
+	}
+}
+
+func (u *User) broadcastTyping(at actionType, channelId uuid.UUID, sid uuid.UUID) {
+	typingInfo := outgoingTypingInfo{
+		UserId:    u.UserID,
+		ServerId:  sid.String(),
+		ChannelId: channelId.String(),
+	}
+	bytes, err := json.Marshal(returnSendMessage[outgoingTypingInfo](at, typingInfo))
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("cant marshal typingInfo. typingInfo -> %+v", typingInfo))
+		log.Printf("%+v", err)
+		return
+	}
+	//入力中の本人には送らない
+	err = u.hub.broadcastToServerExcept(sid, u.UserID, bytes)
+	if err != nil {
+		log.Printf("failed to broadcast typing event: %+v", err)
+	}
+}
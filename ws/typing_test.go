@@ -0,0 +1,114 @@
+package ws
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// setTypingIntervalsはテストの間だけtyping_startの間隔と自動でtyping_stopを送るまでの時間を変更する
+func setTypingIntervals(t *testing.T, throttle time.Duration, timeout time.Duration) {
+	t.Helper()
+	originalThrottle, originalTimeout := typingThrottle, typingTimeout
+	typingThrottle, typingTimeout = throttle, timeout
+	t.Cleanup(func() {
+		typingThrottle, typingTimeout = originalThrottle, originalTimeout
+	})
+}
+
+func receiveTyping(t *testing.T, user *User, at actionType, channelId uuid.UUID) {
+	t.Helper()
+	var typingInfo outgoingTypingInfo
+	err := json.Unmarshal(receiveAction(t, user, at), &typingInfo)
+	if err != nil {
+		t.Fatalf("invalid %s: %v", at, err)
+	}
+	if typingInfo.ChannelId != channelId.String() {
+		t.Errorf("%s channel_id = %s, want %s", at, typingInfo.ChannelId, channelId)
+	}
+}
+
+// typing_startはtypingThrottleの間に1回だけ他のメンバーに送り、入力中の本人には送らない
+func TestTypingStartIsThrottled(t *testing.T) {
+	setTypingIntervals(t, 300*time.Millisecond, time.Minute)
+	hub := newTestHub(t, newTestBackplane(t))
+	server := uuid.New()
+	channelId := uuid.New()
+	typer := connectTestUser(hub, "auth0|typer", server)
+	observer := connectTestUser(hub, "auth0|observer", server)
+
+	typer.startTyping(channelId, &typingState{serverId: server})
+	typer.startTyping(channelId, &typingState{serverId: server})
+	receiveTyping(t, observer, typingStartAction, channelId)
+	expectNoAction(t, observer, typingStartAction)
+	expectNoAction(t, typer, typingStartAction)
+
+	time.Sleep(typingThrottle)
+	typer.startTyping(channelId, &typingState{serverId: server})
+	receiveTyping(t, observer, typingStartAction, channelId)
+	typer.stopAllTyping()
+}
+
+// typing_startの後にtypingTimeoutの間何も送られてこない場合は、自動でtyping_stopを送る
+func TestTypingStopsAfterTimeout(t *testing.T) {
+	setTypingIntervals(t, time.Minute, 100*time.Millisecond)
+	hub := newTestHub(t, newTestBackplane(t))
+	server := uuid.New()
+	channelId := uuid.New()
+	typer := connectTestUser(hub, "auth0|typer", server)
+	observer := connectTestUser(hub, "auth0|observer", server)
+
+	typer.startTyping(channelId, &typingState{serverId: server})
+	receiveTyping(t, observer, typingStartAction, channelId)
+	receiveTyping(t, observer, typingStopAction, channelId)
+	typer.typingMu.Lock()
+	defer typer.typingMu.Unlock()
+	if len(typer.typing) != 0 {
+		t.Errorf("typing state must be removed after timeout. typing -> %v", typer.typing)
+	}
+}
+
+// 入力中にtyping_startが届くとtypingTimeoutを延長する
+func TestTypingStartExtendsTimeout(t *testing.T) {
+	setTypingIntervals(t, time.Minute, time.Second)
+	hub := newTestHub(t, newTestBackplane(t))
+	server := uuid.New()
+	channelId := uuid.New()
+	typer := connectTestUser(hub, "auth0|typer", server)
+	observer := connectTestUser(hub, "auth0|observer", server)
+
+	typer.startTyping(channelId, &typingState{serverId: server})
+	receiveTyping(t, observer, typingStartAction, channelId)
+	time.Sleep(typingTimeout / 2)
+	typer.startTyping(channelId, &typingState{serverId: server})
+	time.Sleep(typingTimeout / 2)
+	//最初のtyping_startからはtypingTimeoutが過ぎているが、延長したのでまだtyping_stopは送らない
+	expectNoAction(t, observer, typingStopAction)
+	receiveTyping(t, observer, typingStopAction, channelId)
+}
+
+// typing_stopが送られてきた場合と切断した場合は、入力中の全てのチャンネルでtyping_stopを送る
+func TestTypingStop(t *testing.T) {
+	setTypingIntervals(t, time.Minute, time.Minute)
+	hub := newTestHub(t, newTestBackplane(t))
+	server := uuid.New()
+	channel1 := uuid.New()
+	channel2 := uuid.New()
+	typer := connectTestUser(hub, "auth0|typer", server)
+	observer := connectTestUser(hub, "auth0|observer", server)
+
+	typer.startTyping(channel1, &typingState{serverId: server})
+	receiveTyping(t, observer, typingStartAction, channel1)
+	typer.handleTyping(typingStopAction, json.RawMessage(`{"server_id":"`+server.String()+`","channel_id":"`+channel1.String()+`"}`))
+	receiveTyping(t, observer, typingStopAction, channel1)
+
+	typer.startTyping(channel2, &typingState{serverId: server})
+	receiveTyping(t, observer, typingStartAction, channel2)
+	typer.stopAllTyping()
+	receiveTyping(t, observer, typingStopAction, channel2)
+	//入力中でないチャンネルのtyping_stopは送らない
+	typer.stopTyping(channel1)
+	expectNoAction(t, observer, typingStopAction)
+}
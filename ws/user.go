@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/hebitigo/CATechAccelChatApp/entity"
 	"github.com/hebitigo/CATechAccelChatApp/repository"
+	"github.com/hebitigo/CATechAccelChatApp/usecase"
 	"github.com/hebitigo/CATechAccelChatApp/util"
 )
 
@@ -24,36 +26,91 @@ const (
 )
 
 type User struct {
-	UserID      string
-	hub         *Hub
-	conn        *websocket.Conn
-	send        chan []byte
-	messageRepo repository.MessageRepositoryInterface
-	userRepo    repository.UserRepositoryInterface
-	ctx         context.Context
+	UserID string
+	//同じuserの複数の接続を区別するために接続ごとに発行するID
+	SessionID string
+	//botとして接続している場合のbotのId。userとして接続している場合は空
+	botEndpointId string
+	//botが接続に使ったトークンのId。トークンが失効した場合にこのセッションを切断するために使う
+	botTokenId uuid.UUID
+	hub        *Hub
+	conn       *websocket.Conn
+	send       chan []byte
+	//接続時点でuserが所属しているサーバー
+	serverIds       []uuid.UUID
+	messageRepo     repository.MessageRepositoryInterface
+	messageUsecase  usecase.MessageUsecaseInterface
+	reactionUsecase usecase.ReactionUsecaseInterface
+	botEventUsecase usecase.BotEventUsecaseInterface
+	commandUsecase  usecase.CommandUsecaseInterface
+	userRepo        repository.UserRepositoryInterface
+	userServerRepo  repository.UserServerRepositoryInterface
+	channelRepo     repository.ChannelRepositoryInterface
+	ctx             context.Context
+	//入力中のチャンネル。readPumpとタイマーの両方から触るのでtypingMuで保護する
+	typingMu sync.Mutex
+	typing   map[uuid.UUID]*typingState
+	//再接続時にreplayしたメッセージのId。writePumpでHubから届いた同じメッセージを読み飛ばすために使う
+	//replayの読み込みが終わるまではwritePumpから読まない
+	replayed          map[string]struct{}
+	replayDedupeUntil time.Time
 }
 
 type actionType string
 
 const (
-	chatMessageAction  actionType = "chat_message"
-	addChannelAction   actionType = "add_channel"
-	userActivateAction actionType = "user_activate"
-	errorAction        actionType = "error"
+	chatMessageAction    actionType = "chat_message"
+	addChannelAction     actionType = "add_channel"
+	userActivateAction   actionType = "user_activate"
+	typingStartAction    actionType = "typing_start"
+	typingStopAction     actionType = "typing_stop"
+	messageEditAction    actionType = "message_edit"
+	messageDeleteAction  actionType = "message_delete"
+	reactionAddAction    actionType = "reaction_add"
+	reactionRemoveAction actionType = "reaction_remove"
+	threadReplyAction    actionType = "thread_reply"
+	chatMessageAckAction actionType = "chat_message_ack"
+	replayCompleteAction actionType = "replay_complete"
+	botInstalledAction   actionType = "bot_installed"
+	botUninstalledAction actionType = "bot_uninstalled"
+	channelTopicAction   actionType = "channel_topic"
+	ephemeralAction      actionType = "ephemeral_message"
+	errorAction          actionType = "error"
 )
 
+// スレッドに返信する場合はparent_message_idに返信先のメッセージのIdを指定する
+// client_msg_idを指定すると、再送されたメッセージは重複して保存されずに保存済みのメッセージのackが返される
 type incomingChatMessageInfo struct {
-	ServerId  string `json:"server_id" validate:"required,uuid"`
-	ChannelId string `json:"channel_id" validate:"required,uuid"`
-	Message   string `json:"message" validate:"required"`
+	ServerId        string `json:"server_id" validate:"required,uuid"`
+	ChannelId       string `json:"channel_id" validate:"required,uuid"`
+	Message         string `json:"message" validate:"required"`
+	ParentMessageId string `json:"parent_message_id,omitempty" validate:"omitempty,uuid"`
+	ClientMsgId     string `json:"client_msg_id,omitempty" validate:"omitempty,max=64"`
 }
 
+// chatMessageAckInfoはchat_messageを送信したセッションにのみ送られる
+// client_msg_idは送信時に指定されていた場合のみ設定される
+type chatMessageAckInfo struct {
+	ClientMsgId string    `json:"client_msg_id,omitempty"`
+	MessageId   string    `json:"message_id"`
+	ChannelId   string    `json:"channel_id"`
+	Seq         *int64    `json:"seq,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// chat_messageとthread_replyで共通のpayload
+// parent_message_idはthread_replyの場合のみ、seqはchat_messageの場合のみ設定される
+// webhook_idはwebhookのメッセージの場合のみ設定され、user_nameとuser_icon_image_urlはwebhookの表示名とアイコン
 type outgoingChatMessageInfo struct {
 	MessageId        string    `json:"message_id"`
+	IsBot            bool      `json:"is_bot"`
+	WebhookId        string    `json:"webhook_id,omitempty"`
 	UserName         string    `json:"user_name"`
 	UserIconImageURL string    `json:"user_icon_image_url"`
 	ServerId         string    `json:"server_id"`
 	ChannelId        string    `json:"channel_id"`
+	ParentMessageId  string    `json:"parent_message_id,omitempty"`
+	Seq              *int64    `json:"seq,omitempty"`
 	Message          string    `json:"message"`
 	CreatedAt        time.Time `json:"created_at"`
 }
@@ -64,6 +121,17 @@ type channelInfo struct {
 	ChannelId string `json:"channel_id"`
 }
 
+type channelTopicInfo struct {
+	ServerId  string `json:"server_id"`
+	ChannelId string `json:"channel_id"`
+	Topic     string `json:"topic"`
+}
+
+type userActivateInfo struct {
+	UserId string `json:"user_id"`
+	Active bool   `json:"active"`
+}
+
 type returnError struct {
 	Message string `json:"message"`
 }
@@ -74,7 +142,7 @@ type readMessage struct {
 }
 
 type Payload interface {
-	outgoingChatMessageInfo | incomingChatMessageInfo | channelInfo | returnError
+	outgoingChatMessageInfo | incomingChatMessageInfo | chatMessageAckInfo | replayCompleteInfo | channelInfo | userActivateInfo | outgoingTypingInfo | outgoingMessageEditInfo | outgoingMessageDeleteInfo | outgoingReactionInfo | botInfo | channelTopicInfo | ephemeralInfo | returnError
 }
 
 type SendMessage struct {
@@ -89,10 +157,13 @@ func returnSendMessage[P Payload](at actionType, p P) SendMessage {
 	}
 }
 
+// readPumpはconnから読み込んだイベントを処理する
+// connに書き込むのはwritePumpのみで、エラーなどはsendErrorでHub経由でsendに入れる
 func (u *User) readPump() {
 	defer func() {
+		u.stopAllTyping()
+		//Hubから登録を解除するとsendが閉じられ、writePumpがsendに残っているエラーなどを書き込んでからconnを閉じる
 		u.hub.unregister <- u
-		u.conn.Close()
 	}()
 	u.conn.SetReadLimit(maxMessageSize)
 	u.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -128,101 +199,98 @@ Loop:
 			err = errors.Wrap(err, fmt.Sprintf("cant unmarshal byteMessage from Websocket. byteMessage -> %+v", byteMessage))
 			log.Printf("%+v", err)
 
-			sendWebsocketError(u.conn, err)
+			u.sendError(err)
 			break
 		}
 		err = validator.Struct(readMessage)
 		if err != nil {
 			err = errors.Wrap(err, fmt.Sprintf("readMessage is invalid. readMessage -> %+v", readMessage))
 			log.Printf("%+v", err)
-			sendWebsocketError(u.conn, err)
+			u.sendError(err)
 			break
 		}
 
+		//botはメッセージの送信のみできる
+		if u.botEndpointId != "" && readMessage.ActionType != chatMessageAction {
+			err = errors.New(fmt.Sprintf("bot can only send chat_message. actionType -> %s", readMessage.ActionType))
+			log.Printf("%+v", err)
+			u.sendError(err)
+			continue
+		}
+
 		switch readMessage.ActionType {
 		case chatMessageAction:
-			var chatMessageInfo incomingChatMessageInfo
-			err := json.Unmarshal(readMessage.Payload, &chatMessageInfo)
-			if err != nil {
-				err = errors.Wrap(err, fmt.Sprintf("cant unmarshal chatMessageInfo from readMessage.Payload. readMessage.Payload -> %+v", readMessage.Payload))
-				log.Printf("%+v", err)
-				sendWebsocketError(u.conn, err)
-				break
-			}
-			err = validator.Struct(chatMessageInfo)
-			if err != nil {
-				err = errors.Wrap(err, fmt.Sprintf("chatMessageInfo is invalid. chatMessageInfo -> %+v", chatMessageInfo))
-				log.Printf("%+v", err)
-				sendWebsocketError(u.conn, err)
-				break
-			}
-			channelId, err := uuid.Parse(chatMessageInfo.ChannelId)
-			if err != nil {
-				err = errors.Wrap(err, fmt.Sprintf("cant parse channelId. channelId -> %s", chatMessageInfo.ChannelId))
-				log.Printf("%+v", err)
-				sendWebsocketError(u.conn, err)
-				break
-			}
-
-			user, err := u.userRepo.GetUser(u.ctx, u.UserID)
-			if err != nil {
-				log.Printf("failed to get user info: %+v", err)
-				sendWebsocketError(u.conn, err)
-				break Loop
-
-			}
-
-			message := entity.Message{
-				UserId:        user.Id,
-				ChannelId:     channelId,
-				IsBot:         false,
-				Message:       chatMessageInfo.Message,
-				BotEndpointId: nil,
-			}
-			createdAt, messageId, err := u.messageRepo.Insert(u.ctx, message)
-			if err != nil {
-				log.Printf("failed to insert message provided by websocket: %+v", err)
-				sendWebsocketError(u.conn, err)
-				break
-
-			}
-
-			returnChatMessageInfo := outgoingChatMessageInfo{
-				MessageId:        messageId.String(),
-				UserName:         user.Name,
-				UserIconImageURL: user.IconImageURL,
-				CreatedAt:        createdAt,
-				ServerId:         chatMessageInfo.ServerId,
-				ChannelId:        chatMessageInfo.ChannelId,
-				Message:          chatMessageInfo.Message,
-			}
-			bytes, err := json.Marshal(returnSendMessage[outgoingChatMessageInfo](
-				chatMessageAction,
-				returnChatMessageInfo,
-			))
-			if err != nil {
-				err = errors.Wrap(err, fmt.Sprintf("cant marshal returnChatMessageInfo. returnChatMessageInfo -> %+v", returnChatMessageInfo))
-				log.Printf("%+v", err)
-				sendWebsocketError(u.conn, err)
-				break
-			}
-			u.hub.broadcast <- bytes
+			u.handleChatMessage(readMessage.Payload)
+		case typingStartAction, typingStopAction:
+			u.handleTyping(readMessage.ActionType, readMessage.Payload)
+		case messageEditAction:
+			u.handleMessageEdit(readMessage.Payload)
+		case messageDeleteAction:
+			u.handleMessageDelete(readMessage.Payload)
+		case reactionAddAction, reactionRemoveAction:
+			u.handleReaction(readMessage.ActionType, readMessage.Payload)
 		default:
 			err = errors.New(fmt.Sprintf("unexpected actionType. actionType -> %s", readMessage.ActionType))
 			log.Printf("%+v", err)
-			sendWebsocketError(u.conn, err)
+			u.sendError(err)
 			break Loop
 		}
 	}
 
 }
 
-func (u *User) writePump() {
+// decodePayloadはreadMessageのPayloadをvに変換してバリデーションを行う
+func decodePayload(payload json.RawMessage, v interface{}) error {
+	err := json.Unmarshal(payload, v)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("cant unmarshal readMessage.Payload. readMessage.Payload -> %s", payload))
+	}
+	err = util.GetValidater().Struct(v)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("payload is invalid. payload -> %+v", v))
+	}
+	return nil
+}
+
+// authorizeChannelはフロントエンドから送られてきたチャンネルが指定されたサーバーのものであり、
+// userがそのサーバーに所属していることを確認してチャンネルを返す
+func (u *User) authorizeChannel(sid string, cid string) (entity.Channel, error) {
+	channelId, err := uuid.Parse(cid)
+	if err != nil {
+		return entity.Channel{}, errors.Wrap(err, fmt.Sprintf("cant parse channelId. channelId -> %s", cid))
+	}
+	serverUUID, err := uuid.Parse(sid)
+	if err != nil {
+		return entity.Channel{}, errors.Wrap(err, fmt.Sprintf("cant parse serverId. serverId -> %s", sid))
+	}
+	channel, err := u.channelRepo.GetChannel(u.ctx, channelId)
+	if err != nil {
+		return entity.Channel{}, err
+	}
+	if channel.ServerId != serverUUID {
+		return entity.Channel{}, errors.New(fmt.Sprintf("channel does not belong to the server. channel_id -> %s, server_id -> %s", cid, sid))
+	}
+	exists, err := u.userServerRepo.ExistUserServer(u.ctx, u.UserID, channel.ServerId)
+	if err != nil {
+		return entity.Channel{}, err
+	}
+	if !exists {
+		return entity.Channel{}, errors.New(fmt.Sprintf("user is not a member of the server. user_id -> %s, server_id -> %s", u.UserID, sid))
+	}
+	return channel, nil
+}
+
+// writePumpはHubから届いたイベントをconnに書き込む
+// cursorが指定されている場合は、最初に再接続時に取りこぼしたメッセージをreplayする
+func (u *User) writePump(cursor *replayCursor) {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
 		u.conn.Close()
 	}()
+	if cursor != nil && !u.replay(cursor) {
+		return
+	}
 	for {
 		select {
 		case payload, ok := <-u.send:
@@ -231,11 +299,13 @@ func (u *User) writePump() {
 				u.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
+			if u.isReplayed(payload) {
+				continue
+			}
 			w, err := u.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
 				err = errors.Wrap(err, "failed to get next writer:")
 				log.Printf("%+v", err)
-				sendWebsocketError(u.conn, err)
 				return
 			}
 			w.Write(payload)
@@ -243,13 +313,15 @@ func (u *User) writePump() {
 			n := len(u.send)
 			for i := 0; i < n; i++ {
 				payload := <-u.send
+				if u.isReplayed(payload) {
+					continue
+				}
 				w.Write(payload)
 			}
 			err = w.Close()
 			if err != nil {
 				err = errors.Wrap(err, "failed to close writer:")
 				log.Printf("%+v", err)
-				sendWebsocketError(u.conn, err)
 				return
 			}
 		case <-ticker.C:
@@ -263,18 +335,23 @@ func (u *User) writePump() {
 	}
 }
 
-func sendWebsocketError(conn *websocket.Conn, err error) {
-	conn.SetWriteDeadline(time.Now().Add(writeWait))
-	bytes, err := json.Marshal(returnSendMessage[returnError](errorAction, returnError{Message: err.Error()}))
-	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("cant marshal error message. err -> %+v", err))
-		log.Printf("%+v", err)
+// sendErrorはエラーをこのセッションにのみ送る
+// writePumpと同時にconnに書き込まないように、Hub経由でsendに入れてwritePumpに書き込ませる
+func (u *User) sendError(err error) {
+	bytes, ok := marshalWebsocketError(err)
+	if !ok {
 		return
 	}
-	err = conn.WriteMessage(websocket.TextMessage, bytes)
-	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("failed to write message to websocket. message -> %+v", bytes))
-		log.Printf("%+v", err)
-		return
+	u.hub.sendToSession(u, bytes)
+}
+
+// marshalWebsocketErrorはerrをクライアントに送るerrorのメッセージにする
+func marshalWebsocketError(err error) ([]byte, bool) {
+	bytes, marshalErr := json.Marshal(returnSendMessage[returnError](errorAction, returnError{Message: err.Error()}))
+	if marshalErr != nil {
+		marshalErr = errors.Wrap(marshalErr, fmt.Sprintf("cant marshal error message. err -> %+v", err))
+		log.Printf("%+v", marshalErr)
+		return nil, false
 	}
+	return bytes, true
 }